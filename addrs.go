@@ -0,0 +1,184 @@
+package whalewall
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+
+	"go4.org/netipx"
+)
+
+// Symbolic values that can be used in place of addresses in the ips
+// of output rules. They are expanded to addresses when rules are
+// created.
+const (
+	symbolHost         = "host"
+	symbolGateway      = "gateway"
+	symbolPrivate      = "private"
+	symbolLoopbackHost = "loopback-host"
+	symbolLinkLocal    = "link-local"
+	symbolInternet     = "internet"
+	// symbolAllowedDomains isn't expanded, rules using it match the
+	// set of addresses allowed domains of the container resolved to
+	symbolAllowedDomains = "allowed-domains"
+)
+
+var addrSymbols = []string{
+	symbolHost,
+	symbolGateway,
+	symbolPrivate,
+	symbolLoopbackHost,
+	symbolLinkLocal,
+	symbolInternet,
+	symbolAllowedDomains,
+}
+
+var (
+	loopbackPrefix  = netip.MustParsePrefix("127.0.0.0/8")
+	linkLocalPrefix = netip.MustParsePrefix("169.254.0.0/16")
+	privatePrefixes = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+	}
+	// specialPrefixes are IPv4 special-purpose ranges from the IANA
+	// registry, and multicast and reserved ranges, that aren't
+	// reachable on the internet.
+	specialPrefixes = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/8"),
+		netip.MustParsePrefix("100.64.0.0/10"),
+		loopbackPrefix,
+		linkLocalPrefix,
+		netip.MustParsePrefix("192.0.0.0/24"),
+		netip.MustParsePrefix("192.0.2.0/24"),
+		netip.MustParsePrefix("192.88.99.0/24"),
+		netip.MustParsePrefix("198.18.0.0/15"),
+		netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParsePrefix("203.0.113.0/24"),
+		netip.MustParsePrefix("224.0.0.0/4"),
+		netip.MustParsePrefix("240.0.0.0/4"),
+	}
+)
+
+// internetRanges returns the ranges of IPv4 addresses that aren't
+// private or special-purpose.
+func internetRanges() []netipx.IPRange {
+	var b netipx.IPSetBuilder
+	b.AddPrefix(netip.MustParsePrefix("0.0.0.0/0"))
+	for _, prefix := range privatePrefixes {
+		b.RemovePrefix(prefix)
+	}
+	for _, prefix := range specialPrefixes {
+		b.RemovePrefix(prefix)
+	}
+	// the set can't fail to build as only valid prefixes were added
+	set, _ := b.IPSet()
+
+	return set.Ranges()
+}
+
+// interfaceAddrs returns the IPv4 addresses of the host's network
+// interfaces, excluding loopback addresses.
+func interfaceAddrs() ([]netip.Addr, error) {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]netip.Addr, 0, len(ifaceAddrs))
+	for _, ifaceAddr := range ifaceAddrs {
+		ipNet, ok := ifaceAddr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if !addr.Is4() || addr.IsLoopback() {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+
+	return slices.Compact(addrs), nil
+}
+
+// addrInterface returns the name of the network interface that has
+// addr. If no interface has addr, an empty string is returned.
+func addrInterface(addr netip.Addr) (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	for _, iface := range ifaces {
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return "", fmt.Errorf("error getting addresses of interface %q: %w", iface.Name, err)
+		}
+		for _, ifaceAddr := range ifaceAddrs {
+			ipNet, ok := ifaceAddr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			a, ok := netip.AddrFromSlice(ipNet.IP)
+			if ok && a.Unmap() == addr {
+				return iface.Name, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// expandAddrs returns addrs with symbolic values replaced by the
+// addresses they stand for. gateway is the gateway of the network
+// rules will be created for.
+func (r *RuleManager) expandAddrs(addrs []addrOrRange, gateway netip.Addr) ([]addrOrRange, error) {
+	if !slices.ContainsFunc(addrs, addrOrRange.isSymbol) {
+		return addrs, nil
+	}
+
+	expanded := make([]addrOrRange, 0, len(addrs))
+	for _, addr := range addrs {
+		switch addr.symbol {
+		case "":
+			expanded = append(expanded, addr)
+		case symbolHost:
+			hostAddrs, err := r.hostAddrs()
+			if err != nil {
+				return nil, fmt.Errorf("error getting host addresses: %w", err)
+			}
+			if len(hostAddrs) == 0 {
+				return nil, errors.New("host has no IPv4 addresses")
+			}
+			for _, hostAddr := range hostAddrs {
+				expanded = append(expanded, addrOrRange{addr: hostAddr})
+			}
+		case symbolGateway:
+			if !gateway.IsValid() {
+				return nil, errors.New("network has no IPv4 gateway")
+			}
+			expanded = append(expanded, addrOrRange{addr: gateway})
+		case symbolPrivate:
+			for _, prefix := range privatePrefixes {
+				expanded = append(expanded, addrOrRange{addrRange: netipx.RangeOfPrefix(prefix)})
+			}
+		case symbolLoopbackHost:
+			expanded = append(expanded, addrOrRange{addrRange: netipx.RangeOfPrefix(loopbackPrefix)})
+		case symbolLinkLocal:
+			expanded = append(expanded, addrOrRange{addrRange: netipx.RangeOfPrefix(linkLocalPrefix)})
+		case symbolInternet:
+			for _, addrRange := range internetRanges() {
+				expanded = append(expanded, addrOrRange{addrRange: addrRange})
+			}
+		}
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,513 @@
+package whalewall
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/exp/maps"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	globalBanSetName = "whalewall-banned"
+
+	banChainSuffix    = "-ban"
+	banSetSuffix      = "-banned"
+	banMeterSetSuffix = "-ban-meter"
+
+	// verdictBan is the verdict of NFLOG prefixes of packets that
+	// caused their source to be banned
+	verdictBan = "ban"
+)
+
+// banConfig bans source addresses that have too many new connections
+// to mapped ports dropped or rejected.
+type banConfig struct {
+	Threshold uint64
+	Period    banPeriod
+	Duration  time.Duration
+	Global    bool
+}
+
+// enabled returns true if sources should be banned.
+func (b banConfig) enabled() bool {
+	return b != banConfig{}
+}
+
+// banPeriod is the period that drops of a source are counted in.
+type banPeriod uint8
+
+const (
+	periodMinute banPeriod = iota
+	periodSecond
+	periodHour
+	periodDay
+)
+
+func (p banPeriod) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *banPeriod) UnmarshalText(text []byte) error {
+	switch {
+	case bytes.Equal(text, []byte("second")):
+		*p = periodSecond
+	case bytes.Equal(text, []byte("minute")):
+		*p = periodMinute
+	case bytes.Equal(text, []byte("hour")):
+		*p = periodHour
+	case bytes.Equal(text, []byte("day")):
+		*p = periodDay
+	default:
+		return fmt.Errorf("invalid ban period %q", string(text))
+	}
+	return nil
+}
+
+func (p banPeriod) String() string {
+	switch p {
+	case periodSecond:
+		return "second"
+	case periodMinute:
+		return "minute"
+	case periodHour:
+		return "hour"
+	case periodDay:
+		return "day"
+	default:
+		return fmt.Sprintf("period(%d)", p)
+	}
+}
+
+func (p banPeriod) limitTime() expr.LimitTime {
+	switch p {
+	case periodSecond:
+		return expr.LimitTimeSecond
+	case periodHour:
+		return expr.LimitTimeHour
+	case periodDay:
+		return expr.LimitTimeDay
+	default:
+		return expr.LimitTimeMinute
+	}
+}
+
+func (p banPeriod) duration() time.Duration {
+	switch p {
+	case periodSecond:
+		return time.Second
+	case periodHour:
+		return time.Hour
+	case periodDay:
+		return 24 * time.Hour
+	default:
+		return time.Minute
+	}
+}
+
+func validateBan(b banConfig) error {
+	if !b.enabled() {
+		return nil
+	}
+	if b.Threshold == 0 {
+		return errors.New(`"threshold" must be set when "ban" is set`)
+	}
+	if b.Duration <= 0 {
+		return errors.New(`"duration" must be set to a positive duration when "ban" is set`)
+	}
+
+	return nil
+}
+
+// banSet returns the set sources banned from the container of chain
+// are added to.
+func banSet(cfg banConfig, chain *nftables.Chain) *nftables.Set {
+	name := chain.Name + banSetSuffix
+	if cfg.Global {
+		name = globalBanSetName
+	}
+
+	return &nftables.Set{
+		Table:      chain.Table,
+		Name:       name,
+		KeyType:    nftables.TypeIPAddr,
+		Dynamic:    true,
+		HasTimeout: true,
+	}
+}
+
+func banMeterSet(cfg banConfig, chain *nftables.Chain) *nftables.Set {
+	return &nftables.Set{
+		Table:      chain.Table,
+		Name:       chain.Name + banMeterSetSuffix,
+		KeyType:    nftables.TypeIPAddr,
+		Dynamic:    true,
+		HasTimeout: true,
+		Timeout:    cfg.Period.duration(),
+	}
+}
+
+// createBanChain creates the chain and sets dropped traffic to the
+// mapped ports of a container is counted in.
+func createBanChain(nfc firewallClient, cfg banConfig, chain *nftables.Chain) (*nftables.Chain, error) {
+	banChain := &nftables.Chain{
+		Table: chain.Table,
+		Name:  chain.Name + banChainSuffix,
+		Type:  nftables.ChainTypeFilter,
+	}
+	nfc.AddChain(banChain)
+	if err := ignoringErr(nfc.Flush, syscall.EEXIST); err != nil {
+		return nil, fmt.Errorf("error creating chain: %w", err)
+	}
+
+	for _, set := range []*nftables.Set{banSet(cfg, chain), banMeterSet(cfg, chain)} {
+		if err := nfc.AddSet(set, nil); err != nil {
+			return nil, fmt.Errorf("error adding set %q: %w", set.Name, err)
+		}
+	}
+	if err := ignoringErr(nfc.Flush, syscall.EEXIST); err != nil {
+		return nil, fmt.Errorf("error creating sets: %w", err)
+	}
+
+	return banChain, nil
+}
+
+// createBanRules returns rules that send new traffic to the mapped
+// ports of a container that wasn't allowed to banChain, and the rules
+// of banChain that ban sources of too much of this traffic and then
+// drop or reject it. The rules must be placed after the rules that
+// allow traffic to the container.
+func (r *RuleManager) createBanRules(cfg banConfig, settings *types.NetworkSettings, addrs map[string][]byte, chain, banChain *nftables.Chain, id string, reject bool) ([]*nftables.Rule, error) {
+	logPrefix := chain.Name + " " + verdictBan + ": "
+	if r.nflog {
+		// the verdict is already part of NFLOG prefixes
+		logPrefix = chain.Name + ": "
+	}
+	banExprs := meterExprs(banMeterSet(cfg, chain), unix.NFT_DYNSET_OP_UPDATE, &expr.Limit{
+		Type: expr.LimitTypePkts,
+		Rate: cfg.Threshold,
+		Over: true,
+		Unit: cfg.Period.limitTime(),
+	})
+	banExprs = append(banExprs,
+		// [ dynset add reg_key 1 set ... timeout ... ]
+		&expr.Dynset{
+			SrcRegKey: 1,
+			SetName:   banSet(cfg, chain).Name,
+			Operation: unix.NFT_DYNSET_OP_ADD,
+			Timeout:   cfg.Duration,
+		},
+		&expr.Counter{},
+		r.createLogExpr(logPrefix, verdictBan),
+	)
+	rules := []*nftables.Rule{
+		{
+			Table:    banChain.Table,
+			Chain:    banChain,
+			Exprs:    banExprs,
+			UserData: []byte(id),
+		},
+	}
+	// traffic is logged, dropped or rejected the same way as traffic
+	// reaching the end of the container chain, and logged with the
+	// name of the container chain so it is attributed to the container
+	for _, rule := range r.createDropRules(chain, id, reject) {
+		rule.Chain = banChain
+		rules = append(rules, rule)
+	}
+
+	// sort mapped ports and networks so rules are created
+	// deterministically making testing much easier
+	sortedPorts := maps.Keys(settings.Ports)
+	slices.Sort(sortedPorts)
+	netNames := maps.Keys(addrs)
+	slices.Sort(netNames)
+
+	for _, netName := range netNames {
+		addr := addrs[netName]
+		var prefix netip.Prefix
+		if netSettings, ok := settings.Networks[netName]; ok && netSettings.IPPrefixLen != 0 {
+			prefix = netip.PrefixFrom(netip.AddrFrom4([4]byte(addr)), netSettings.IPPrefixLen).Masked()
+		}
+
+		for _, port := range sortedPorts {
+			// ports exposed by images but not mapped can't be reached
+			// externally
+			if len(settings.Ports[port]) == 0 {
+				continue
+			}
+			var proto protocol
+			if err := proto.UnmarshalText([]byte(port.Proto())); err != nil {
+				return nil, fmt.Errorf("error parsing protocol: %w", err)
+			}
+			l4proto := unix.IPPROTO_TCP
+			if proto == udp {
+				l4proto = unix.IPPROTO_UDP
+			}
+
+			exprs := matchAddrExprs(addr, dstAddrOffset)
+			// traffic from the host and other containers of the
+			// network is not external
+			if prefix.IsValid() {
+				exprs = append(exprs, excludePrefixExprs(prefix, srcAddrOffset)...)
+			}
+			exprs = append(exprs, matchProtoExprs(l4proto)...)
+			exprs = append(exprs, matchPortExprs(uint16(port.Int()), dstPortOffset)...)
+			exprs = append(exprs, matchConnStateExprs(stateNew)...)
+			exprs = append(exprs,
+				&expr.Counter{},
+				&expr.Verdict{
+					Kind:  expr.VerdictGoto,
+					Chain: banChain.Name,
+				},
+			)
+			rules = append(rules, &nftables.Rule{
+				Table:    chain.Table,
+				Chain:    chain,
+				Exprs:    exprs,
+				UserData: []byte(id),
+			})
+		}
+	}
+
+	return rules, nil
+}
+
+// excludePrefixExprs returns expressions that match if the address at
+// offset is not in prefix.
+func excludePrefixExprs(prefix netip.Prefix, offset uint32) []expr.Any {
+	return []expr.Any{
+		// [ payload load 4b @ network header + offset => reg 1 ]
+		getAddrExpr(offset),
+		// [ bitwise reg 1 = ( reg 1 & mask ) ^ 0x00000000 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           net.CIDRMask(prefix.Bits(), 32),
+			Xor:            []byte{0, 0, 0, 0},
+		},
+		// [ cmp neq reg 1 ... ]
+		&expr.Cmp{
+			Op:       expr.CmpOpNeq,
+			Register: 1,
+			Data:     prefix.Masked().Addr().AsSlice(),
+		},
+	}
+}
+
+// createBannedDropRules returns rules that drop traffic from banned
+// sources to a container. They must be inserted into the whalewall
+// chain so banned traffic is dropped before any container rules are
+// evaluated.
+func createBannedDropRules(cfg banConfig, addrs map[string][]byte, chain *nftables.Chain, id string) []*nftables.Rule {
+	set := banSet(cfg, chain)
+	netNames := maps.Keys(addrs)
+	slices.Sort(netNames)
+
+	rules := make([]*nftables.Rule, 0, len(addrs))
+	for _, netName := range netNames {
+		exprs := matchAddrExprs(addrs[netName], dstAddrOffset)
+		exprs = append(exprs,
+			// [ payload load 4b @ network header + 12 => reg 1 ]
+			getAddrExpr(srcAddrOffset),
+			// [ lookup reg 1 set ... ]
+			matchFromSetExpr(set),
+			&expr.Counter{},
+			dropVerdict,
+		)
+		rules = append(rules, &nftables.Rule{
+			Table:    filterTable,
+			Chain:    whalewallChain,
+			Exprs:    exprs,
+			UserData: []byte(id),
+		})
+	}
+
+	return rules
+}
+
+// deleteBanChain deletes the ban chain of a container chain and the
+// sets of the container it uses. The global ban set is never deleted
+// as other containers may use it.
+func deleteBanChain(nfc firewallClient, chain *nftables.Chain) error {
+	nfc.DelChain(&nftables.Chain{
+		Table: chain.Table,
+		Name:  chain.Name + banChainSuffix,
+	})
+	if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+		return fmt.Errorf("error deleting chain: %w", err)
+	}
+
+	for _, suffix := range []string{banSetSuffix, banMeterSetSuffix} {
+		nfc.DelSet(&nftables.Set{
+			Table: chain.Table,
+			Name:  chain.Name + suffix,
+		})
+		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+			return fmt.Errorf("error deleting set %q: %w", chain.Name+suffix, err)
+		}
+	}
+
+	return nil
+}
+
+// Ban is a source address that is banned from a container.
+type Ban struct {
+	Addr netip.Addr
+	// Expires is how long until the ban is lifted.
+	Expires time.Duration
+}
+
+// BanStatus is the state of the bans of a container.
+type BanStatus struct {
+	// Enabled is true if sources can be banned from the container.
+	Enabled bool
+	// Global is true if sources are banned from all containers with
+	// global bans instead of only this container.
+	Global bool
+	// Dropped is the number of packets to the container that were
+	// dropped because their source was banned.
+	Dropped uint64
+	// Bans are the currently banned sources.
+	Bans []Ban
+
+	set      *nftables.Set
+	meterSet *nftables.Set
+}
+
+// BanStatus returns the state of the bans of a container.
+func (r *RuleManager) BanStatus(ctx context.Context, contName string) (BanStatus, error) {
+	nfc, err := r.newFirewallClient()
+	if err != nil {
+		return BanStatus{}, fmt.Errorf("error creating netlink connection: %w", err)
+	}
+
+	return r.banStatus(ctx, nfc, contName)
+}
+
+func (r *RuleManager) banStatus(ctx context.Context, nfc firewallClient, contName string) (BanStatus, error) {
+	id, name, err := r.getContainerIDAndName(ctx, r.db, contName)
+	if err != nil {
+		return BanStatus{}, err
+	}
+
+	// the rules that drop banned traffic refer to the set sources are
+	// banned in
+	rules, err := nfc.GetRules(filterTable, whalewallChain)
+	if err != nil {
+		return BanStatus{}, fmt.Errorf("error getting rules of chain %q: %w", whalewallChainName, err)
+	}
+	chainName := buildChainName(name, id)
+	contSetName := chainName + banSetSuffix
+	status := BanStatus{
+		meterSet: &nftables.Set{
+			Table: filterTable,
+			Name:  chainName + banMeterSetSuffix,
+		},
+	}
+	for _, rule := range rules {
+		if !bytes.Equal(rule.UserData, []byte(id)) {
+			continue
+		}
+		var setName string
+		var packets uint64
+		for _, e := range rule.Exprs {
+			switch e := e.(type) {
+			case *expr.Lookup:
+				if e.SetName == contSetName || e.SetName == globalBanSetName {
+					setName = e.SetName
+				}
+			case *expr.Counter:
+				packets = e.Packets
+			}
+		}
+		if setName == "" {
+			continue
+		}
+
+		status.Enabled = true
+		status.Global = setName == globalBanSetName
+		status.Dropped += packets
+		status.set = &nftables.Set{
+			Table: filterTable,
+			Name:  setName,
+		}
+	}
+	if !status.Enabled {
+		return status, nil
+	}
+
+	elems, err := nfc.GetSetElements(status.set)
+	if err != nil {
+		return BanStatus{}, fmt.Errorf("error getting elements of set %q: %w", status.set.Name, err)
+	}
+	for _, elem := range elems {
+		addr, ok := netip.AddrFromSlice(elem.Key)
+		if !ok {
+			continue
+		}
+		status.Bans = append(status.Bans, Ban{
+			Addr:    addr,
+			Expires: elem.Expires,
+		})
+	}
+	slices.SortFunc(status.Bans, func(a, b Ban) int {
+		return a.Addr.Compare(b.Addr)
+	})
+
+	return status, nil
+}
+
+// LiftBan removes a ban of addr from a container. If the container
+// uses global bans, addr is unbanned from all containers using global
+// bans.
+func (r *RuleManager) LiftBan(ctx context.Context, contName string, addr netip.Addr) error {
+	if !addr.Is4() {
+		return fmt.Errorf("%s is not an IPv4 address", addr)
+	}
+
+	nfc, err := r.newFirewallClient()
+	if err != nil {
+		return fmt.Errorf("error creating netlink connection: %w", err)
+	}
+	status, err := r.banStatus(ctx, nfc, contName)
+	if err != nil {
+		return err
+	}
+	if !status.Enabled {
+		return fmt.Errorf("sources are not banned from %s", contName)
+	}
+
+	elems := []nftables.SetElement{{Key: addr.AsSlice()}}
+	if err := nfc.SetDeleteElements(status.set, elems); err != nil {
+		return fmt.Errorf("error marshaling set elements: %w", err)
+	}
+	if err := nfc.Flush(); err != nil {
+		if errors.Is(err, syscall.ENOENT) {
+			return fmt.Errorf("%s is not banned from %s", addr, contName)
+		}
+		return fmt.Errorf("error deleting set element: %w", err)
+	}
+
+	// forget the dropped traffic of the source so it isn't banned
+	// again by the next packet that is dropped
+	if err := nfc.SetDeleteElements(status.meterSet, elems); err != nil {
+		return fmt.Errorf("error marshaling set elements: %w", err)
+	}
+	if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+		return fmt.Errorf("error deleting set element: %w", err)
+	}
+
+	return nil
+}
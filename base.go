@@ -17,6 +17,7 @@ const (
 	outputChainName      = "OUTPUT"
 	whalewallChainName   = "whalewall"
 	containerAddrSetName = "whalewall-container-addrs"
+	managedAddrSetName   = "whalewall-managed-addrs"
 )
 
 var (
@@ -36,6 +37,14 @@ var (
 		KeyType:  nftables.TypeIPAddr,
 		DataType: nftables.TypeVerdict,
 	}
+	// a set of container IPs is required in addition to
+	// containerAddrSet as lookups against maps must set a destination
+	// register
+	managedAddrSet = &nftables.Set{
+		Table:   filterTable,
+		Name:    managedAddrSetName,
+		KeyType: nftables.TypeIPAddr,
+	}
 
 	srcJumpRule = &nftables.Rule{
 		Table: filterTable,
@@ -81,6 +90,38 @@ var (
 	}
 )
 
+// createEstFastPathRule returns a rule that accepts established and
+// related traffic if the address at addrOffset is of a managed
+// container.
+func createEstFastPathRule(addrOffset uint32) *nftables.Rule {
+	exprs := []expr.Any{
+		// [ payload load 4b @ network header + addrOffset => reg 1 ]
+		&expr.Payload{
+			OperationType: expr.PayloadLoad,
+			Len:           4,
+			Base:          expr.PayloadBaseNetworkHeader,
+			Offset:        addrOffset,
+			DestRegister:  1,
+		},
+		// [ lookup reg 1 set whalewall-managed-addrs ]
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        managedAddrSetName,
+		},
+	}
+	exprs = append(exprs, matchConnStateExprs(stateEst)...)
+	exprs = append(exprs,
+		&expr.Counter{},
+		acceptVerdict,
+	)
+
+	return &nftables.Rule{
+		Table: filterTable,
+		Chain: whalewallChain,
+		Exprs: exprs,
+	}
+}
+
 func (r *RuleManager) createBaseRules() error {
 	nfc, err := r.newFirewallClient()
 	if err != nil {
@@ -92,12 +133,20 @@ func (r *RuleManager) createBaseRules() error {
 		return fmt.Errorf("error listing IPv4 chains: %w", err)
 	}
 	var (
-		whalewallChainFound bool
-		dockerChain         *nftables.Chain
-		inputChain          *nftables.Chain
-		outputChain         *nftables.Chain
+		whalewallChainFound  bool
+		hostInputChainFound  bool
+		hostOutputChainFound bool
+		markChainFound       bool
+		oldMarkChain         *nftables.Chain
+		dockerChain          *nftables.Chain
+		inputChain           *nftables.Chain
+		outputChain          *nftables.Chain
 	)
 	for _, c := range chains {
+		if c.Table.Name == markTableName && c.Name == markChainName {
+			markChainFound = true
+			continue
+		}
 		if c.Table.Name != filterTableName {
 			continue
 		}
@@ -107,6 +156,13 @@ func (r *RuleManager) createBaseRules() error {
 			dockerChain = c
 		case whalewallChainName:
 			whalewallChainFound = true
+		case hostInputChainName:
+			hostInputChainFound = true
+		case hostOutputChainName:
+			hostOutputChainFound = true
+		case markChainName:
+			// older versions marked traffic in the filter table
+			oldMarkChain = c
 		case inputChainName:
 			inputChain = c
 		case outputChainName:
@@ -143,8 +199,28 @@ func (r *RuleManager) createBaseRules() error {
 		nfc.InsertRule(dockerUserJumpRule)
 	}
 
-	// add rule to jump from INPUT/OUTPUT chains to whalewall chain
-	handleMainChain := func(name string, hook *nftables.ChainHook, mainChain *nftables.Chain) error {
+	// create chains containers using host networking are filtered in
+	if !hostInputChainFound {
+		nfc.AddChain(hostInputChain)
+	}
+	if !hostOutputChainFound {
+		nfc.AddChain(hostOutputChain)
+	}
+
+	// create table and chain outbound traffic is marked in before it
+	// is routed, rules of the old chain are recreated in the new one
+	// when rules of containers are
+	if oldMarkChain != nil {
+		nfc.DelChain(oldMarkChain)
+	}
+	nfc.AddTable(markTable)
+	if !markChainFound {
+		nfc.AddChain(markChain)
+	}
+
+	// add rules to jump from INPUT/OUTPUT chains to whalewall chain
+	// and the chain for containers using host networking
+	handleMainChain := func(name string, hook *nftables.ChainHook, mainChain *nftables.Chain, hostChainName string) error {
 		if mainChain == nil {
 			r.logger.Debug("creating chain", zap.String("chain.name", name))
 			// INPUT and OUTPUT sometimes don't exist in nftables
@@ -166,17 +242,23 @@ func (r *RuleManager) createBaseRules() error {
 		if err != nil {
 			return fmt.Errorf("error listing rules of %q chain: %w", name, err)
 		}
-		jumpRule := createJumpRule(mainChain, whalewallChainName)
-		if !findRule(r.logger, jumpRule, rules) {
-			nfc.InsertRule(jumpRule)
+		// insert rules in reverse order to maintain order
+		jumpRules := []*nftables.Rule{
+			createJumpRule(mainChain, whalewallChainName),
+			createJumpRule(mainChain, hostChainName),
+		}
+		for i := len(jumpRules) - 1; i >= 0; i-- {
+			if !findRule(r.logger, jumpRules[i], rules) {
+				nfc.InsertRule(jumpRules[i])
+			}
 		}
 
 		return nil
 	}
-	if err := handleMainChain(inputChainName, nftables.ChainHookInput, inputChain); err != nil {
+	if err := handleMainChain(inputChainName, nftables.ChainHookInput, inputChain, hostInputChainName); err != nil {
 		return err
 	}
-	if err := handleMainChain(outputChainName, nftables.ChainHookOutput, outputChain); err != nil {
+	if err := handleMainChain(outputChainName, nftables.ChainHookOutput, outputChain, hostOutputChainName); err != nil {
 		return err
 	}
 
@@ -185,6 +267,37 @@ func (r *RuleManager) createBaseRules() error {
 		return fmt.Errorf("error adding set %q: %w", containerAddrSetName, err)
 	}
 
+	// create or remove rules that accept established traffic of
+	// containers before jumping to container chains
+	estFastPathRules := []*nftables.Rule{
+		createEstFastPathRule(srcAddrOffset),
+		createEstFastPathRule(dstAddrOffset),
+	}
+	if r.estFastPath {
+		if err := nfc.AddSet(managedAddrSet, nil); err != nil {
+			return fmt.Errorf("error adding set %q: %w", managedAddrSetName, err)
+		}
+		// insert rules in reverse order to maintain order
+		for i := len(estFastPathRules) - 1; i >= 0; i-- {
+			if !findRule(r.logger, estFastPathRules[i], mainChainRules) {
+				nfc.InsertRule(estFastPathRules[i])
+			}
+		}
+	} else {
+		var found bool
+		for _, rule := range estFastPathRules {
+			if findRule(r.logger, rule, mainChainRules) {
+				if err := nfc.DelRule(rule); err != nil {
+					return fmt.Errorf("error deleting rule: %w", err)
+				}
+				found = true
+			}
+		}
+		if found {
+			nfc.DelSet(managedAddrSet)
+		}
+	}
+
 	// create rules to jump to container chain if packet is from/to a container
 	if addContainerJumpRules || !findRule(r.logger, srcJumpRule, mainChainRules) {
 		nfc.AddRule(srcJumpRule)
@@ -194,6 +307,19 @@ func (r *RuleManager) createBaseRules() error {
 		nfc.AddRule(dstJumpRule)
 	}
 
+	// create sets of connections whose server names are being or were
+	// checked
+	if r.sni != nil {
+		if err := createSNISets(nfc); err != nil {
+			return err
+		}
+	}
+
+	// create user chains before containers jump to them
+	if err := r.createUserChains(nfc); err != nil {
+		return fmt.Errorf("error creating user chains: %w", err)
+	}
+
 	if err := nfc.Flush(); err != nil {
 		return fmt.Errorf("error flushing nftables commands: %w", err)
 	}
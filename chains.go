@@ -0,0 +1,367 @@
+package whalewall
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// UserChains are chains defined in the daemon config that are created
+// in the filter table so rules of containers can jump to them.
+type UserChains struct {
+	chains []userChain
+}
+
+// daemonConfig is the YAML daemon config user chains are parsed from.
+type daemonConfig struct {
+	Chains []userChain
+}
+
+type userChain struct {
+	Name  string
+	Rules []userChainRule
+}
+
+// userChainRule is a rule of a user chain. User chains are jumped to
+// by both inbound and outbound traffic, so rules match source and
+// destination addresses instead of the direction of traffic.
+type userChainRule struct {
+	SrcIPs   []addrOrRange `yaml:"src_ips"`
+	DstIPs   []addrOrRange `yaml:"dst_ips"`
+	Proto    protocol
+	SrcPorts []rulePorts `yaml:"src_ports"`
+	DstPorts []rulePorts `yaml:"dst_ports"`
+	Verdict  chainVerdict
+}
+
+// chainVerdict is the verdict of a rule in a user chain. If it is
+// unset matched traffic is only counted.
+type chainVerdict uint8
+
+const (
+	chainContinue chainVerdict = iota
+	chainAccept
+	chainDrop
+	chainReject
+	chainReturn
+)
+
+func (v chainVerdict) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+func (v *chainVerdict) UnmarshalText(text []byte) error {
+	switch {
+	case bytes.Equal(text, []byte("accept")):
+		*v = chainAccept
+	case bytes.Equal(text, []byte("drop")):
+		*v = chainDrop
+	case bytes.Equal(text, []byte("reject")):
+		*v = chainReject
+	case bytes.Equal(text, []byte("return")):
+		*v = chainReturn
+	default:
+		return fmt.Errorf("invalid verdict %q", string(text))
+	}
+	return nil
+}
+
+func (v chainVerdict) String() string {
+	switch v {
+	case chainContinue:
+		return "continue"
+	case chainAccept:
+		return "accept"
+	case chainDrop:
+		return "drop"
+	case chainReject:
+		return "reject"
+	case chainReturn:
+		return "return"
+	default:
+		return fmt.Sprintf("verdict(%d)", v)
+	}
+}
+
+// ParseUserChains parses and validates user chains from a YAML daemon
+// config.
+func ParseUserChains(r io.Reader) (UserChains, error) {
+	var cfg daemonConfig
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return UserChains{}, fmt.Errorf("error parsing config: %w", err)
+	}
+	if err := validateUserChains(cfg.Chains); err != nil {
+		return UserChains{}, fmt.Errorf("error validating config: %w", err)
+	}
+
+	return UserChains{chains: cfg.Chains}, nil
+}
+
+// WithUserChains makes the RuleManager create chains before rules of
+// containers are created. Existing rules of the chains are replaced.
+func WithUserChains(chains UserChains) Option {
+	return func(r *RuleManager) {
+		r.userChains = chains.chains
+	}
+}
+
+func validateUserChains(chains []userChain) error {
+	names := make(map[string]bool, len(chains))
+	for i, c := range chains {
+		if err := validateUserChainName(c.Name); err != nil {
+			return fmt.Errorf("chain #%d: %w", i, err)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("chain #%d: chain %q is defined more than once", i, c.Name)
+		}
+		names[c.Name] = true
+
+		for j, rule := range c.Rules {
+			if err := validateUserChainRule(rule); err != nil {
+				return fmt.Errorf("chain %q: rule #%d: %w", c.Name, j, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateUserChainName(name string) error {
+	switch {
+	case name == "":
+		return errors.New(`"name" must be set`)
+	case len(name) >= unix.NFT_CHAIN_MAXNAMELEN:
+		return fmt.Errorf("chain name %q is too long", name)
+	// chains whalewall and Docker create are managed by them, don't
+	// let their rules get replaced
+	case strings.HasPrefix(name, whalewallChainName):
+		return fmt.Errorf("chain name %q is reserved, chains starting with %q are created by whalewall", name, whalewallChainName)
+	case strings.HasPrefix(name, "DOCKER"):
+		return fmt.Errorf("chain name %q is reserved, chains starting with %q are created by Docker", name, "DOCKER")
+	case name == inputChainName || name == outputChainName || name == "FORWARD":
+		return fmt.Errorf("chain name %q is reserved for base chains", name)
+	}
+
+	return nil
+}
+
+func validateUserChainRule(rule userChainRule) error {
+	if slices.ContainsFunc(rule.SrcIPs, addrOrRange.isSymbol) || slices.ContainsFunc(rule.DstIPs, addrOrRange.isSymbol) {
+		return errors.New("symbolic addresses are only supported in output and deny rules")
+	}
+	if rule.Proto == invalidProto && len(rule.SrcPorts) != 0 {
+		return errors.New(`"proto" must be set when "src_ports" is set`)
+	}
+	if rule.Proto == invalidProto && len(rule.DstPorts) != 0 {
+		return errors.New(`"proto" must be set when "dst_ports" is set`)
+	}
+
+	return nil
+}
+
+// createUserChains creates user chains and replaces their rules.
+func (r *RuleManager) createUserChains(nfc firewallClient) error {
+	if len(r.userChains) == 0 {
+		return nil
+	}
+
+	chains, err := nfc.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return fmt.Errorf("error listing IPv4 chains: %w", err)
+	}
+	existing := make(map[string]*nftables.Chain)
+	for _, c := range chains {
+		if c.Table.Name == filterTableName {
+			existing[c.Name] = c
+		}
+	}
+
+	for _, uc := range r.userChains {
+		chain := &nftables.Chain{
+			Name:  uc.Name,
+			Table: filterTable,
+			Type:  nftables.ChainTypeFilter,
+		}
+		if c, ok := existing[uc.Name]; ok {
+			if c.Hooknum != nil {
+				return fmt.Errorf("chain %q is a base chain", uc.Name)
+			}
+			// delete and add rules in the same batch so there's never
+			// a moment where the chain is empty
+			rules, err := nfc.GetRules(filterTable, chain)
+			if err != nil {
+				return fmt.Errorf("error listing rules of %q chain: %w", uc.Name, err)
+			}
+			for _, rule := range rules {
+				if err := nfc.DelRule(rule); err != nil {
+					return fmt.Errorf("error deleting rule of %q chain: %w", uc.Name, err)
+				}
+			}
+		} else {
+			r.logger.Info("creating user chain", zap.String("chain.name", uc.Name))
+			nfc.AddChain(chain)
+		}
+
+		for i, rule := range uc.Rules {
+			nftRule, err := createUserChainRule(nfc, chain, rule)
+			if err != nil {
+				return fmt.Errorf("error creating rule #%d of %q chain: %w", i, uc.Name, err)
+			}
+			nfc.AddRule(nftRule)
+		}
+	}
+
+	return nil
+}
+
+func createUserChainRule(nfc firewallClient, chain *nftables.Chain, rule userChainRule) (*nftables.Rule, error) {
+	var exprs []expr.Any
+	if len(rule.SrcIPs) != 0 {
+		ipExprs, err := createIPExprs(nfc, rule.SrcIPs, srcAddrOffset, chain)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, ipExprs...)
+	}
+	if len(rule.DstIPs) != 0 {
+		ipExprs, err := createIPExprs(nfc, rule.DstIPs, dstAddrOffset, chain)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, ipExprs...)
+	}
+	if rule.Proto != invalidProto {
+		proto := unix.IPPROTO_TCP
+		if rule.Proto == udp {
+			proto = unix.IPPROTO_UDP
+		}
+		exprs = append(exprs, matchProtoExprs(proto)...)
+	}
+	if len(rule.SrcPorts) != 0 {
+		portExprs, err := createPortExprs(nfc, rule.SrcPorts, srcPortOffset, chain)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, portExprs...)
+	}
+	if len(rule.DstPorts) != 0 {
+		portExprs, err := createPortExprs(nfc, rule.DstPorts, dstPortOffset, chain)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, portExprs...)
+	}
+	exprs = append(exprs, &expr.Counter{})
+
+	switch rule.Verdict {
+	case chainAccept:
+		exprs = append(exprs, acceptVerdict)
+	case chainDrop:
+		exprs = append(exprs, dropVerdict)
+	case chainReject:
+		exprs = append(exprs, rejectExpr(rule.Proto == tcp))
+	case chainReturn:
+		exprs = append(exprs, &expr.Verdict{
+			Kind: expr.VerdictReturn,
+		})
+	}
+
+	return &nftables.Rule{
+		Table: filterTable,
+		Chain: chain,
+		Exprs: exprs,
+	}, nil
+}
+
+// validateChainRefs returns an error for each rule of c that jumps to
+// a chain that doesn't exist in the filter table or can't be jumped to.
+func (r *RuleManager) validateChainRefs(c config) error {
+	var refs []struct {
+		rule  string
+		chain string
+	}
+	addRef := func(rule string, v verdict) {
+		if v.Chain != "" {
+			refs = append(refs, struct {
+				rule  string
+				chain string
+			}{rule: rule, chain: v.Chain})
+		}
+	}
+	for i, rule := range c.FromHost {
+		addRef(fmt.Sprintf("from_host rule #%d", i), rule.Verdict)
+	}
+	addRef("mapped_ports: localhost", c.MappedPorts.Localhost.Verdict)
+	for i, port := range c.MappedPorts.Localhost.Ports {
+		addRef(fmt.Sprintf("mapped_ports: localhost: port #%d", i), port.Verdict)
+	}
+	addRef("mapped_ports: external", c.MappedPorts.External.Verdict)
+	for i, port := range c.MappedPorts.External.Ports {
+		addRef(fmt.Sprintf("mapped_ports: external: port #%d", i), port.Verdict)
+	}
+	for i, rule := range c.Input {
+		addRef(fmt.Sprintf("input rule #%d", i), rule.Verdict)
+	}
+	for i, rule := range c.Output {
+		addRef(fmt.Sprintf("output rule #%d", i), rule.Verdict)
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+
+	nfc, err := r.newFirewallClient()
+	if err != nil {
+		return fmt.Errorf("error creating netlink connection: %w", err)
+	}
+	chains, err := nfc.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return fmt.Errorf("error listing IPv4 chains: %w", err)
+	}
+	existing := make(map[string]*nftables.Chain)
+	for _, c := range chains {
+		if c.Table.Name == filterTableName {
+			existing[c.Name] = c
+		}
+	}
+
+	var errs []error
+	for _, ref := range refs {
+		c, ok := existing[ref.chain]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("%s: chain %q doesn't exist in table %q", ref.rule, ref.chain, filterTableName))
+		case c.Hooknum != nil:
+			errs = append(errs, fmt.Errorf("%s: chain %q is a base chain and can't be jumped to", ref.rule, ref.chain))
+		case strings.HasPrefix(ref.chain, whalewallChainName):
+			errs = append(errs, fmt.Errorf("%s: chain %q is managed by whalewall and can't be jumped to", ref.rule, ref.chain))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// deleteUserChains deletes user chains. Chains that are still jumped
+// to by rules not created by whalewall are left alone.
+func (r *RuleManager) deleteUserChains(nfc firewallClient) {
+	for _, uc := range r.userChains {
+		nfc.DelChain(&nftables.Chain{
+			Name:  uc.Name,
+			Table: filterTable,
+		})
+		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+			r.logger.Error("error deleting user chain", zap.String("chain.name", uc.Name), zap.Error(err))
+		}
+	}
+}
@@ -6,12 +6,15 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
+	"net/netip"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime/debug"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/landlock-lsm/go-landlock/landlock"
@@ -30,10 +33,21 @@ func main() {
 }
 
 func mainRetCode() int {
+	chainsPath := flag.String("chains", "", "path to a YAML file of chains to create that rules of containers can jump to")
 	clear := flag.Bool("clear", false, "remove all firewall rules created by whalewall")
 	dataDir := flag.String("d", ".", "directory to store state in")
 	debugLogs := flag.Bool("debug", false, "enable debug logging")
+	dnsQueue := flag.Int("dns-queue", -1, "nfqueue to read DNS responses to containers with allowed_domains set from; if unset allowed_domains can't be used")
+	dnsResolvers := flag.String("dns-resolvers", "", "comma separated IPv4 addresses of DNS servers whose responses to containers with allowed_domains set are trusted, in addition to the DNS servers set on each container")
+	estFastPath := flag.Bool("est-fast-path", false, "accept established and related traffic of all managed containers before container rules are evaluated")
+	learn := flag.Bool("learn", false, "log and accept traffic of containers that isn't allowed instead of dropping it; can be overridden per container with the whalewall.mode label")
 	logPath := flag.String("l", "stdout", "path to log to")
+	logGroup := flag.Int("log-group", -1, "NFLOG group to log packets to; if unset packets are logged to the kernel log")
+	logDrops := flag.Bool("log-drops", false, "log traffic of containers that is dropped or rejected because it isn't allowed")
+	dropLogLimit := flag.Uint("drop-log-limit", whalewall.DefaultDropLogLimit, "maximum number of dropped packets to log per container per minute when -log-drops is set; 0 logs all dropped packets")
+	reject := flag.Bool("reject", false, "reject traffic of containers that isn't allowed with TCP resets or ICMP errors instead of dropping it")
+	ruleLayout := flag.String("rule-layout", "rules", "how to lay out allowed traffic in container chains, either 'rules' or 'sets'")
+	sniQueue := flag.Int("sni-queue", -1, "nfqueue to check the server names of TLS connections of containers with allowed_sni set in; if unset allowed_sni can't be used")
 	timeout := flag.Duration("t", 10*time.Second, "timeout for Docker API requests")
 	displayVersion := flag.Bool("version", false, "print version and build information and exit")
 	flag.Parse()
@@ -92,7 +106,72 @@ func mainRetCode() int {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	r, err := whalewall.NewRuleManager(ctx, logger, sqliteFile, *timeout)
+	layout, err := whalewall.ParseRuleLayout(*ruleLayout)
+	if err != nil {
+		logger.Error("error parsing flag", zap.String("flag", "rule-layout"), zap.Error(err))
+		return 1
+	}
+
+	opts := []whalewall.Option{
+		whalewall.WithRuleLayout(layout),
+		whalewall.WithEstablishedFastPath(*estFastPath),
+		whalewall.WithLearnMode(*learn),
+		whalewall.WithReject(*reject),
+		whalewall.WithDropLogging(*logDrops),
+		whalewall.WithDropLogLimit(uint32(*dropLogLimit)),
+	}
+	if *chainsPath != "" {
+		f, err := os.Open(*chainsPath)
+		if err != nil {
+			logger.Error("error opening chains file", zap.Error(err))
+			return 1
+		}
+		chains, err := whalewall.ParseUserChains(f)
+		f.Close()
+		if err != nil {
+			logger.Error("error parsing chains file", zap.String("path", *chainsPath), zap.Error(err))
+			return 1
+		}
+		opts = append(opts, whalewall.WithUserChains(chains))
+	}
+	if *logGroup != -1 {
+		if *logGroup < 0 || *logGroup > math.MaxUint16 {
+			logger.Error("error parsing flag", zap.String("flag", "log-group"), zap.Error(errors.New("NFLOG group must be between 0 and 65535")))
+			return 1
+		}
+		opts = append(opts, whalewall.WithLogGroup(uint16(*logGroup)))
+	}
+	if *sniQueue != -1 {
+		if *sniQueue < 0 || *sniQueue > math.MaxUint16 {
+			logger.Error("error parsing flag", zap.String("flag", "sni-queue"), zap.Error(errors.New("queue must be between 0 and 65535")))
+			return 1
+		}
+		opts = append(opts, whalewall.WithSNIQueue(uint16(*sniQueue)))
+	}
+	if *dnsQueue != -1 {
+		if *dnsQueue < 0 || *dnsQueue > math.MaxUint16 {
+			logger.Error("error parsing flag", zap.String("flag", "dns-queue"), zap.Error(errors.New("queue must be between 0 and 65535")))
+			return 1
+		}
+		opts = append(opts, whalewall.WithDNSQueue(uint16(*dnsQueue)))
+	}
+	if *dnsResolvers != "" {
+		var addrs []netip.Addr
+		for _, s := range strings.Split(*dnsResolvers, ",") {
+			addr, err := netip.ParseAddr(strings.TrimSpace(s))
+			if err == nil && !addr.Is4() {
+				err = errors.New("only IPv4 addresses are supported")
+			}
+			if err != nil {
+				logger.Error("error parsing flag", zap.String("flag", "dns-resolvers"), zap.Error(err))
+				return 1
+			}
+			addrs = append(addrs, addr)
+		}
+		opts = append(opts, whalewall.WithDNSResolvers(addrs))
+	}
+
+	r, err := whalewall.NewRuleManager(ctx, logger, sqliteFile, *timeout, opts...)
 	if err != nil {
 		logger.Error("error initializing", zap.Error(err))
 	}
@@ -101,6 +180,18 @@ func mainRetCode() int {
 		return 1
 	}
 
+	// print information about a container if the user asked to
+	switch flag.Arg(0) {
+	case "denials":
+		return printDenials(ctx, logger, r, flag.Args()[1:])
+	case "suggest":
+		return printSuggestedRules(ctx, logger, r, flag.Args()[1:])
+	case "status":
+		return printStatus(ctx, logger, r, flag.Args()[1:])
+	case "bans":
+		return manageBans(ctx, logger, r, flag.Args()[1:])
+	}
+
 	// remove all created firewall rules if the user asked to clear
 	if *clear {
 		logger.Info("clearing rules")
@@ -144,6 +235,196 @@ func mainRetCode() int {
 	return 0
 }
 
+func printDenials(ctx context.Context, logger *zap.Logger, r *whalewall.RuleManager, args []string) int {
+	fs := flag.NewFlagSet("denials", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] denials [-yaml] <container>\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	printYAML := fs.Bool("yaml", false, "print output rules that would allow outbound dropped traffic")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	contName := fs.Arg(0)
+
+	denials, err := r.Denials(ctx, contName)
+	if err != nil {
+		logger.Error("error getting denials", zap.String("container.name", contName), zap.Error(err))
+		return 1
+	}
+
+	if *printYAML {
+		rules, err := whalewall.SuggestOutputRules(denials)
+		if err != nil {
+			logger.Error("error creating output rules", zap.Error(err))
+			return 1
+		}
+		if rules == nil {
+			fmt.Printf("no outbound TCP or UDP traffic of %s was dropped\n", contName)
+			return 0
+		}
+		os.Stdout.Write(rules)
+		return 0
+	}
+
+	if len(denials) == 0 {
+		fmt.Printf("no traffic of %s was dropped\n", contName)
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DIRECTION\tADDRESS\tPROTO\tPORT\tCOUNT\tFIRST SEEN\tLAST SEEN")
+	for _, d := range denials {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			d.Direction,
+			d.Addr,
+			d.Proto,
+			d.Port,
+			d.Count,
+			d.FirstSeen.Format(time.RFC3339),
+			d.LastSeen.Format(time.RFC3339),
+		)
+	}
+	tw.Flush()
+	fmt.Println("\nrerun with 'denials -yaml' to print output rules that would allow the outbound traffic")
+
+	return 0
+}
+
+func printSuggestedRules(ctx context.Context, logger *zap.Logger, r *whalewall.RuleManager, args []string) int {
+	fs := flag.NewFlagSet("suggest", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] suggest <container>\n", filepath.Base(os.Args[0]))
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	contName := fs.Arg(0)
+
+	rules, err := r.SuggestRules(ctx, contName)
+	if err != nil {
+		logger.Error("error creating rules", zap.String("container.name", contName), zap.Error(err))
+		return 1
+	}
+	if rules == nil {
+		fmt.Printf("no traffic of %s was recorded in learn mode\n", contName)
+		return 0
+	}
+	os.Stdout.Write(rules)
+
+	return 0
+}
+
+func printStatus(ctx context.Context, logger *zap.Logger, r *whalewall.RuleManager, args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] status <container>\n", filepath.Base(os.Args[0]))
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	contName := fs.Arg(0)
+
+	statuses, err := r.LimitStatus(ctx, contName)
+	if err != nil {
+		logger.Error("error getting status", zap.String("container.name", contName), zap.Error(err))
+		return 1
+	}
+	banStatus, err := r.BanStatus(ctx, contName)
+	if err != nil {
+		logger.Error("error getting status", zap.String("container.name", contName), zap.Error(err))
+		return 1
+	}
+	if len(statuses) == 0 && !banStatus.Enabled {
+		fmt.Printf("%s has no rate limits, connection limits or bans\n", contName)
+		return 0
+	}
+
+	if len(statuses) != 0 {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "LIMIT\tSOURCES\tDROPPED")
+		for _, s := range statuses {
+			fmt.Fprintf(tw, "%s\t%d\t%d\n", s.Limit, s.Sources, s.Dropped)
+		}
+		tw.Flush()
+	}
+	if banStatus.Enabled {
+		if len(statuses) != 0 {
+			fmt.Println()
+		}
+		printBans(contName, banStatus)
+	}
+
+	return 0
+}
+
+func manageBans(ctx context.Context, logger *zap.Logger, r *whalewall.RuleManager, args []string) int {
+	fs := flag.NewFlagSet("bans", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s [flags] bans [-lift address] <container>\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	lift := fs.String("lift", "", "lift the ban of a source address instead of listing bans")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	contName := fs.Arg(0)
+
+	if *lift != "" {
+		addr, err := netip.ParseAddr(*lift)
+		if err != nil {
+			logger.Error("error parsing flag", zap.String("flag", "lift"), zap.Error(err))
+			return 2
+		}
+		if err := r.LiftBan(ctx, contName, addr); err != nil {
+			logger.Error("error lifting ban", zap.String("container.name", contName), zap.Stringer("addr", addr), zap.Error(err))
+			return 1
+		}
+		logger.Info("lifted ban", zap.String("container.name", contName), zap.Stringer("addr", addr))
+		return 0
+	}
+
+	status, err := r.BanStatus(ctx, contName)
+	if err != nil {
+		logger.Error("error getting bans", zap.String("container.name", contName), zap.Error(err))
+		return 1
+	}
+	if !status.Enabled {
+		fmt.Printf("sources are not banned from %s\n", contName)
+		return 0
+	}
+	printBans(contName, status)
+
+	return 0
+}
+
+func printBans(contName string, status whalewall.BanStatus) {
+	scope := contName
+	if status.Global {
+		scope = "all containers with global bans"
+	}
+	fmt.Printf("%d packets of banned sources were dropped\n", status.Dropped)
+	if len(status.Bans) == 0 {
+		fmt.Printf("no sources are banned from %s\n", scope)
+		return
+	}
+
+	fmt.Printf("sources banned from %s:\n", scope)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tEXPIRES IN")
+	for _, b := range status.Bans {
+		fmt.Fprintf(tw, "%s\t%s\n", b.Addr, b.Expires.Round(time.Second))
+	}
+	tw.Flush()
+}
+
 // TODO: test with docker with TLS
 func restrictPrivileges(logger *zap.Logger, sqliteFile, logPath string) bool {
 	// only allow needed files to be read/written to
@@ -2,19 +2,32 @@ package whalewall
 
 import (
 	"bytes"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"net/netip"
 	"slices"
 	"strconv"
+	"strings"
 
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
 	"go.uber.org/zap/zapcore"
 	"go4.org/netipx"
+	"golang.org/x/exp/maps"
+	"golang.org/x/sys/unix"
 )
 
 type config struct {
-	MappedPorts mappedPorts `yaml:"mapped_ports"`
-	Output      []ruleConfig
+	MappedPorts    mappedPorts  `yaml:"mapped_ports"`
+	FromHost       []ruleConfig `yaml:"from_host"`
+	Input          []ruleConfig
+	Output         []ruleConfig
+	Deny           []ruleConfig
+	Reject         *bool
+	AllowedSNI     []string    `yaml:"allowed_sni"`
+	SNIPorts       []rulePorts `yaml:"sni_ports"`
+	AllowedDomains []string    `yaml:"allowed_domains"`
 }
 
 type mappedPorts struct {
@@ -27,26 +40,138 @@ type localRules struct {
 	Allow     bool
 	LogPrefix string `yaml:"log_prefix"`
 	Verdict   verdict
+	// Ports overrides the above options for specific container ports.
+	Ports []localPortRules
 }
 
-type externalRules struct {
+type localPortRules struct {
+	Port      uint16
+	Proto     protocol
 	Allow     bool
 	LogPrefix string `yaml:"log_prefix"`
-	IPs       []addrOrRange
 	Verdict   verdict
 }
 
+type externalRules struct {
+	Allow          bool
+	LogPrefix      string `yaml:"log_prefix"`
+	IPs            []addrOrRange
+	Interfaces     []string
+	RateLimit      rateLimit `yaml:"rate_limit"`
+	MaxConnections uint32    `yaml:"max_connections"`
+	Verdict        verdict
+	// Ports overrides the above options for specific container ports.
+	Ports []externalPortRules
+	// Ban applies to all mapped ports and can't be overridden per port.
+	Ban banConfig
+}
+
+type externalPortRules struct {
+	Port           uint16
+	Proto          protocol
+	Allow          bool
+	LogPrefix      string `yaml:"log_prefix"`
+	IPs            []addrOrRange
+	Interfaces     []string
+	RateLimit      rateLimit `yaml:"rate_limit"`
+	MaxConnections uint32    `yaml:"max_connections"`
+	Verdict        verdict
+}
+
+// allowed returns true if access to any mapped port is allowed.
+func (m mappedPorts) allowed() bool {
+	if m.Localhost.Allow || m.External.Allow {
+		return true
+	}
+	return slices.ContainsFunc(m.Localhost.Ports, func(p localPortRules) bool {
+		return p.Allow
+	}) || slices.ContainsFunc(m.External.Ports, func(p externalPortRules) bool {
+		return p.Allow
+	})
+}
+
+// forPort returns the rules that apply to a container port. Rules of
+// the first entry of Ports that matches the port are returned if one
+// exists, otherwise the default rules are.
+func (l localRules) forPort(port uint16, proto protocol) localRules {
+	i := slices.IndexFunc(l.Ports, func(p localPortRules) bool {
+		return p.Port == port && p.Proto == proto
+	})
+	if i == -1 {
+		return localRules{
+			Allow:     l.Allow,
+			LogPrefix: l.LogPrefix,
+			Verdict:   l.Verdict,
+		}
+	}
+
+	p := l.Ports[i]
+	return localRules{
+		Allow:     p.Allow,
+		LogPrefix: p.LogPrefix,
+		Verdict:   p.Verdict,
+	}
+}
+
+// forPort returns the rules that apply to a container port. Rules of
+// the first entry of Ports that matches the port are returned if one
+// exists, otherwise the default rules are.
+func (e externalRules) forPort(port uint16, proto protocol) externalRules {
+	i := slices.IndexFunc(e.Ports, func(p externalPortRules) bool {
+		return p.Port == port && p.Proto == proto
+	})
+	if i == -1 {
+		return externalRules{
+			Allow:          e.Allow,
+			LogPrefix:      e.LogPrefix,
+			IPs:            e.IPs,
+			Interfaces:     e.Interfaces,
+			RateLimit:      e.RateLimit,
+			MaxConnections: e.MaxConnections,
+			Verdict:        e.Verdict,
+		}
+	}
+
+	p := e.Ports[i]
+	return externalRules{
+		Allow:          p.Allow,
+		LogPrefix:      p.LogPrefix,
+		IPs:            p.IPs,
+		Interfaces:     p.Interfaces,
+		RateLimit:      p.RateLimit,
+		MaxConnections: p.MaxConnections,
+		Verdict:        p.Verdict,
+	}
+}
+
 type ruleConfig struct {
-	LogPrefix string `yaml:"log_prefix"`
-	Network   string
-	IPs       []addrOrRange
-	Container string
-	Proto     protocol
-	SrcPorts  []rulePorts `yaml:"src_ports"`
-	DstPorts  []rulePorts `yaml:"dst_ports"`
-	Verdict   verdict
+	LogPrefix         string `yaml:"log_prefix"`
+	Network           string
+	NetworkPeers      bool `yaml:"network_peers"`
+	IPs               []addrOrRange
+	Container         string
+	ContainerSelector containerSelector `yaml:"container_selector"`
+	Proto             protocol
+	SrcPorts          []rulePorts `yaml:"src_ports"`
+	DstPorts          []rulePorts `yaml:"dst_ports"`
+	EgressInterfaces  []string    `yaml:"egress_interfaces"`
+	RateLimit         rateLimit   `yaml:"rate_limit"`
+	MaxConnections    uint32      `yaml:"max_connections"`
+	Verdict           verdict
 
 	skip bool
+	// addrSet is a set of addresses matched instead of IPs if set
+	addrSet *nftables.Set
+	// iifnames are the interfaces inbound traffic must arrive on if set
+	iifnames []string
+	// hostAddrs are the addresses of the host connections must have
+	// been made to before being DNATed if set
+	hostAddrs []netip.Addr
+	// meter is evaluated after the connection state is matched if set
+	meter []expr.Any
+	// banChain is the chain traffic dropped by limits is sent to if
+	// sources are banned
+	banChain *nftables.Chain
 }
 
 func (r ruleConfig) MarshalLogObject(enc zapcore.ObjectEncoder) error {
@@ -56,6 +181,9 @@ func (r ruleConfig) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	if r.Network != "" {
 		enc.AddString("network", r.Network)
 	}
+	if r.NetworkPeers {
+		enc.AddBool("network_peers", r.NetworkPeers)
+	}
 	if len(r.IPs) != 0 {
 		if err := enc.AddArray("ips", addrsList(r.IPs)); err != nil {
 			return err
@@ -64,6 +192,11 @@ func (r ruleConfig) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	if r.Container != "" {
 		enc.AddString("container", r.Container)
 	}
+	if len(r.ContainerSelector) != 0 {
+		if err := enc.AddObject("container_selector", r.ContainerSelector); err != nil {
+			return err
+		}
+	}
 	enc.AddString("proto", r.Proto.String())
 	if len(r.SrcPorts) != 0 {
 		if err := enc.AddArray("src_ports", portsList(r.SrcPorts)); err != nil {
@@ -84,31 +217,83 @@ func (r ruleConfig) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 
 type verdict struct {
 	Chain          string
-	Queue          uint16
-	InputEstQueue  uint16 `yaml:"input_est_queue"`
-	OutputEstQueue uint16 `yaml:"output_est_queue"`
+	Queue          queueNums
+	InputEstQueue  queueNums `yaml:"input_est_queue"`
+	OutputEstQueue queueNums `yaml:"output_est_queue"`
+	Fanout         bool
+	Bypass         bool
+	Mark           uint32
+	CtMark         uint32 `yaml:"ct_mark"`
 
-	drop bool
+	drop   bool
+	reject bool
+	// setMarks makes rules set the marks above on packets instead of
+	// having a verdict
+	setMarks bool
+	// gotoChain is a chain matched traffic is sent to without
+	// returning to the chain of the rule afterwards
+	gotoChain string
 }
 
 func (v verdict) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	if v.Chain != "" {
 		enc.AddString("chain", v.Chain)
 	}
-	if v.Queue != 0 {
-		enc.AddUint16("queue", v.Queue)
+	if v.gotoChain != "" {
+		enc.AddString("goto_chain", v.gotoChain)
 	}
-	if v.InputEstQueue != 0 {
-		enc.AddUint16("input_est_queue", v.InputEstQueue)
+	if v.Queue.set() {
+		enc.AddString("queue", v.Queue.String())
 	}
-	if v.OutputEstQueue != 0 {
-		enc.AddUint16("output_est_queue", v.OutputEstQueue)
+	if v.InputEstQueue.set() {
+		enc.AddString("input_est_queue", v.InputEstQueue.String())
+	}
+	if v.OutputEstQueue.set() {
+		enc.AddString("output_est_queue", v.OutputEstQueue.String())
+	}
+	if v.Fanout {
+		enc.AddBool("fanout", v.Fanout)
+	}
+	if v.Bypass {
+		enc.AddBool("bypass", v.Bypass)
+	}
+	if v.Mark != 0 {
+		enc.AddUint32("mark", v.Mark)
+	}
+	if v.CtMark != 0 {
+		enc.AddUint32("ct_mark", v.CtMark)
 	}
 	enc.AddBool("drop", v.drop)
+	if v.reject {
+		enc.AddBool("reject", v.reject)
+	}
 
 	return nil
 }
 
+// containerSelector is a set of labels containers must have to be
+// selected by a rule.
+type containerSelector map[string]string
+
+func (c containerSelector) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	keys := maps.Keys(c)
+	slices.Sort(keys)
+	for _, key := range keys {
+		enc.AddString(key, c[key])
+	}
+	return nil
+}
+
+// matches returns true if labels has every label of the selector.
+func (c containerSelector) matches(labels map[string]string) bool {
+	for key, val := range c {
+		if labelVal, ok := labels[key]; !ok || labelVal != val {
+			return false
+		}
+	}
+	return true
+}
+
 type addrsList []addrOrRange
 
 func (a addrsList) MarshalLogArray(enc zapcore.ArrayEncoder) error {
@@ -124,9 +309,13 @@ func (a addrsList) MarshalLogArray(enc zapcore.ArrayEncoder) error {
 type addrOrRange struct {
 	addr      netip.Addr
 	addrRange netipx.IPRange
+	symbol    string
 }
 
 func (a addrOrRange) MarshalText() ([]byte, error) {
+	if a.symbol != "" {
+		return []byte(a.symbol), nil
+	}
 	if a.addr.IsValid() {
 		return a.addr.MarshalText()
 	}
@@ -138,6 +327,10 @@ func (a addrOrRange) MarshalBinary() ([]byte, error) {
 }
 
 func (a *addrOrRange) UnmarshalText(text []byte) error {
+	if slices.Contains(addrSymbols, string(text)) {
+		a.symbol = string(text)
+		return nil
+	}
 	if bytes.ContainsRune(text, '/') {
 		prefix := new(netip.Prefix)
 		err := prefix.UnmarshalText(text)
@@ -157,7 +350,9 @@ func (a *addrOrRange) UnmarshalBinary(data []byte) error {
 }
 
 func (a addrOrRange) MarshalLogObject(enc zapcore.ObjectEncoder) error {
-	if a.addr.IsValid() {
+	if a.symbol != "" {
+		enc.AddString("symbol", a.symbol)
+	} else if a.addr.IsValid() {
 		enc.AddString("addr", a.addr.String())
 	} else {
 		enc.AddString("addrs", a.addrRange.String())
@@ -166,7 +361,24 @@ func (a addrOrRange) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 }
 
 func (a *addrOrRange) IsValid() bool {
-	return a.addr.IsValid() || a.addrRange.IsValid()
+	return a.addr.IsValid() || a.addrRange.IsValid() || a.symbol != ""
+}
+
+func (a addrOrRange) isSymbol() bool {
+	return a.symbol != ""
+}
+
+// isPrivate returns true if a is or contains a private address.
+func (a addrOrRange) isPrivate() bool {
+	if a.symbol != "" {
+		return a.symbol == symbolPrivate
+	}
+	if a.addr.IsValid() {
+		return a.addr.IsPrivate()
+	}
+	return slices.ContainsFunc(privatePrefixes, func(p netip.Prefix) bool {
+		return a.addrRange.From().Compare(netipx.PrefixLastIP(p)) <= 0 && p.Addr().Compare(a.addrRange.To()) <= 0
+	})
 }
 
 func (a *addrOrRange) Addr() (netip.Addr, bool) {
@@ -311,28 +523,487 @@ func (p rulePorts) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	return nil
 }
 
+// queueNums is a nfqueue or a range of nfqueues packets are
+// distributed across.
+type queueNums struct {
+	first uint16
+	last  uint16
+}
+
+// set returns true if packets are sent to a queue.
+func (q queueNums) set() bool {
+	return q != queueNums{}
+}
+
+// isRange returns true if q is a range of more than one queue.
+func (q queueNums) isRange() bool {
+	return q.last > q.first
+}
+
+func (q queueNums) String() string {
+	if q.first == q.last {
+		return strconv.Itoa(int(q.first))
+	}
+	return fmt.Sprintf("%d-%d", q.first, q.last)
+}
+
+func (q queueNums) MarshalText() ([]byte, error) {
+	return []byte(q.String()), nil
+}
+
+func (q queueNums) MarshalBinary() ([]byte, error) {
+	return q.MarshalText()
+}
+
+func (q *queueNums) UnmarshalText(text []byte) error {
+	firstStr, lastStr, isRange := strings.Cut(string(text), "-")
+	first, err := strconv.ParseUint(firstStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("error parsing queue: %w", err)
+	}
+	last := first
+	if isRange {
+		last, err = strconv.ParseUint(lastStr, 10, 16)
+		if err != nil {
+			return fmt.Errorf("error parsing end of queue range: %w", err)
+		}
+	}
+
+	*q = queueNums{
+		first: uint16(first),
+		last:  uint16(last),
+	}
+
+	return nil
+}
+
+func (q *queueNums) UnmarshalBinary(data []byte) error {
+	return q.UnmarshalText(data)
+}
+
+// legacyRuleConfig is a ruleConfig as it was encoded before queue
+// ranges were supported, when queues were single numbers. Rules are
+// stored encoded in the database, so rules stored by older versions
+// have to be decoded as this.
+type legacyRuleConfig struct {
+	LogPrefix         string
+	Network           string
+	NetworkPeers      bool
+	IPs               []addrOrRange
+	Container         string
+	ContainerSelector containerSelector
+	Proto             protocol
+	SrcPorts          []rulePorts
+	DstPorts          []rulePorts
+	EgressInterfaces  []string
+	RateLimit         rateLimit
+	MaxConnections    uint32
+	Verdict           legacyVerdict
+}
+
+type legacyVerdict struct {
+	Chain          string
+	Queue          uint16
+	InputEstQueue  uint16
+	OutputEstQueue uint16
+	Mark           uint32
+	CtMark         uint32
+}
+
+func (l legacyRuleConfig) ruleConfig() ruleConfig {
+	queue := func(n uint16) queueNums {
+		return queueNums{first: n, last: n}
+	}
+	var v verdict
+	if l.Verdict.Queue != 0 {
+		v.Queue = queue(l.Verdict.Queue)
+	}
+	if l.Verdict.InputEstQueue != 0 {
+		v.InputEstQueue = queue(l.Verdict.InputEstQueue)
+	}
+	if l.Verdict.OutputEstQueue != 0 {
+		v.OutputEstQueue = queue(l.Verdict.OutputEstQueue)
+	}
+	v.Chain = l.Verdict.Chain
+	v.Mark = l.Verdict.Mark
+	v.CtMark = l.Verdict.CtMark
+
+	return ruleConfig{
+		LogPrefix:         l.LogPrefix,
+		Network:           l.Network,
+		NetworkPeers:      l.NetworkPeers,
+		IPs:               l.IPs,
+		Container:         l.Container,
+		ContainerSelector: l.ContainerSelector,
+		Proto:             l.Proto,
+		SrcPorts:          l.SrcPorts,
+		DstPorts:          l.DstPorts,
+		EgressInterfaces:  l.EgressInterfaces,
+		RateLimit:         l.RateLimit,
+		MaxConnections:    l.MaxConnections,
+		Verdict:           v,
+	}
+}
+
+// decodeRuleConfig decodes a ruleConfig that was stored in the
+// database. Rules stored by versions that didn't support queue ranges
+// are decoded as well.
+func decodeRuleConfig(data []byte) (ruleConfig, error) {
+	var cfg ruleConfig
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cfg)
+	if err == nil {
+		return cfg, nil
+	}
+
+	var legacyCfg legacyRuleConfig
+	if legacyErr := gob.NewDecoder(bytes.NewReader(data)).Decode(&legacyCfg); legacyErr != nil {
+		return ruleConfig{}, err
+	}
+	return legacyCfg.ruleConfig(), nil
+}
+
+// usesEstQueues returns true if any rule sends established traffic to
+// a queue.
+func (c config) usesEstQueues() bool {
+	verdicts := []verdict{
+		c.MappedPorts.Localhost.Verdict,
+		c.MappedPorts.External.Verdict,
+	}
+	for _, p := range c.MappedPorts.Localhost.Ports {
+		verdicts = append(verdicts, p.Verdict)
+	}
+	for _, p := range c.MappedPorts.External.Ports {
+		verdicts = append(verdicts, p.Verdict)
+	}
+	for _, r := range c.FromHost {
+		verdicts = append(verdicts, r.Verdict)
+	}
+	for _, r := range c.Input {
+		verdicts = append(verdicts, r.Verdict)
+	}
+	for _, r := range c.Output {
+		verdicts = append(verdicts, r.Verdict)
+	}
+
+	return slices.ContainsFunc(verdicts, func(v verdict) bool {
+		return v.InputEstQueue.set() || v.OutputEstQueue.set()
+	})
+}
+
 func validateConfig(c config) error {
+	for i, r := range c.FromHost {
+		err := validateFromHostRule(r)
+		if err != nil {
+			return fmt.Errorf("from_host rule #%d: %w", i, err)
+		}
+	}
+	if slices.ContainsFunc(c.MappedPorts.External.IPs, addrOrRange.isSymbol) {
+		return errors.New("mapped_ports: external: symbolic addresses are only supported in output and deny rules")
+	}
+	if err := validateMappedPorts(c.MappedPorts); err != nil {
+		return fmt.Errorf("mapped_ports: %w", err)
+	}
+	for i, r := range c.Input {
+		if slices.ContainsFunc(r.IPs, addrOrRange.isSymbol) {
+			return fmt.Errorf("input rule #%d: symbolic addresses are only supported in output and deny rules", i)
+		}
+		if r.NetworkPeers {
+			return fmt.Errorf(`input rule #%d: "network_peers" is only supported in output rules`, i)
+		}
+		if len(r.EgressInterfaces) != 0 {
+			return fmt.Errorf(`input rule #%d: "egress_interfaces" is only supported in output rules`, i)
+		}
+		if r.Verdict.marked() {
+			return fmt.Errorf(`input rule #%d: "mark" and "ct_mark" are only supported in output rules`, i)
+		}
+		err := validateRule(r)
+		if err != nil {
+			return fmt.Errorf("input rule #%d: %w", i, err)
+		}
+	}
 	for i, r := range c.Output {
+		if r.usesAllowedDomains() {
+			if err := validateAllowedDomainsRule(c, r); err != nil {
+				return fmt.Errorf("output rule #%d: %w", i, err)
+			}
+		}
+		if r.limited() {
+			return fmt.Errorf(`output rule #%d: "rate_limit" and "max_connections" are only supported in input and mapped port rules`, i)
+		}
+		// rules allowing traffic to other containers are recreated
+		// when the other containers are, but rules marking traffic
+		// aren't tracked per container
+		if r.Verdict.marked() && (r.Container != "" || len(r.ContainerSelector) != 0 || r.NetworkPeers) {
+			return fmt.Errorf(`output rule #%d: "mark" and "ct_mark" are not supported with "container", "container_selector" or "network_peers"`, i)
+		}
 		err := validateRule(r)
 		if err != nil {
 			return fmt.Errorf("output rule #%d: %w", i, err)
 		}
 	}
+	for i, r := range c.Deny {
+		err := validateDenyRule(r)
+		if err != nil {
+			return fmt.Errorf("deny rule #%d: %w", i, err)
+		}
+	}
+	for _, p := range c.AllowedSNI {
+		if err := validateDomainPattern(p); err != nil {
+			return fmt.Errorf("allowed_sni: %w", err)
+		}
+	}
+	if len(c.SNIPorts) != 0 && len(c.AllowedSNI) == 0 {
+		return errors.New(`"sni_ports" requires "allowed_sni" to be set`)
+	}
+	for _, p := range c.AllowedDomains {
+		if err := validateDomainPattern(p); err != nil {
+			return fmt.Errorf("allowed_domains: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// validateAllowedDomainsRule returns an error if the output rule r
+// can't match addresses of allowed domains.
+func validateAllowedDomainsRule(c config, r ruleConfig) error {
+	switch {
+	case len(c.AllowedDomains) == 0:
+		return fmt.Errorf(`symbolic address %q requires "allowed_domains" to be set`, symbolAllowedDomains)
+	case len(r.IPs) != 1:
+		return fmt.Errorf(`symbolic address %q can't be used with other addresses`, symbolAllowedDomains)
+	case r.Container != "" || len(r.ContainerSelector) != 0 || r.NetworkPeers:
+		return fmt.Errorf(`symbolic address %q is not supported with "container", "container_selector" or "network_peers"`, symbolAllowedDomains)
+	// packets are marked in another table than the set of addresses
+	// of allowed domains is in
+	case r.Verdict.marked():
+		return fmt.Errorf(`symbolic address %q is not supported with "mark" or "ct_mark"`, symbolAllowedDomains)
+	}
+	return nil
+}
+
+// validateSidecarConfig returns an error if c sets options that only
+// the container owning a network namespace can set.
+func validateSidecarConfig(c config) error {
+	if c.MappedPorts.allowed() {
+		return errors.New(`"mapped_ports" is not supported for containers sharing a network namespace, set it on the network namespace owner instead`)
+	}
+	if len(c.FromHost) != 0 {
+		return errors.New(`"from_host" is not supported for containers sharing a network namespace, set it on the network namespace owner instead`)
+	}
+	if c.Reject != nil {
+		return errors.New(`"reject" is not supported for containers sharing a network namespace, set it on the network namespace owner instead`)
+	}
+	if len(c.AllowedSNI) != 0 {
+		return errors.New(`"allowed_sni" is not supported for containers sharing a network namespace, set it on the network namespace owner instead`)
+	}
+	if len(c.AllowedDomains) != 0 {
+		return errors.New(`"allowed_domains" is not supported for containers sharing a network namespace, set it on the network namespace owner instead`)
+	}
 
 	return nil
 }
 
+// validateHostNetworkConfig returns an error if c sets options that
+// aren't supported for containers using host networking. They have no
+// Docker networks, so only rules that match addresses and ports are
+// supported.
+func validateHostNetworkConfig(c config) error {
+	if c.MappedPorts.allowed() {
+		return errors.New(`"mapped_ports" is not supported for containers using host networking`)
+	}
+	if len(c.FromHost) != 0 {
+		return errors.New(`"from_host" is not supported for containers using host networking`)
+	}
+	if len(c.Deny) != 0 {
+		return errors.New(`"deny" is not supported for containers using host networking`)
+	}
+	if len(c.AllowedSNI) != 0 {
+		return errors.New(`"allowed_sni" is not supported for containers using host networking`)
+	}
+	if len(c.AllowedDomains) != 0 {
+		return errors.New(`"allowed_domains" is not supported for containers using host networking`)
+	}
+	validate := func(r ruleConfig) error {
+		switch {
+		case r.Network != "":
+			return errors.New(`"network" is not supported for containers using host networking`)
+		case r.Container != "":
+			return errors.New(`"container" is not supported for containers using host networking`)
+		case len(r.ContainerSelector) != 0:
+			return errors.New(`"container_selector" is not supported for containers using host networking`)
+		case slices.ContainsFunc(r.IPs, func(a addrOrRange) bool { return a.symbol == symbolGateway }):
+			return errors.New(`symbolic address "gateway" is not supported for containers using host networking`)
+		case r.Verdict.marked():
+			return errors.New(`"mark" and "ct_mark" are not supported for containers using host networking`)
+		}
+		return nil
+	}
+	for i, r := range c.Input {
+		if err := validate(r); err != nil {
+			return fmt.Errorf("input rule #%d: %w", i, err)
+		}
+	}
+	for i, r := range c.Output {
+		if err := validate(r); err != nil {
+			return fmt.Errorf("output rule #%d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func validateMappedPorts(m mappedPorts) error {
+	type portProto struct {
+		port  uint16
+		proto protocol
+	}
+	validatePort := func(ports map[portProto]struct{}, port uint16, proto protocol) error {
+		if port == 0 {
+			return errors.New(`"port" must be set`)
+		}
+		if proto == invalidProto {
+			return errors.New(`"proto" must be set`)
+		}
+		pp := portProto{port: port, proto: proto}
+		if _, ok := ports[pp]; ok {
+			return fmt.Errorf("port %d/%s is configured more than once", port, proto)
+		}
+		ports[pp] = struct{}{}
+		return nil
+	}
+
+	verdicts := []verdict{m.Localhost.Verdict, m.External.Verdict}
+	for _, p := range m.Localhost.Ports {
+		verdicts = append(verdicts, p.Verdict)
+	}
+	for _, p := range m.External.Ports {
+		verdicts = append(verdicts, p.Verdict)
+	}
+	if slices.ContainsFunc(verdicts, verdict.marked) {
+		return errors.New(`"mark" and "ct_mark" are only supported in output rules`)
+	}
+
+	localPorts := make(map[portProto]struct{})
+	for i, p := range m.Localhost.Ports {
+		if err := validatePort(localPorts, p.Port, p.Proto); err != nil {
+			return fmt.Errorf("localhost: port #%d: %w", i, err)
+		}
+		if err := validateVerdict(p.Verdict); err != nil {
+			return fmt.Errorf("localhost: port #%d: %w", i, err)
+		}
+	}
+	if err := validateInterfaces(m.External.Interfaces); err != nil {
+		return fmt.Errorf("external: %w", err)
+	}
+	if err := validateRateLimit(m.External.RateLimit); err != nil {
+		return fmt.Errorf("external: %w", err)
+	}
+	if err := validateBan(m.External.Ban); err != nil {
+		return fmt.Errorf("external: %w", err)
+	}
+	externalPorts := make(map[portProto]struct{})
+	for i, p := range m.External.Ports {
+		if err := validatePort(externalPorts, p.Port, p.Proto); err != nil {
+			return fmt.Errorf("external: port #%d: %w", i, err)
+		}
+		if slices.ContainsFunc(p.IPs, addrOrRange.isSymbol) {
+			return fmt.Errorf("external: port #%d: symbolic addresses are only supported in output and deny rules", i)
+		}
+		if err := validateInterfaces(p.Interfaces); err != nil {
+			return fmt.Errorf("external: port #%d: %w", i, err)
+		}
+		if err := validateRateLimit(p.RateLimit); err != nil {
+			return fmt.Errorf("external: port #%d: %w", i, err)
+		}
+		if err := validateVerdict(p.Verdict); err != nil {
+			return fmt.Errorf("external: port #%d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func validateFromHostRule(r ruleConfig) error {
+	if len(r.IPs) != 0 {
+		return errors.New(`"ips" is not supported, traffic is allowed from the gateways of the container's networks`)
+	}
+	if r.Container != "" {
+		return errors.New(`"container" is not supported, use an input rule instead`)
+	}
+	if r.NetworkPeers {
+		return errors.New(`"network_peers" is not supported, use an input rule instead`)
+	}
+	if len(r.ContainerSelector) != 0 {
+		return errors.New(`"container_selector" is not supported, use an input rule instead`)
+	}
+	if r.Proto == invalidProto {
+		return errors.New(`"proto" must be set`)
+	}
+	if len(r.EgressInterfaces) != 0 {
+		return errors.New(`"egress_interfaces" is only supported in output rules`)
+	}
+	if r.limited() {
+		return errors.New(`"rate_limit" and "max_connections" are only supported in input and mapped port rules`)
+	}
+	if r.Verdict.marked() {
+		return errors.New(`"mark" and "ct_mark" are only supported in output rules`)
+	}
+
+	return validateRule(r)
+}
+
+func validateDenyRule(r ruleConfig) error {
+	if r.Container != "" {
+		return errors.New(`"container" is not supported, traffic to containers is denied unless allowed`)
+	}
+	if r.NetworkPeers {
+		return errors.New(`"network_peers" is not supported, traffic to containers is denied unless allowed`)
+	}
+	if len(r.ContainerSelector) != 0 {
+		return errors.New(`"container_selector" is not supported, traffic to containers is denied unless allowed`)
+	}
+	if r.usesAllowedDomains() {
+		return fmt.Errorf("symbolic address %q is only supported in output rules", symbolAllowedDomains)
+	}
+	if r.Verdict != (verdict{}) {
+		return errors.New(`"verdict" is not supported, denied traffic is dropped or rejected depending on "reject"`)
+	}
+	if len(r.EgressInterfaces) != 0 {
+		return errors.New(`"egress_interfaces" is only supported in output rules`)
+	}
+	if r.limited() {
+		return errors.New(`"rate_limit" and "max_connections" are only supported in input and mapped port rules`)
+	}
+	return validateRule(r)
+}
+
 func validateRule(r ruleConfig) error {
-	if len(r.IPs) == 0 && r.Container == "" && r.Proto == invalidProto && len(r.SrcPorts) == 0 && len(r.DstPorts) == 0 {
+	if len(r.IPs) == 0 && r.Container == "" && !r.NetworkPeers && len(r.ContainerSelector) == 0 && r.Proto == invalidProto && len(r.SrcPorts) == 0 && len(r.DstPorts) == 0 && len(r.EgressInterfaces) == 0 {
 		return errors.New("rule is empty")
 	}
 	if len(r.IPs) != 0 && r.Container != "" {
 		return errors.New(`"ip" and "container" are mutually exclusive`)
 	}
+	if r.NetworkPeers && (len(r.IPs) != 0 || r.Container != "") {
+		return errors.New(`"network_peers" is mutually exclusive with "ips" and "container"`)
+	}
+	if len(r.ContainerSelector) != 0 && (len(r.IPs) != 0 || r.Container != "" || r.NetworkPeers) {
+		return errors.New(`"container_selector" is mutually exclusive with "ips", "container" and "network_peers"`)
+	}
 
 	if r.Network == "" && r.Container != "" {
 		return errors.New(`"network" must be set when "container" is set`)
 	}
+	if _, name, ok := splitQualifiedName(r.Container); ok && (name == "" || strings.Contains(name, "/")) {
+		return errors.New(`"container" must be a container name optionally prefixed with a Compose project and "/"`)
+	}
+	if r.Network == "" && r.NetworkPeers {
+		return errors.New(`"network" must be set when "network_peers" is set`)
+	}
+	if r.Network == "" && len(r.ContainerSelector) != 0 {
+		return errors.New(`"network" must be set when "container_selector" is set`)
+	}
 
 	if len(r.SrcPorts) != 0 && r.Proto == invalidProto {
 		return errors.New(`"proto" must be set when "src_ports" is set`)
@@ -343,26 +1014,62 @@ func validateRule(r ruleConfig) error {
 	if r.Proto != invalidProto && len(r.DstPorts) == 0 {
 		return errors.New(`"dst_ports" must be set when "proto" is set`)
 	}
+	if err := validateInterfaces(r.EgressInterfaces); err != nil {
+		return err
+	}
+	if err := validateRateLimit(r.RateLimit); err != nil {
+		return err
+	}
 
 	return validateVerdict(r.Verdict)
 }
 
+func validateInterfaces(names []string) error {
+	for _, name := range names {
+		// interface names are limited to IFNAMSIZ bytes including the
+		// NUL terminator
+		if name == "" || len(name) >= unix.IFNAMSIZ {
+			return fmt.Errorf("invalid interface name %q", name)
+		}
+	}
+
+	return nil
+}
+
 func validateVerdict(v verdict) error {
-	if v.Chain != "" && v.Queue != 0 {
+	for _, q := range []struct {
+		name  string
+		queue queueNums
+	}{
+		{name: "queue", queue: v.Queue},
+		{name: "input_est_queue", queue: v.InputEstQueue},
+		{name: "output_est_queue", queue: v.OutputEstQueue},
+	} {
+		if q.queue.first > q.queue.last {
+			return fmt.Errorf("%q range %d-%d is invalid, the first queue is greater than the last queue", q.name, q.queue.first, q.queue.last)
+		}
+	}
+	if v.Chain != "" && v.Queue.set() {
 		return errors.New(`"chain" and "queue" are mutually exclusive`)
 	}
-	if v.Queue == 0 && v.InputEstQueue != 0 {
+	if !v.Queue.set() && v.InputEstQueue.set() {
 		return errors.New(`"queue" must be set when "input_est_queue" is set`)
 	}
-	if v.Queue == 0 && v.OutputEstQueue != 0 {
+	if !v.Queue.set() && v.OutputEstQueue.set() {
 		return errors.New(`"queue" must be set when "output_est_queue" is set`)
 	}
-	if v.InputEstQueue == 0 && v.OutputEstQueue != 0 {
+	if !v.InputEstQueue.set() && v.OutputEstQueue.set() {
 		return errors.New(`"input_est_queue" must be set when "output_est_queue" is set`)
 	}
-	if v.OutputEstQueue == 0 && v.InputEstQueue != 0 {
+	if !v.OutputEstQueue.set() && v.InputEstQueue.set() {
 		return errors.New(`"output_est_queue" must be set when "input_est_queue" is set`)
 	}
+	if !v.Queue.set() && v.Bypass {
+		return errors.New(`"queue" must be set when "bypass" is set`)
+	}
+	if v.Fanout && !v.Queue.isRange() && !v.InputEstQueue.isRange() && !v.OutputEstQueue.isRange() {
+		return errors.New(`"fanout" requires "queue", "input_est_queue" or "output_est_queue" to be a range of queues`)
+	}
 
 	return nil
 }
@@ -15,10 +15,13 @@ import (
 	"syscall"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"go4.org/netipx"
 	"golang.org/x/exp/maps"
 	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v3"
@@ -40,6 +43,10 @@ const (
 	srcPortOffset = uint32(0)
 	dstPortOffset = uint32(2)
 
+	// icmpAdminProhibited is the code of ICMP destination unreachable
+	// errors that signal communication is administratively prohibited.
+	icmpAdminProhibited = 13
+
 	stateNew    = expr.CtStateBitNEW
 	stateEst    = expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED
 	stateNewEst = stateNew | stateEst
@@ -59,6 +66,16 @@ var (
 // createRules adds nftables rules for started containers.
 func (r *RuleManager) createRules(ctx context.Context) {
 	for c := range r.createCh {
+		if c.recreate {
+			if err := r.recreateContainerRules(ctx, c.container); err != nil {
+				r.logger.Error("error recreating rules",
+					zap.String("container.id", c.container.ID[:12]),
+					zap.String("container.name", stripName(c.container.Name)),
+					zap.Error(err),
+				)
+			}
+			continue
+		}
 		if err := r.createContainerRules(ctx, c.container, c.isNew); err != nil {
 			r.logger.Error("error creating rules",
 				zap.String("container.id", c.container.ID[:12]),
@@ -69,6 +86,38 @@ func (r *RuleManager) createRules(ctx context.Context) {
 	}
 }
 
+// recreateContainerRules deletes the rules of a container and creates
+// them again, so they are created from the container's current
+// networks.
+func (r *RuleManager) recreateContainerRules(ctx context.Context, container types.ContainerJSON) error {
+	// the container may have been renamed since its rules were created
+	name, err := r.db.GetContainerName(ctx, container.ID)
+	if err != nil {
+		return fmt.Errorf("error getting name of container from database: %w", err)
+	}
+	if err := r.deleteContainerRules(ctx, container.ID, name); err != nil {
+		return fmt.Errorf("error deleting rules: %w", err)
+	}
+	if err := r.createContainerRules(ctx, container, true); err != nil {
+		return err
+	}
+
+	// deleting the chain of the container deleted the rules jumping
+	// to the chains of containers sharing its network namespace, and
+	// their rules were created from its old networks
+	sidecars, err := r.netnsSidecars(ctx, container)
+	if err != nil {
+		return err
+	}
+	for _, sidecar := range sidecars {
+		if err := r.recreateContainerRules(ctx, sidecar); err != nil {
+			return fmt.Errorf("error recreating rules of container %q sharing network namespace: %w", stripName(sidecar.Name), err)
+		}
+	}
+
+	return nil
+}
+
 // createContainerRules creates nftables rules for a container.
 func (r *RuleManager) createContainerRules(ctx context.Context, container types.ContainerJSON, isNew bool) (retErr error) {
 	ctx, cleanup := r.containerTracker.StartCreatingContainer(ctx, container.ID)
@@ -82,10 +131,24 @@ func (r *RuleManager) createContainerRules(ctx context.Context, container types.
 	if container.NetworkSettings == nil {
 		return fmt.Errorf("container %q has no network settings", contName)
 	}
+	var hostNetworking bool
 	if len(container.NetworkSettings.Networks) == 1 {
-		if _, ok := container.NetworkSettings.Networks[hostNetworkName]; ok {
-			return fmt.Errorf("container %q is using host networking, rules cannot be created for it", contName)
-		}
+		_, hostNetworking = container.NetworkSettings.Networks[hostNetworkName]
+	}
+
+	// containers that share the network namespace of another container
+	// have no networks of their own, their traffic uses the addresses
+	// of the container that owns the network namespace
+	networks := container.NetworkSettings.Networks
+	project := container.Config.Labels[composeProjectLabel]
+	owner, isSidecar, err := r.netnsOwner(ctx, container)
+	if err != nil {
+		return err
+	}
+	if isSidecar {
+		logger.Info("sharing network namespace of container", zap.String("owner.id", owner.ID[:12]), zap.String("owner.name", stripName(owner.Name)))
+		networks = owner.NetworkSettings.Networks
+		project = owner.Config.Labels[composeProjectLabel]
 	}
 
 	// parse rules config if the rules label exists; if the label
@@ -102,16 +165,79 @@ func (r *RuleManager) createContainerRules(ctx context.Context, container types.
 		if err := validateConfig(rulesCfg); err != nil {
 			return fmt.Errorf("error validating rules: %w", err)
 		}
+		if err := r.validateChainRefs(rulesCfg); err != nil {
+			return fmt.Errorf("error validating rules: %w", err)
+		}
+		if len(rulesCfg.AllowedSNI) != 0 && r.sni == nil {
+			return errors.New(`error validating rules: "allowed_sni" is set but no SNI queue is configured`)
+		}
+		if len(rulesCfg.AllowedDomains) != 0 && r.dns == nil {
+			return errors.New(`error validating rules: "allowed_domains" is set but no DNS queue is configured`)
+		}
+		if len(rulesCfg.AllowedDomains) != 0 && len(r.containerResolvers(container)) == 0 {
+			return errors.New(`error validating rules: "allowed_domains" is set but no trusted DNS servers are configured, set DNS servers on the container or pass -dns-resolvers`)
+		}
+		// established traffic is accepted before it reaches the rules
+		// that check it
+		if len(rulesCfg.AllowedSNI) != 0 && r.estFastPath {
+			return errors.New(`error validating rules: "allowed_sni" is not supported when the established traffic fast path is enabled`)
+		}
+		if len(rulesCfg.AllowedDomains) != 0 && r.estFastPath {
+			return errors.New(`error validating rules: "allowed_domains" is not supported when the established traffic fast path is enabled`)
+		}
+		if r.estFastPath && rulesCfg.usesEstQueues() {
+			logger.Warn("established traffic fast path is enabled, established traffic will not be sent to queues")
+		}
+		if isSidecar {
+			if err := validateSidecarConfig(rulesCfg); err != nil {
+				return fmt.Errorf("error validating rules: %w", err)
+			}
+		}
+	}
+	reject := r.reject
+	if rulesCfg.Reject != nil {
+		reject = *rulesCfg.Reject
+	}
+	learn, err := r.learnMode(container.Config.Labels)
+	if err != nil {
+		return fmt.Errorf("error parsing %s label: %w", modeLabel, err)
+	}
+	if learn && isSidecar {
+		return errors.New("learn mode cannot be enabled for containers that share the network namespace of another container")
+	}
+	if learn && hostNetworking {
+		return errors.New("learn mode cannot be enabled for containers using host networking")
+	}
+	if learn && len(rulesCfg.AllowedSNI) != 0 {
+		return errors.New(`learn mode cannot be enabled for containers with "allowed_sni" set`)
+	}
+	if learn {
+		logger.Info("learn mode is enabled, traffic that isn't allowed will be logged and accepted")
+		if !r.nflog {
+			logger.Warn("learn mode is enabled but no NFLOG group is set, traffic will not be recorded")
+		}
+	}
+
+	// containers using host networking have no addresses of their
+	// own, their traffic is matched by cgroup instead
+	if hostNetworking {
+		return r.createHostNetworkRules(ctx, logger, container, contName, rulesCfg, reject, isNew)
 	}
 
 	// ensure specified networks and containers in rules are valid
-	addrs := make(map[string][]byte, len(container.NetworkSettings.Networks))
-	for netName, netSettings := range container.NetworkSettings.Networks {
+	addrs := make(map[string][]byte, len(networks))
+	gateways := make(map[string]netip.Addr, len(networks))
+	for netName, netSettings := range networks {
 		addr, err := netip.ParseAddr(netSettings.IPAddress)
 		if err != nil {
 			return fmt.Errorf("error parsing IP of container: %q: %w", contName, err)
 		}
 		addrs[netName] = ref(addr.As4())[:]
+
+		gateway, err := netip.ParseAddr(netSettings.Gateway)
+		if err == nil && gateway.Is4() {
+			gateways[netName] = gateway
+		}
 	}
 
 	nfc, err := r.newFirewallClient()
@@ -132,22 +258,38 @@ func (r *RuleManager) createContainerRules(ctx context.Context, container types.
 	}
 
 	// add container IPs to jump set so traffic to/from this
-	// container will go to the correct chain
-	addrElems := make([]nftables.SetElement, 0, len(addrs))
-	for _, addr := range addrs {
-		addrElems = append(addrElems, nftables.SetElement{
-			Key: addr,
-			VerdictData: &expr.Verdict{
-				Kind:  expr.VerdictJump,
-				Chain: contChainName,
-			},
-		})
-	}
-	if err := nfc.SetAddElements(containerAddrSet, addrElems); err != nil {
-		return fmt.Errorf("error marshaling set elements: %w", err)
-	}
-	if err := ignoringErr(nfc.Flush, syscall.EEXIST); err != nil {
-		return fmt.Errorf("error adding elements to container address set: %w", err)
+	// container will go to the correct chain; the addresses of
+	// containers sharing a network namespace already jump to the chain
+	// of the network namespace owner
+	var addrElems, managedAddrElems []nftables.SetElement
+	if !isSidecar {
+		addrElems = make([]nftables.SetElement, 0, len(addrs))
+		for _, addr := range addrs {
+			addrElems = append(addrElems, nftables.SetElement{
+				Key: addr,
+				VerdictData: &expr.Verdict{
+					Kind:  expr.VerdictJump,
+					Chain: contChainName,
+				},
+			})
+		}
+		if err := nfc.SetAddElements(containerAddrSet, addrElems); err != nil {
+			return fmt.Errorf("error marshaling set elements: %w", err)
+		}
+		if r.estFastPath {
+			managedAddrElems = make([]nftables.SetElement, 0, len(addrs))
+			for _, addr := range addrs {
+				managedAddrElems = append(managedAddrElems, nftables.SetElement{
+					Key: addr,
+				})
+			}
+			if err := nfc.SetAddElements(managedAddrSet, managedAddrElems); err != nil {
+				return fmt.Errorf("error marshaling set elements: %w", err)
+			}
+		}
+		if err := ignoringErr(nfc.Flush, syscall.EEXIST); err != nil {
+			return fmt.Errorf("error adding elements to container address set: %w", err)
+		}
 	}
 
 	// cleanup created rules if the context was canceled
@@ -166,11 +308,18 @@ func (r *RuleManager) createContainerRules(ctx context.Context, container types.
 		}
 
 		logger.Info("rule creation canceled, deleting created rules")
-		if err := nfc.SetDeleteElements(containerAddrSet, addrElems); err != nil {
-			logger.Error("error marshaling set elements", zap.Error(err))
-		}
-		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
-			logger.Error("error deleting elements to container address set", zap.Error(err))
+		if len(addrElems) != 0 {
+			if err := nfc.SetDeleteElements(containerAddrSet, addrElems); err != nil {
+				logger.Error("error marshaling set elements", zap.Error(err))
+			}
+			if len(managedAddrElems) != 0 {
+				if err := nfc.SetDeleteElements(managedAddrSet, managedAddrElems); err != nil {
+					logger.Error("error marshaling set elements", zap.Error(err))
+				}
+			}
+			if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+				logger.Error("error deleting elements to container address set", zap.Error(err))
+			}
 		}
 		for _, rule := range createdRules {
 			if rule.Chain.Name == chain.Name {
@@ -188,6 +337,24 @@ func (r *RuleManager) createContainerRules(ctx context.Context, container types.
 		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
 			logger.Error("error deleting chain", zap.String("chain.name", chain.Name), zap.Error(err))
 		}
+		if err := deleteFlowSets(nfc, chain); err != nil {
+			logger.Error("error deleting sets", zap.Error(err))
+		}
+		if err := deleteLimitSets(nfc, chain); err != nil {
+			logger.Error("error deleting sets", zap.Error(err))
+		}
+		if err := deleteBanChain(nfc, chain); err != nil {
+			logger.Error("error deleting ban chain", zap.Error(err))
+		}
+		if err := deleteDomainSet(nfc, chain); err != nil {
+			logger.Error("error deleting sets", zap.Error(err))
+		}
+		if r.sni != nil {
+			r.sni.deletePolicy(container.ID)
+		}
+		if r.dns != nil {
+			r.dns.deletePolicy(container.ID)
+		}
 	}()
 
 	createRules := func(rules []*nftables.Rule, insert bool) error {
@@ -239,8 +406,70 @@ func (r *RuleManager) createContainerRules(ctx context.Context, container types.
 		return nfc.Flush()
 	}
 
-	// create rule to drop all not explicitly allowed traffic
-	err = createRules([]*nftables.Rule{createDropRule(chain, container.ID)}, false)
+	// create sets allowed traffic will be stored in if configured to
+	var flows *flowSets
+	var endRules []*nftables.Rule
+	if isSidecar {
+		// traffic not allowed by the rules of this container returns
+		// to the chain of the network namespace owner, which decides
+		// what to do with it
+		ownerChain := &nftables.Chain{
+			Table: filterTable,
+			Name:  buildChainName(stripName(owner.Name), owner.ID),
+		}
+		jumpRule := createJumpRule(ownerChain, contChainName)
+		jumpRule.UserData = []byte(container.ID)
+		if err := createRules([]*nftables.Rule{jumpRule}, true); err != nil {
+			return fmt.Errorf("error creating jump rule: %w", err)
+		}
+	} else if learn {
+		endRules = r.createLearnRules(chain, container.ID, networkGateways(container.NetworkSettings.Networks))
+	} else {
+		endRules = r.createDropRules(chain, container.ID, reject)
+	}
+
+	// send traffic to mapped ports that isn't allowed to a chain that
+	// bans sources sending too much of it
+	var banChain *nftables.Chain
+	banCfg := rulesCfg.MappedPorts.External.Ban
+	if banCfg.enabled() && learn {
+		logger.Warn("learn mode is enabled, sources will not be banned")
+	} else if banCfg.enabled() && !isSidecar {
+		banChain, err = createBanChain(nfc, banCfg, chain)
+		if err != nil {
+			return err
+		}
+		banRules, err := r.createBanRules(banCfg, container.NetworkSettings, addrs, chain, banChain, container.ID, reject)
+		if err != nil {
+			return fmt.Errorf("error creating ban rules: %w", err)
+		}
+		endRules = append(banRules, endRules...)
+
+		// drop traffic of banned sources before it reaches the
+		// container chain
+		if err := createRules(createBannedDropRules(banCfg, addrs, chain, container.ID), true); err != nil {
+			return fmt.Errorf("error creating banned drop rules: %w", err)
+		}
+	}
+	if r.ruleLayout == LayoutSets && !isSidecar {
+		flows = newFlowSets(chain)
+		if err := createFlowSets(nfc, flows); err != nil {
+			return err
+		}
+		if err := ignoringErr(nfc.Flush, syscall.EEXIST); err != nil {
+			return fmt.Errorf("error creating sets: %w", err)
+		}
+
+		flowRules := createFlowSetRules(chain, flows, container.ID, r.estFastPath)
+		if err := deleteMisplacedDropRules(nfc, logger, chain, flowRules[0], endRules); err != nil {
+			return err
+		}
+		endRules = append(flowRules, endRules...)
+	}
+
+	// create rule to drop all not explicitly allowed traffic, or log
+	// and accept it if learning
+	err = createRules(endRules, false)
 	if err != nil {
 		return fmt.Errorf("error creating drop rule: %w", err)
 	}
@@ -258,32 +487,70 @@ func (r *RuleManager) createContainerRules(ctx context.Context, container types.
 		}
 	}
 
-	project := container.Config.Labels[composeProjectLabel]
 	estContainers := make(map[string]struct{})
+	if isSidecar {
+		// the rule jumping to this container's chain needs to be
+		// cleaned up when this container is stopped
+		estContainers[owner.ID] = struct{}{}
+	}
 	if configExists {
-		if err := r.populateOutputRules(ctx, tx, rulesCfg, container.ID, project, addrs, estContainers); err != nil {
+		if err := r.populateContainerRules(ctx, tx, rulesCfg, container.ID, project, addrs, estContainers); err != nil {
 			return fmt.Errorf("error validating rules: %w", err)
 		}
 	}
 
 	// create rules that allow traffic from another container to this
-	// container if necessary that couldn't be created before
+	// container if necessary that couldn't be created before; other
+	// containers refer to the network namespace owner instead of
+	// containers that share its network namespace, so no rules can be
+	// waiting for them
 	service := container.Config.Labels[composeServiceLabel]
-	logger.Debug("creating waiting rules")
-	waitingRules, err := r.createWaitingContainerRules(ctx, nfc, logger, tx, container.ID, contName, service, project, addrs, chain, estContainers)
-	if err != nil {
-		return fmt.Errorf("error creating waiting output rules: %w", err)
-	}
-	if err := createRules(waitingRules, true); err != nil {
-		logger.Error("error creating waiting rules", zap.Error(err))
+	if !isSidecar {
+		logger.Debug("creating waiting rules")
+		waitingRules, err := r.createWaitingContainerRules(ctx, nfc, logger, tx, container.ID, contName, service, project, addrs, chain, estContainers)
+		if err != nil {
+			return fmt.Errorf("error creating waiting output rules: %w", err)
+		}
+		if err := createRules(waitingRules, true); err != nil {
+			logger.Error("error creating waiting rules", zap.Error(err))
+		}
+		waitingInputRules, err := r.createWaitingInputRules(ctx, nfc, logger, tx, container.ID, contName, service, project, addrs, chain, estContainers)
+		if err != nil {
+			return fmt.Errorf("error creating waiting input rules: %w", err)
+		}
+		if err := createRules(waitingInputRules, true); err != nil {
+			logger.Error("error creating waiting input rules", zap.Error(err))
+		}
+		waitingPeerRules, err := r.createWaitingNetworkPeerRules(ctx, nfc, logger, tx, container.ID, addrs, chain)
+		if err != nil {
+			return fmt.Errorf("error creating waiting network peer rules: %w", err)
+		}
+		if err := createRules(waitingPeerRules, true); err != nil {
+			logger.Error("error creating waiting network peer rules", zap.Error(err))
+		}
+		waitingSelectorRules, err := r.createWaitingSelectorRules(ctx, nfc, logger, tx, container.ID, container.Config.Labels, project, addrs, chain)
+		if err != nil {
+			return fmt.Errorf("error creating waiting selector rules: %w", err)
+		}
+		if err := createRules(waitingSelectorRules, true); err != nil {
+			logger.Error("error creating waiting selector rules", zap.Error(err))
+		}
 	}
 
 	// if no rules were explicitly specified, only the rule that drops
 	// traffic to/from the container will be added
 	if configExists {
+		// create the set addresses of allowed domains are added to
+		// before output rules that match it
+		if len(rulesCfg.AllowedDomains) != 0 {
+			if err := createDomainSet(nfc, chain); err != nil {
+				return err
+			}
+		}
+
 		// handle outbound rules
 		logger.Debug("creating output rules")
-		outputRules, err := r.createOutputRules(ctx, nfc, logger, tx, rulesCfg.Output, project, addrs, chain, contName, container.ID)
+		outputRules, err := r.createOutputRules(ctx, nfc, logger, tx, rulesCfg.Output, project, addrs, gateways, chain, contName, container.ID, flows)
 		if err != nil {
 			return fmt.Errorf("error creating output rules: %w", err)
 		}
@@ -291,15 +558,92 @@ func (r *RuleManager) createContainerRules(ctx context.Context, container types.
 			logger.Error("error creating output rules", zap.Error(err))
 		}
 
+		// handle inbound rules
+		logger.Debug("creating input rules")
+		inputRules, err := r.createInputRules(ctx, nfc, logger, tx, rulesCfg.Input, project, addrs, chain, contName, container.ID, flows)
+		if err != nil {
+			return fmt.Errorf("error creating input rules: %w", err)
+		}
+		if err := createRules(inputRules, true); err != nil {
+			logger.Error("error creating input rules", zap.Error(err))
+		}
+
+		// handle rules for traffic from the host
+		logger.Debug("creating from host rules")
+		fromHostRules, err := r.createFromHostRules(nfc, logger, container, contName, rulesCfg.FromHost, project, addrs, chain, flows)
+		if err != nil {
+			return fmt.Errorf("error creating from host rules: %w", err)
+		}
+		if err := createRules(fromHostRules, true); err != nil {
+			logger.Error("error creating from host rules", zap.Error(err))
+		}
+
 		// handle port mapping rules
 		logger.Debug("creating mapped port rules")
-		portMapRules, err := r.createPortMappingRules(nfc, logger, container, contName, rulesCfg.MappedPorts, addrs, chain)
+		portMapRules, err := r.createPortMappingRules(nfc, logger, container, contName, rulesCfg.MappedPorts, addrs, chain, banChain, flows, learn)
 		if err != nil {
 			return fmt.Errorf("error creating port mapping rules: %w", err)
 		}
 		if err := createRules(portMapRules, true); err != nil {
 			logger.Error("error creating mapped port rules", zap.Error(err))
 		}
+
+		// handle deny rules last so they are inserted before any
+		// rules that allow traffic
+		logger.Debug("creating deny rules")
+		denyRules, err := r.createDenyRules(ctx, nfc, logger, tx, rulesCfg.Deny, reject, project, addrs, gateways, chain, contName, container.ID)
+		if err != nil {
+			return fmt.Errorf("error creating deny rules: %w", err)
+		}
+		if err := createRules(denyRules, true); err != nil {
+			logger.Error("error creating deny rules", zap.Error(err))
+		}
+
+		// handle TLS server name rules after deny rules so ClientHellos
+		// are checked before any rules accept established traffic
+		if len(rulesCfg.AllowedSNI) != 0 {
+			logger.Debug("creating TLS server name rules")
+			r.sni.setPolicy(addrs, sniPolicy{
+				contID:   container.ID,
+				contName: contName,
+				allowed:  rulesCfg.AllowedSNI,
+			})
+			sniRules, err := r.createSNIRules(nfc, addrs, rulesCfg.SNIPorts, chain, container.ID)
+			if err != nil {
+				return fmt.Errorf("error creating TLS server name rules: %w", err)
+			}
+			if err := createRules(sniRules, true); err != nil {
+				logger.Error("error creating TLS server name rules", zap.Error(err))
+			}
+		}
+
+		// handle DNS response rules last for the same reason, they
+		// only read responses so their order relative to TLS server
+		// name rules doesn't matter
+		if len(rulesCfg.AllowedDomains) != 0 {
+			logger.Debug("creating DNS response rules")
+			resolvers := r.containerResolvers(container)
+			r.dns.setPolicy(addrs, dnsPolicy{
+				contID:    container.ID,
+				contName:  contName,
+				allowed:   rulesCfg.AllowedDomains,
+				set:       buildDomainSet(chain),
+				resolvers: resolvers,
+			})
+			if err := createRules(r.createDNSRules(addrs, resolvers, chain, container.ID), true); err != nil {
+				logger.Error("error creating DNS response rules", zap.Error(err))
+			}
+		}
+	}
+
+	if flows != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		logger.Debug("adding elements to sets")
+		if err := fillFlowSets(nfc, flows); err != nil {
+			return fmt.Errorf("error adding elements to sets: %w", err)
+		}
 	}
 
 	// remove rules in this container's chain not created by whalewall
@@ -332,7 +676,14 @@ func (r *RuleManager) createContainerRules(ctx context.Context, container types.
 
 	logger.Debug("adding to database")
 
-	if err := r.addContainer(ctx, tx, container.ID, contName, service, addrs, estContainers); err != nil {
+	// the addresses of containers sharing a network namespace belong
+	// to the network namespace owner
+	contAddrs := addrs
+	if isSidecar {
+		contAddrs = nil
+	}
+	contProject := container.Config.Labels[composeProjectLabel]
+	if err := r.addContainer(ctx, tx, container.ID, contName, service, contProject, contAddrs, estContainers); err != nil {
 		return fmt.Errorf("error adding container information to database: %w", err)
 	}
 
@@ -347,15 +698,16 @@ func stripName(name string) string {
 	return name
 }
 
-// populateOutputRules attempts to find the IPs of containers specified
-// in output rules and fills the rules appropriately.
-func (r *RuleManager) populateOutputRules(ctx context.Context, tx database.TX, cfg config, id, project string, addrs map[string][]byte, estConts map[string]struct{}) error {
+// populateContainerRules attempts to find the IPs of containers
+// specified in input and output rules and fills the rules
+// appropriately.
+func (r *RuleManager) populateContainerRules(ctx context.Context, tx database.TX, cfg config, id, project string, addrs map[string][]byte, estConts map[string]struct{}) error {
 	// only get a list of containers if at least one rule specifies a
 	// container
-	i := slices.IndexFunc(cfg.Output, func(r ruleConfig) bool {
+	hasContainer := func(r ruleConfig) bool {
 		return r.Container != ""
-	})
-	if i == -1 {
+	}
+	if !slices.ContainsFunc(cfg.Input, hasContainer) && !slices.ContainsFunc(cfg.Output, hasContainer) {
 		return nil
 	}
 	listedConts, err := r.dockerCli.ContainerList(ctx, types.ContainerListOptions{})
@@ -364,11 +716,28 @@ func (r *RuleManager) populateOutputRules(ctx context.Context, tx database.TX, c
 	}
 
 	containers := make(map[string]types.ContainerJSON)
-	for i, ruleCfg := range cfg.Output {
+	if err := r.populateRules(ctx, tx, cfg.Input, true, listedConts, containers, id, project, addrs, estConts); err != nil {
+		return err
+	}
+	return r.populateRules(ctx, tx, cfg.Output, false, listedConts, containers, id, project, addrs, estConts)
+}
+
+// populateRules fills input rules if inbound is true or output rules
+// otherwise with the IPs of the containers they specify, or marks them
+// to be created later if the containers haven't been processed yet.
+func (r *RuleManager) populateRules(ctx context.Context, tx database.TX, ruleCfgs []ruleConfig, inbound bool, listedConts []types.Container, containers map[string]types.ContainerJSON, id, project string, addrs map[string][]byte, estConts map[string]struct{}) error {
+	ruleType := "output"
+	if inbound {
+		ruleType = "input"
+	}
+
+	var err error
+	for i, ruleCfg := range ruleCfgs {
 		// ensure the specified network exists
 		if ruleCfg.Network != "" {
 			if _, _, ok := findNetwork(ruleCfg.Network, project, addrs); !ok {
-				return fmt.Errorf("output rule #%d: network %q not found",
+				return fmt.Errorf("%s rule #%d: network %q not found",
+					ruleType,
 					i,
 					ruleCfg.Network,
 				)
@@ -397,17 +766,26 @@ func (r *RuleManager) populateOutputRules(ctx context.Context, tx database.TX, c
 						return fmt.Errorf("error parsing container %q label: %w", cont.ID[:12], err)
 					}
 					if !enabled {
-						return fmt.Errorf("output rule #%d: container %q does not have whalewall enabled",
+						return fmt.Errorf("%s rule #%d: container %q does not have whalewall enabled",
+							ruleType,
 							i,
 							ruleCfg.Container,
 						)
 					}
 					containers[ruleCfg.Container] = cont
 				}
-				dstProject := cont.Config.Labels[composeProjectLabel]
-				dstNetName, dstNetwork, ok := findNetwork(ruleCfg.Network, dstProject, cont.NetworkSettings.Networks)
+				if cont.HostConfig != nil && cont.HostConfig.NetworkMode.IsContainer() {
+					return fmt.Errorf("%s rule #%d: container %q shares the network namespace of another container, refer to that container instead",
+						ruleType,
+						i,
+						ruleCfg.Container,
+					)
+				}
+				peerProject := cont.Config.Labels[composeProjectLabel]
+				peerNetName, peerNetwork, ok := findNetwork(ruleCfg.Network, peerProject, cont.NetworkSettings.Networks)
 				if !ok {
-					return fmt.Errorf("output rule #%d: network %q not found for container %q",
+					return fmt.Errorf("%s rule #%d: network %q not found for container %q",
+						ruleType,
 						i,
 						ruleCfg.Network,
 						ruleCfg.Container,
@@ -425,13 +803,22 @@ func (r *RuleManager) populateOutputRules(ctx context.Context, tx database.TX, c
 					break
 				}
 				estConts[cont.ID] = struct{}{}
+				if inbound {
+					// rules allowing traffic from the other container
+					// are put into both container's chains, so
+					// rules in this container's chain need to be
+					// cleaned up when the other container is stopped
+					if err := tx.AddEstContainer(ctx, cont.ID, id); err != nil {
+						return fmt.Errorf("error adding established container to database: %w", err)
+					}
+				}
 				found = true
 
-				addr, err := netip.ParseAddr(dstNetwork.IPAddress)
+				addr, err := netip.ParseAddr(peerNetwork.IPAddress)
 				if err != nil {
-					return fmt.Errorf("error parsing IP of container %q from network %q: %w", ruleCfg.Container, dstNetName, err)
+					return fmt.Errorf("error parsing IP of container %q from network %q: %w", ruleCfg.Container, peerNetName, err)
 				}
-				cfg.Output[i].IPs = []addrOrRange{
+				ruleCfgs[i].IPs = []addrOrRange{
 					{addr: addr},
 				}
 				break
@@ -441,7 +828,7 @@ func (r *RuleManager) populateOutputRules(ctx context.Context, tx database.TX, c
 				// we need to add rules to this container's chain, but it
 				// hasn't been processed yet; wait until this container
 				// is processed to create the rules
-				cfg.Output[i].skip = true
+				ruleCfgs[i].skip = true
 			}
 			// Add the rule to the database so when we are processing
 			// this container, this rule will be created. This is done
@@ -452,11 +839,19 @@ func (r *RuleManager) populateOutputRules(ctx context.Context, tx database.TX, c
 			if err := encoder.Encode(ruleCfg); err != nil {
 				return fmt.Errorf("error encoding waiting container rule: %w", err)
 			}
-			err := tx.AddWaitingContainerRule(ctx, database.AddWaitingContainerRuleParams{
-				SrcContainerID:   id,
-				DstContainerName: ruleCfg.Container,
-				Rule:             buf.Bytes(),
-			})
+			if inbound {
+				err = tx.AddWaitingInputRule(ctx, database.AddWaitingInputRuleParams{
+					DstContainerID:   id,
+					SrcContainerName: ruleCfg.Container,
+					Rule:             buf.Bytes(),
+				})
+			} else {
+				err = tx.AddWaitingContainerRule(ctx, database.AddWaitingContainerRuleParams{
+					SrcContainerID:   id,
+					DstContainerName: ruleCfg.Container,
+					Rule:             buf.Bytes(),
+				})
+			}
 			if err != nil {
 				return fmt.Errorf("error adding waiting container rule to database: %w", err)
 			}
@@ -493,6 +888,15 @@ func containerNameMatches(expectedName string, labels map[string]string, names .
 		return false
 	}
 
+	// a name qualified with a Docker Compose project only matches
+	// containers of that project
+	if project, name, ok := splitQualifiedName(expectedName); ok {
+		if labels[composeProjectLabel] != project {
+			return false
+		}
+		expectedName = name
+	}
+
 	// maybe user prefixed a backslash already?
 	if slices.Contains(names, expectedName) {
 		return true
@@ -515,6 +919,17 @@ func containerNameMatches(expectedName string, labels map[string]string, names .
 	return false
 }
 
+// splitQualifiedName splits a container name qualified with a Docker
+// Compose project, such as "infra/postgres", into the project and
+// container name.
+func splitQualifiedName(name string) (string, string, bool) {
+	project, name, ok := strings.Cut(name, "/")
+	if !ok || project == "" {
+		return "", "", false
+	}
+	return project, name, true
+}
+
 func buildChainName(name, id string) string {
 	return fmt.Sprintf("%s%s-%s", chainPrefix, name, id[:12])
 }
@@ -522,7 +937,7 @@ func buildChainName(name, id string) string {
 // TODO: avoid creating almost duplicate rules as output rules
 // createPortMappingRules adds nftables rules to allow or deny access to
 // mapped ports.
-func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Logger, container types.ContainerJSON, contName string, mappedPortsCfg mappedPorts, addrs map[string][]byte, chain *nftables.Chain) ([]*nftables.Rule, error) {
+func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Logger, container types.ContainerJSON, contName string, mappedPortsCfg mappedPorts, addrs map[string][]byte, chain, banChain *nftables.Chain, flows *flowSets, learn bool) ([]*nftables.Rule, error) {
 	// check if there are any mapped ports to create rules for
 	var hasMappedPorts bool
 	for _, hostPorts := range container.NetworkSettings.Ports {
@@ -533,7 +948,7 @@ func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Log
 			break
 		}
 	}
-	if (mappedPortsCfg.Localhost.Allow || mappedPortsCfg.External.Allow) && !hasMappedPorts {
+	if mappedPortsCfg.allowed() && !hasMappedPorts {
 		logger.Warn("local and/or external access to mapped ports is allowed, but there are not any mapped ports")
 		return nil, nil
 	}
@@ -541,14 +956,6 @@ func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Log
 		return nil, nil
 	}
 
-	// prepend container name and ID to log prefixes
-	if mappedPortsCfg.Localhost.LogPrefix != "" {
-		mappedPortsCfg.Localhost.LogPrefix = formatLogPrefix(mappedPortsCfg.Localhost.LogPrefix, contName, container.ID)
-	}
-	if mappedPortsCfg.External.LogPrefix != "" {
-		mappedPortsCfg.External.LogPrefix = formatLogPrefix(mappedPortsCfg.External.LogPrefix, contName, container.ID)
-	}
-
 	nftRules := make([]*nftables.Rule, 0, len(container.NetworkSettings.Networks))
 	for netName, netSettings := range container.NetworkSettings.Networks {
 		gateway, err := netip.ParseAddr(netSettings.Gateway)
@@ -563,12 +970,39 @@ func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Log
 
 		for _, port := range sortedPorts {
 			hostPorts := container.NetworkSettings.Ports[port]
-			localAllowed := mappedPortsCfg.Localhost.Allow
 
 			var proto protocol
 			if err := proto.UnmarshalText([]byte(port.Proto())); err != nil {
 				return nil, fmt.Errorf("error parsing protocol: %w", err)
 			}
+			localCfg := mappedPortsCfg.Localhost.forPort(uint16(port.Int()), proto)
+			externalCfg := mappedPortsCfg.External.forPort(uint16(port.Int()), proto)
+			localAllowed := localCfg.Allow
+
+			// find the addresses of the host external traffic to the
+			// host ports can be sent to; no addresses means any address
+			var (
+				externalHostAddrs []netip.Addr
+				externalReachable bool
+			)
+			if externalCfg.Allow {
+				externalHostAddrs, externalReachable, err = r.externalHostAddrs(logger, hostPorts, externalCfg)
+				if err != nil {
+					return nil, fmt.Errorf("error finding addresses of port mapping: %w", err)
+				}
+			}
+			// if all external inbound traffic is allowed to any
+			// address on any interface, the rule that allows it will
+			// cover traffic from the gateway too
+			externalAllowsAll := externalReachable && len(externalCfg.IPs) == 0 && len(externalCfg.Interfaces) == 0 && len(externalHostAddrs) == 0
+
+			// prepend container name and ID to log prefixes
+			if localCfg.LogPrefix != "" {
+				localCfg.LogPrefix = formatLogPrefix(localCfg.LogPrefix, contName, container.ID)
+			}
+			if externalCfg.LogPrefix != "" {
+				externalCfg.LogPrefix = formatLogPrefix(externalCfg.LogPrefix, contName, container.ID)
+			}
 
 			for _, hostPort := range hostPorts {
 				addr, err := netip.ParseAddr(hostPort.HostIP)
@@ -580,7 +1014,6 @@ func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Log
 					continue
 				}
 
-				// TODO: make same checks for external
 				if localAllowed && !addr.IsUnspecified() && addr != localAddr {
 					logger.Sugar().Warnf("local access to mapped ports is allowed, but port %s is listening on %s which is not accessible to localhost",
 						hostPort.HostPort,
@@ -595,8 +1028,13 @@ func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Log
 					// create any rules
 					continue
 				}
+				if !localAllowed && learn {
+					// traffic from localhost will be logged and
+					// accepted by learn rules instead of dropped
+					continue
+				}
 
-				if !localAllowed || (localAllowed && (!mappedPortsCfg.External.Allow || len(mappedPortsCfg.External.IPs) != 0)) {
+				if !localAllowed || !externalAllowsAll {
 					// Create rules to allow/drop traffic from container
 					// network gateway to container; this will only be hit
 					// for traffic originating from localhost after being
@@ -608,7 +1046,7 @@ func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Log
 						inbound: true,
 						addr:    addrs[netName],
 						cfg: ruleConfig{
-							LogPrefix: mappedPortsCfg.Localhost.LogPrefix,
+							LogPrefix: localCfg.LogPrefix,
 							IPs: []addrOrRange{
 								{addr: gateway},
 							},
@@ -618,18 +1056,20 @@ func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Log
 									single: uint16(port.Int()),
 								},
 							},
-							Verdict: mappedPortsCfg.Localhost.Verdict,
+							Verdict: localCfg.Verdict,
 						},
 						chain:  chain,
 						contID: container.ID,
 					}
 					rule.cfg.Verdict.drop = !localAllowed
 
-					rules, err := createNFTRules(nfc, logger, rule)
-					if err != nil {
-						return nil, fmt.Errorf("error creating firewall rules: %w", err)
+					if flows == nil || !flows.add(rule) {
+						rules, err := r.createNFTRules(nfc, logger, rule)
+						if err != nil {
+							return nil, fmt.Errorf("error creating firewall rules: %w", err)
+						}
+						nftRules = append(nftRules, rules...)
 					}
-					nftRules = append(nftRules, rules...)
 				}
 
 				if !localAllowed {
@@ -661,7 +1101,7 @@ func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Log
 						contID: container.ID,
 					}
 
-					rules, err := createNFTRules(nfc, logger, localhostDropRule)
+					rules, err := r.createNFTRules(nfc, logger, localhostDropRule)
 					if err != nil {
 						return nil, fmt.Errorf("error creating firewall rules: %w", err)
 					}
@@ -673,27 +1113,35 @@ func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Log
 			// don't create allow rules as the port wasn't exposed by
 			// the user but rather was created from an EXPOSE Dockerfile
 			// directive
-			if mappedPortsCfg.External.Allow && len(hostPorts) > 0 {
+			if externalReachable {
 				// create rules to allow external traffic to container
 				rule := ruleDetails{
 					inbound: true,
 					addr:    addrs[netName],
 					cfg: ruleConfig{
-						LogPrefix: mappedPortsCfg.External.LogPrefix,
-						IPs:       mappedPortsCfg.External.IPs,
+						LogPrefix: externalCfg.LogPrefix,
+						IPs:       externalCfg.IPs,
 						Proto:     proto,
 						DstPorts: []rulePorts{
 							{
 								single: uint16(port.Int()),
 							},
 						},
-						Verdict: mappedPortsCfg.External.Verdict,
+						RateLimit:      externalCfg.RateLimit,
+						MaxConnections: externalCfg.MaxConnections,
+						Verdict:        externalCfg.Verdict,
+						iifnames:       externalCfg.Interfaces,
+						hostAddrs:      externalHostAddrs,
+						banChain:       banChain,
 					},
 					chain:  chain,
 					contID: container.ID,
 				}
+				if flows != nil && flows.add(rule) {
+					continue
+				}
 
-				rules, err := createNFTRules(nfc, logger, rule)
+				rules, err := r.createNFTRules(nfc, logger, rule)
 				if err != nil {
 					return nil, fmt.Errorf("error creating firewall rules: %w", err)
 				}
@@ -705,11 +1153,82 @@ func (r *RuleManager) createPortMappingRules(nfc firewallClient, logger *zap.Log
 	return nftRules, nil
 }
 
+// externalHostAddrs returns the addresses of the host that external
+// traffic to hostPorts can be sent to, and whether external traffic
+// can reach any of hostPorts at all. If a host port is listening on
+// every address, no addresses are returned as traffic to any address
+// can reach it. Warnings are logged when external traffic allowed by
+// cfg can't reach a host port.
+func (r *RuleManager) externalHostAddrs(logger *zap.Logger, hostPorts []nat.PortBinding, cfg externalRules) ([]netip.Addr, bool, error) {
+	var (
+		anyAddr bool
+		addrs   []netip.Addr
+	)
+	for _, hostPort := range hostPorts {
+		addr, err := netip.ParseAddr(hostPort.HostIP)
+		if err != nil {
+			return nil, false, fmt.Errorf("error parsing IP of port mapping: %w", err)
+		}
+		// TODO: support IPv6
+		if addr.Is6() {
+			continue
+		}
+
+		switch {
+		case addr.IsUnspecified():
+			anyAddr = true
+			continue
+		case addr.IsLoopback():
+			logger.Sugar().Warnf("external access to mapped ports is allowed, but port %s is listening on %s which is not accessible externally",
+				hostPort.HostPort,
+				addr,
+			)
+			continue
+		}
+
+		iface, err := r.addrInterface(addr)
+		if err != nil {
+			return nil, false, fmt.Errorf("error finding interface of %s: %w", addr, err)
+		}
+		if iface == "" {
+			logger.Sugar().Warnf("external access to mapped ports is allowed, but port %s is listening on %s which is not an address of any network interface",
+				hostPort.HostPort,
+				addr,
+			)
+			continue
+		}
+		if len(cfg.Interfaces) != 0 && !slices.Contains(cfg.Interfaces, iface) {
+			logger.Sugar().Warnf("external access to mapped ports is allowed, but port %s is listening on %s of interface %s which is not an allowed interface",
+				hostPort.HostPort,
+				addr,
+				iface,
+			)
+			continue
+		}
+		if addr.IsPrivate() && len(cfg.IPs) != 0 && !slices.ContainsFunc(cfg.IPs, addrOrRange.isPrivate) {
+			logger.Sugar().Warnf("external access to mapped ports is allowed, but port %s is listening on private address %s and none of the allowed IPs are private",
+				hostPort.HostPort,
+				addr,
+			)
+		}
+
+		if !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	if anyAddr {
+		return nil, true, nil
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	return addrs, len(addrs) != 0, nil
+}
+
 // createOutputRules adds nftables rules to allow outbound access from
 // a container.
-func (r *RuleManager) createOutputRules(ctx context.Context, nfc firewallClient, logger *zap.Logger, tx database.TX, ruleCfgs []ruleConfig, project string, addrs map[string][]byte, chain *nftables.Chain, name, id string) ([]*nftables.Rule, error) {
+func (r *RuleManager) createOutputRules(ctx context.Context, nfc firewallClient, logger *zap.Logger, tx database.TX, ruleCfgs []ruleConfig, project string, addrs map[string][]byte, gateways map[string]netip.Addr, chain *nftables.Chain, name, id string, flows *flowSets) ([]*nftables.Rule, error) {
 	nftRules := make([]*nftables.Rule, 0, len(ruleCfgs)*3)
-	for _, ruleCfg := range ruleCfgs {
+	for i, ruleCfg := range ruleCfgs {
 		// prepend container name and ID to log prefixes
 		if ruleCfg.LogPrefix != "" {
 			ruleCfg.LogPrefix = formatLogPrefix(ruleCfg.LogPrefix, name, id)
@@ -722,13 +1241,41 @@ func (r *RuleManager) createOutputRules(ctx context.Context, nfc firewallClient,
 			contID:  id,
 		}
 
+		// addresses allowed domains resolved to are only known
+		// when DNS responses are read, match the set they are
+		// added to instead
+		if ruleCfg.usesAllowedDomains() {
+			rule.cfg.IPs = nil
+			rule.cfg.addrSet = buildDomainSet(chain)
+		}
+
 		if ruleCfg.Network != "" {
-			_, addr, ok := findNetwork(ruleCfg.Network, project, addrs)
+			netName, addr, ok := findNetwork(ruleCfg.Network, project, addrs)
 			if !ok {
 				return nil, fmt.Errorf("network %q not found", ruleCfg.Network)
 			}
 			rule.addr = addr
+			ips, err := r.expandAddrs(rule.cfg.IPs, gateways[netName])
+			if err != nil {
+				return nil, fmt.Errorf("error expanding ips of network %q: %w", netName, err)
+			}
+			rule.cfg.IPs = ips
 
+			if len(ruleCfg.ContainerSelector) != 0 {
+				rules, err := r.createSelectorRules(ctx, nfc, logger, tx, rule, i, id)
+				if err != nil {
+					return nil, err
+				}
+				nftRules = append(nftRules, rules...)
+				continue
+			}
+			if ruleCfg.NetworkPeers {
+				peerRules, err := r.createNetworkPeersRules(ctx, nfc, logger, tx, &rule, netName, id)
+				if err != nil {
+					return nil, err
+				}
+				nftRules = append(nftRules, peerRules...)
+			}
 			if ruleCfg.Container != "" {
 				if ruleCfg.skip {
 					// the container either hasn't been started yet or
@@ -748,16 +1295,30 @@ func (r *RuleManager) createOutputRules(ctx context.Context, nfc firewallClient,
 				rule.contID = dstID
 				rule.estContID = id
 			}
+			if flows != nil && flows.add(rule) {
+				continue
+			}
 
-			rules, err := createNFTRules(nfc, logger, rule)
+			rules, err := r.createNFTRules(nfc, logger, rule)
 			if err != nil {
 				return nil, fmt.Errorf("error creating firewall rules: %w", err)
 			}
 			nftRules = append(nftRules, rules...)
 		} else {
-			for _, addr := range addrs {
+			// symbols are expanded differently for every network, so
+			// always expand the IPs the rule was configured with
+			ruleIPs := rule.cfg.IPs
+			for netName, addr := range addrs {
 				rule.addr = addr
-				rules, err := createNFTRules(nfc, logger, rule)
+				ips, err := r.expandAddrs(ruleIPs, gateways[netName])
+				if err != nil {
+					return nil, fmt.Errorf("error expanding ips of network %q: %w", netName, err)
+				}
+				rule.cfg.IPs = ips
+				if flows != nil && flows.add(rule) {
+					continue
+				}
+				rules, err := r.createNFTRules(nfc, logger, rule)
 				if err != nil {
 					return nil, fmt.Errorf("error creating firewall rules: %w", err)
 				}
@@ -769,24 +1330,310 @@ func (r *RuleManager) createOutputRules(ctx context.Context, nfc firewallClient,
 	return nftRules, nil
 }
 
-// getContainerIDAndName returns the ID and canonical name of a container
-// if it is present in the database.
-func (r *RuleManager) getContainerIDAndName(ctx context.Context, db database.Querier, contName string) (string, string, error) {
-	name := contName
+// createNetworkPeersRules sets the IPs of rd to the subnet of a network
+// so traffic to all containers on it is allowed. Established traffic
+// from containers on the network that whalewall manages has to be
+// allowed in their chains as well, so rules to do that are returned,
+// and rd is saved so rules can be created in the chains of containers
+// that join the network later.
+func (r *RuleManager) createNetworkPeersRules(ctx context.Context, nfc firewallClient, logger *zap.Logger, tx database.TX, rd *ruleDetails, netName, id string) ([]*nftables.Rule, error) {
+	subnet, peerIDs, err := r.inspectNetwork(ctx, netName)
+	if err != nil {
+		return nil, err
+	}
+	rd.cfg.IPs = []addrOrRange{{addrRange: netipx.RangeOfPrefix(subnet)}}
 
-	id, err := db.GetContainerID(ctx, contName)
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	if err := encoder.Encode(rd.cfg); err != nil {
+		return nil, fmt.Errorf("error encoding network peer rule: %w", err)
+	}
+	err = tx.AddNetworkPeerRule(ctx, database.AddNetworkPeerRuleParams{
+		SrcContainerID: id,
+		NetworkName:    netName,
+		Addr:           rd.addr,
+		Rule:           buf.Bytes(),
+	})
 	if err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			return "", "", fmt.Errorf("error getting container %q ID from database: %w", contName, err)
-		}
+		return nil, fmt.Errorf("error adding network peer rule to database: %w", err)
+	}
 
-		info, err := db.GetContainerIDAndNameFromAlias(ctx, contName)
+	var nftRules []*nftables.Rule
+	for _, peerID := range peerIDs {
+		if peerID == id {
+			continue
+		}
+		// only containers that have been processed have chains;
+		// the rest will have rules created when they are processed
+		peerName, err := tx.GetContainerName(ctx, peerID)
 		if err != nil {
-			return "", "", fmt.Errorf("error getting container %q ID from database: %w", contName, err)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return nil, fmt.Errorf("error getting container %s name from database: %w", peerID[:12], err)
 		}
 
-		id = info.ID
-		name = info.Name
+		peerRule := *rd
+		peerRule.estChain = &nftables.Chain{
+			Table: filterTable,
+			Name:  buildChainName(peerName, peerID),
+		}
+		peerRule.estContID = id
+		rules, err := r.createChainRules(nfc, logger, peerRule, peerRule.estChain)
+		if err != nil {
+			return nil, fmt.Errorf("error creating firewall rules: %w", err)
+		}
+		nftRules = append(nftRules, rules...)
+
+		// rules in the other container's chain need to be cleaned up
+		// when this container is stopped
+		if err := tx.AddEstContainer(ctx, id, peerID); err != nil {
+			return nil, fmt.Errorf("error adding established container to database: %w", err)
+		}
+	}
+
+	return nftRules, nil
+}
+
+// inspectNetwork returns the IPv4 subnet of a Docker network and the
+// IDs of the containers attached to it.
+func (r *RuleManager) inspectNetwork(ctx context.Context, netName string) (netip.Prefix, []string, error) {
+	resource, err := r.dockerCli.NetworkInspect(ctx, netName, types.NetworkInspectOptions{})
+	if err != nil {
+		return netip.Prefix{}, nil, fmt.Errorf("error inspecting network %q: %w", netName, err)
+	}
+
+	var subnet netip.Prefix
+	for _, ipamCfg := range resource.IPAM.Config {
+		prefix, err := netip.ParsePrefix(ipamCfg.Subnet)
+		if err == nil && prefix.Addr().Is4() {
+			subnet = prefix.Masked()
+			break
+		}
+	}
+	if !subnet.IsValid() {
+		return netip.Prefix{}, nil, fmt.Errorf("network %q has no IPv4 subnet", netName)
+	}
+
+	peerIDs := maps.Keys(resource.Containers)
+	slices.Sort(peerIDs)
+
+	return subnet, peerIDs, nil
+}
+
+// createChainRules returns the rules described by rd that are put in
+// chain.
+func (r *RuleManager) createChainRules(nfc firewallClient, logger *zap.Logger, rd ruleDetails, chain *nftables.Chain) ([]*nftables.Rule, error) {
+	rules, err := r.createNFTRules(nfc, logger, rd)
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(rules, func(rule *nftables.Rule) bool {
+		return rule.Chain.Name != chain.Name
+	}), nil
+}
+
+// createInputRules adds nftables rules to allow inbound access to a
+// container.
+func (r *RuleManager) createInputRules(ctx context.Context, nfc firewallClient, logger *zap.Logger, tx database.TX, ruleCfgs []ruleConfig, project string, addrs map[string][]byte, chain *nftables.Chain, name, id string, flows *flowSets) ([]*nftables.Rule, error) {
+	nftRules := make([]*nftables.Rule, 0, len(ruleCfgs)*3)
+	for i, ruleCfg := range ruleCfgs {
+		// prepend container name and ID to log prefixes
+		if ruleCfg.LogPrefix != "" {
+			ruleCfg.LogPrefix = formatLogPrefix(ruleCfg.LogPrefix, name, id)
+		}
+
+		rule := ruleDetails{
+			inbound: true,
+			cfg:     ruleCfg,
+			chain:   chain,
+			contID:  id,
+		}
+
+		if ruleCfg.Network != "" {
+			_, addr, ok := findNetwork(ruleCfg.Network, project, addrs)
+			if !ok {
+				return nil, fmt.Errorf("network %q not found", ruleCfg.Network)
+			}
+			rule.addr = addr
+
+			if len(ruleCfg.ContainerSelector) != 0 {
+				rules, err := r.createSelectorRules(ctx, nfc, logger, tx, rule, i, id)
+				if err != nil {
+					return nil, err
+				}
+				nftRules = append(nftRules, rules...)
+				continue
+			}
+			if ruleCfg.Container != "" {
+				if ruleCfg.skip {
+					// the container either hasn't been started yet or
+					// doesn't exist; this rule will be created when
+					// processing this container later
+					continue
+				}
+
+				srcID, srcName, err := r.getContainerIDAndName(ctx, tx, ruleCfg.Container)
+				if err != nil {
+					return nil, fmt.Errorf("error getting container %q ID from database: %w", ruleCfg.Container, err)
+				}
+				srcAddr, _ := ruleCfg.IPs[0].Addr()
+				dstAddr, ok := netip.AddrFromSlice(addr)
+				if !ok {
+					return nil, fmt.Errorf("error parsing IP of from network %q", ruleCfg.Network)
+				}
+				srcChain := &nftables.Chain{
+					Table: filterTable,
+					Name:  buildChainName(srcName, srcID),
+				}
+				rule = containerInputRule(ruleCfg, srcAddr, dstAddr, srcChain, chain, srcID, id)
+			}
+			if flows != nil && flows.add(rule) {
+				continue
+			}
+
+			rules, err := r.createNFTRules(nfc, logger, rule)
+			if err != nil {
+				return nil, fmt.Errorf("error creating firewall rules: %w", err)
+			}
+			nftRules = append(nftRules, rules...)
+		} else {
+			for _, addr := range addrs {
+				rule.addr = addr
+				if flows != nil && flows.add(rule) {
+					continue
+				}
+				rules, err := r.createNFTRules(nfc, logger, rule)
+				if err != nil {
+					return nil, fmt.Errorf("error creating firewall rules: %w", err)
+				}
+				nftRules = append(nftRules, rules...)
+			}
+		}
+	}
+
+	return nftRules, nil
+}
+
+// createFromHostRules adds nftables rules to allow inbound access to
+// a container from the host. Processes on the host reach containers
+// from the gateways of the container's networks, so only traffic from
+// the gateway of each network is allowed.
+func (r *RuleManager) createFromHostRules(nfc firewallClient, logger *zap.Logger, container types.ContainerJSON, contName string, ruleCfgs []ruleConfig, project string, addrs map[string][]byte, chain *nftables.Chain, flows *flowSets) ([]*nftables.Rule, error) {
+	nftRules := make([]*nftables.Rule, 0, len(ruleCfgs)*len(addrs)*3)
+	for _, ruleCfg := range ruleCfgs {
+		// prepend container name and ID to log prefixes
+		if ruleCfg.LogPrefix != "" {
+			ruleCfg.LogPrefix = formatLogPrefix(ruleCfg.LogPrefix, contName, container.ID)
+		}
+
+		networks := container.NetworkSettings.Networks
+		if ruleCfg.Network != "" {
+			netName, netSettings, ok := findNetwork(ruleCfg.Network, project, networks)
+			if !ok {
+				return nil, fmt.Errorf("network %q not found", ruleCfg.Network)
+			}
+			networks = map[string]*network.EndpointSettings{
+				netName: netSettings,
+			}
+		}
+
+		for netName, netSettings := range networks {
+			gateway, err := netip.ParseAddr(netSettings.Gateway)
+			if err != nil || !gateway.Is4() {
+				// the network doesn't have a gateway, so the host
+				// can't reach the container on it
+				logger.Debug("skipping network without gateway", zap.String("network", netName))
+				continue
+			}
+
+			rule := ruleDetails{
+				inbound: true,
+				addr:    addrs[netName],
+				cfg:     ruleCfg,
+				chain:   chain,
+				contID:  container.ID,
+			}
+			rule.cfg.IPs = []addrOrRange{{addr: gateway}}
+			if flows != nil && flows.add(rule) {
+				continue
+			}
+
+			rules, err := r.createNFTRules(nfc, logger, rule)
+			if err != nil {
+				return nil, fmt.Errorf("error creating firewall rules: %w", err)
+			}
+			nftRules = append(nftRules, rules...)
+		}
+	}
+
+	return nftRules, nil
+}
+
+// containerInputRule returns details of rules that allow traffic from
+// the source container with the chain srcChain to the destination
+// container with the chain dstChain as the input rule cfg of the
+// destination container describes. Traffic from managed containers is
+// evaluated in their own chain first, so new traffic is allowed in the
+// source container's chain and established traffic in the destination
+// container's chain, like an output rule of the source container would.
+func containerInputRule(cfg ruleConfig, srcAddr, dstAddr netip.Addr, srcChain, dstChain *nftables.Chain, srcID, dstID string) ruleDetails {
+	cfg.IPs = []addrOrRange{{addr: dstAddr}}
+	// established queues are relative to the destination container
+	cfg.Verdict.InputEstQueue, cfg.Verdict.OutputEstQueue = cfg.Verdict.OutputEstQueue, cfg.Verdict.InputEstQueue
+
+	return ruleDetails{
+		inbound:   false,
+		addr:      ref(srcAddr.As4())[:],
+		cfg:       cfg,
+		chain:     srcChain,
+		estChain:  dstChain,
+		contID:    dstID,
+		estContID: srcID,
+	}
+}
+
+// createDenyRules adds nftables rules to drop or reject outbound traffic
+// from a container.
+func (r *RuleManager) createDenyRules(ctx context.Context, nfc firewallClient, logger *zap.Logger, tx database.TX, ruleCfgs []ruleConfig, reject bool, project string, addrs map[string][]byte, gateways map[string]netip.Addr, chain *nftables.Chain, name, id string) ([]*nftables.Rule, error) {
+	denyCfgs := make([]ruleConfig, 0, len(ruleCfgs))
+	for _, ruleCfg := range ruleCfgs {
+		ruleCfg.Verdict.drop = true
+		ruleCfg.Verdict.reject = reject
+		if reject && ruleCfg.Proto == invalidProto {
+			// TCP traffic is reset and other traffic is sent an ICMP
+			// error, so a separate rule that matches TCP is needed
+			tcpCfg := ruleCfg
+			tcpCfg.Proto = tcp
+			denyCfgs = append(denyCfgs, tcpCfg)
+		}
+		denyCfgs = append(denyCfgs, ruleCfg)
+	}
+
+	// deny rules are never added to sets so they can be evaluated
+	// before allowed traffic is
+	return r.createOutputRules(ctx, nfc, logger, tx, denyCfgs, project, addrs, gateways, chain, name, id, nil)
+}
+
+// getContainerIDAndName returns the ID and canonical name of a container
+// if it is present in the database.
+func (r *RuleManager) getContainerIDAndName(ctx context.Context, db database.Querier, contName string) (string, string, error) {
+	name := contName
+
+	id, err := db.GetContainerID(ctx, contName)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", "", fmt.Errorf("error getting container %q ID from database: %w", contName, err)
+		}
+
+		info, err := db.GetContainerIDAndNameFromAlias(ctx, contName)
+		if err != nil {
+			return "", "", fmt.Errorf("error getting container %q ID from database: %w", contName, err)
+		}
+
+		id = info.ID
+		name = info.Name
 	}
 
 	return id, name, nil
@@ -799,30 +1646,26 @@ func (r *RuleManager) getContainerIDAndName(ctx context.Context, db database.Que
 func (r *RuleManager) createWaitingContainerRules(ctx context.Context, nfc firewallClient, logger *zap.Logger, tx database.TX, id, name, service, project string, addrs map[string][]byte, chain *nftables.Chain, estContainers map[string]struct{}) ([]*nftables.Rule, error) {
 	var (
 		waitingRules []database.GetWaitingContainerRulesRow
-		err          error
-		aliases      = append([]string{name}, containerAliases(name, service)...)
+		aliases      = append([]string{name}, containerAliases(name, service, project)...)
 	)
 
+	// other containers may have referred to this container by
+	// different aliases, so collect the rules of all of them
 	for _, alias := range aliases {
-		waitingRules, err = tx.GetWaitingContainerRules(ctx, alias)
+		rules, err := tx.GetWaitingContainerRules(ctx, alias)
 		if err != nil {
 			return nil, fmt.Errorf("error getting waiting container rules of %q from database: %w", alias, err)
 		}
-
-		if len(waitingRules) == 0 {
-			continue
-		}
-		break
+		waitingRules = append(waitingRules, rules...)
 	}
-	if waitingRules == nil {
+	if len(waitingRules) == 0 {
 		return nil, nil
 	}
 
 	nftRules := make([]*nftables.Rule, 0, len(waitingRules)*3)
 	for _, waitingRule := range waitingRules {
-		decoder := gob.NewDecoder(bytes.NewReader(waitingRule.Rule))
-		var ruleCfg ruleConfig
-		if err := decoder.Decode(&ruleCfg); err != nil {
+		ruleCfg, err := decodeRuleConfig(waitingRule.Rule)
+		if err != nil {
 			return nil, fmt.Errorf("error decoding waiting container rule: %w", err)
 		}
 
@@ -831,6 +1674,15 @@ func (r *RuleManager) createWaitingContainerRules(ctx context.Context, nfc firew
 		if err != nil {
 			return nil, fmt.Errorf("error inspecting container %q: %w", waitingRule.Name, err)
 		}
+		// the source container may share the network namespace of
+		// another container and use its addresses
+		srcOwner, isSidecar, err := r.netnsOwner(ctx, srcCont)
+		if err != nil {
+			return nil, err
+		}
+		if isSidecar {
+			srcCont = srcOwner
+		}
 		srcProject := srcCont.Config.Labels[composeProjectLabel]
 		srcNetName, srcNetwork, ok := findNetwork(ruleCfg.Network, srcProject, srcCont.NetworkSettings.Networks)
 		if !ok {
@@ -869,7 +1721,7 @@ func (r *RuleManager) createWaitingContainerRules(ctx context.Context, nfc firew
 			estContID: waitingRule.SrcContainerID,
 		}
 
-		rules, err := createNFTRules(nfc, logger, rule)
+		rules, err := r.createNFTRules(nfc, logger, rule)
 		if err != nil {
 			return nil, fmt.Errorf("error creating firewall rules: %w", err)
 		}
@@ -880,6 +1732,147 @@ func (r *RuleManager) createWaitingContainerRules(ctx context.Context, nfc firew
 	return nftRules, nil
 }
 
+// createWaitingInputRules creates nftables rules to allow access from
+// this container to another container. The other container was
+// processed before this container and allows access from it with an
+// input rule, so rules concerning this container couldn't be created
+// until now.
+func (r *RuleManager) createWaitingInputRules(ctx context.Context, nfc firewallClient, logger *zap.Logger, tx database.TX, id, name, service, project string, addrs map[string][]byte, chain *nftables.Chain, estContainers map[string]struct{}) ([]*nftables.Rule, error) {
+	var (
+		waitingRules []database.GetWaitingInputRulesRow
+		aliases      = append([]string{name}, containerAliases(name, service, project)...)
+	)
+
+	// other containers may have referred to this container by
+	// different aliases, so collect the rules of all of them
+	for _, alias := range aliases {
+		rules, err := tx.GetWaitingInputRules(ctx, alias)
+		if err != nil {
+			return nil, fmt.Errorf("error getting waiting input rules of %q from database: %w", alias, err)
+		}
+		waitingRules = append(waitingRules, rules...)
+	}
+	if len(waitingRules) == 0 {
+		return nil, nil
+	}
+
+	nftRules := make([]*nftables.Rule, 0, len(waitingRules)*3)
+	for _, waitingRule := range waitingRules {
+		ruleCfg, err := decodeRuleConfig(waitingRule.Rule)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding waiting input rule: %w", err)
+		}
+		if ruleCfg.LogPrefix != "" {
+			ruleCfg.LogPrefix = formatLogPrefix(ruleCfg.LogPrefix, waitingRule.Name, waitingRule.DstContainerID)
+		}
+
+		// find destination container IP (not this container)
+		dstCont, err := r.dockerCli.ContainerInspect(ctx, waitingRule.DstContainerID)
+		if err != nil {
+			return nil, fmt.Errorf("error inspecting container %q: %w", waitingRule.Name, err)
+		}
+		dstProject := dstCont.Config.Labels[composeProjectLabel]
+		dstNetName, dstNetwork, ok := findNetwork(ruleCfg.Network, dstProject, dstCont.NetworkSettings.Networks)
+		if !ok {
+			return nil, fmt.Errorf("network %q not found for container %q",
+				ruleCfg.Network,
+				waitingRule.Name,
+			)
+		}
+		dstAddr, err := netip.ParseAddr(dstNetwork.IPAddress)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing IP of container %q from network %q: %w", waitingRule.Name, dstNetName, err)
+		}
+
+		// find source container IP (this container)
+		srcNetName, srcNetwork, ok := findNetwork(ruleCfg.Network, project, addrs)
+		if !ok {
+			return nil, fmt.Errorf("network %q not found", ruleCfg.Network)
+		}
+		srcAddr, ok := netip.AddrFromSlice(srcNetwork)
+		if !ok {
+			return nil, fmt.Errorf("error parsing IP of from network %q", srcNetName)
+		}
+
+		// create rules
+		dstChain := &nftables.Chain{
+			Table: filterTable,
+			Name:  buildChainName(waitingRule.Name, waitingRule.DstContainerID),
+		}
+		rule := containerInputRule(ruleCfg, srcAddr, dstAddr, chain, dstChain, id, waitingRule.DstContainerID)
+		rules, err := r.createNFTRules(nfc, logger, rule)
+		if err != nil {
+			return nil, fmt.Errorf("error creating firewall rules: %w", err)
+		}
+		nftRules = append(nftRules, rules...)
+
+		// rules in this container's chain need to be cleaned up when
+		// the other container is stopped as well
+		estContainers[waitingRule.DstContainerID] = struct{}{}
+		if err := tx.AddEstContainer(ctx, waitingRule.DstContainerID, id); err != nil {
+			return nil, fmt.Errorf("error adding established container to database: %w", err)
+		}
+	}
+
+	return nftRules, nil
+}
+
+// createWaitingNetworkPeerRules creates nftables rules to allow
+// established traffic from this container to other containers that
+// allow traffic to all containers on a network this container is
+// attached to. The other containers were processed before this
+// container, so rules concerning this container couldn't be created
+// until now.
+func (r *RuleManager) createWaitingNetworkPeerRules(ctx context.Context, nfc firewallClient, logger *zap.Logger, tx database.TX, id string, addrs map[string][]byte, chain *nftables.Chain) ([]*nftables.Rule, error) {
+	netNames := maps.Keys(addrs)
+	slices.Sort(netNames)
+
+	var nftRules []*nftables.Rule
+	for _, netName := range netNames {
+		peerRules, err := tx.GetNetworkPeerRules(ctx, netName)
+		if err != nil {
+			return nil, fmt.Errorf("error getting network peer rules of %q from database: %w", netName, err)
+		}
+
+		for _, peerRule := range peerRules {
+			if peerRule.SrcContainerID == id {
+				continue
+			}
+
+			ruleCfg, err := decodeRuleConfig(peerRule.Rule)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding network peer rule: %w", err)
+			}
+
+			rule := ruleDetails{
+				inbound: false,
+				addr:    peerRule.Addr,
+				cfg:     ruleCfg,
+				chain: &nftables.Chain{
+					Table: filterTable,
+					Name:  buildChainName(peerRule.Name, peerRule.SrcContainerID),
+				},
+				estChain:  chain,
+				contID:    peerRule.SrcContainerID,
+				estContID: peerRule.SrcContainerID,
+			}
+			rules, err := r.createChainRules(nfc, logger, rule, chain)
+			if err != nil {
+				return nil, fmt.Errorf("error creating firewall rules: %w", err)
+			}
+			nftRules = append(nftRules, rules...)
+
+			// rules in this container's chain need to be cleaned up
+			// when the other container is stopped
+			if err := tx.AddEstContainer(ctx, peerRule.SrcContainerID, id); err != nil {
+				return nil, fmt.Errorf("error adding established container to database: %w", err)
+			}
+		}
+	}
+
+	return nftRules, nil
+}
+
 func formatLogPrefix(prefix, name, id string) string {
 	prefix = fmt.Sprintf("whalewall-%s-%s %s", name, id[:12], prefix)
 	if !strings.HasSuffix(prefix, ": ") {
@@ -924,7 +1917,7 @@ func (r ruleDetails) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 }
 
 // createNFTRules returns a slice of [*nftables.Rule] described by rd.
-func createNFTRules(nfc firewallClient, logger *zap.Logger, rd ruleDetails) ([]*nftables.Rule, error) {
+func (r *RuleManager) createNFTRules(nfc firewallClient, logger *zap.Logger, rd ruleDetails) ([]*nftables.Rule, error) {
 	logger.Debug("generating rule", zap.Object("rule", rd))
 
 	rules := make([]*nftables.Rule, 0, 3)
@@ -935,22 +1928,51 @@ func createNFTRules(nfc firewallClient, logger *zap.Logger, rd ruleDetails) ([]*
 		estContID = rd.estContID
 	}
 
+	// drop traffic of sources that exceed limits before it can be
+	// allowed
+	if rd.inbound && !rd.cfg.Verdict.drop && rd.cfg.limited() {
+		limitRules, err := r.createLimitRules(nfc, rd)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, limitRules...)
+	}
+
+	// mark outbound traffic before it is routed
+	if !rd.inbound && rd.cfg.Verdict.marked() {
+		rule, err := r.createMarkRule(nfc, rd)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
 	// if the rule is a drop rule, only need to handle new traffic
 	if rd.cfg.Verdict.drop {
-		rule, err := createNFTRule(nfc, rd.inbound, false, stateNew, rd.addr, rd.cfg, 0, rd.chain, rd.contID)
+		rule, err := r.createNFTRule(nfc, rd.inbound, false, stateNew, rd.addr, rd.cfg, queueNums{}, rd.chain, rd.contID)
+		if err != nil {
+			return nil, err
+		}
+		return append(rules, rule), nil
+	}
+
+	// established traffic is accepted in the whalewall chain, only
+	// new traffic needs to be handled
+	if r.estFastPath {
+		rule, err := r.createNFTRule(nfc, rd.inbound, false, stateNew, rd.addr, rd.cfg, rd.cfg.Verdict.Queue, rd.chain, rd.contID)
 		if err != nil {
 			return nil, err
 		}
 		return append(rules, rule), nil
 	}
 
-	if rd.cfg.Verdict.Queue == 0 {
+	if !rd.cfg.Verdict.Queue.set() {
 		if rd.cfg.LogPrefix == "" {
-			newEstRule, err := createNFTRule(nfc, rd.inbound, false, stateNewEst, rd.addr, rd.cfg, 0, rd.chain, rd.contID)
+			newEstRule, err := r.createNFTRule(nfc, rd.inbound, false, stateNewEst, rd.addr, rd.cfg, queueNums{}, rd.chain, rd.contID)
 			if err != nil {
 				return nil, err
 			}
-			estRule, err := createNFTRule(nfc, !rd.inbound, true, stateEst, rd.addr, rd.cfg, 0, rd.estChain, estContID)
+			estRule, err := r.createNFTRule(nfc, !rd.inbound, true, stateEst, rd.addr, rd.cfg, queueNums{}, rd.estChain, estContID)
 			if err != nil {
 				return nil, err
 			}
@@ -958,15 +1980,15 @@ func createNFTRules(nfc firewallClient, logger *zap.Logger, rd ruleDetails) ([]*
 		}
 
 		// create a separate rule for new traffic to log it
-		dstNewRule, err := createNFTRule(nfc, rd.inbound, false, stateNew, rd.addr, rd.cfg, 0, rd.chain, rd.contID)
+		dstNewRule, err := r.createNFTRule(nfc, rd.inbound, false, stateNew, rd.addr, rd.cfg, queueNums{}, rd.chain, rd.contID)
 		if err != nil {
 			return nil, err
 		}
-		dstEstRule, err := createNFTRule(nfc, rd.inbound, false, stateEst, rd.addr, rd.cfg, 0, rd.chain, rd.contID)
+		dstEstRule, err := r.createNFTRule(nfc, rd.inbound, false, stateEst, rd.addr, rd.cfg, queueNums{}, rd.chain, rd.contID)
 		if err != nil {
 			return nil, err
 		}
-		srcEstRule, err := createNFTRule(nfc, !rd.inbound, true, stateEst, rd.addr, rd.cfg, 0, rd.estChain, estContID)
+		srcEstRule, err := r.createNFTRule(nfc, !rd.inbound, true, stateEst, rd.addr, rd.cfg, queueNums{}, rd.estChain, estContID)
 		if err != nil {
 			return nil, err
 		}
@@ -980,11 +2002,11 @@ func createNFTRules(nfc firewallClient, logger *zap.Logger, rd ruleDetails) ([]*
 		if rd.inbound && rd.cfg.Verdict.Queue == rd.cfg.Verdict.InputEstQueue {
 			// if rule is inbound and queue and established inbound queue
 			// are the same, create one rule for inbound traffic
-			newEstRule, err := createNFTRule(nfc, true, false, stateNewEst, rd.addr, rd.cfg, rd.cfg.Verdict.Queue, rd.chain, rd.contID)
+			newEstRule, err := r.createNFTRule(nfc, true, false, stateNewEst, rd.addr, rd.cfg, rd.cfg.Verdict.Queue, rd.chain, rd.contID)
 			if err != nil {
 				return nil, err
 			}
-			estRule, err := createNFTRule(nfc, false, true, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.OutputEstQueue, rd.estChain, estContID)
+			estRule, err := r.createNFTRule(nfc, false, true, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.OutputEstQueue, rd.estChain, estContID)
 			if err != nil {
 				return nil, err
 			}
@@ -992,11 +2014,11 @@ func createNFTRules(nfc firewallClient, logger *zap.Logger, rd ruleDetails) ([]*
 		} else if !rd.inbound && rd.cfg.Verdict.Queue == rd.cfg.Verdict.OutputEstQueue {
 			// if rule is outbound and queue and established outbound queue
 			// are the same, create one rule for outbound traffic
-			newEstRule, err := createNFTRule(nfc, false, false, stateNewEst, rd.addr, rd.cfg, rd.cfg.Verdict.Queue, rd.chain, rd.contID)
+			newEstRule, err := r.createNFTRule(nfc, false, false, stateNewEst, rd.addr, rd.cfg, rd.cfg.Verdict.Queue, rd.chain, rd.contID)
 			if err != nil {
 				return nil, err
 			}
-			estRule, err := createNFTRule(nfc, true, true, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.InputEstQueue, rd.estChain, estContID)
+			estRule, err := r.createNFTRule(nfc, true, true, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.InputEstQueue, rd.estChain, estContID)
 			if err != nil {
 				return nil, err
 			}
@@ -1009,15 +2031,15 @@ func createNFTRules(nfc firewallClient, logger *zap.Logger, rd ruleDetails) ([]*
 	// or, logging was requested which means we need to create a
 	// separate rule for new traffic
 	if rd.inbound {
-		dstNewRule, err := createNFTRule(nfc, true, false, stateNew, rd.addr, rd.cfg, rd.cfg.Verdict.Queue, rd.chain, rd.contID)
+		dstNewRule, err := r.createNFTRule(nfc, true, false, stateNew, rd.addr, rd.cfg, rd.cfg.Verdict.Queue, rd.chain, rd.contID)
 		if err != nil {
 			return nil, err
 		}
-		dstEstRule, err := createNFTRule(nfc, true, false, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.InputEstQueue, rd.chain, rd.contID)
+		dstEstRule, err := r.createNFTRule(nfc, true, false, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.InputEstQueue, rd.chain, rd.contID)
 		if err != nil {
 			return nil, err
 		}
-		srcEstRule, err := createNFTRule(nfc, false, true, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.OutputEstQueue, rd.estChain, estContID)
+		srcEstRule, err := r.createNFTRule(nfc, false, true, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.OutputEstQueue, rd.estChain, estContID)
 		if err != nil {
 			return nil, err
 		}
@@ -1028,22 +2050,22 @@ func createNFTRules(nfc firewallClient, logger *zap.Logger, rd ruleDetails) ([]*
 	// are different, need to create separate rules for them;
 	// or, logging was requested which means we need to create a
 	// separate rule for new traffic
-	dstNewRule, err := createNFTRule(nfc, false, false, stateNew, rd.addr, rd.cfg, rd.cfg.Verdict.Queue, rd.chain, rd.contID)
+	dstNewRule, err := r.createNFTRule(nfc, false, false, stateNew, rd.addr, rd.cfg, rd.cfg.Verdict.Queue, rd.chain, rd.contID)
 	if err != nil {
 		return nil, err
 	}
-	dstEstRule, err := createNFTRule(nfc, false, false, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.OutputEstQueue, rd.chain, rd.contID)
+	dstEstRule, err := r.createNFTRule(nfc, false, false, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.OutputEstQueue, rd.chain, rd.contID)
 	if err != nil {
 		return nil, err
 	}
-	srcEstRule, err := createNFTRule(nfc, true, true, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.InputEstQueue, rd.estChain, estContID)
+	srcEstRule, err := r.createNFTRule(nfc, true, true, stateEst, rd.addr, rd.cfg, rd.cfg.Verdict.InputEstQueue, rd.estChain, estContID)
 	if err != nil {
 		return nil, err
 	}
 	return append(rules, dstNewRule, dstEstRule, srcEstRule), nil
 }
 
-func createNFTRule(nfc firewallClient, inbound, inversePortOffsets bool, state uint32, addr []byte, cfg ruleConfig, queueNum uint16, chain *nftables.Chain, contID string) (*nftables.Rule, error) {
+func (r *RuleManager) createNFTRule(nfc firewallClient, inbound, inversePortOffsets bool, state uint32, addr []byte, cfg ruleConfig, queue queueNums, chain *nftables.Chain, contID string) (*nftables.Rule, error) {
 	addrOffset := srcAddrOffset
 	cfgAddrOffset := dstAddrOffset
 	if inbound {
@@ -1054,15 +2076,42 @@ func createNFTRule(nfc firewallClient, inbound, inversePortOffsets bool, state u
 	if cfg.Proto == udp {
 		proto = unix.IPPROTO_UDP
 	}
-	exprs := make([]expr.Any, 0, 15)
-	if len(cfg.IPs) != 0 {
+	exprs := make([]expr.Any, 0, 17)
+	ifnames, ifnameKey := cfg.EgressInterfaces, expr.MetaKeyOIFNAME
+	if inbound {
+		ifnames, ifnameKey = cfg.iifnames, expr.MetaKeyIIFNAME
+	}
+	if len(ifnames) != 0 {
+		ifnameExprs, err := createIfnameExprs(nfc, ifnames, ifnameKey, chain)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, ifnameExprs...)
+	}
+	if len(cfg.hostAddrs) != 0 {
+		hostAddrExprs, err := createHostAddrExprs(nfc, cfg.hostAddrs, chain)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, hostAddrExprs...)
+	}
+	if len(cfg.IPs) != 0 || cfg.addrSet != nil {
 		var addrExprs []expr.Any
 		if len(addr) != 0 {
 			addrExprs = matchAddrExprs(addr, addrOffset)
 		}
-		cfgAddrExprs, err := createIPExprs(nfc, cfg.IPs, cfgAddrOffset, chain)
-		if err != nil {
-			return nil, err
+		var cfgAddrExprs []expr.Any
+		if cfg.addrSet != nil {
+			cfgAddrExprs = []expr.Any{
+				getAddrExpr(cfgAddrOffset),
+				matchFromSetExpr(cfg.addrSet),
+			}
+		} else {
+			var err error
+			cfgAddrExprs, err = createIPExprs(nfc, cfg.IPs, cfgAddrOffset, chain)
+			if err != nil {
+				return nil, err
+			}
 		}
 		if inbound {
 			exprs = append(exprs, cfgAddrExprs...)
@@ -1112,25 +2161,33 @@ func createNFTRule(nfc firewallClient, inbound, inversePortOffsets bool, state u
 	}
 
 	exprs = append(exprs, matchConnStateExprs(state)...)
+	exprs = append(exprs, cfg.meter...)
 	exprs = append(exprs, &expr.Counter{})
 	if state == stateNew && cfg.LogPrefix != "" {
-		exprs = append(exprs, logExpr(cfg.LogPrefix))
+		exprs = append(exprs, r.createLogExpr(cfg.LogPrefix, verdictName(cfg, queue)))
 	}
 
 	switch {
-	case cfg.Verdict.Chain != "":
+	case cfg.Verdict.setMarks:
+		exprs = append(exprs, setMarkExprs(cfg.Verdict)...)
+	case cfg.Verdict.gotoChain != "":
 		exprs = append(exprs,
 			&expr.Verdict{
-				Kind:  expr.VerdictJump,
-				Chain: cfg.Verdict.Chain,
+				Kind:  expr.VerdictGoto,
+				Chain: cfg.Verdict.gotoChain,
 			},
 		)
-	case queueNum != 0:
+	case cfg.Verdict.Chain != "":
 		exprs = append(exprs,
-			&expr.Queue{
-				Num: queueNum,
+			&expr.Verdict{
+				Kind:  expr.VerdictJump,
+				Chain: cfg.Verdict.Chain,
 			},
 		)
+	case queue.set():
+		exprs = append(exprs, createQueueExpr(queue, cfg.Verdict))
+	case cfg.Verdict.drop && cfg.Verdict.reject:
+		exprs = append(exprs, rejectExpr(cfg.Proto == tcp))
 	case cfg.Verdict.drop:
 		exprs = append(exprs, dropVerdict)
 	default:
@@ -1145,6 +2202,25 @@ func createNFTRule(nfc firewallClient, inbound, inversePortOffsets bool, state u
 	}, nil
 }
 
+// createQueueExpr returns an expression that sends packets to queue
+// with the queue flags of v.
+func createQueueExpr(queue queueNums, v verdict) *expr.Queue {
+	e := &expr.Queue{
+		Num: queue.first,
+	}
+	if queue.isRange() {
+		e.Total = queue.last - queue.first + 1
+		if v.Fanout {
+			e.Flag |= expr.QueueFlagFanout
+		}
+	}
+	if v.Bypass {
+		e.Flag |= expr.QueueFlagBypass
+	}
+
+	return e
+}
+
 func createIPExprs(nfc firewallClient, addrs []addrOrRange, addrOffset uint32, chain *nftables.Chain) ([]expr.Any, error) {
 	var exprs []expr.Any
 
@@ -1160,76 +2236,52 @@ func createIPExprs(nfc firewallClient, addrs []addrOrRange, addrOffset uint32, c
 		return exprs, nil
 	}
 
-	exprs = append(exprs, getAddrExpr(addrOffset))
-
-	var singleAddr []byte
-	var singleAddrElems []nftables.SetElement
-	for _, addr := range addrs {
-		if addr, ok := addr.Addr(); ok {
-			singleAddr = ref(addr.As4())[:]
+	var hasRange bool
+	singleAddrElems := make([]nftables.SetElement, 0, len(addrs))
+	intervals := make([]keyInterval, 0, len(addrs))
+	for _, addrOrRange := range addrs {
+		if addr, ok := addrOrRange.Addr(); ok {
+			singleAddr := ref(addr.As4())[:]
 			singleAddrElems = append(singleAddrElems, nftables.SetElement{
 				Key: singleAddr,
 			})
-		}
-	}
-	if len(singleAddrElems) != 0 {
-		if len(singleAddrElems) == 1 {
-			// there is only one single addr, no need to create a set
-			exprs = append(exprs, compareAddrExpr(singleAddr))
-		} else {
-			set := &nftables.Set{
-				Table:     chain.Table,
-				Anonymous: true,
-				Constant:  true,
-				KeyType:   nftables.TypeInetService,
-			}
-			if err := nfc.AddSet(set, singleAddrElems); err != nil {
-				return nil, fmt.Errorf("error creating set: %w", err)
-			}
-			exprs = append(exprs, matchFromSetExpr(set))
-		}
-	}
-
-	var addrRangeLow []byte
-	var addrRangeHigh []byte
-	var addrRangeElems []nftables.SetElement
-	for _, addr := range addrs {
-		if lowAddr, highAddr, ok := addr.Range(); ok {
-			addrRangeLow = ref(lowAddr.As4())[:]
-			addrRangeHigh = ref(highAddr.As4())[:]
-			addrRangeElems = append(addrRangeElems, nftables.SetElement{
-				Key: addrRangeLow,
+			intervals = append(intervals, keyInterval{
+				low:  singleAddr,
+				high: singleAddr,
 			})
-			addrRangeElems = append(addrRangeElems, nftables.SetElement{
-				Key:         addrRangeHigh,
-				IntervalEnd: true,
+		} else if lowAddr, highAddr, ok := addrOrRange.Range(); ok {
+			hasRange = true
+			intervals = append(intervals, keyInterval{
+				low:  ref(lowAddr.As4())[:],
+				high: ref(highAddr.As4())[:],
 			})
-		}
-	}
-	if len(addrRangeElems) != 0 {
-		if len(addrRangeElems) == 2 {
-			// there is only one single port range, no need to create a set
-			exprs = append(exprs, compareAddrRangeExprs(addrRangeLow, addrRangeHigh)...)
 		} else {
-			set := &nftables.Set{
-				Table:     chain.Table,
-				Anonymous: true,
-				Constant:  true,
-				Interval:  true,
-				KeyType:   nftables.TypeIPAddr,
-			}
-			if err := nfc.AddSet(set, addrRangeElems); err != nil {
-				return nil, fmt.Errorf("error creating set: %w", err)
-			}
-			exprs = append(exprs, matchFromSetExpr(set))
+			// should never happen if cfg.IP.IsValid is true
+			return nil, errors.New("whalewall bug: invalid IP address")
 		}
 	}
 
-	if len(exprs) == 1 {
-		return nil, errors.New("whalewall bug: only one addr expr created")
+	// addresses and ranges are a union, so if there are any ranges
+	// every address is added to an interval set
+	set := &nftables.Set{
+		Table:     chain.Table,
+		Anonymous: true,
+		Constant:  true,
+		KeyType:   nftables.TypeIPAddr,
+	}
+	elems := singleAddrElems
+	if hasRange {
+		set.Interval = true
+		elems = intervalSetElems(intervals)
+	}
+	if err := nfc.AddSet(set, elems); err != nil {
+		return nil, fmt.Errorf("error creating set: %w", err)
 	}
 
-	return exprs, nil
+	return []expr.Any{
+		getAddrExpr(addrOffset),
+		matchFromSetExpr(set),
+	}, nil
 }
 
 func createPortExprs(nfc firewallClient, ports []rulePorts, portOffset uint32, chain *nftables.Chain) ([]expr.Any, error) {
@@ -1244,74 +2296,107 @@ func createPortExprs(nfc firewallClient, ports []rulePorts, portOffset uint32, c
 		return exprs, nil
 	}
 
-	exprs = append(exprs, getPortExpr(portOffset))
-
-	var singlePort uint16
-	var singlePortElems []nftables.SetElement
+	var hasRange bool
+	singlePortElems := make([]nftables.SetElement, 0, len(ports))
+	intervals := make([]keyInterval, 0, len(ports))
 	for _, port := range ports {
 		if port.single != 0 {
-			singlePort = port.single
+			singlePort := binary.BigEndian.AppendUint16(nil, port.single)
 			singlePortElems = append(singlePortElems, nftables.SetElement{
-				Key: binary.BigEndian.AppendUint16(nil, port.single),
+				Key: singlePort,
+			})
+			intervals = append(intervals, keyInterval{
+				low:  singlePort,
+				high: singlePort,
+			})
+		} else {
+			hasRange = true
+			intervals = append(intervals, keyInterval{
+				low:  binary.BigEndian.AppendUint16(nil, port.interval.min),
+				high: binary.BigEndian.AppendUint16(nil, port.interval.max),
 			})
 		}
 	}
-	if len(singlePortElems) != 0 {
-		if len(singlePortElems) == 1 {
-			// there is only one single port, no need to create a set
-			exprs = append(exprs, comparePortExpr(singlePort))
-		} else {
-			set := &nftables.Set{
-				Table:     chain.Table,
-				Anonymous: true,
-				Constant:  true,
-				KeyType:   nftables.TypeInetService,
+
+	// ports and port ranges are a union, so if there are any ranges
+	// every port is added to an interval set
+	set := &nftables.Set{
+		Table:     chain.Table,
+		Anonymous: true,
+		Constant:  true,
+		KeyType:   nftables.TypeInetService,
+	}
+	elems := singlePortElems
+	if hasRange {
+		set.Interval = true
+		elems = intervalSetElems(intervals)
+	}
+	if err := nfc.AddSet(set, elems); err != nil {
+		return nil, fmt.Errorf("error creating set: %w", err)
+	}
+
+	return []expr.Any{
+		getPortExpr(portOffset),
+		matchFromSetExpr(set),
+	}, nil
+}
+
+// keyInterval is an inclusive range of big-endian set keys.
+type keyInterval struct {
+	low  []byte
+	high []byte
+}
+
+// intervalSetElems returns the elements of an interval set that
+// matches the union of intervals. Overlapping and adjacent intervals
+// are merged, as the kernel rejects overlapping elements. The end
+// element of an interval is exclusive, so it is the key after the
+// interval and is omitted if the interval reaches the largest key.
+func intervalSetElems(intervals []keyInterval) []nftables.SetElement {
+	intervals = slices.Clone(intervals)
+	slices.SortFunc(intervals, func(a, b keyInterval) int {
+		return bytes.Compare(a.low, b.low)
+	})
+
+	elems := make([]nftables.SetElement, 0, 2*len(intervals))
+	for i := 0; i < len(intervals); {
+		low, high := intervals[i].low, intervals[i].high
+		end, ok := nextKey(high)
+		for i++; i < len(intervals); i++ {
+			if ok && bytes.Compare(intervals[i].low, end) > 0 {
+				break
 			}
-			if err := nfc.AddSet(set, singlePortElems); err != nil {
-				return nil, fmt.Errorf("error creating set: %w", err)
+			if bytes.Compare(intervals[i].high, high) > 0 {
+				high = intervals[i].high
+				end, ok = nextKey(high)
 			}
-			exprs = append(exprs, matchFromSetExpr(set))
 		}
-	}
 
-	var portRange portInterval
-	var portIntervalElems []nftables.SetElement
-	for _, port := range ports {
-		if port.single == 0 {
-			portRange = port.interval
-			portIntervalElems = append(portIntervalElems, nftables.SetElement{
-				Key: binary.BigEndian.AppendUint16(nil, port.interval.min),
-			})
-			portIntervalElems = append(portIntervalElems, nftables.SetElement{
-				Key:         binary.BigEndian.AppendUint16(nil, port.interval.max),
+		elems = append(elems, nftables.SetElement{
+			Key: low,
+		})
+		if ok {
+			elems = append(elems, nftables.SetElement{
+				Key:         end,
 				IntervalEnd: true,
 			})
 		}
 	}
-	if len(portIntervalElems) != 0 {
-		if len(portIntervalElems) == 2 {
-			// there is only one single port range, no need to create a set
-			exprs = append(exprs, comparePortsExprs(portRange)...)
-		} else {
-			set := &nftables.Set{
-				Table:     chain.Table,
-				Anonymous: true,
-				Constant:  true,
-				Interval:  true,
-				KeyType:   nftables.TypeInetService,
-			}
-			if err := nfc.AddSet(set, portIntervalElems); err != nil {
-				return nil, fmt.Errorf("error creating set: %w", err)
-			}
-			exprs = append(exprs, matchFromSetExpr(set))
-		}
-	}
 
-	if len(exprs) == 1 {
-		return nil, errors.New("whalewall bug: only one port expr created")
-	}
+	return elems
+}
 
-	return exprs, nil
+// nextKey returns the big-endian key after key, and false if key is
+// the largest key.
+func nextKey(key []byte) ([]byte, bool) {
+	next := slices.Clone(key)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next, true
+		}
+	}
+	return nil, false
 }
 
 func matchAddrExprs(addr []byte, offset uint32) []expr.Any {
@@ -1379,6 +2464,92 @@ func matchProtoExprs(proto int) []expr.Any {
 	}
 }
 
+// createIfnameExprs returns expressions that match traffic whose
+// interface loaded by key is one of names.
+func createIfnameExprs(nfc firewallClient, names []string, key expr.MetaKey, chain *nftables.Chain) ([]expr.Any, error) {
+	exprs := []expr.Any{
+		// [ meta load iifname/oifname => reg 1 ]
+		&expr.Meta{
+			Key:      key,
+			Register: 1,
+		},
+	}
+
+	if len(names) == 1 {
+		// [ cmp eq reg 1 ... ]
+		return append(exprs, &expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     ifnameData(names[0]),
+		}), nil
+	}
+
+	set := &nftables.Set{
+		Table:     chain.Table,
+		Anonymous: true,
+		Constant:  true,
+		KeyType:   nftables.TypeIFName,
+	}
+	elems := make([]nftables.SetElement, len(names))
+	for i, name := range names {
+		elems[i] = nftables.SetElement{
+			Key: ifnameData(name),
+		}
+	}
+	if err := nfc.AddSet(set, elems); err != nil {
+		return nil, fmt.Errorf("error creating set: %w", err)
+	}
+
+	return append(exprs, matchFromSetExpr(set)), nil
+}
+
+// createHostAddrExprs returns expressions that match connections that
+// were made to one of addrs before being DNATed. The original
+// destination is matched instead of the interface traffic arrives on
+// so traffic that is sent to addrs from containers or over VPNs is
+// matched as well.
+func createHostAddrExprs(nfc firewallClient, addrs []netip.Addr, chain *nftables.Chain) ([]expr.Any, error) {
+	exprs := []expr.Any{
+		// [ ct load dst => reg 1 , dir original ]
+		&expr.Ct{
+			Register:  1,
+			Key:       expr.CtKeyDST,
+			Direction: ctDirOriginal,
+		},
+	}
+
+	if len(addrs) == 1 {
+		// [ cmp eq reg 1 ... ]
+		return append(exprs, compareAddrExpr(ref(addrs[0].As4())[:])), nil
+	}
+
+	set := &nftables.Set{
+		Table:     chain.Table,
+		Anonymous: true,
+		Constant:  true,
+		KeyType:   nftables.TypeIPAddr,
+	}
+	elems := make([]nftables.SetElement, len(addrs))
+	for i, addr := range addrs {
+		elems[i] = nftables.SetElement{
+			Key: ref(addr.As4())[:],
+		}
+	}
+	if err := nfc.AddSet(set, elems); err != nil {
+		return nil, fmt.Errorf("error creating set: %w", err)
+	}
+
+	return append(exprs, matchFromSetExpr(set)), nil
+}
+
+// ifnameData returns name padded with NULs, as interface names are
+// compared with their padding.
+func ifnameData(name string) []byte {
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return data
+}
+
 func matchPortExprs(port uint16, offset uint32) []expr.Any {
 	return []expr.Any{
 		getPortExpr(offset),
@@ -1476,7 +2647,6 @@ func createDropRule(chain *nftables.Chain, id string) *nftables.Rule {
 		Chain: chain,
 		Exprs: []expr.Any{
 			&expr.Counter{},
-			logExpr(chain.Name + " drop: "),
 			&expr.Verdict{
 				Kind: expr.VerdictDrop,
 			},
@@ -1485,6 +2655,95 @@ func createDropRule(chain *nftables.Chain, id string) *nftables.Rule {
 	}
 }
 
+// createDropRules returns rules that drop traffic that reaches the end
+// of a container chain, and log it if logging dropped traffic is
+// enabled. If reject is true, traffic is rejected instead of dropped.
+func (r *RuleManager) createDropRules(chain *nftables.Chain, id string, reject bool) []*nftables.Rule {
+	if !reject && !r.logDrops {
+		return []*nftables.Rule{createDropRule(chain, id)}
+	}
+
+	verdict := "drop"
+	if reject {
+		verdict = "reject"
+	}
+	prefix := chain.Name + " " + verdict + ": "
+	if r.nflog {
+		// the verdict is already part of NFLOG prefixes
+		prefix = chain.Name + ": "
+	}
+
+	var rules []*nftables.Rule
+	var logExprs []expr.Any
+	switch {
+	case !r.logDrops:
+	case r.dropLogLimit == 0:
+		logExprs = []expr.Any{r.createLogExpr(prefix, verdict)}
+	default:
+		// packets over the limit won't match the rule that logs, so
+		// dropping has to be done in a separate rule
+		rules = append(rules, &nftables.Rule{
+			Table: chain.Table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				&expr.Limit{
+					Type: expr.LimitTypePkts,
+					Rate: uint64(r.dropLogLimit),
+					Unit: expr.LimitTimeMinute,
+				},
+				r.createLogExpr(prefix, verdict),
+			},
+			UserData: []byte(id),
+		})
+	}
+
+	if !reject {
+		exprs := append([]expr.Any{&expr.Counter{}}, logExprs...)
+		return append(rules, &nftables.Rule{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    append(exprs, dropVerdict),
+			UserData: []byte(id),
+		})
+	}
+
+	// TCP traffic is reset and other traffic is sent an ICMP error,
+	// which requires a separate rule that only matches TCP
+	tcpExprs := matchProtoExprs(unix.IPPROTO_TCP)
+	tcpExprs = append(tcpExprs, &expr.Counter{})
+	tcpExprs = append(tcpExprs, logExprs...)
+	exprs := append([]expr.Any{&expr.Counter{}}, logExprs...)
+	return append(rules,
+		&nftables.Rule{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    append(tcpExprs, rejectExpr(true)),
+			UserData: []byte(id),
+		},
+		&nftables.Rule{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    append(exprs, rejectExpr(false)),
+			UserData: []byte(id),
+		},
+	)
+}
+
+// rejectExpr returns an expression that rejects packets with a TCP
+// reset if tcp is true, or an ICMP administratively prohibited error
+// otherwise.
+func rejectExpr(tcp bool) expr.Any {
+	if tcp {
+		return &expr.Reject{
+			Type: unix.NFT_REJECT_TCP_RST,
+		}
+	}
+	return &expr.Reject{
+		Type: unix.NFT_REJECT_ICMP_UNREACH,
+		Code: icmpAdminProhibited,
+	}
+}
+
 func ref[T any](v T) *T {
 	return &v
 }
@@ -33,12 +33,27 @@ func Prepare(ctx context.Context, db DBTX) (*Queries, error) {
 	if q.addContainerAliasStmt, err = db.PrepareContext(ctx, addContainerAlias); err != nil {
 		return nil, fmt.Errorf("error preparing query AddContainerAlias: %w", err)
 	}
+	if q.addDenialStmt, err = db.PrepareContext(ctx, addDenial); err != nil {
+		return nil, fmt.Errorf("error preparing query AddDenial: %w", err)
+	}
 	if q.addEstContainerStmt, err = db.PrepareContext(ctx, addEstContainer); err != nil {
 		return nil, fmt.Errorf("error preparing query AddEstContainer: %w", err)
 	}
+	if q.addLearnedFlowStmt, err = db.PrepareContext(ctx, addLearnedFlow); err != nil {
+		return nil, fmt.Errorf("error preparing query AddLearnedFlow: %w", err)
+	}
+	if q.addNetworkPeerRuleStmt, err = db.PrepareContext(ctx, addNetworkPeerRule); err != nil {
+		return nil, fmt.Errorf("error preparing query AddNetworkPeerRule: %w", err)
+	}
+	if q.addSelectorRuleStmt, err = db.PrepareContext(ctx, addSelectorRule); err != nil {
+		return nil, fmt.Errorf("error preparing query AddSelectorRule: %w", err)
+	}
 	if q.addWaitingContainerRuleStmt, err = db.PrepareContext(ctx, addWaitingContainerRule); err != nil {
 		return nil, fmt.Errorf("error preparing query AddWaitingContainerRule: %w", err)
 	}
+	if q.addWaitingInputRuleStmt, err = db.PrepareContext(ctx, addWaitingInputRule); err != nil {
+		return nil, fmt.Errorf("error preparing query AddWaitingInputRule: %w", err)
+	}
 	if q.containerExistsStmt, err = db.PrepareContext(ctx, containerExists); err != nil {
 		return nil, fmt.Errorf("error preparing query ContainerExists: %w", err)
 	}
@@ -54,9 +69,24 @@ func Prepare(ctx context.Context, db DBTX) (*Queries, error) {
 	if q.deleteEstContainersStmt, err = db.PrepareContext(ctx, deleteEstContainers); err != nil {
 		return nil, fmt.Errorf("error preparing query DeleteEstContainers: %w", err)
 	}
+	if q.deleteNetworkPeerRulesStmt, err = db.PrepareContext(ctx, deleteNetworkPeerRules); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteNetworkPeerRules: %w", err)
+	}
+	if q.deleteOldDenialsStmt, err = db.PrepareContext(ctx, deleteOldDenials); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteOldDenials: %w", err)
+	}
+	if q.deleteOldLearnedFlowsStmt, err = db.PrepareContext(ctx, deleteOldLearnedFlows); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteOldLearnedFlows: %w", err)
+	}
+	if q.deleteSelectorRulesStmt, err = db.PrepareContext(ctx, deleteSelectorRules); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteSelectorRules: %w", err)
+	}
 	if q.deleteWaitingContainerRulesStmt, err = db.PrepareContext(ctx, deleteWaitingContainerRules); err != nil {
 		return nil, fmt.Errorf("error preparing query DeleteWaitingContainerRules: %w", err)
 	}
+	if q.deleteWaitingInputRulesStmt, err = db.PrepareContext(ctx, deleteWaitingInputRules); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteWaitingInputRules: %w", err)
+	}
 	if q.getContainerAddrsStmt, err = db.PrepareContext(ctx, getContainerAddrs); err != nil {
 		return nil, fmt.Errorf("error preparing query GetContainerAddrs: %w", err)
 	}
@@ -69,15 +99,33 @@ func Prepare(ctx context.Context, db DBTX) (*Queries, error) {
 	if q.getContainerNameStmt, err = db.PrepareContext(ctx, getContainerName); err != nil {
 		return nil, fmt.Errorf("error preparing query GetContainerName: %w", err)
 	}
+	if q.getContainerNameAndNetworkFromAddrStmt, err = db.PrepareContext(ctx, getContainerNameAndNetworkFromAddr); err != nil {
+		return nil, fmt.Errorf("error preparing query GetContainerNameAndNetworkFromAddr: %w", err)
+	}
 	if q.getContainersStmt, err = db.PrepareContext(ctx, getContainers); err != nil {
 		return nil, fmt.Errorf("error preparing query GetContainers: %w", err)
 	}
+	if q.getDenialsStmt, err = db.PrepareContext(ctx, getDenials); err != nil {
+		return nil, fmt.Errorf("error preparing query GetDenials: %w", err)
+	}
 	if q.getEstContainersStmt, err = db.PrepareContext(ctx, getEstContainers); err != nil {
 		return nil, fmt.Errorf("error preparing query GetEstContainers: %w", err)
 	}
+	if q.getLearnedFlowsStmt, err = db.PrepareContext(ctx, getLearnedFlows); err != nil {
+		return nil, fmt.Errorf("error preparing query GetLearnedFlows: %w", err)
+	}
+	if q.getNetworkPeerRulesStmt, err = db.PrepareContext(ctx, getNetworkPeerRules); err != nil {
+		return nil, fmt.Errorf("error preparing query GetNetworkPeerRules: %w", err)
+	}
+	if q.getSelectorRulesStmt, err = db.PrepareContext(ctx, getSelectorRules); err != nil {
+		return nil, fmt.Errorf("error preparing query GetSelectorRules: %w", err)
+	}
 	if q.getWaitingContainerRulesStmt, err = db.PrepareContext(ctx, getWaitingContainerRules); err != nil {
 		return nil, fmt.Errorf("error preparing query GetWaitingContainerRules: %w", err)
 	}
+	if q.getWaitingInputRulesStmt, err = db.PrepareContext(ctx, getWaitingInputRules); err != nil {
+		return nil, fmt.Errorf("error preparing query GetWaitingInputRules: %w", err)
+	}
 	return &q, nil
 }
 
@@ -98,16 +146,41 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing addContainerAliasStmt: %w", cerr)
 		}
 	}
+	if q.addDenialStmt != nil {
+		if cerr := q.addDenialStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing addDenialStmt: %w", cerr)
+		}
+	}
 	if q.addEstContainerStmt != nil {
 		if cerr := q.addEstContainerStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing addEstContainerStmt: %w", cerr)
 		}
 	}
+	if q.addLearnedFlowStmt != nil {
+		if cerr := q.addLearnedFlowStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing addLearnedFlowStmt: %w", cerr)
+		}
+	}
+	if q.addNetworkPeerRuleStmt != nil {
+		if cerr := q.addNetworkPeerRuleStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing addNetworkPeerRuleStmt: %w", cerr)
+		}
+	}
+	if q.addSelectorRuleStmt != nil {
+		if cerr := q.addSelectorRuleStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing addSelectorRuleStmt: %w", cerr)
+		}
+	}
 	if q.addWaitingContainerRuleStmt != nil {
 		if cerr := q.addWaitingContainerRuleStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing addWaitingContainerRuleStmt: %w", cerr)
 		}
 	}
+	if q.addWaitingInputRuleStmt != nil {
+		if cerr := q.addWaitingInputRuleStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing addWaitingInputRuleStmt: %w", cerr)
+		}
+	}
 	if q.containerExistsStmt != nil {
 		if cerr := q.containerExistsStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing containerExistsStmt: %w", cerr)
@@ -133,11 +206,36 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing deleteEstContainersStmt: %w", cerr)
 		}
 	}
+	if q.deleteNetworkPeerRulesStmt != nil {
+		if cerr := q.deleteNetworkPeerRulesStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteNetworkPeerRulesStmt: %w", cerr)
+		}
+	}
+	if q.deleteOldDenialsStmt != nil {
+		if cerr := q.deleteOldDenialsStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteOldDenialsStmt: %w", cerr)
+		}
+	}
+	if q.deleteOldLearnedFlowsStmt != nil {
+		if cerr := q.deleteOldLearnedFlowsStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteOldLearnedFlowsStmt: %w", cerr)
+		}
+	}
+	if q.deleteSelectorRulesStmt != nil {
+		if cerr := q.deleteSelectorRulesStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteSelectorRulesStmt: %w", cerr)
+		}
+	}
 	if q.deleteWaitingContainerRulesStmt != nil {
 		if cerr := q.deleteWaitingContainerRulesStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing deleteWaitingContainerRulesStmt: %w", cerr)
 		}
 	}
+	if q.deleteWaitingInputRulesStmt != nil {
+		if cerr := q.deleteWaitingInputRulesStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteWaitingInputRulesStmt: %w", cerr)
+		}
+	}
 	if q.getContainerAddrsStmt != nil {
 		if cerr := q.getContainerAddrsStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing getContainerAddrsStmt: %w", cerr)
@@ -158,21 +256,51 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing getContainerNameStmt: %w", cerr)
 		}
 	}
+	if q.getContainerNameAndNetworkFromAddrStmt != nil {
+		if cerr := q.getContainerNameAndNetworkFromAddrStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getContainerNameAndNetworkFromAddrStmt: %w", cerr)
+		}
+	}
 	if q.getContainersStmt != nil {
 		if cerr := q.getContainersStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing getContainersStmt: %w", cerr)
 		}
 	}
+	if q.getDenialsStmt != nil {
+		if cerr := q.getDenialsStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getDenialsStmt: %w", cerr)
+		}
+	}
 	if q.getEstContainersStmt != nil {
 		if cerr := q.getEstContainersStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing getEstContainersStmt: %w", cerr)
 		}
 	}
+	if q.getLearnedFlowsStmt != nil {
+		if cerr := q.getLearnedFlowsStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getLearnedFlowsStmt: %w", cerr)
+		}
+	}
+	if q.getNetworkPeerRulesStmt != nil {
+		if cerr := q.getNetworkPeerRulesStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getNetworkPeerRulesStmt: %w", cerr)
+		}
+	}
+	if q.getSelectorRulesStmt != nil {
+		if cerr := q.getSelectorRulesStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getSelectorRulesStmt: %w", cerr)
+		}
+	}
 	if q.getWaitingContainerRulesStmt != nil {
 		if cerr := q.getWaitingContainerRulesStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing getWaitingContainerRulesStmt: %w", cerr)
 		}
 	}
+	if q.getWaitingInputRulesStmt != nil {
+		if cerr := q.getWaitingInputRulesStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing getWaitingInputRulesStmt: %w", cerr)
+		}
+	}
 	return err
 }
 
@@ -210,49 +338,81 @@ func (q *Queries) queryRow(ctx context.Context, stmt *sql.Stmt, query string, ar
 }
 
 type Queries struct {
-	db                                 DBTX
-	tx                                 *sql.Tx
-	addContainerStmt                   *sql.Stmt
-	addContainerAddrStmt               *sql.Stmt
-	addContainerAliasStmt              *sql.Stmt
-	addEstContainerStmt                *sql.Stmt
-	addWaitingContainerRuleStmt        *sql.Stmt
-	containerExistsStmt                *sql.Stmt
-	deleteContainerStmt                *sql.Stmt
-	deleteContainerAddrsStmt           *sql.Stmt
-	deleteContainerAliasesStmt         *sql.Stmt
-	deleteEstContainersStmt            *sql.Stmt
-	deleteWaitingContainerRulesStmt    *sql.Stmt
-	getContainerAddrsStmt              *sql.Stmt
-	getContainerIDStmt                 *sql.Stmt
-	getContainerIDAndNameFromAliasStmt *sql.Stmt
-	getContainerNameStmt               *sql.Stmt
-	getContainersStmt                  *sql.Stmt
-	getEstContainersStmt               *sql.Stmt
-	getWaitingContainerRulesStmt       *sql.Stmt
+	db                                     DBTX
+	tx                                     *sql.Tx
+	addContainerStmt                       *sql.Stmt
+	addContainerAddrStmt                   *sql.Stmt
+	addContainerAliasStmt                  *sql.Stmt
+	addDenialStmt                          *sql.Stmt
+	addEstContainerStmt                    *sql.Stmt
+	addLearnedFlowStmt                     *sql.Stmt
+	addNetworkPeerRuleStmt                 *sql.Stmt
+	addSelectorRuleStmt                    *sql.Stmt
+	addWaitingContainerRuleStmt            *sql.Stmt
+	addWaitingInputRuleStmt                *sql.Stmt
+	containerExistsStmt                    *sql.Stmt
+	deleteContainerStmt                    *sql.Stmt
+	deleteContainerAddrsStmt               *sql.Stmt
+	deleteContainerAliasesStmt             *sql.Stmt
+	deleteEstContainersStmt                *sql.Stmt
+	deleteNetworkPeerRulesStmt             *sql.Stmt
+	deleteOldDenialsStmt                   *sql.Stmt
+	deleteOldLearnedFlowsStmt              *sql.Stmt
+	deleteSelectorRulesStmt                *sql.Stmt
+	deleteWaitingContainerRulesStmt        *sql.Stmt
+	deleteWaitingInputRulesStmt            *sql.Stmt
+	getContainerAddrsStmt                  *sql.Stmt
+	getContainerIDStmt                     *sql.Stmt
+	getContainerIDAndNameFromAliasStmt     *sql.Stmt
+	getContainerNameStmt                   *sql.Stmt
+	getContainerNameAndNetworkFromAddrStmt *sql.Stmt
+	getContainersStmt                      *sql.Stmt
+	getDenialsStmt                         *sql.Stmt
+	getEstContainersStmt                   *sql.Stmt
+	getLearnedFlowsStmt                    *sql.Stmt
+	getNetworkPeerRulesStmt                *sql.Stmt
+	getSelectorRulesStmt                   *sql.Stmt
+	getWaitingContainerRulesStmt           *sql.Stmt
+	getWaitingInputRulesStmt               *sql.Stmt
 }
 
 func (q *Queries) WithTx(tx *sql.Tx) *Queries {
 	return &Queries{
-		db:                                 tx,
-		tx:                                 tx,
-		addContainerStmt:                   q.addContainerStmt,
-		addContainerAddrStmt:               q.addContainerAddrStmt,
-		addContainerAliasStmt:              q.addContainerAliasStmt,
-		addEstContainerStmt:                q.addEstContainerStmt,
-		addWaitingContainerRuleStmt:        q.addWaitingContainerRuleStmt,
-		containerExistsStmt:                q.containerExistsStmt,
-		deleteContainerStmt:                q.deleteContainerStmt,
-		deleteContainerAddrsStmt:           q.deleteContainerAddrsStmt,
-		deleteContainerAliasesStmt:         q.deleteContainerAliasesStmt,
-		deleteEstContainersStmt:            q.deleteEstContainersStmt,
-		deleteWaitingContainerRulesStmt:    q.deleteWaitingContainerRulesStmt,
-		getContainerAddrsStmt:              q.getContainerAddrsStmt,
-		getContainerIDStmt:                 q.getContainerIDStmt,
-		getContainerIDAndNameFromAliasStmt: q.getContainerIDAndNameFromAliasStmt,
-		getContainerNameStmt:               q.getContainerNameStmt,
-		getContainersStmt:                  q.getContainersStmt,
-		getEstContainersStmt:               q.getEstContainersStmt,
-		getWaitingContainerRulesStmt:       q.getWaitingContainerRulesStmt,
+		db:                                     tx,
+		tx:                                     tx,
+		addContainerStmt:                       q.addContainerStmt,
+		addContainerAddrStmt:                   q.addContainerAddrStmt,
+		addContainerAliasStmt:                  q.addContainerAliasStmt,
+		addDenialStmt:                          q.addDenialStmt,
+		addEstContainerStmt:                    q.addEstContainerStmt,
+		addLearnedFlowStmt:                     q.addLearnedFlowStmt,
+		addNetworkPeerRuleStmt:                 q.addNetworkPeerRuleStmt,
+		addSelectorRuleStmt:                    q.addSelectorRuleStmt,
+		addWaitingContainerRuleStmt:            q.addWaitingContainerRuleStmt,
+		addWaitingInputRuleStmt:                q.addWaitingInputRuleStmt,
+		containerExistsStmt:                    q.containerExistsStmt,
+		deleteContainerStmt:                    q.deleteContainerStmt,
+		deleteContainerAddrsStmt:               q.deleteContainerAddrsStmt,
+		deleteContainerAliasesStmt:             q.deleteContainerAliasesStmt,
+		deleteEstContainersStmt:                q.deleteEstContainersStmt,
+		deleteNetworkPeerRulesStmt:             q.deleteNetworkPeerRulesStmt,
+		deleteOldDenialsStmt:                   q.deleteOldDenialsStmt,
+		deleteOldLearnedFlowsStmt:              q.deleteOldLearnedFlowsStmt,
+		deleteSelectorRulesStmt:                q.deleteSelectorRulesStmt,
+		deleteWaitingContainerRulesStmt:        q.deleteWaitingContainerRulesStmt,
+		deleteWaitingInputRulesStmt:            q.deleteWaitingInputRulesStmt,
+		getContainerAddrsStmt:                  q.getContainerAddrsStmt,
+		getContainerIDStmt:                     q.getContainerIDStmt,
+		getContainerIDAndNameFromAliasStmt:     q.getContainerIDAndNameFromAliasStmt,
+		getContainerNameStmt:                   q.getContainerNameStmt,
+		getContainerNameAndNetworkFromAddrStmt: q.getContainerNameAndNetworkFromAddrStmt,
+		getContainersStmt:                      q.getContainersStmt,
+		getDenialsStmt:                         q.getDenialsStmt,
+		getEstContainersStmt:                   q.getEstContainersStmt,
+		getLearnedFlowsStmt:                    q.getLearnedFlowsStmt,
+		getNetworkPeerRulesStmt:                q.getNetworkPeerRulesStmt,
+		getSelectorRulesStmt:                   q.getSelectorRulesStmt,
+		getWaitingContainerRulesStmt:           q.getWaitingContainerRulesStmt,
+		getWaitingInputRulesStmt:               q.getWaitingInputRulesStmt,
 	}
 }
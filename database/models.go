@@ -9,6 +9,7 @@ import ()
 type Addr struct {
 	Addr        []byte
 	ContainerID string
+	NetworkName string
 }
 
 type Container struct {
@@ -21,13 +22,59 @@ type ContainerAlias struct {
 	ContainerAlias string
 }
 
+type Denial struct {
+	ContainerName string
+	Direction     string
+	Addr          []byte
+	Proto         int64
+	Port          int64
+	Count         int64
+	FirstSeen     int64
+	LastSeen      int64
+}
+
 type EstContainer struct {
 	SrcContainerID string
 	DstContainerID string
 }
 
+type LearnedFlow struct {
+	ContainerName string
+	Direction     string
+	Addr          []byte
+	Proto         int64
+	Port          int64
+	Localhost     int64
+	PeerContainer string
+	PeerNetwork   string
+	Count         int64
+	FirstSeen     int64
+	LastSeen      int64
+}
+
+type NetworkPeerRule struct {
+	SrcContainerID string
+	NetworkName    string
+	Addr           []byte
+	Rule           []byte
+}
+
+type SelectorRule struct {
+	SrcContainerID string
+	SetName        string
+	Inbound        int64
+	Addr           []byte
+	Rule           []byte
+}
+
 type WaitingContainerRule struct {
 	SrcContainerID   string
 	DstContainerName string
 	Rule             []byte
 }
+
+type WaitingInputRule struct {
+	DstContainerID   string
+	SrcContainerName string
+	Rule             []byte
+}
@@ -10,23 +10,39 @@ import (
 
 type Querier interface {
 	AddContainer(ctx context.Context, iD string, name string) error
-	AddContainerAddr(ctx context.Context, addr []byte, containerID string) error
+	AddContainerAddr(ctx context.Context, arg AddContainerAddrParams) error
 	AddContainerAlias(ctx context.Context, containerID string, containerAlias string) error
+	AddDenial(ctx context.Context, arg AddDenialParams) error
 	AddEstContainer(ctx context.Context, srcContainerID string, dstContainerID string) error
+	AddLearnedFlow(ctx context.Context, arg AddLearnedFlowParams) error
+	AddNetworkPeerRule(ctx context.Context, arg AddNetworkPeerRuleParams) error
+	AddSelectorRule(ctx context.Context, arg AddSelectorRuleParams) error
 	AddWaitingContainerRule(ctx context.Context, arg AddWaitingContainerRuleParams) error
+	AddWaitingInputRule(ctx context.Context, arg AddWaitingInputRuleParams) error
 	ContainerExists(ctx context.Context, id string) (int64, error)
 	DeleteContainer(ctx context.Context, id string) error
 	DeleteContainerAddrs(ctx context.Context, containerID string) error
 	DeleteContainerAliases(ctx context.Context, containerID string) error
 	DeleteEstContainers(ctx context.Context, srcContainerID string, dstContainerID string) error
+	DeleteNetworkPeerRules(ctx context.Context, srcContainerID string) error
+	DeleteOldDenials(ctx context.Context, n int64) error
+	DeleteOldLearnedFlows(ctx context.Context, n int64) error
+	DeleteSelectorRules(ctx context.Context, srcContainerID string) error
 	DeleteWaitingContainerRules(ctx context.Context, srcContainerID string) error
+	DeleteWaitingInputRules(ctx context.Context, dstContainerID string) error
 	GetContainerAddrs(ctx context.Context, containerID string) ([][]byte, error)
 	GetContainerID(ctx context.Context, name string) (string, error)
 	GetContainerIDAndNameFromAlias(ctx context.Context, containerAlias string) (Container, error)
 	GetContainerName(ctx context.Context, id string) (string, error)
+	GetContainerNameAndNetworkFromAddr(ctx context.Context, addr []byte) (GetContainerNameAndNetworkFromAddrRow, error)
 	GetContainers(ctx context.Context) ([]Container, error)
+	GetDenials(ctx context.Context, containerName string) ([]GetDenialsRow, error)
 	GetEstContainers(ctx context.Context, srcContainerID string) ([]GetEstContainersRow, error)
+	GetLearnedFlows(ctx context.Context, containerName string) ([]GetLearnedFlowsRow, error)
+	GetNetworkPeerRules(ctx context.Context, networkName string) ([]GetNetworkPeerRulesRow, error)
+	GetSelectorRules(ctx context.Context) ([]GetSelectorRulesRow, error)
 	GetWaitingContainerRules(ctx context.Context, dstContainerName string) ([]GetWaitingContainerRulesRow, error)
+	GetWaitingInputRules(ctx context.Context, srcContainerName string) ([]GetWaitingInputRulesRow, error)
 }
 
 var _ Querier = (*Queries)(nil)
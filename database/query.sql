@@ -9,9 +9,10 @@ VALUES
 
 -- name: AddContainerAddr :exec
 INSERT INTO
-	addrs(addr, container_id)
+	addrs(addr, container_id, network_name)
 VALUES
 	(
+		?,
 		?,
 		?
 	);
@@ -25,6 +26,34 @@ VALUES
 		?
 	);
 
+-- name: AddDenial :exec
+INSERT INTO
+	denials
+	(
+		container_name,
+		direction,
+		addr,
+		proto,
+		port,
+		count,
+		first_seen,
+		last_seen
+	)
+VALUES
+	(
+		?,
+		?,
+		?,
+		?,
+		?,
+		1,
+		?,
+		?
+	)
+ON CONFLICT(container_name, direction, addr, proto, port) DO UPDATE SET
+	count = count + 1,
+	last_seen = excluded.last_seen;
+
 -- name: AddEstContainer :exec
 INSERT INTO
 	est_containers(src_container_id, dst_container_id)
@@ -32,7 +61,82 @@ VALUES
 	(
 		?,
 		?
-	);
+	)
+ON CONFLICT(src_container_id, dst_container_id) DO NOTHING;
+
+-- name: AddLearnedFlow :exec
+INSERT INTO
+	learned_flows
+	(
+		container_name,
+		direction,
+		addr,
+		proto,
+		port,
+		localhost,
+		peer_container,
+		peer_network,
+		count,
+		first_seen,
+		last_seen
+	)
+VALUES
+	(
+		?,
+		?,
+		?,
+		?,
+		?,
+		?,
+		?,
+		?,
+		1,
+		?,
+		?
+	)
+ON CONFLICT(container_name, direction, addr, proto, port) DO UPDATE SET
+	peer_container = excluded.peer_container,
+	peer_network = excluded.peer_network,
+	count = count + 1,
+	last_seen = excluded.last_seen;
+
+-- name: AddNetworkPeerRule :exec
+INSERT INTO
+	network_peer_rules
+	(
+		src_container_id,
+		network_name,
+		addr,
+		rule
+	)
+VALUES
+	(
+		?,
+		?,
+		?,
+		?
+	)
+ON CONFLICT(src_container_id, network_name, rule) DO NOTHING;
+
+-- name: AddSelectorRule :exec
+INSERT INTO
+	selector_rules
+	(
+		src_container_id,
+		set_name,
+		inbound,
+		addr,
+		rule
+	)
+VALUES
+	(
+		?,
+		?,
+		?,
+		?,
+		?
+	)
+ON CONFLICT(src_container_id, set_name) DO NOTHING;
 
 -- name: AddWaitingContainerRule :exec
 INSERT INTO
@@ -50,6 +154,22 @@ VALUES
 	)
 ON CONFLICT(src_container_id, dst_container_name, rule) DO NOTHING;
 
+-- name: AddWaitingInputRule :exec
+INSERT INTO
+	waiting_input_rules
+	(
+		dst_container_id,
+		src_container_name,
+		rule
+	)
+VALUES
+	(
+		?,
+		?,
+		?
+	)
+ON CONFLICT(dst_container_id, src_container_name, rule) DO NOTHING;
+
 -- name: ContainerExists :one
 SELECT
 	EXISTS (
@@ -86,12 +206,74 @@ WHERE
 	src_container_id = ? OR
 	dst_container_id = ?;
 
+-- name: DeleteNetworkPeerRules :exec
+DELETE FROM
+	network_peer_rules
+WHERE
+	src_container_id = ?;
+
+-- name: DeleteOldDenials :exec
+DELETE FROM
+	denials
+WHERE
+	rowid IN (
+		SELECT
+			id
+		FROM
+			(
+				SELECT
+					rowid AS id,
+					ROW_NUMBER() OVER (
+						PARTITION BY container_name
+						ORDER BY last_seen DESC
+					) AS n
+				FROM
+					denials
+			)
+		WHERE
+			n > ?
+	);
+
+-- name: DeleteOldLearnedFlows :exec
+DELETE FROM
+	learned_flows
+WHERE
+	rowid IN (
+		SELECT
+			id
+		FROM
+			(
+				SELECT
+					rowid AS id,
+					ROW_NUMBER() OVER (
+						PARTITION BY container_name
+						ORDER BY last_seen DESC
+					) AS n
+				FROM
+					learned_flows
+			)
+		WHERE
+			n > ?
+	);
+
+-- name: DeleteSelectorRules :exec
+DELETE FROM
+	selector_rules
+WHERE
+	src_container_id = ?;
+
 -- name: DeleteWaitingContainerRules :exec
 DELETE FROM
 	waiting_container_rules
 WHERE
 	src_container_id = ?;
 
+-- name: DeleteWaitingInputRules :exec
+DELETE FROM
+	waiting_input_rules
+WHERE
+	dst_container_id = ?;
+
 -- name: GetContainerAddrs :many
 SELECT 
 	addr
@@ -116,6 +298,19 @@ FROM
 WHERE
 	id = ?;
 
+-- name: GetContainerNameAndNetworkFromAddr :one
+SELECT
+	c.name,
+	a.network_name
+FROM
+	containers c
+JOIN
+	addrs a
+ON
+	a.container_id = c.id
+WHERE
+	a.addr = ?;
+
 -- name: GetContainerIDAndNameFromAlias :one
 SELECT
 	c.id,
@@ -136,6 +331,22 @@ SELECT
 FROM
 	containers;
 
+-- name: GetDenials :many
+SELECT
+	direction,
+	addr,
+	proto,
+	port,
+	count,
+	first_seen,
+	last_seen
+FROM
+	denials
+WHERE
+	container_name = ?
+ORDER BY
+	last_seen DESC;
+
 -- name: GetEstContainers :many
 SELECT
 	e.dst_container_id,
@@ -149,6 +360,53 @@ ON
 WHERE
 	e.src_container_id = ?;
 
+-- name: GetLearnedFlows :many
+SELECT
+	direction,
+	addr,
+	proto,
+	port,
+	localhost,
+	peer_container,
+	peer_network,
+	count,
+	first_seen,
+	last_seen
+FROM
+	learned_flows
+WHERE
+	container_name = ?;
+
+-- name: GetNetworkPeerRules :many
+SELECT
+	n.src_container_id,
+	c.name,
+	n.addr,
+	n.rule
+FROM
+	network_peer_rules n
+JOIN
+	containers c
+ON
+	c.id = n.src_container_id
+WHERE
+	n.network_name = ?;
+
+-- name: GetSelectorRules :many
+SELECT
+	s.src_container_id,
+	c.name,
+	s.set_name,
+	s.inbound,
+	s.addr,
+	s.rule
+FROM
+	selector_rules s
+JOIN
+	containers c
+ON
+	c.id = s.src_container_id;
+
 -- name: GetWaitingContainerRules :many
 SELECT
 	w.src_container_id,
@@ -162,3 +420,17 @@ ON
 	c.id = w.src_container_id
 WHERE
 	w.dst_container_name = ?;
+
+-- name: GetWaitingInputRules :many
+SELECT
+	w.dst_container_id,
+	c.name,
+	w.rule
+FROM
+	waiting_input_rules w
+JOIN
+	containers c
+ON
+	c.id = w.dst_container_id
+WHERE
+	w.src_container_name = ?;
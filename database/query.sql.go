@@ -26,16 +26,23 @@ func (q *Queries) AddContainer(ctx context.Context, iD string, name string) erro
 
 const addContainerAddr = `-- name: AddContainerAddr :exec
 INSERT INTO
-	addrs(addr, container_id)
+	addrs(addr, container_id, network_name)
 VALUES
 	(
+		?,
 		?,
 		?
 	)
 `
 
-func (q *Queries) AddContainerAddr(ctx context.Context, addr []byte, containerID string) error {
-	_, err := q.exec(ctx, q.addContainerAddrStmt, addContainerAddr, addr, containerID)
+type AddContainerAddrParams struct {
+	Addr        []byte
+	ContainerID string
+	NetworkName string
+}
+
+func (q *Queries) AddContainerAddr(ctx context.Context, arg AddContainerAddrParams) error {
+	_, err := q.exec(ctx, q.addContainerAddrStmt, addContainerAddr, arg.Addr, arg.ContainerID, arg.NetworkName)
 	return err
 }
 
@@ -54,6 +61,58 @@ func (q *Queries) AddContainerAlias(ctx context.Context, containerID string, con
 	return err
 }
 
+const addDenial = `-- name: AddDenial :exec
+INSERT INTO
+	denials
+	(
+		container_name,
+		direction,
+		addr,
+		proto,
+		port,
+		count,
+		first_seen,
+		last_seen
+	)
+VALUES
+	(
+		?,
+		?,
+		?,
+		?,
+		?,
+		1,
+		?,
+		?
+	)
+ON CONFLICT(container_name, direction, addr, proto, port) DO UPDATE SET
+	count = count + 1,
+	last_seen = excluded.last_seen
+`
+
+type AddDenialParams struct {
+	ContainerName string
+	Direction     string
+	Addr          []byte
+	Proto         int64
+	Port          int64
+	FirstSeen     int64
+	LastSeen      int64
+}
+
+func (q *Queries) AddDenial(ctx context.Context, arg AddDenialParams) error {
+	_, err := q.exec(ctx, q.addDenialStmt, addDenial,
+		arg.ContainerName,
+		arg.Direction,
+		arg.Addr,
+		arg.Proto,
+		arg.Port,
+		arg.FirstSeen,
+		arg.LastSeen,
+	)
+	return err
+}
+
 const addEstContainer = `-- name: AddEstContainer :exec
 INSERT INTO
 	est_containers(src_container_id, dst_container_id)
@@ -62,6 +121,7 @@ VALUES
 		?,
 		?
 	)
+ON CONFLICT(src_container_id, dst_container_id) DO NOTHING
 `
 
 func (q *Queries) AddEstContainer(ctx context.Context, srcContainerID string, dstContainerID string) error {
@@ -69,6 +129,148 @@ func (q *Queries) AddEstContainer(ctx context.Context, srcContainerID string, ds
 	return err
 }
 
+const addLearnedFlow = `-- name: AddLearnedFlow :exec
+INSERT INTO
+	learned_flows
+	(
+		container_name,
+		direction,
+		addr,
+		proto,
+		port,
+		localhost,
+		peer_container,
+		peer_network,
+		count,
+		first_seen,
+		last_seen
+	)
+VALUES
+	(
+		?,
+		?,
+		?,
+		?,
+		?,
+		?,
+		?,
+		?,
+		1,
+		?,
+		?
+	)
+ON CONFLICT(container_name, direction, addr, proto, port) DO UPDATE SET
+	peer_container = excluded.peer_container,
+	peer_network = excluded.peer_network,
+	count = count + 1,
+	last_seen = excluded.last_seen
+`
+
+type AddLearnedFlowParams struct {
+	ContainerName string
+	Direction     string
+	Addr          []byte
+	Proto         int64
+	Port          int64
+	Localhost     int64
+	PeerContainer string
+	PeerNetwork   string
+	FirstSeen     int64
+	LastSeen      int64
+}
+
+func (q *Queries) AddLearnedFlow(ctx context.Context, arg AddLearnedFlowParams) error {
+	_, err := q.exec(ctx, q.addLearnedFlowStmt, addLearnedFlow,
+		arg.ContainerName,
+		arg.Direction,
+		arg.Addr,
+		arg.Proto,
+		arg.Port,
+		arg.Localhost,
+		arg.PeerContainer,
+		arg.PeerNetwork,
+		arg.FirstSeen,
+		arg.LastSeen,
+	)
+	return err
+}
+
+const addNetworkPeerRule = `-- name: AddNetworkPeerRule :exec
+INSERT INTO
+	network_peer_rules
+	(
+		src_container_id,
+		network_name,
+		addr,
+		rule
+	)
+VALUES
+	(
+		?,
+		?,
+		?,
+		?
+	)
+ON CONFLICT(src_container_id, network_name, rule) DO NOTHING
+`
+
+type AddNetworkPeerRuleParams struct {
+	SrcContainerID string
+	NetworkName    string
+	Addr           []byte
+	Rule           []byte
+}
+
+func (q *Queries) AddNetworkPeerRule(ctx context.Context, arg AddNetworkPeerRuleParams) error {
+	_, err := q.exec(ctx, q.addNetworkPeerRuleStmt, addNetworkPeerRule,
+		arg.SrcContainerID,
+		arg.NetworkName,
+		arg.Addr,
+		arg.Rule,
+	)
+	return err
+}
+
+const addSelectorRule = `-- name: AddSelectorRule :exec
+INSERT INTO
+	selector_rules
+	(
+		src_container_id,
+		set_name,
+		inbound,
+		addr,
+		rule
+	)
+VALUES
+	(
+		?,
+		?,
+		?,
+		?,
+		?
+	)
+ON CONFLICT(src_container_id, set_name) DO NOTHING
+`
+
+type AddSelectorRuleParams struct {
+	SrcContainerID string
+	SetName        string
+	Inbound        int64
+	Addr           []byte
+	Rule           []byte
+}
+
+func (q *Queries) AddSelectorRule(ctx context.Context, arg AddSelectorRuleParams) error {
+	_, err := q.exec(ctx, q.addSelectorRuleStmt, addSelectorRule,
+		arg.SrcContainerID,
+		arg.SetName,
+		arg.Inbound,
+		arg.Addr,
+		arg.Rule,
+	)
+	return err
+}
+
 const addWaitingContainerRule = `-- name: AddWaitingContainerRule :exec
 INSERT INTO
 	waiting_container_rules
@@ -97,6 +299,34 @@ func (q *Queries) AddWaitingContainerRule(ctx context.Context, arg AddWaitingCon
 	return err
 }
 
+const addWaitingInputRule = `-- name: AddWaitingInputRule :exec
+INSERT INTO
+	waiting_input_rules
+	(
+		dst_container_id,
+		src_container_name,
+		rule
+	)
+VALUES
+	(
+		?,
+		?,
+		?
+	)
+ON CONFLICT(dst_container_id, src_container_name, rule) DO NOTHING
+`
+
+type AddWaitingInputRuleParams struct {
+	DstContainerID   string
+	SrcContainerName string
+	Rule             []byte
+}
+
+func (q *Queries) AddWaitingInputRule(ctx context.Context, arg AddWaitingInputRuleParams) error {
+	_, err := q.exec(ctx, q.addWaitingInputRuleStmt, addWaitingInputRule, arg.DstContainerID, arg.SrcContainerName, arg.Rule)
+	return err
+}
+
 const containerExists = `-- name: ContainerExists :one
 SELECT
 	EXISTS (
@@ -165,6 +395,86 @@ func (q *Queries) DeleteEstContainers(ctx context.Context, srcContainerID string
 	return err
 }
 
+const deleteNetworkPeerRules = `-- name: DeleteNetworkPeerRules :exec
+DELETE FROM
+	network_peer_rules
+WHERE
+	src_container_id = ?
+`
+
+func (q *Queries) DeleteNetworkPeerRules(ctx context.Context, srcContainerID string) error {
+	_, err := q.exec(ctx, q.deleteNetworkPeerRulesStmt, deleteNetworkPeerRules, srcContainerID)
+	return err
+}
+
+const deleteOldDenials = `-- name: DeleteOldDenials :exec
+DELETE FROM
+	denials
+WHERE
+	rowid IN (
+		SELECT
+			id
+		FROM
+			(
+				SELECT
+					rowid AS id,
+					ROW_NUMBER() OVER (
+						PARTITION BY container_name
+						ORDER BY last_seen DESC
+					) AS n
+				FROM
+					denials
+			)
+		WHERE
+			n > ?
+	)
+`
+
+func (q *Queries) DeleteOldDenials(ctx context.Context, n int64) error {
+	_, err := q.exec(ctx, q.deleteOldDenialsStmt, deleteOldDenials, n)
+	return err
+}
+
+const deleteOldLearnedFlows = `-- name: DeleteOldLearnedFlows :exec
+DELETE FROM
+	learned_flows
+WHERE
+	rowid IN (
+		SELECT
+			id
+		FROM
+			(
+				SELECT
+					rowid AS id,
+					ROW_NUMBER() OVER (
+						PARTITION BY container_name
+						ORDER BY last_seen DESC
+					) AS n
+				FROM
+					learned_flows
+			)
+		WHERE
+			n > ?
+	)
+`
+
+func (q *Queries) DeleteOldLearnedFlows(ctx context.Context, n int64) error {
+	_, err := q.exec(ctx, q.deleteOldLearnedFlowsStmt, deleteOldLearnedFlows, n)
+	return err
+}
+
+const deleteSelectorRules = `-- name: DeleteSelectorRules :exec
+DELETE FROM
+	selector_rules
+WHERE
+	src_container_id = ?
+`
+
+func (q *Queries) DeleteSelectorRules(ctx context.Context, srcContainerID string) error {
+	_, err := q.exec(ctx, q.deleteSelectorRulesStmt, deleteSelectorRules, srcContainerID)
+	return err
+}
+
 const deleteWaitingContainerRules = `-- name: DeleteWaitingContainerRules :exec
 DELETE FROM
 	waiting_container_rules
@@ -177,6 +487,18 @@ func (q *Queries) DeleteWaitingContainerRules(ctx context.Context, srcContainerI
 	return err
 }
 
+const deleteWaitingInputRules = `-- name: DeleteWaitingInputRules :exec
+DELETE FROM
+	waiting_input_rules
+WHERE
+	dst_container_id = ?
+`
+
+func (q *Queries) DeleteWaitingInputRules(ctx context.Context, dstContainerID string) error {
+	_, err := q.exec(ctx, q.deleteWaitingInputRulesStmt, deleteWaitingInputRules, dstContainerID)
+	return err
+}
+
 const getContainerAddrs = `-- name: GetContainerAddrs :many
 SELECT 
 	addr
@@ -262,6 +584,32 @@ func (q *Queries) GetContainerName(ctx context.Context, id string) (string, erro
 	return name, err
 }
 
+const getContainerNameAndNetworkFromAddr = `-- name: GetContainerNameAndNetworkFromAddr :one
+SELECT
+	c.name,
+	a.network_name
+FROM
+	containers c
+JOIN
+	addrs a
+ON
+	a.container_id = c.id
+WHERE
+	a.addr = ?
+`
+
+type GetContainerNameAndNetworkFromAddrRow struct {
+	Name        string
+	NetworkName string
+}
+
+func (q *Queries) GetContainerNameAndNetworkFromAddr(ctx context.Context, addr []byte) (GetContainerNameAndNetworkFromAddrRow, error) {
+	row := q.queryRow(ctx, q.getContainerNameAndNetworkFromAddrStmt, getContainerNameAndNetworkFromAddr, addr)
+	var i GetContainerNameAndNetworkFromAddrRow
+	err := row.Scan(&i.Name, &i.NetworkName)
+	return i, err
+}
+
 const getContainers = `-- name: GetContainers :many
 SELECT 
 	id,
@@ -293,6 +641,64 @@ func (q *Queries) GetContainers(ctx context.Context) ([]Container, error) {
 	return items, nil
 }
 
+const getDenials = `-- name: GetDenials :many
+SELECT
+	direction,
+	addr,
+	proto,
+	port,
+	count,
+	first_seen,
+	last_seen
+FROM
+	denials
+WHERE
+	container_name = ?
+ORDER BY
+	last_seen DESC
+`
+
+type GetDenialsRow struct {
+	Direction string
+	Addr      []byte
+	Proto     int64
+	Port      int64
+	Count     int64
+	FirstSeen int64
+	LastSeen  int64
+}
+
+func (q *Queries) GetDenials(ctx context.Context, containerName string) ([]GetDenialsRow, error) {
+	rows, err := q.query(ctx, q.getDenialsStmt, getDenials, containerName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetDenialsRow
+	for rows.Next() {
+		var i GetDenialsRow
+		if err := rows.Scan(
+			&i.Direction,
+			&i.Addr,
+			&i.Proto,
+			&i.Port,
+			&i.Count,
+			&i.FirstSeen,
+			&i.LastSeen,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getEstContainers = `-- name: GetEstContainers :many
 SELECT
 	e.dst_container_id,
@@ -335,6 +741,177 @@ func (q *Queries) GetEstContainers(ctx context.Context, srcContainerID string) (
 	return items, nil
 }
 
+const getLearnedFlows = `-- name: GetLearnedFlows :many
+SELECT
+	direction,
+	addr,
+	proto,
+	port,
+	localhost,
+	peer_container,
+	peer_network,
+	count,
+	first_seen,
+	last_seen
+FROM
+	learned_flows
+WHERE
+	container_name = ?
+`
+
+type GetLearnedFlowsRow struct {
+	Direction     string
+	Addr          []byte
+	Proto         int64
+	Port          int64
+	Localhost     int64
+	PeerContainer string
+	PeerNetwork   string
+	Count         int64
+	FirstSeen     int64
+	LastSeen      int64
+}
+
+func (q *Queries) GetLearnedFlows(ctx context.Context, containerName string) ([]GetLearnedFlowsRow, error) {
+	rows, err := q.query(ctx, q.getLearnedFlowsStmt, getLearnedFlows, containerName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetLearnedFlowsRow
+	for rows.Next() {
+		var i GetLearnedFlowsRow
+		if err := rows.Scan(
+			&i.Direction,
+			&i.Addr,
+			&i.Proto,
+			&i.Port,
+			&i.Localhost,
+			&i.PeerContainer,
+			&i.PeerNetwork,
+			&i.Count,
+			&i.FirstSeen,
+			&i.LastSeen,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getNetworkPeerRules = `-- name: GetNetworkPeerRules :many
+SELECT
+	n.src_container_id,
+	c.name,
+	n.addr,
+	n.rule
+FROM
+	network_peer_rules n
+JOIN
+	containers c
+ON
+	c.id = n.src_container_id
+WHERE
+	n.network_name = ?
+`
+
+type GetNetworkPeerRulesRow struct {
+	SrcContainerID string
+	Name           string
+	Addr           []byte
+	Rule           []byte
+}
+
+func (q *Queries) GetNetworkPeerRules(ctx context.Context, networkName string) ([]GetNetworkPeerRulesRow, error) {
+	rows, err := q.query(ctx, q.getNetworkPeerRulesStmt, getNetworkPeerRules, networkName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetNetworkPeerRulesRow
+	for rows.Next() {
+		var i GetNetworkPeerRulesRow
+		if err := rows.Scan(
+			&i.SrcContainerID,
+			&i.Name,
+			&i.Addr,
+			&i.Rule,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getSelectorRules = `-- name: GetSelectorRules :many
+SELECT
+	s.src_container_id,
+	c.name,
+	s.set_name,
+	s.inbound,
+	s.addr,
+	s.rule
+FROM
+	selector_rules s
+JOIN
+	containers c
+ON
+	c.id = s.src_container_id
+`
+
+type GetSelectorRulesRow struct {
+	SrcContainerID string
+	Name           string
+	SetName        string
+	Inbound        int64
+	Addr           []byte
+	Rule           []byte
+}
+
+func (q *Queries) GetSelectorRules(ctx context.Context) ([]GetSelectorRulesRow, error) {
+	rows, err := q.query(ctx, q.getSelectorRulesStmt, getSelectorRules)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetSelectorRulesRow
+	for rows.Next() {
+		var i GetSelectorRulesRow
+		if err := rows.Scan(
+			&i.SrcContainerID,
+			&i.Name,
+			&i.SetName,
+			&i.Inbound,
+			&i.Addr,
+			&i.Rule,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getWaitingContainerRules = `-- name: GetWaitingContainerRules :many
 SELECT
 	w.src_container_id,
@@ -378,3 +955,47 @@ func (q *Queries) GetWaitingContainerRules(ctx context.Context, dstContainerName
 	}
 	return items, nil
 }
+
+const getWaitingInputRules = `-- name: GetWaitingInputRules :many
+SELECT
+	w.dst_container_id,
+	c.name,
+	w.rule
+FROM
+	waiting_input_rules w
+JOIN
+	containers c
+ON
+	c.id = w.dst_container_id
+WHERE
+	w.src_container_name = ?
+`
+
+type GetWaitingInputRulesRow struct {
+	DstContainerID string
+	Name           string
+	Rule           []byte
+}
+
+func (q *Queries) GetWaitingInputRules(ctx context.Context, srcContainerName string) ([]GetWaitingInputRulesRow, error) {
+	rows, err := q.query(ctx, q.getWaitingInputRulesStmt, getWaitingInputRules, srcContainerName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetWaitingInputRulesRow
+	for rows.Next() {
+		var i GetWaitingInputRulesRow
+		if err := rows.Scan(&i.DstContainerID, &i.Name, &i.Rule); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
@@ -1,16 +1,17 @@
-CREATE TABLE containers (
+CREATE TABLE IF NOT EXISTS containers (
   id   TEXT PRIMARY KEY,
   name TEXT UNIQUE NOT NULL
 ) STRICT;
 
-CREATE TABLE addrs (
+CREATE TABLE IF NOT EXISTS addrs (
   addr         BLOB PRIMARY KEY,
   container_id TEXT NOT NULL,
+  network_name TEXT NOT NULL DEFAULT '',
 
   FOREIGN KEY(container_id) REFERENCES containers(id)
 ) STRICT;
 
-CREATE TABLE container_aliases (
+CREATE TABLE IF NOT EXISTS container_aliases (
   container_id    TEXT NOT NULL,
   container_alias TEXT NOT NULL,
 
@@ -18,7 +19,7 @@ CREATE TABLE container_aliases (
   FOREIGN KEY(container_id) REFERENCES containers(id)
 ) STRICT;
 
-CREATE TABLE est_containers (
+CREATE TABLE IF NOT EXISTS est_containers (
   src_container_id TEXT NOT NULL,
   dst_container_id TEXT NOT NULL,
 
@@ -27,7 +28,7 @@ CREATE TABLE est_containers (
   FOREIGN KEY(dst_container_id) REFERENCES containers(id)
 ) STRICT;
 
-CREATE TABLE waiting_container_rules (
+CREATE TABLE IF NOT EXISTS waiting_container_rules (
   src_container_id   TEXT    NOT NULL,
   dst_container_name TEXT    NOT NULL,
   rule               BLOB    NOT NULL,
@@ -35,3 +36,62 @@ CREATE TABLE waiting_container_rules (
   PRIMARY KEY(src_container_id, dst_container_name, rule),
   FOREIGN KEY (src_container_id) REFERENCES containers(id)
 ) STRICT;
+
+CREATE TABLE IF NOT EXISTS waiting_input_rules (
+  dst_container_id   TEXT    NOT NULL,
+  src_container_name TEXT    NOT NULL,
+  rule               BLOB    NOT NULL,
+
+  PRIMARY KEY(dst_container_id, src_container_name, rule),
+  FOREIGN KEY (dst_container_id) REFERENCES containers(id)
+) STRICT;
+
+CREATE TABLE IF NOT EXISTS network_peer_rules (
+  src_container_id TEXT NOT NULL,
+  network_name     TEXT NOT NULL,
+  addr             BLOB NOT NULL,
+  rule             BLOB NOT NULL,
+
+  PRIMARY KEY(src_container_id, network_name, rule),
+  FOREIGN KEY (src_container_id) REFERENCES containers(id)
+) STRICT;
+
+CREATE TABLE IF NOT EXISTS selector_rules (
+  src_container_id TEXT    NOT NULL,
+  set_name         TEXT    NOT NULL,
+  inbound          INTEGER NOT NULL,
+  addr             BLOB    NOT NULL,
+  rule             BLOB    NOT NULL,
+
+  PRIMARY KEY(src_container_id, set_name),
+  FOREIGN KEY (src_container_id) REFERENCES containers(id)
+) STRICT;
+
+CREATE TABLE IF NOT EXISTS denials (
+  container_name TEXT    NOT NULL,
+  direction      TEXT    NOT NULL,
+  addr           BLOB    NOT NULL,
+  proto          INTEGER NOT NULL,
+  port           INTEGER NOT NULL,
+  count          INTEGER NOT NULL,
+  first_seen     INTEGER NOT NULL,
+  last_seen      INTEGER NOT NULL,
+
+  PRIMARY KEY(container_name, direction, addr, proto, port)
+) STRICT;
+
+CREATE TABLE IF NOT EXISTS learned_flows (
+  container_name TEXT    NOT NULL,
+  direction      TEXT    NOT NULL,
+  addr           BLOB    NOT NULL,
+  proto          INTEGER NOT NULL,
+  port           INTEGER NOT NULL,
+  localhost      INTEGER NOT NULL,
+  peer_container TEXT    NOT NULL,
+  peer_network   TEXT    NOT NULL,
+  count          INTEGER NOT NULL,
+  first_seen     INTEGER NOT NULL,
+  last_seen      INTEGER NOT NULL,
+
+  PRIMARY KEY(container_name, direction, addr, proto, port)
+) STRICT;
@@ -20,9 +20,13 @@ func (r *RuleManager) containerExists(ctx context.Context, db database.Querier,
 	return exists == 1, nil
 }
 
-func (r *RuleManager) addContainer(ctx context.Context, tx database.TX, id, name, service string, addrs map[string][]byte, estContainers map[string]struct{}) error {
-	for _, addr := range addrs {
-		err := tx.AddContainerAddr(ctx, addr, id)
+func (r *RuleManager) addContainer(ctx context.Context, tx database.TX, id, name, service, project string, addrs map[string][]byte, estContainers map[string]struct{}) error {
+	for netName, addr := range addrs {
+		err := tx.AddContainerAddr(ctx, database.AddContainerAddrParams{
+			Addr:        addr,
+			ContainerID: id,
+			NetworkName: netName,
+		})
 		if err != nil {
 			return fmt.Errorf("error adding container addr to database: %w", err)
 		}
@@ -30,7 +34,7 @@ func (r *RuleManager) addContainer(ctx context.Context, tx database.TX, id, name
 
 	// add names the container may have been referred to in user rules
 	// so when creating rules that specify this container it can be found
-	aliases := containerAliases(name, service)
+	aliases := containerAliases(name, service, project)
 	for _, alias := range aliases {
 		err := tx.AddContainerAlias(ctx, id, alias)
 		if err != nil {
@@ -50,12 +54,20 @@ func (r *RuleManager) addContainer(ctx context.Context, tx database.TX, id, name
 	return tx.Commit()
 }
 
-func containerAliases(name, service string) []string {
+func containerAliases(name, service, project string) []string {
 	aliases := []string{"/" + name}
 	if service != "" && service != name {
 		aliases = append(aliases, service)
 		aliases = append(aliases, "/"+service)
 	}
+	// containers of other Compose projects may refer to this container
+	// by its name or service qualified with its project
+	if project != "" {
+		aliases = append(aliases, project+"/"+name)
+		if service != "" && service != name {
+			aliases = append(aliases, project+"/"+service)
+		}
+	}
 	return aliases
 }
 
@@ -73,6 +85,18 @@ func (r *RuleManager) deleteContainer(ctx context.Context, tx database.TX, id st
 	if err := tx.DeleteWaitingContainerRules(ctx, id); err != nil {
 		return fmt.Errorf("error deleting waiting container rules in database: %w", err)
 	}
+	// delete waiting input rules that this container created
+	if err := tx.DeleteWaitingInputRules(ctx, id); err != nil {
+		return fmt.Errorf("error deleting waiting input rules in database: %w", err)
+	}
+	// delete network peer rules that this container created
+	if err := tx.DeleteNetworkPeerRules(ctx, id); err != nil {
+		return fmt.Errorf("error deleting network peer rules in database: %w", err)
+	}
+	// delete selector rules that this container created
+	if err := tx.DeleteSelectorRules(ctx, id); err != nil {
+		return fmt.Errorf("error deleting selector rules in database: %w", err)
+	}
 	if err := tx.DeleteContainer(ctx, id); err != nil {
 		return fmt.Errorf("error deleting container in database: %w", err)
 	}
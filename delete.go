@@ -6,6 +6,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"slices"
 	"syscall"
 
 	"github.com/docker/docker/client"
@@ -47,34 +48,57 @@ func (r *RuleManager) clearRules(ctx context.Context) error {
 		return fmt.Errorf("error creating netlink connection: %w", err)
 	}
 
-	// delete jump rules to whalewall chain
-	for _, chainName := range []string{dockerChainName, inputChainName, outputChainName} {
+	// delete jump rules to whalewall chain and the chains of
+	// containers using host networking
+	jumps := []struct {
+		chainName    string
+		dstChainName string
+	}{
+		{dockerChainName, whalewallChainName},
+		{inputChainName, whalewallChainName},
+		{outputChainName, whalewallChainName},
+		{inputChainName, hostInputChainName},
+		{outputChainName, hostOutputChainName},
+	}
+	for _, jump := range jumps {
 		chain := &nftables.Chain{
-			Name:  chainName,
+			Name:  jump.chainName,
 			Table: filterTable,
 		}
 		rules, err := nfc.GetRules(filterTable, chain)
 		if err != nil {
-			r.logger.Error("error getting rules of chain", zap.String("chain.name", chainName), zap.Error(err))
+			r.logger.Error("error getting rules of chain", zap.String("chain.name", jump.chainName), zap.Error(err))
 			continue
 		}
 
-		jumpRule := createJumpRule(chain, whalewallChainName)
+		jumpRule := createJumpRule(chain, jump.dstChainName)
 		if findRule(r.logger, jumpRule, rules) {
 			if err := nfc.DelRule(jumpRule); err != nil {
 				r.logger.Error("error deleting rule", zap.Error(err))
 				continue
 			}
 			if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
-				r.logger.Error("error deleting rule from chain", zap.String("chain.name", chainName), zap.Error(err))
+				r.logger.Error("error deleting rule from chain", zap.String("chain.name", jump.chainName), zap.Error(err))
 			}
 		}
 	}
 
-	// delete whalewall chain
-	nfc.DelChain(whalewallChain)
+	// delete user chains now that container chains don't jump to them
+	r.deleteUserChains(nfc)
+
+	// delete whalewall chain and the chains of containers using host
+	// networking
+	for _, chain := range []*nftables.Chain{whalewallChain, hostInputChain, hostOutputChain} {
+		nfc.DelChain(chain)
+		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+			return fmt.Errorf("error deleting chain %q: %w", chain.Name, err)
+		}
+	}
+
+	// delete the table traffic is marked in
+	nfc.DelTable(markTable)
 	if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
-		return fmt.Errorf("error deleting chain %q: %w", whalewallChainName, err)
+		return fmt.Errorf("error deleting table %q: %w", markTableName, err)
 	}
 
 	// delete container address set
@@ -83,6 +107,27 @@ func (r *RuleManager) clearRules(ctx context.Context) error {
 		return fmt.Errorf("error deleting set %q: %w", containerAddrSetName, err)
 	}
 
+	// delete managed address set
+	nfc.DelSet(managedAddrSet)
+	if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+		return fmt.Errorf("error deleting set %q: %w", managedAddrSetName, err)
+	}
+
+	// delete set of sources banned from all containers with global
+	// bans
+	nfc.DelSet(&nftables.Set{
+		Table: filterTable,
+		Name:  globalBanSetName,
+	})
+	if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+		return fmt.Errorf("error deleting set %q: %w", globalBanSetName, err)
+	}
+
+	// delete sets of connections whose server names were checked
+	if err := deleteSNISets(nfc); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -186,6 +231,31 @@ func (r *RuleManager) deleteContainerRules(ctx context.Context, id, name string)
 	}
 	deleteRulesFromContainer(logger, nfc, rules, id)
 
+	// delete rules marking traffic of the container
+	rules, err = nfc.GetRules(markTable, markChain)
+	if err != nil {
+		logger.Error("error getting rules of chain", zap.String("chain.name", markChainName), zap.Error(err))
+	} else {
+		deleteRulesFromContainer(logger, nfc, rules, id)
+	}
+
+	// delete rules jumping to the chains of the container if it is
+	// using host networking
+	var hostNetworking bool
+	for _, hostChain := range []*nftables.Chain{hostInputChain, hostOutputChain} {
+		rules, err := nfc.GetRules(filterTable, hostChain)
+		if err != nil {
+			logger.Error("error getting rules of chain", zap.String("chain.name", hostChain.Name), zap.Error(err))
+			continue
+		}
+		if slices.ContainsFunc(rules, func(rule *nftables.Rule) bool {
+			return bytes.Equal(rule.UserData, []byte(id))
+		}) {
+			hostNetworking = true
+		}
+		deleteRulesFromContainer(logger, nfc, rules, id)
+	}
+
 	addrs, err := tx.GetContainerAddrs(ctx, id)
 	if err != nil {
 		return fmt.Errorf("error getting container addrs: %w", err)
@@ -202,6 +272,17 @@ func (r *RuleManager) deleteContainerRules(ctx context.Context, id, name string)
 		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
 			logger.Error("error deleting set element", zap.Error(err))
 		}
+
+		if !r.estFastPath {
+			continue
+		}
+		if err := nfc.SetDeleteElements(managedAddrSet, e); err != nil {
+			logger.Error("error marshaling set elements", zap.Error(err))
+			continue
+		}
+		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+			logger.Error("error deleting set element", zap.Error(err))
+		}
 	}
 
 	estContainers, err := tx.GetEstContainers(ctx, id)
@@ -232,6 +313,54 @@ func (r *RuleManager) deleteContainerRules(ctx context.Context, id, name string)
 	if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
 		logger.Error("error deleting chain", zap.String("chain.name", chainName), zap.Error(err))
 	}
+	if hostNetworking {
+		inChainName := buildHostInputChainName(name, id)
+		nfc.DelChain(&nftables.Chain{
+			Table: filterTable,
+			Name:  inChainName,
+		})
+		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+			logger.Error("error deleting chain", zap.String("chain.name", inChainName), zap.Error(err))
+		}
+	}
+	// delete the chain sources are banned from, it can only be deleted
+	// after the container chain jumping to it is
+	if err := deleteBanChain(nfc, &nftables.Chain{Table: filterTable, Name: chainName}); err != nil {
+		logger.Error("error deleting ban chain", zap.Error(err))
+	}
+	// delete sets of the container chain if they were created
+	if err := deleteFlowSets(nfc, &nftables.Chain{Table: filterTable, Name: chainName}); err != nil {
+		logger.Error("error deleting sets", zap.Error(err))
+	}
+	limitChainNames := []string{chainName}
+	if hostNetworking {
+		limitChainNames = append(limitChainNames, buildHostInputChainName(name, id))
+	}
+	for _, limitChainName := range limitChainNames {
+		if err := deleteLimitSets(nfc, &nftables.Chain{Table: filterTable, Name: limitChainName}); err != nil {
+			logger.Error("error deleting sets", zap.Error(err))
+		}
+	}
+	// delete sets of rules with container selectors, and remove this
+	// container from sets of other containers' rules that selected it
+	if err := deleteSelectorSets(ctx, logger, nfc, tx, id, addrs); err != nil {
+		logger.Error("error deleting selector sets", zap.Error(err))
+	}
+
+	// delete the set of addresses of allowed domains, it can only be
+	// deleted after the rules matching it are
+	if err := deleteDomainSet(nfc, &nftables.Chain{Table: filterTable, Name: chainName}); err != nil {
+		logger.Error("error deleting sets", zap.Error(err))
+	}
+
+	// stop allowing TLS connections of the container's addresses, they
+	// may be reused by another container
+	if r.sni != nil {
+		r.sni.deletePolicy(id)
+	}
+	if r.dns != nil {
+		r.dns.deletePolicy(id)
+	}
 
 	logger.Debug("deleting from database")
 	if err := r.deleteContainer(ctx, tx, id); err != nil {
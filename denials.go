@@ -0,0 +1,165 @@
+package whalewall
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+
+	"github.com/capnspacehook/whalewall/database"
+)
+
+// Denial is aggregated traffic of a container that was dropped.
+type Denial struct {
+	// Direction is either "outbound" or "inbound".
+	Direction string
+	// Addr is the address of the other end of the flow.
+	Addr netip.Addr
+	// Proto is the name of the transport protocol of the flow.
+	Proto string
+	// Port is the destination port of the flow, or 0 if the protocol
+	// doesn't have ports.
+	Port      uint16
+	Count     int64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+const (
+	// maxRecordedFlows is the maximum number of denials and learned
+	// flows that are kept per container.
+	maxRecordedFlows = 1000
+	// trimRecordedFlowsInterval is how often the least recently seen
+	// denials and learned flows over maxRecordedFlows are deleted.
+	trimRecordedFlowsInterval = 10 * time.Minute
+)
+
+// trimRecordedFlows periodically deletes the least recently seen
+// denials and learned flows of containers so the database doesn't grow
+// without bound.
+func (r *RuleManager) trimRecordedFlows(ctx context.Context) {
+	ticker := time.NewTicker(trimRecordedFlowsInterval)
+	defer ticker.Stop()
+
+	for {
+		r.deleteOldFlows(ctx)
+
+		select {
+		case <-r.stopping:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deleteOldFlows deletes the least recently seen denials and learned
+// flows of each container so at most maxRecordedFlows of each are
+// kept.
+func (r *RuleManager) deleteOldFlows(ctx context.Context) {
+	if err := r.db.DeleteOldDenials(ctx, maxRecordedFlows); err != nil {
+		r.logger.Error("error deleting old denials from database", zap.Error(err))
+	}
+	if err := r.db.DeleteOldLearnedFlows(ctx, maxRecordedFlows); err != nil {
+		r.logger.Error("error deleting old learned flows from database", zap.Error(err))
+	}
+}
+
+// recordDenial adds a dropped packet of a container to the database.
+func (r *RuleManager) recordDenial(ctx context.Context, contName, direction string, flow packetFlow, seen time.Time) {
+	addr := flow.dstAddr
+	if direction == "inbound" {
+		addr = flow.srcAddr
+	}
+	addrBytes, err := addr.MarshalBinary()
+	if err != nil {
+		r.logger.Error("error marshaling address", zap.Error(err))
+		return
+	}
+
+	err = r.db.AddDenial(ctx, database.AddDenialParams{
+		ContainerName: contName,
+		Direction:     direction,
+		Addr:          addrBytes,
+		Proto:         int64(flow.proto),
+		Port:          int64(flow.dstPort),
+		FirstSeen:     seen.Unix(),
+		LastSeen:      seen.Unix(),
+	})
+	if err != nil {
+		r.logger.Error("error adding denial to database", zap.String("container.name", contName), zap.Error(err))
+	}
+}
+
+// Denials returns traffic of the container contName that was dropped,
+// most recently dropped first. Dropped traffic is only recorded when
+// it is logged to a NFLOG group.
+func (r *RuleManager) Denials(ctx context.Context, contName string) ([]Denial, error) {
+	rows, err := r.db.GetDenials(ctx, contName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting denials from database: %w", err)
+	}
+
+	denials := make([]Denial, len(rows))
+	for i, row := range rows {
+		addr, ok := netip.AddrFromSlice(row.Addr)
+		if !ok {
+			return nil, fmt.Errorf("invalid address %v in database", row.Addr)
+		}
+		denials[i] = Denial{
+			Direction: row.Direction,
+			Addr:      addr,
+			Proto:     protoName(uint8(row.Proto)),
+			Port:      uint16(row.Port),
+			Count:     row.Count,
+			FirstSeen: time.Unix(row.FirstSeen, 0),
+			LastSeen:  time.Unix(row.LastSeen, 0),
+		}
+	}
+
+	return denials, nil
+}
+
+// SuggestOutputRules returns the YAML of output rules that would allow
+// the outbound denials of denials. Inbound denials and denials of
+// protocols other than TCP and UDP are ignored, as they can't be
+// allowed with output rules.
+func SuggestOutputRules(denials []Denial) ([]byte, error) {
+	type protoPort struct {
+		proto string
+		port  uint16
+	}
+
+	addrs := make(map[protoPort][]netip.Addr)
+	for _, d := range denials {
+		if d.Direction != "outbound" {
+			continue
+		}
+		if d.Proto != protoName(unix.IPPROTO_TCP) && d.Proto != protoName(unix.IPPROTO_UDP) {
+			continue
+		}
+		pp := protoPort{proto: d.Proto, port: d.Port}
+		if !slices.Contains(addrs[pp], d.Addr) {
+			addrs[pp] = append(addrs[pp], d.Addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	var cfg suggestedConfig
+	for pp, ips := range addrs {
+		slices.SortFunc(ips, netip.Addr.Compare)
+		cfg.Output = append(cfg.Output, suggestedRule{
+			IPs:      ips,
+			Proto:    pp.proto,
+			DstPorts: []any{pp.port},
+		})
+	}
+	slices.SortFunc(cfg.Output, compareSuggestedRules)
+
+	return cfg.marshal()
+}
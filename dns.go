@@ -0,0 +1,642 @@
+package whalewall
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"golang.org/x/sys/unix"
+
+	"github.com/capnspacehook/whalewall/nfqueue"
+)
+
+const (
+	domainSetSuffix = "-domains"
+
+	// dnsCopyLen is how many bytes of queued packets are copied from
+	// the kernel, enough for any IPv4 packet.
+	dnsCopyLen = 0xffff
+	// dnsMinTimeout is the shortest time addresses of allowed domains
+	// are allowed for. Resolvers and applications often use answers
+	// for a short time after their TTL expires, and answers with a
+	// TTL of 0 would otherwise never be usable.
+	dnsMinTimeout = time.Minute
+
+	dnsPort       = 53
+	dnsHeaderLen  = 12
+	dnsMaxNameLen = 255
+	dnsTypeA      = 1
+	dnsTypeCNAME  = 5
+	dnsClassINET  = 1
+)
+
+var errDNSTruncated = errors.New("DNS message is truncated")
+
+// WithDNSQueue makes rules of containers with allowed_domains set send
+// DNS responses to the containers from trusted DNS servers to queue.
+// Packets sent to the queue are read by the RuleManager, which adds
+// addresses of allowed domains to the sets output rules of containers
+// match. DNS responses are always accepted, and are accepted without
+// being read if the RuleManager isn't running.
+func WithDNSQueue(queue uint16) Option {
+	return func(r *RuleManager) {
+		r.dnsQueue = queue
+		r.dns = newDNSSnooper()
+	}
+}
+
+// WithDNSResolvers sets addresses of DNS servers whose responses to all
+// containers with allowed_domains set are trusted. Responses from the
+// DNS servers set on each container are trusted as well.
+func WithDNSResolvers(addrs []netip.Addr) Option {
+	return func(r *RuleManager) {
+		r.dnsResolvers = addrs
+	}
+}
+
+// containerResolvers returns the sorted addresses of the DNS servers
+// whose responses to container are trusted.
+func (r *RuleManager) containerResolvers(container types.ContainerJSON) []netip.Addr {
+	resolvers := slices.Clone(r.dnsResolvers)
+	if container.HostConfig != nil {
+		for _, s := range container.HostConfig.DNS {
+			addr, err := netip.ParseAddr(s)
+			if err == nil && addr.Is4() {
+				resolvers = append(resolvers, addr)
+			}
+		}
+	}
+	slices.SortFunc(resolvers, netip.Addr.Compare)
+	return slices.Compact(resolvers)
+}
+
+// validateDomainPattern returns an error if p isn't a domain or a
+// domain prefixed with a "*." wildcard.
+func validateDomainPattern(p string) error {
+	name := strings.TrimSuffix(strings.TrimPrefix(p, "*."), ".")
+	if strings.Contains(name, "*") {
+		return fmt.Errorf("invalid domain %q, wildcards are only supported as the first label", p)
+	}
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid domain %q", p)
+	}
+	if _, err := netip.ParseAddr(name); err == nil {
+		return fmt.Errorf("invalid domain %q, domains can't be IP addresses", p)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid domain %q", p)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid domain %q", p)
+			}
+		}
+	}
+
+	return nil
+}
+
+// domainAllowed returns true if name matches one of patterns. Patterns
+// starting with "*." match subdomains of any depth but not the domain
+// itself. Names are compared case-insensitively.
+func domainAllowed(patterns []string, name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, p := range patterns {
+		p = strings.TrimSuffix(strings.ToLower(p), ".")
+		if domain, ok := strings.CutPrefix(p, "*."); ok {
+			if strings.HasSuffix(name, "."+domain) {
+				return true
+			}
+			continue
+		}
+		if name == p {
+			return true
+		}
+	}
+
+	return false
+}
+
+// usesAllowedDomains returns true if the ips of r are the addresses
+// allowed domains resolved to.
+func (r ruleConfig) usesAllowedDomains() bool {
+	return slices.ContainsFunc(r.IPs, func(a addrOrRange) bool {
+		return a.symbol == symbolAllowedDomains
+	})
+}
+
+// dnsRecord is an A or CNAME record of a DNS response.
+type dnsRecord struct {
+	name string
+	typ  uint16
+	ttl  uint32
+	// addr is set if the record is an A record
+	addr netip.Addr
+	// target is set if the record is a CNAME record
+	target string
+}
+
+// parseDNSResponse returns the A and CNAME records in the answer
+// section of the DNS response msg. Other records are skipped. No
+// records are returned if the response is an error.
+func parseDNSResponse(msg []byte) ([]dnsRecord, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errDNSTruncated
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&0x8000 == 0 {
+		return nil, errors.New("DNS message is not a response")
+	}
+	// only standard queries that succeeded have useful answers
+	if opcode := flags >> 11 & 0xf; opcode != 0 {
+		return nil, nil
+	}
+	if rcode := flags & 0xf; rcode != 0 {
+		return nil, nil
+	}
+	qdCount := binary.BigEndian.Uint16(msg[4:6])
+	anCount := binary.BigEndian.Uint16(msg[6:8])
+
+	off := dnsHeaderLen
+	for range qdCount {
+		var err error
+		_, off, err = readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		// skip type and class
+		off += 4
+		if off > len(msg) {
+			return nil, errDNSTruncated
+		}
+	}
+
+	var records []dnsRecord
+	for range anCount {
+		name, n, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+		if off+10 > len(msg) {
+			return nil, errDNSTruncated
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdLen > len(msg) {
+			return nil, errDNSTruncated
+		}
+		rdata := msg[off : off+rdLen]
+		rdOff := off
+		off += rdLen
+
+		if class != dnsClassINET {
+			continue
+		}
+		// TTLs with the most significant bit set are treated as 0
+		if ttl&0x80000000 != 0 {
+			ttl = 0
+		}
+		switch typ {
+		case dnsTypeA:
+			if len(rdata) != 4 {
+				return nil, errors.New("invalid A record")
+			}
+			records = append(records, dnsRecord{
+				name: name,
+				typ:  typ,
+				ttl:  ttl,
+				addr: netip.AddrFrom4([4]byte(rdata)),
+			})
+		case dnsTypeCNAME:
+			// names in records may point to names elsewhere in the
+			// message, so the whole message is needed to read them
+			target, n, err := readDNSName(msg, rdOff)
+			if err != nil {
+				return nil, err
+			}
+			if n != off {
+				return nil, errors.New("invalid CNAME record")
+			}
+			records = append(records, dnsRecord{
+				name:   name,
+				typ:    typ,
+				ttl:    ttl,
+				target: target,
+			})
+		}
+	}
+
+	return records, nil
+}
+
+// readDNSName reads the possibly compressed name at off of msg. The
+// name is returned in lowercase without a trailing dot along with the
+// offset after it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var (
+		name strings.Builder
+		// end is the offset after the name, which is right after
+		// the first compression pointer if there is one
+		end = -1
+		// pointers may only point before themselves, which prevents
+		// loops
+		limit = off
+	)
+	for {
+		if off >= len(msg) {
+			return "", 0, errDNSTruncated
+		}
+		l := int(msg[off])
+		switch l & 0xc0 {
+		case 0x00:
+			if l == 0 {
+				if end == -1 {
+					end = off + 1
+				}
+				return strings.ToLower(name.String()), end, nil
+			}
+			if off+1+l > len(msg) {
+				return "", 0, errDNSTruncated
+			}
+			if name.Len() != 0 {
+				name.WriteByte('.')
+			}
+			name.Write(msg[off+1 : off+1+l])
+			if name.Len() > dnsMaxNameLen {
+				return "", 0, errors.New("DNS name is too long")
+			}
+			off += 1 + l
+		case 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, errDNSTruncated
+			}
+			ptr := int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			if ptr >= limit {
+				return "", 0, errors.New("invalid DNS name compression pointer")
+			}
+			if end == -1 {
+				end = off + 2
+			}
+			off, limit = ptr, ptr
+		default:
+			return "", 0, errors.New("invalid DNS label type")
+		}
+	}
+}
+
+// allowedAddrs returns the A records of records whose names are
+// allowed by patterns, either directly or because they are the target
+// of a CNAME record of an allowed name.
+func allowedAddrs(patterns []string, records []dnsRecord) []dnsRecord {
+	allowed := make(map[string]bool)
+	for _, rec := range records {
+		if domainAllowed(patterns, rec.name) {
+			allowed[rec.name] = true
+		}
+	}
+	// CNAME records may form a chain in any order, follow them until
+	// no more names are allowed
+	for changed := true; changed; {
+		changed = false
+		for _, rec := range records {
+			if rec.typ == dnsTypeCNAME && allowed[rec.name] && !allowed[rec.target] {
+				allowed[rec.target] = true
+				changed = true
+			}
+		}
+	}
+
+	var addrs []dnsRecord
+	for _, rec := range records {
+		if rec.typ == dnsTypeA && allowed[rec.name] {
+			addrs = append(addrs, rec)
+		}
+	}
+	return addrs
+}
+
+// parseUDPDatagram parses the flow and payload of an IPv4 UDP packet.
+func parseUDPDatagram(b []byte) (packetFlow, []byte, error) {
+	flow, err := parsePacketFlow(b)
+	if err != nil {
+		return flow, nil, err
+	}
+	if flow.proto != unix.IPPROTO_UDP {
+		return flow, nil, errors.New("packet is not UDP")
+	}
+
+	ipHdrLen := int(b[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(b[2:4]))
+	if totalLen > len(b) || totalLen < ipHdrLen+8 {
+		return flow, nil, errors.New("packet truncated")
+	}
+
+	return flow, b[ipHdrLen+8 : totalLen], nil
+}
+
+// parseDNSPacket parses the flow and DNS message of an IPv4 UDP or TCP
+// packet. Messages over TCP are only read if the segment starts with
+// the whole message.
+func parseDNSPacket(b []byte) (packetFlow, []byte, error) {
+	flow, err := parsePacketFlow(b)
+	if err != nil {
+		return flow, nil, err
+	}
+	if flow.proto == unix.IPPROTO_UDP {
+		return parseUDPDatagram(b)
+	}
+
+	flow, _, payload, err := parseTCPSegment(b)
+	if err != nil {
+		return flow, nil, err
+	}
+	// messages over TCP are prefixed with their length
+	if len(payload) < 2 {
+		return flow, nil, errors.New("segment doesn't start a DNS message")
+	}
+	msgLen := int(binary.BigEndian.Uint16(payload))
+	if len(payload)-2 < msgLen {
+		return flow, nil, errors.New("DNS message is split across segments")
+	}
+
+	return flow, payload[2 : 2+msgLen], nil
+}
+
+// dnsPolicy is the domains a container is allowed to connect to, the
+// set addresses of those domains are added to, and the DNS servers
+// whose responses are trusted.
+type dnsPolicy struct {
+	contID    string
+	contName  string
+	allowed   []string
+	set       *nftables.Set
+	resolvers []netip.Addr
+}
+
+// dnsResult is the outcome of reading a DNS response sent to the DNS
+// queue.
+type dnsResult struct {
+	flow   packetFlow
+	policy dnsPolicy
+	// addrs are the A records of allowed domains
+	addrs []dnsRecord
+}
+
+// dnsSnooper finds addresses of allowed domains in DNS responses sent
+// to containers.
+type dnsSnooper struct {
+	mtx      sync.Mutex
+	policies map[netip.Addr]dnsPolicy
+}
+
+func newDNSSnooper() *dnsSnooper {
+	return &dnsSnooper{
+		policies: make(map[netip.Addr]dnsPolicy),
+	}
+}
+
+// setPolicy sets the domains the container with the addresses addrs
+// is allowed to connect to.
+func (s *dnsSnooper) setPolicy(addrs map[string][]byte, policy dnsPolicy) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, addr := range addrs {
+		s.policies[netip.AddrFrom4([4]byte(addr))] = policy
+	}
+}
+
+// deletePolicy removes the policy of the container with the ID id.
+func (s *dnsSnooper) deletePolicy(id string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	maps.DeleteFunc(s.policies, func(_ netip.Addr, p dnsPolicy) bool {
+		return p.contID == id
+	})
+}
+
+// check returns the addresses of allowed domains in the DNS response
+// b and the policy of the container it was sent to.
+func (s *dnsSnooper) check(b []byte) (dnsResult, error) {
+	var res dnsResult
+	flow, msg, err := parseDNSPacket(b)
+	if err != nil {
+		return res, err
+	}
+	res.flow = flow
+
+	s.mtx.Lock()
+	policy, ok := s.policies[flow.dstAddr]
+	s.mtx.Unlock()
+	if !ok {
+		return res, errors.New("destination is not a container with allowed domains")
+	}
+	res.policy = policy
+	if !slices.Contains(policy.resolvers, flow.srcAddr) {
+		return res, errors.New("source is not a trusted DNS server of the container")
+	}
+
+	records, err := parseDNSResponse(msg)
+	if err != nil {
+		return res, err
+	}
+	res.addrs = allowedAddrs(policy.allowed, records)
+
+	return res, nil
+}
+
+// buildDomainSet returns the set of addresses of allowed domains of a
+// container chain.
+func buildDomainSet(chain *nftables.Chain) *nftables.Set {
+	return &nftables.Set{
+		Table:      chain.Table,
+		Name:       chain.Name + domainSetSuffix,
+		KeyType:    nftables.TypeIPAddr,
+		HasTimeout: true,
+	}
+}
+
+// createDomainSet adds the set of addresses of allowed domains of a
+// container chain. Elements of an existing set are kept so connections
+// to domains that were already resolved aren't dropped when recreating
+// rules for a container.
+func createDomainSet(nfc firewallClient, chain *nftables.Chain) error {
+	set := buildDomainSet(chain)
+	if err := nfc.AddSet(set, nil); err != nil {
+		return fmt.Errorf("error adding set %q: %w", set.Name, err)
+	}
+	if err := ignoringErr(nfc.Flush, syscall.EEXIST); err != nil {
+		return fmt.Errorf("error adding set %q: %w", set.Name, err)
+	}
+	return nil
+}
+
+// deleteDomainSet deletes the set of addresses of allowed domains of a
+// container chain if it exists.
+func deleteDomainSet(nfc firewallClient, chain *nftables.Chain) error {
+	set := buildDomainSet(chain)
+	nfc.DelSet(set)
+	if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+		return fmt.Errorf("error deleting set %q: %w", set.Name, err)
+	}
+	return nil
+}
+
+// createDNSRules returns rules that send DNS responses over UDP and TCP
+// to a container from resolvers to the DNS queue. The rules must be placed before any
+// rules that accept established traffic of the container.
+func (r *RuleManager) createDNSRules(addrs map[string][]byte, resolvers []netip.Addr, chain *nftables.Chain, id string) []*nftables.Rule {
+	netNames := maps.Keys(addrs)
+	slices.Sort(netNames)
+
+	protos := []int{unix.IPPROTO_UDP, unix.IPPROTO_TCP}
+	rules := make([]*nftables.Rule, 0, len(netNames)*len(resolvers)*len(protos))
+	for _, netName := range netNames {
+		for _, resolver := range resolvers {
+			for _, proto := range protos {
+				exprs := matchAddrExprs(resolver.AsSlice(), srcAddrOffset)
+				exprs = append(exprs, matchAddrExprs(addrs[netName], dstAddrOffset)...)
+				exprs = append(exprs, matchProtoExprs(proto)...)
+				exprs = append(exprs, matchPortExprs(dnsPort, srcPortOffset)...)
+				exprs = append(exprs, matchConnStateExprs(stateEst)...)
+				exprs = append(exprs,
+					&expr.Counter{},
+					// responses are only read, don't drop them if
+					// whalewall isn't running
+					&expr.Queue{
+						Num:  r.dnsQueue,
+						Flag: expr.QueueFlagBypass,
+					},
+				)
+				rules = append(rules, &nftables.Rule{
+					Table:    chain.Table,
+					Chain:    chain,
+					Exprs:    exprs,
+					UserData: []byte(id),
+				})
+			}
+		}
+	}
+
+	return rules
+}
+
+// snoopDNS reads packets sent to the DNS queue until the RuleManager
+// is stopped.
+func (r *RuleManager) snoopDNS(conn *nfqueue.Conn, nfc firewallClient) {
+	go func() {
+		<-r.stopping
+		if err := conn.Close(); err != nil {
+			r.logger.Error("error closing DNS queue", zap.Error(err))
+		}
+	}()
+
+	var errs int
+	for {
+		pkts, err := conn.Receive()
+		if err != nil {
+			select {
+			case <-r.stopping:
+				return
+			default:
+			}
+			r.logger.Error("error receiving queued packets", zap.Error(err))
+			errs++
+			if !r.receiveBackoff(errs) {
+				return
+			}
+			continue
+		}
+		errs = 0
+
+		for _, pkt := range pkts {
+			r.handleDNSPacket(nfc, pkt.Payload)
+			if err := conn.SetVerdict(pkt.ID, nfqueue.Accept); err != nil {
+				r.logger.Error("error setting verdict of queued packet", zap.Error(err))
+			}
+		}
+	}
+}
+
+// handleDNSPacket adds the addresses of allowed domains in the DNS
+// response b to the set of the container it was sent to. The addresses
+// expire when the TTLs of their records do.
+func (r *RuleManager) handleDNSPacket(nfc firewallClient, b []byte) {
+	res, err := r.dns.check(b)
+	if err != nil {
+		fields := []zap.Field{zap.Error(err)}
+		if res.flow.srcAddr.IsValid() {
+			fields = append(fields,
+				zap.Stringer("packet.src_addr", res.flow.srcAddr),
+				zap.Stringer("packet.dst_addr", res.flow.dstAddr),
+			)
+		}
+		r.logger.Debug("error reading DNS response", fields...)
+		return
+	}
+	if len(res.addrs) == 0 {
+		return
+	}
+
+	elems := make([]nftables.SetElement, 0, len(res.addrs))
+	for _, rec := range res.addrs {
+		timeout := max(time.Duration(rec.ttl)*time.Second, dnsMinTimeout)
+		r.logger.Debug("allowing address of domain",
+			zap.String("container.id", res.policy.contID[:12]),
+			zap.String("container.name", res.policy.contName),
+			zap.String("dns.name", rec.name),
+			zap.Stringer("dns.addr", rec.addr),
+			zap.Duration("timeout", timeout),
+		)
+
+		i := slices.IndexFunc(elems, func(e nftables.SetElement) bool {
+			return netip.AddrFrom4([4]byte(e.Key)) == rec.addr
+		})
+		if i == -1 {
+			elems = append(elems, nftables.SetElement{Key: rec.addr.AsSlice(), Timeout: timeout})
+		} else if elems[i].Timeout < timeout {
+			elems[i].Timeout = timeout
+		}
+	}
+
+	// timeouts of existing elements aren't updated when they are
+	// added again, so replace them in one batch. If any of the
+	// elements don't exist the batch fails, so add them without
+	// replacing any instead
+	if err := nfc.SetDeleteElements(res.policy.set, elems); err != nil {
+		r.logger.Error("error marshaling set elements", zap.Error(err))
+		return
+	}
+	if err := nfc.SetAddElements(res.policy.set, elems); err != nil {
+		r.logger.Error("error marshaling set elements", zap.Error(err))
+		return
+	}
+	err = nfc.Flush()
+	if errors.Is(err, syscall.ENOENT) {
+		if err := nfc.SetAddElements(res.policy.set, elems); err != nil {
+			r.logger.Error("error marshaling set elements", zap.Error(err))
+			return
+		}
+		err = ignoringErr(nfc.Flush, syscall.EEXIST)
+	}
+	if err != nil {
+		r.logger.Error("error adding elements to set", zap.String("set.name", res.policy.set.Name), zap.Error(err))
+	}
+}
@@ -0,0 +1,354 @@
+package whalewall
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	hostInputChainName  = "whalewall-host-input"
+	hostOutputChainName = "whalewall-host-output"
+
+	cgroupRoot = "/sys/fs/cgroup"
+)
+
+var (
+	// Packets of containers using host networking don't have addresses
+	// of their own, they are matched by the cgroup of their sockets
+	// instead. Sockets can only be matched in the INPUT and OUTPUT
+	// hooks, so these chains are only jumped to from those hooks.
+	hostInputChain = &nftables.Chain{
+		Name:  hostInputChainName,
+		Table: filterTable,
+		Type:  nftables.ChainTypeFilter,
+	}
+	hostOutputChain = &nftables.Chain{
+		Name:  hostOutputChainName,
+		Table: filterTable,
+		Type:  nftables.ChainTypeFilter,
+	}
+)
+
+// cgroup is the cgroup v2 of a container.
+type cgroup struct {
+	// path is relative to the root of the cgroup v2 hierarchy.
+	path string
+	// level is the depth of the cgroup in the cgroup v2 hierarchy.
+	level uint32
+	// id is the inode number of the cgroup directory, which is what
+	// the kernel compares the cgroup of sockets against.
+	id uint64
+}
+
+// checkCgroupv2Support returns an error if the kernel can't match
+// sockets by their cgroup v2.
+func checkCgroupv2Support() error {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(cgroupRoot, &statfs); err != nil {
+		return fmt.Errorf("error getting file system of %s: %w", cgroupRoot, err)
+	}
+	if statfs.Type != unix.CGROUP2_SUPER_MAGIC {
+		return fmt.Errorf("%s is not a cgroup v2 file system", cgroupRoot)
+	}
+
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return fmt.Errorf("error getting kernel version: %w", err)
+	}
+	kernelVer := unix.ByteSliceToString(uname.Release[:])
+	var major, minor int
+	if _, err := fmt.Sscanf(kernelVer, "%d.%d", &major, &minor); err != nil {
+		return fmt.Errorf("error parsing kernel version: %w", err)
+	}
+	// matching sockets by cgroup v2 was added in 5.13
+	if major < 5 || (major == 5 && minor < 13) {
+		return fmt.Errorf("kernel version %q is too old, 5.13 or greater is required", kernelVer)
+	}
+
+	return nil
+}
+
+// containerCgroup returns the cgroup v2 of the main process of a
+// container.
+func containerCgroup(container types.ContainerJSON) (cgroup, error) {
+	if container.State == nil || container.State.Pid == 0 {
+		return cgroup{}, errors.New("container has no running process")
+	}
+
+	procFile := fmt.Sprintf("/proc/%d/cgroup", container.State.Pid)
+	b, err := os.ReadFile(procFile)
+	if err != nil {
+		return cgroup{}, fmt.Errorf("error reading %s: %w", procFile, err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		// the cgroup v2 hierarchy always has an ID of 0
+		path, ok := strings.CutPrefix(line, "0::")
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(path, "/..") {
+			return cgroup{}, errors.New("cgroup of container is outside of the cgroup namespace of whalewall")
+		}
+		path = strings.Trim(path, "/")
+		if path == "" {
+			return cgroup{}, errors.New("container is in the root cgroup")
+		}
+
+		var stat unix.Stat_t
+		if err := unix.Stat(filepath.Join(cgroupRoot, path), &stat); err != nil {
+			return cgroup{}, fmt.Errorf("error getting ID of cgroup %q: %w", path, err)
+		}
+
+		return cgroup{
+			path:  path,
+			level: uint32(strings.Count(path, "/") + 1),
+			id:    stat.Ino,
+		}, nil
+	}
+
+	return cgroup{}, fmt.Errorf("cgroup v2 not found in %s", procFile)
+}
+
+func buildHostInputChainName(name, id string) string {
+	return buildChainName(name, id) + "-in"
+}
+
+// createCgroupJumpRule returns a rule that jumps to dstChainName if the
+// socket of a packet belongs to cg or one of its descendants.
+func createCgroupJumpRule(srcChain *nftables.Chain, dstChainName string, cg cgroup, contID string) *nftables.Rule {
+	return &nftables.Rule{
+		Table: filterTable,
+		Chain: srcChain,
+		Exprs: []expr.Any{
+			// [ socket load cgroupv2 => reg 1 , level cg.level ]
+			&expr.Socket{
+				Key:      expr.SocketKeyCgroupv2,
+				Level:    cg.level,
+				Register: 1,
+			},
+			// [ cmp eq reg 1 cg.id ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     binary.NativeEndian.AppendUint64(nil, cg.id),
+			},
+			&expr.Counter{},
+			&expr.Verdict{
+				Kind:  expr.VerdictJump,
+				Chain: dstChainName,
+			},
+		},
+		UserData: []byte(contID),
+	}
+}
+
+// createHostNetworkRules creates nftables rules for a container that
+// uses host networking. Traffic of the container is matched by the
+// cgroup of its sockets, and only output rules and input rules that
+// match ports are supported.
+func (r *RuleManager) createHostNetworkRules(ctx context.Context, logger *zap.Logger, container types.ContainerJSON, contName string, rulesCfg config, reject, isNew bool) error {
+	if r.cgroupv2Err != nil {
+		return fmt.Errorf("container %q is using host networking, but its traffic can't be filtered: %w", contName, r.cgroupv2Err)
+	}
+	if err := validateHostNetworkConfig(rulesCfg); err != nil {
+		return fmt.Errorf("error validating rules: %w", err)
+	}
+	cg, err := r.containerCgroup(container)
+	if err != nil {
+		return fmt.Errorf("error finding cgroup of container: %w", err)
+	}
+	logger.Info("filtering host networked container by cgroup", zap.String("cgroup.path", cg.path))
+
+	nfc, err := r.newFirewallClient()
+	if err != nil {
+		return fmt.Errorf("error creating netlink connection: %w", err)
+	}
+
+	// traffic from the container is handled in the output chain and
+	// traffic to the container in the input chain
+	outChain := &nftables.Chain{
+		Name:  buildChainName(contName, container.ID),
+		Table: filterTable,
+		Type:  nftables.ChainTypeFilter,
+	}
+	inChain := &nftables.Chain{
+		Name:  buildHostInputChainName(contName, container.ID),
+		Table: filterTable,
+		Type:  nftables.ChainTypeFilter,
+	}
+	nfc.AddChain(outChain)
+	nfc.AddChain(inChain)
+	if err := ignoringErr(nfc.Flush, syscall.EEXIST); err != nil {
+		return fmt.Errorf("error creating chains: %w", err)
+	}
+
+	chainRules := map[string][]*nftables.Rule{
+		outChain.Name: nil,
+		inChain.Name:  nil,
+	}
+	if r.estFastPath {
+		// established traffic of containers using host networking
+		// isn't accepted in the whalewall chain as they have no
+		// addresses of their own
+		for _, chain := range []*nftables.Chain{outChain, inChain} {
+			chainRules[chain.Name] = append(chainRules[chain.Name], createHostEstRule(chain, container.ID))
+		}
+	}
+
+	addRules := func(ruleCfgs []ruleConfig, inbound bool) error {
+		chain, estChain := outChain, inChain
+		if inbound {
+			chain, estChain = inChain, outChain
+		}
+		for _, ruleCfg := range ruleCfgs {
+			if ruleCfg.LogPrefix != "" {
+				ruleCfg.LogPrefix = formatLogPrefix(ruleCfg.LogPrefix, contName, container.ID)
+			}
+			ips, err := r.expandAddrs(ruleCfg.IPs, netip.Addr{})
+			if err != nil {
+				return fmt.Errorf("error expanding ips: %w", err)
+			}
+			ruleCfg.IPs = ips
+
+			rules, err := r.createNFTRules(nfc, logger, ruleDetails{
+				inbound:   inbound,
+				cfg:       ruleCfg,
+				chain:     chain,
+				estChain:  estChain,
+				contID:    container.ID,
+				estContID: container.ID,
+			})
+			if err != nil {
+				return fmt.Errorf("error creating firewall rules: %w", err)
+			}
+			for _, rule := range rules {
+				chainRules[rule.Chain.Name] = append(chainRules[rule.Chain.Name], rule)
+			}
+		}
+		return nil
+	}
+	if err := addRules(rulesCfg.Output, false); err != nil {
+		return fmt.Errorf("error creating output rules: %w", err)
+	}
+	if err := addRules(rulesCfg.Input, true); err != nil {
+		return fmt.Errorf("error creating input rules: %w", err)
+	}
+	for _, chain := range []*nftables.Chain{outChain, inChain} {
+		chainRules[chain.Name] = append(chainRules[chain.Name], r.createDropRules(chain, container.ID, reject)...)
+	}
+
+	for _, chain := range []*nftables.Chain{outChain, inChain} {
+		if err := syncChainRules(nfc, logger, chain, chainRules[chain.Name]); err != nil {
+			return err
+		}
+	}
+
+	// jump to the container's chains last so its traffic is never
+	// allowed by an incomplete chain
+	jumpRules := []*nftables.Rule{
+		createCgroupJumpRule(hostOutputChain, outChain.Name, cg, container.ID),
+		createCgroupJumpRule(hostInputChain, inChain.Name, cg, container.ID),
+	}
+	for _, jumpRule := range jumpRules {
+		rules, err := nfc.GetRules(filterTable, jumpRule.Chain)
+		if err != nil {
+			return fmt.Errorf("error getting rules of chain %q: %w", jumpRule.Chain.Name, err)
+		}
+		if !findRule(logger, jumpRule, rules) {
+			nfc.AddRule(jumpRule)
+		}
+	}
+	if err := nfc.Flush(); err != nil {
+		return fmt.Errorf("error creating jump rules: %w", err)
+	}
+
+	if !isNew {
+		return nil
+	}
+
+	logger.Debug("adding to database")
+
+	tx, err := r.db.Begin(ctx, logger)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := tx.AddContainer(ctx, container.ID, contName); err != nil {
+		return fmt.Errorf("error adding container to database: %w", err)
+	}
+	service := container.Config.Labels[composeServiceLabel]
+	project := container.Config.Labels[composeProjectLabel]
+	if err := r.addContainer(ctx, tx, container.ID, contName, service, project, nil, nil); err != nil {
+		return fmt.Errorf("error adding container information to database: %w", err)
+	}
+
+	return nil
+}
+
+// createHostEstRule returns a rule that accepts established and related
+// traffic.
+func createHostEstRule(chain *nftables.Chain, contID string) *nftables.Rule {
+	exprs := matchConnStateExprs(stateEst)
+	exprs = append(exprs,
+		&expr.Counter{},
+		acceptVerdict,
+	)
+
+	return &nftables.Rule{
+		Table:    filterTable,
+		Chain:    chain,
+		Exprs:    exprs,
+		UserData: []byte(contID),
+	}
+}
+
+// syncChainRules makes the rules of chain equal to rules. Rules of
+// chain that aren't in rules are deleted.
+func syncChainRules(nfc firewallClient, logger *zap.Logger, chain *nftables.Chain, rules []*nftables.Rule) error {
+	currentRules, err := nfc.GetRules(filterTable, chain)
+	if err != nil {
+		return fmt.Errorf("error getting rules of chain %q: %w", chain.Name, err)
+	}
+	if len(currentRules) == len(rules) {
+		equal := true
+		for i := range rules {
+			if !rulesEqual(logger, currentRules[i], rules[i]) {
+				equal = false
+				break
+			}
+		}
+		if equal {
+			return nil
+		}
+	}
+
+	// replace the rules of the chain in one batch so traffic is never
+	// handled by an incomplete chain
+	for _, rule := range rules {
+		nfc.AddRule(rule)
+	}
+	for _, rule := range currentRules {
+		if err := nfc.DelRule(rule); err != nil {
+			logger.Error("error deleting rule", zap.Error(err))
+		}
+	}
+	if err := nfc.Flush(); err != nil {
+		return fmt.Errorf("error creating rules of chain %q: %w", chain.Name, err)
+	}
+
+	return nil
+}
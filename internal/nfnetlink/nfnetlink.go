@@ -0,0 +1,134 @@
+// Package nfnetlink implements the netlink plumbing shared by netfilter
+// subsystems that send packets to userspace.
+package nfnetlink
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// HeaderLen is the length of the netfilter header that precedes
+// attributes in every message.
+const HeaderLen = 4
+
+// Conn is a netlink connection to a netfilter subsystem. Messages sent
+// over it refer to a single resource of the subsystem, such as a NFLOG
+// group or a nfqueue.
+type Conn struct {
+	c      *netlink.Conn
+	subsys uint8
+	resID  uint16
+}
+
+// Dial opens a netlink connection to the netfilter subsystem subsys
+// that sends messages for the resource resID.
+func Dial(subsys uint8, resID uint16) (*Conn, error) {
+	c, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening netlink connection: %w", err)
+	}
+
+	return &Conn{
+		c:      c,
+		subsys: subsys,
+		resID:  resID,
+	}, nil
+}
+
+// Execute sends a message of type msgType with a single attribute and
+// waits for it to be acknowledged.
+func (c *Conn) Execute(msgType uint8, attrType uint16, data []byte) error {
+	msg, err := c.message(msgType, netlink.Request|netlink.Acknowledge, attrType, data)
+	if err != nil {
+		return err
+	}
+	_, err = c.c.Execute(msg)
+	return err
+}
+
+// Send sends a message of type msgType with a single attribute without
+// waiting for it to be acknowledged.
+func (c *Conn) Send(msgType uint8, attrType uint16, data []byte) error {
+	msg, err := c.message(msgType, netlink.Request, attrType, data)
+	if err != nil {
+		return err
+	}
+	_, err = c.c.Send(msg)
+	return err
+}
+
+func (c *Conn) message(msgType uint8, flags netlink.HeaderFlags, attrType uint16, data []byte) (netlink.Message, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(attrType, data)
+	attrs, err := ae.Encode()
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  c.msgType(msgType),
+			Flags: flags,
+		},
+		Data: append(Header(unix.AF_UNSPEC, c.resID), attrs...),
+	}, nil
+}
+
+// Receive blocks until messages are received and returns the data of
+// the ones of type msgType.
+func (c *Conn) Receive(msgType uint8) ([][]byte, error) {
+	msgs, err := c.c.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([][]byte, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.Header.Type == c.msgType(msgType) {
+			data = append(data, msg.Data)
+		}
+	}
+
+	return data, nil
+}
+
+func (c *Conn) msgType(msgType uint8) netlink.HeaderType {
+	return netlink.HeaderType(uint16(c.subsys)<<8 | uint16(msgType))
+}
+
+// Close closes the connection. Any blocked calls to Receive will be
+// unblocked. Closing the connection releases resources the kernel
+// bound to it, so they don't have to be unbound first; doing so would
+// need a lock that blocked calls to Receive hold.
+func (c *Conn) Close() error {
+	return c.c.Close()
+}
+
+// Attributes returns a decoder of the attributes of the message data
+// b.
+func Attributes(b []byte) (*netlink.AttributeDecoder, error) {
+	if len(b) < HeaderLen {
+		return nil, errors.New("message too short")
+	}
+
+	ad, err := netlink.NewAttributeDecoder(b[HeaderLen:])
+	if err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	return ad, nil
+}
+
+// Header returns the netfilter header of a message.
+func Header(family uint8, resID uint16) []byte {
+	// struct nfgenmsg {
+	//     __u8   nfgen_family;
+	//     __u8   version;
+	//     __be16 res_id;
+	// };
+	return binary.BigEndian.AppendUint16([]byte{family, unix.NFNETLINK_V0}, resID)
+}
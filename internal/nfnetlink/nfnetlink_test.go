@@ -0,0 +1,41 @@
+package nfnetlink
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCloseUnblocksReceive(t *testing.T) {
+	c, err := Dial(unix.NFNL_SUBSYS_QUEUE, 0)
+	if err != nil {
+		t.Skipf("netlink sockets aren't available: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := c.Receive(0)
+		errCh <- err
+	}()
+	// give Receive time to block
+	time.Sleep(100 * time.Millisecond)
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("error closing connection: %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("expected Receive to return an error after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Receive is still blocked after Close")
+	}
+}
+
+func TestAttributesTooShort(t *testing.T) {
+	if _, err := Attributes([]byte{unix.AF_INET, 0}); err == nil {
+		t.Error("expected error decoding truncated message")
+	}
+}
@@ -0,0 +1,180 @@
+package whalewall
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/docker/docker/api/types/network"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"go.uber.org/zap"
+
+	"github.com/capnspacehook/whalewall/database"
+)
+
+const (
+	modeLearn   = "learn"
+	modeEnforce = "enforce"
+
+	// learnLocalhostPrefix is the log prefix of rules that log new
+	// traffic from the gateway of a container's network, which is
+	// traffic from localhost to mapped ports.
+	learnLocalhostPrefix = "localhost"
+)
+
+// learnMode returns true if traffic of a container with labels that
+// isn't allowed should be logged and accepted instead of dropped.
+func (r *RuleManager) learnMode(labels map[string]string) (bool, error) {
+	mode, ok := labels[modeLabel]
+	if !ok {
+		return r.learn, nil
+	}
+
+	switch mode {
+	case modeLearn:
+		return true, nil
+	case modeEnforce:
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid mode %q, must be %q or %q", mode, modeLearn, modeEnforce)
+	}
+}
+
+// createLearnRules returns rules that log new traffic that reaches the
+// end of a container chain and accept it. New traffic from gateways
+// is logged separately so it can be identified as coming from
+// localhost.
+func (r *RuleManager) createLearnRules(chain *nftables.Chain, id string, gateways []netip.Addr) []*nftables.Rule {
+	prefix := chain.Name + " learn: "
+	localPrefix := chain.Name + " learn " + learnLocalhostPrefix + ": "
+	if r.nflog {
+		// the verdict is already part of NFLOG prefixes
+		prefix = chain.Name + ": "
+		localPrefix = chain.Name + " " + learnLocalhostPrefix + ": "
+	}
+
+	rules := make([]*nftables.Rule, 0, len(gateways)+2)
+	for _, gateway := range gateways {
+		exprs := matchConnStateExprs(stateNew)
+		exprs = append(exprs, matchAddrExprs(ref(gateway.As4())[:], srcAddrOffset)...)
+		exprs = append(exprs,
+			&expr.Counter{},
+			r.createLogExpr(localPrefix, modeLearn),
+			acceptVerdict,
+		)
+		rules = append(rules, &nftables.Rule{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: []byte(id),
+		})
+	}
+
+	exprs := matchConnStateExprs(stateNew)
+	exprs = append(exprs,
+		&expr.Counter{},
+		r.createLogExpr(prefix, modeLearn),
+	)
+	rules = append(rules,
+		&nftables.Rule{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: []byte(id),
+		},
+		&nftables.Rule{
+			Table: chain.Table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				&expr.Counter{},
+				acceptVerdict,
+			},
+			UserData: []byte(id),
+		},
+	)
+
+	return rules
+}
+
+// networkGateways returns the sorted IPv4 gateways of networks.
+func networkGateways(networks map[string]*network.EndpointSettings) []netip.Addr {
+	gateways := make([]netip.Addr, 0, len(networks))
+	for _, netSettings := range networks {
+		gateway, err := netip.ParseAddr(netSettings.Gateway)
+		if err != nil || !gateway.Is4() {
+			continue
+		}
+		if !slices.Contains(gateways, gateway) {
+			gateways = append(gateways, gateway)
+		}
+	}
+	slices.SortFunc(gateways, netip.Addr.Compare)
+
+	return gateways
+}
+
+// recordLearnedFlow adds new traffic of a container in learn mode to
+// the database. If the other end of the flow is a container managed
+// by whalewall, its name and the network it was reached on is recorded
+// as well.
+func (r *RuleManager) recordLearnedFlow(ctx context.Context, prefix logPrefix, direction string, flow packetFlow, seen time.Time) {
+	addr := flow.dstAddr
+	if direction == "inbound" {
+		addr = flow.srcAddr
+	}
+	addrBytes, err := addr.MarshalBinary()
+	if err != nil {
+		r.logger.Error("error marshaling address", zap.Error(err))
+		return
+	}
+
+	var localhost int64
+	if direction == "inbound" && prefix.rulePrefix == learnLocalhostPrefix {
+		localhost = 1
+	}
+	var peerName, peerNetwork string
+	if localhost == 0 {
+		peerName, peerNetwork, err = r.findPeerContainer(ctx, addrBytes)
+		if err != nil {
+			r.logger.Error("error finding container from address", zap.Stringer("addr", addr), zap.Error(err))
+		}
+	}
+
+	err = r.db.AddLearnedFlow(ctx, database.AddLearnedFlowParams{
+		ContainerName: prefix.contName,
+		Direction:     direction,
+		Addr:          addrBytes,
+		Proto:         int64(flow.proto),
+		Port:          int64(flow.dstPort),
+		Localhost:     localhost,
+		PeerContainer: peerName,
+		PeerNetwork:   peerNetwork,
+		FirstSeen:     seen.Unix(),
+		LastSeen:      seen.Unix(),
+	})
+	if err != nil {
+		r.logger.Error("error adding learned flow to database", zap.String("container.name", prefix.contName), zap.Error(err))
+	}
+}
+
+// findPeerContainer returns the name of the container managed by
+// whalewall that has address addr and the network the address belongs
+// to. Empty strings are returned if no container has the address.
+// Peers are found in the database instead of inspecting containers, as
+// this is done for every packet that is learned.
+func (r *RuleManager) findPeerContainer(ctx context.Context, addr []byte) (string, string, error) {
+	cont, err := r.db.GetContainerNameAndNetworkFromAddr(ctx, addr)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("error getting container from database: %w", err)
+	}
+
+	return cont.Name, cont.NetworkName, nil
+}
@@ -0,0 +1,324 @@
+package whalewall
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	rateLimitSetInfix = "-rate-"
+	connLimitSetInfix = "-conn-"
+
+	// rateLimitTimeout is how long sources are tracked after their
+	// last packet
+	rateLimitTimeout = time.Minute
+
+	// connlimitInvert is NFT_CONNLIMIT_F_INV, which makes connlimit
+	// expressions match when the connection count is over the limit
+	connlimitInvert = 1
+)
+
+// rateLimit limits how many packets or new connections each source
+// address is allowed to send per second.
+type rateLimit struct {
+	Rate  uint64
+	Burst uint32
+	Unit  limitUnit
+}
+
+type limitUnit uint8
+
+const (
+	limitConnections limitUnit = iota
+	limitPackets
+)
+
+func (u limitUnit) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+func (u *limitUnit) UnmarshalText(text []byte) error {
+	switch {
+	case bytes.Equal(text, []byte("connections")):
+		*u = limitConnections
+	case bytes.Equal(text, []byte("packets")):
+		*u = limitPackets
+	default:
+		return fmt.Errorf("invalid rate limit unit %q", string(text))
+	}
+	return nil
+}
+
+func (u limitUnit) String() string {
+	switch u {
+	case limitConnections:
+		return "connections"
+	case limitPackets:
+		return "packets"
+	default:
+		return fmt.Sprintf("unit(%d)", u)
+	}
+}
+
+// limited returns true if traffic matched by r is limited per source.
+func (r ruleConfig) limited() bool {
+	return r.RateLimit != (rateLimit{}) || r.MaxConnections != 0
+}
+
+func validateRateLimit(rl rateLimit) error {
+	if rl != (rateLimit{}) && rl.Rate == 0 {
+		return errors.New(`"rate" must be set when "rate_limit" is set`)
+	}
+
+	return nil
+}
+
+// createLimitRules returns rules that drop traffic of rd from sources
+// that exceed the rate limit or connection limit of rd. They must be
+// placed before the rules that allow the traffic.
+func (r *RuleManager) createLimitRules(nfc firewallClient, rd ruleDetails) ([]*nftables.Rule, error) {
+	cfg := rd.cfg
+	cfg.LogPrefix = ""
+	cfg.Verdict = verdict{
+		drop: true,
+	}
+	// the ban chain drops traffic after counting it towards bans
+	if rd.cfg.banChain != nil {
+		cfg.Verdict = verdict{
+			gotoChain: rd.cfg.banChain.Name,
+		}
+	}
+
+	var rules []*nftables.Rule
+	if rl := rd.cfg.RateLimit; rl.Rate != 0 {
+		// limiting packets limits established traffic too, unless it
+		// is accepted by the established fast path first
+		state := stateNew
+		if rl.Unit == limitPackets {
+			state = stateNewEst
+		}
+
+		set := &nftables.Set{
+			Table:      rd.chain.Table,
+			Name:       limitSetName(rd, rateLimitSetInfix),
+			KeyType:    nftables.TypeIPAddr,
+			Dynamic:    true,
+			HasTimeout: true,
+			Timeout:    rateLimitTimeout,
+		}
+		cfg.meter = meterExprs(set, unix.NFT_DYNSET_OP_UPDATE, &expr.Limit{
+			Type:  expr.LimitTypePkts,
+			Rate:  rl.Rate,
+			Over:  true,
+			Unit:  expr.LimitTimeSecond,
+			Burst: rl.Burst,
+		})
+		rule, err := r.createLimitRule(nfc, rd, cfg, state, set)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if rd.cfg.MaxConnections != 0 {
+		set := &nftables.Set{
+			Table:   rd.chain.Table,
+			Name:    limitSetName(rd, connLimitSetInfix),
+			KeyType: nftables.TypeIPAddr,
+			Dynamic: true,
+		}
+		cfg.meter = meterExprs(set, unix.NFT_DYNSET_OP_ADD, &expr.Connlimit{
+			Count: rd.cfg.MaxConnections,
+			Flags: connlimitInvert,
+		})
+		rule, err := r.createLimitRule(nfc, rd, cfg, stateNew, set)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func (r *RuleManager) createLimitRule(nfc firewallClient, rd ruleDetails, cfg ruleConfig, state uint32, set *nftables.Set) (*nftables.Rule, error) {
+	if err := nfc.AddSet(set, nil); err != nil {
+		return nil, fmt.Errorf("error adding set %q: %w", set.Name, err)
+	}
+	if err := ignoringErr(nfc.Flush, syscall.EEXIST); err != nil {
+		return nil, fmt.Errorf("error creating set %q: %w", set.Name, err)
+	}
+
+	return r.createNFTRule(nfc, rd.inbound, false, state, rd.addr, cfg, queueNums{}, rd.chain, rd.contID)
+}
+
+// limitSetName returns the name of the set that tracks the sources of
+// the traffic rd matches. The name is derived from what rd matches so
+// the same set is used when rules are recreated.
+func limitSetName(rd ruleDetails, infix string) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%v %v %v %v %v %v %v %v %v",
+		rd.addr,
+		rd.cfg.IPs,
+		rd.cfg.Proto,
+		rd.cfg.SrcPorts,
+		rd.cfg.DstPorts,
+		rd.cfg.iifnames,
+		rd.cfg.RateLimit,
+		rd.cfg.MaxConnections,
+		rd.cfg.addrSet != nil,
+	)
+	if rd.cfg.addrSet != nil {
+		fmt.Fprint(h, rd.cfg.addrSet.Name)
+	}
+
+	return fmt.Sprintf("%s%s%08x", rd.chain.Name, infix, h.Sum32())
+}
+
+// meterExprs returns expressions that store the source address of
+// packets in set and evaluate stmt for each source address.
+func meterExprs(set *nftables.Set, op uint32, stmt expr.Any) []expr.Any {
+	return []expr.Any{
+		// [ payload load 4b @ network header + 12 => reg 1 ]
+		getAddrExpr(srcAddrOffset),
+		// [ dynset update/add reg_key 1 set ... expr ... ]
+		&expr.Dynset{
+			SrcRegKey: 1,
+			SetName:   set.Name,
+			Operation: op,
+			Exprs:     []expr.Any{stmt},
+		},
+	}
+}
+
+// deleteLimitSets deletes the sets of the rate limits and connection
+// limits of a chain.
+func deleteLimitSets(nfc firewallClient, chain *nftables.Chain) error {
+	sets, err := nfc.GetSets(chain.Table)
+	if err != nil {
+		return fmt.Errorf("error getting sets: %w", err)
+	}
+
+	for _, set := range sets {
+		if !isLimitSet(chain, set.Name) {
+			continue
+		}
+		nfc.DelSet(set)
+		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+			return fmt.Errorf("error deleting set %q: %w", set.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func isLimitSet(chain *nftables.Chain, setName string) bool {
+	return strings.HasPrefix(setName, chain.Name+rateLimitSetInfix) || strings.HasPrefix(setName, chain.Name+connLimitSetInfix)
+}
+
+// LimitStatus is the state of a rate limit or connection limit of a
+// container.
+type LimitStatus struct {
+	// Limit describes the limit, such as "rate_limit 10/second".
+	Limit string
+	// Sources is the number of source addresses that are tracked.
+	Sources int
+	// Dropped is the number of packets that were dropped because a
+	// source exceeded the limit.
+	Dropped uint64
+}
+
+// LimitStatus returns the state of the rate limits and connection
+// limits of a container.
+func (r *RuleManager) LimitStatus(ctx context.Context, contName string) ([]LimitStatus, error) {
+	id, name, err := r.getContainerIDAndName(ctx, r.db, contName)
+	if err != nil {
+		return nil, err
+	}
+
+	nfc, err := r.newFirewallClient()
+	if err != nil {
+		return nil, fmt.Errorf("error creating netlink connection: %w", err)
+	}
+
+	var statuses []LimitStatus
+	for _, chainName := range []string{buildChainName(name, id), buildHostInputChainName(name, id)} {
+		chain := &nftables.Chain{
+			Table: filterTable,
+			Name:  chainName,
+		}
+		rules, err := nfc.GetRules(filterTable, chain)
+		if err != nil {
+			// only containers using host networking have a host input
+			// chain
+			if errors.Is(err, syscall.ENOENT) {
+				continue
+			}
+			return nil, fmt.Errorf("error getting rules of chain %q: %w", chainName, err)
+		}
+
+		for _, rule := range rules {
+			status, ok, err := ruleLimitStatus(nfc, chain, rule)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				statuses = append(statuses, status)
+			}
+		}
+	}
+
+	return statuses, nil
+}
+
+func ruleLimitStatus(nfc firewallClient, chain *nftables.Chain, rule *nftables.Rule) (LimitStatus, bool, error) {
+	var (
+		status LimitStatus
+		dynset *expr.Dynset
+	)
+	for _, e := range rule.Exprs {
+		switch e := e.(type) {
+		case *expr.Dynset:
+			if isLimitSet(chain, e.SetName) {
+				dynset = e
+			}
+		case *expr.Counter:
+			status.Dropped = e.Packets
+		}
+	}
+	if dynset == nil {
+		return LimitStatus{}, false, nil
+	}
+
+	for _, e := range dynset.Exprs {
+		switch e := e.(type) {
+		case *expr.Limit:
+			status.Limit = fmt.Sprintf("rate_limit %d/second burst %d", e.Rate, e.Burst)
+		case *expr.Connlimit:
+			status.Limit = fmt.Sprintf("max_connections %d", e.Count)
+		}
+	}
+	if status.Limit == "" {
+		status.Limit = dynset.SetName
+	}
+
+	elems, err := nfc.GetSetElements(&nftables.Set{
+		Table: chain.Table,
+		Name:  dynset.SetName,
+	})
+	if err != nil {
+		return LimitStatus{}, false, fmt.Errorf("error getting elements of set %q: %w", dynset.SetName, err)
+	}
+	status.Sources = len(elems)
+
+	return status, true, nil
+}
@@ -0,0 +1,318 @@
+package whalewall
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/nftables/expr"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+
+	"github.com/capnspacehook/whalewall/nflog"
+)
+
+// nflogCopyLen is how many bytes of logged packets are copied from the
+// kernel, enough for IPv4 headers with options and transport headers.
+const nflogCopyLen = 128
+
+const (
+	// maxReceiveErrs is how many times in a row receiving packets from
+	// the kernel may fail before whalewall stops receiving them.
+	maxReceiveErrs = 10
+	// receiveBackoffMin and receiveBackoffMax bound how long whalewall
+	// waits before receiving packets again after receiving them failed.
+	receiveBackoffMin = 100 * time.Millisecond
+	receiveBackoffMax = 10 * time.Second
+)
+
+// createLogExpr returns an expression that logs packets with prefix.
+// If logging to a NFLOG group is enabled, verdict is added to the
+// prefix so the log reader knows what happened to the packet.
+func (r *RuleManager) createLogExpr(prefix, verdict string) expr.Any {
+	if !r.nflog {
+		return logExpr(prefix)
+	}
+
+	return &expr.Log{
+		Key:   (1 << unix.NFTA_LOG_PREFIX) | (1 << unix.NFTA_LOG_GROUP),
+		Group: r.logGroup,
+		Data:  []byte(verdict + " " + prefix),
+	}
+}
+
+// verdictName returns the name of the verdict a rule created from cfg
+// will have.
+func verdictName(cfg ruleConfig, queue queueNums) string {
+	switch {
+	case cfg.Verdict.Chain != "" || cfg.Verdict.gotoChain != "":
+		return "chain"
+	case queue.set():
+		return "queue"
+	case cfg.Verdict.drop && cfg.Verdict.reject:
+		return "reject"
+	case cfg.Verdict.drop:
+		return "drop"
+	default:
+		return "accept"
+	}
+}
+
+// logPrefix is a parsed NFLOG prefix created by createLogExpr.
+type logPrefix struct {
+	verdict    string
+	contName   string
+	contID     string
+	rulePrefix string
+}
+
+// parseLogPrefix parses a prefix in the form of
+// "<verdict> whalewall-<name>-<id> <rule prefix>: ".
+func parseLogPrefix(prefix string) (logPrefix, bool) {
+	var p logPrefix
+
+	verdict, rest, ok := strings.Cut(prefix, " ")
+	if !ok {
+		return p, false
+	}
+	chainName, rulePrefix, _ := strings.Cut(rest, " ")
+	chainName = strings.TrimSuffix(chainName, ":")
+	if !strings.HasPrefix(chainName, chainPrefix) {
+		return p, false
+	}
+	chainName = chainName[len(chainPrefix):]
+	i := strings.LastIndexByte(chainName, '-')
+	if i == -1 {
+		return p, false
+	}
+
+	p.verdict = verdict
+	p.contName = chainName[:i]
+	p.contID = chainName[i+1:]
+	p.rulePrefix = strings.TrimSuffix(rulePrefix, ": ")
+
+	return p, true
+}
+
+// packetFlow is the 5-tuple of a packet.
+type packetFlow struct {
+	srcAddr netip.Addr
+	dstAddr netip.Addr
+	proto   uint8
+	srcPort uint16
+	dstPort uint16
+}
+
+// parsePacketFlow parses the 5-tuple of an IPv4 packet. Ports will be
+// zero if the packet isn't TCP or UDP.
+func parsePacketFlow(b []byte) (packetFlow, error) {
+	var flow packetFlow
+	if len(b) < 20 {
+		return flow, errors.New("packet too short")
+	}
+	if b[0]>>4 != 4 {
+		return flow, errors.New("packet is not IPv4")
+	}
+
+	flow.proto = b[9]
+	flow.srcAddr = netip.AddrFrom4([4]byte(b[12:16]))
+	flow.dstAddr = netip.AddrFrom4([4]byte(b[16:20]))
+	hdrLen := int(b[0]&0x0f) * 4
+	if flow.proto == unix.IPPROTO_TCP || flow.proto == unix.IPPROTO_UDP {
+		if len(b) < hdrLen+4 {
+			return flow, errors.New("transport header truncated")
+		}
+		flow.srcPort = binary.BigEndian.Uint16(b[hdrLen:])
+		flow.dstPort = binary.BigEndian.Uint16(b[hdrLen+2:])
+	}
+
+	return flow, nil
+}
+
+func protoName(proto uint8) string {
+	switch proto {
+	case unix.IPPROTO_TCP:
+		return "tcp"
+	case unix.IPPROTO_UDP:
+		return "udp"
+	case unix.IPPROTO_ICMP:
+		return "icmp"
+	default:
+		return "unknown"
+	}
+}
+
+// readLogs logs packets logged to the NFLOG group until the RuleManager
+// is stopped.
+func (r *RuleManager) readLogs(ctx context.Context, conn *nflog.Conn) {
+	go func() {
+		<-r.stopping
+		if err := conn.Close(); err != nil {
+			r.logger.Error("error closing NFLOG connection", zap.Error(err))
+		}
+	}()
+
+	var errs int
+	for {
+		pkts, skipped, err := conn.Receive()
+		if err != nil {
+			select {
+			case <-r.stopping:
+				return
+			default:
+			}
+			r.logger.Error("error receiving logged packets", zap.Error(err))
+			errs++
+			if !r.receiveBackoff(errs) {
+				return
+			}
+			continue
+		}
+		errs = 0
+
+		for _, err := range skipped {
+			r.logger.Warn("skipping malformed logged packet", zap.Error(err))
+		}
+		r.logPackets(ctx, pkts)
+	}
+}
+
+// receiveBackoff waits before packets are received again after
+// receiving them failed errs times in a row. False is returned if the
+// RuleManager is stopping or receiving packets failed too many times
+// in a row, in which case packets should no longer be received.
+func (r *RuleManager) receiveBackoff(errs int) bool {
+	if errs > maxReceiveErrs {
+		r.logger.Error("too many errors receiving packets, no longer receiving them")
+		return false
+	}
+
+	backoff := min(receiveBackoffMin<<(errs-1), receiveBackoffMax)
+	select {
+	case <-r.stopping:
+		return false
+	case <-time.After(backoff):
+		return true
+	}
+}
+
+// contAddrs are the addresses of a container, or ok is false if they
+// could not be found.
+type contAddrs struct {
+	addrs []netip.Addr
+	ok    bool
+}
+
+// logPackets logs a batch of packets received from the NFLOG group.
+// The addresses of each container are only looked up once per batch,
+// as the database would otherwise be queried for every packet.
+func (r *RuleManager) logPackets(ctx context.Context, pkts []nflog.Packet) {
+	addrCache := make(map[string]contAddrs)
+	for _, pkt := range pkts {
+		r.logPacket(ctx, pkt, addrCache)
+	}
+}
+
+func (r *RuleManager) logPacket(ctx context.Context, pkt nflog.Packet, addrCache map[string]contAddrs) {
+	prefix, ok := parseLogPrefix(pkt.Prefix)
+	if !ok {
+		r.logger.Debug("ignoring logged packet with unknown prefix", zap.String("prefix", pkt.Prefix))
+		return
+	}
+	flow, err := parsePacketFlow(pkt.Payload)
+	if err != nil {
+		r.logger.Debug("error parsing logged packet", zap.Error(err))
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("container.id", prefix.contID),
+		zap.String("container.name", prefix.contName),
+	}
+	if prefix.rulePrefix != "" {
+		fields = append(fields, zap.String("rule.log_prefix", prefix.rulePrefix))
+	}
+	addrs, ok := addrCache[prefix.contName]
+	if !ok {
+		addrs = r.containerAddrs(ctx, prefix.contName)
+		addrCache[prefix.contName] = addrs
+	}
+	direction := packetDirection(addrs, flow.srcAddr)
+	fields = append(fields,
+		zap.String("packet.direction", direction),
+		zap.String("packet.verdict", prefix.verdict),
+		zap.String("packet.proto", protoName(flow.proto)),
+		zap.Stringer("packet.src_addr", flow.srcAddr),
+		zap.Uint16("packet.src_port", flow.srcPort),
+		zap.Stringer("packet.dst_addr", flow.dstAddr),
+		zap.Uint16("packet.dst_port", flow.dstPort),
+	)
+	if !pkt.Timestamp.IsZero() {
+		fields = append(fields, zap.Time("packet.time", pkt.Timestamp))
+	}
+
+	// the packet will be logged again when it is dropped or rejected
+	if prefix.verdict == verdictBan {
+		r.logger.Warn("banned source address", fields...)
+		return
+	}
+	r.logger.Info("logged packet", fields...)
+
+	if direction == "unknown" {
+		return
+	}
+	seen := pkt.Timestamp
+	if seen.IsZero() {
+		seen = time.Now()
+	}
+	switch prefix.verdict {
+	case "drop", "reject":
+		r.recordDenial(ctx, prefix.contName, direction, flow, seen)
+	case modeLearn:
+		r.recordLearnedFlow(ctx, prefix, direction, flow, seen)
+	}
+}
+
+// containerAddrs returns the addresses of the container named
+// contName from the database.
+func (r *RuleManager) containerAddrs(ctx context.Context, contName string) contAddrs {
+	id, err := r.db.GetContainerID(ctx, contName)
+	if err != nil {
+		r.logger.Debug("error getting container ID", zap.String("container.name", contName), zap.Error(err))
+		return contAddrs{}
+	}
+	dbAddrs, err := r.db.GetContainerAddrs(ctx, id)
+	if err != nil {
+		r.logger.Debug("error getting container addrs", zap.String("container.name", contName), zap.Error(err))
+		return contAddrs{}
+	}
+
+	addrs := make([]netip.Addr, 0, len(dbAddrs))
+	for _, addr := range dbAddrs {
+		if a, ok := netip.AddrFromSlice(addr); ok {
+			addrs = append(addrs, a)
+		}
+	}
+	return contAddrs{
+		addrs: addrs,
+		ok:    true,
+	}
+}
+
+// packetDirection returns "outbound" if srcAddr is an address of the
+// container, "inbound" if not or "unknown" if the container's addresses
+// could not be found.
+func packetDirection(addrs contAddrs, srcAddr netip.Addr) string {
+	if !addrs.ok {
+		return "unknown"
+	}
+	if slices.Contains(addrs.addrs, srcAddr) {
+		return "outbound"
+	}
+
+	return "inbound"
+}
@@ -0,0 +1,27 @@
+package whalewall
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestReceiveBackoff(t *testing.T) {
+	t.Parallel()
+
+	r := &RuleManager{
+		logger:   zap.NewNop(),
+		stopping: make(chan struct{}),
+	}
+	if !r.receiveBackoff(1) {
+		t.Error("expected receiving to be retried after an error")
+	}
+	if r.receiveBackoff(maxReceiveErrs + 1) {
+		t.Error("expected receiving to stop after too many errors")
+	}
+
+	close(r.stopping)
+	if r.receiveBackoff(1) {
+		t.Error("expected receiving to stop when stopping")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"sync"
@@ -24,6 +25,8 @@ import (
 
 	"github.com/capnspacehook/whalewall/container"
 	"github.com/capnspacehook/whalewall/database"
+	"github.com/capnspacehook/whalewall/nflog"
+	"github.com/capnspacehook/whalewall/nfqueue"
 )
 
 const (
@@ -36,6 +39,7 @@ PRAGMA journal_mode = WAL;
 	dummyName = "dummy_name"
 
 	enabledLabel = "whalewall.enabled"
+	modeLabel    = "whalewall.mode"
 	rulesLabel   = "whalewall.rules"
 )
 
@@ -51,12 +55,40 @@ type RuleManager struct {
 
 	newDockerClient   dockerClientCreator
 	newFirewallClient firewallClientCreator
+	hostAddrs         func() ([]netip.Addr, error)
+	addrInterface     func(netip.Addr) (string, error)
+	checkCgroupv2     func() error
+	containerCgroup   func(types.ContainerJSON) (cgroup, error)
 
 	containerTracker *container.Tracker
 
 	createCh chan containerDetails
 	deleteCh chan string
 
+	ruleLayout   RuleLayout
+	estFastPath  bool
+	learn        bool
+	reject       bool
+	nflog        bool
+	logGroup     uint16
+	logDrops     bool
+	dropLogLimit uint32
+	userChains   []userChain
+	sniQueue     uint16
+	// sni is set if the server names of TLS connections of containers
+	// can be filtered
+	sni      *sniFilter
+	dnsQueue uint16
+	// dns is set if addresses of domains containers are allowed to
+	// connect to can be read from DNS responses
+	dns *dnsSnooper
+	// dnsResolvers are DNS servers whose responses to all containers
+	// are trusted
+	dnsResolvers []netip.Addr
+	// cgroupv2Err is set if containers using host networking can't be
+	// filtered
+	cgroupv2Err error
+
 	db        database.DB
 	dockerCli dockerClient
 }
@@ -68,9 +100,83 @@ type firewallClientCreator func() (firewallClient, error)
 type containerDetails struct {
 	container types.ContainerJSON
 	isNew     bool
+	// recreate is true if the container's rules should be deleted
+	// before they are created again
+	recreate bool
+}
+
+// Option configures optional behavior of a [RuleManager].
+type Option func(*RuleManager)
+
+// WithRuleLayout sets how allowed traffic is laid out in container
+// chains. [LayoutRules] is used by default.
+func WithRuleLayout(layout RuleLayout) Option {
+	return func(r *RuleManager) {
+		r.ruleLayout = layout
+	}
+}
+
+// WithEstablishedFastPath sets whether established and related traffic
+// of all managed containers is accepted at the top of the whalewall
+// chain. If enabled, only rules for new traffic are created in
+// container chains.
+func WithEstablishedFastPath(enabled bool) Option {
+	return func(r *RuleManager) {
+		r.estFastPath = enabled
+	}
+}
+
+// WithLearnMode sets whether traffic of containers that isn't allowed
+// is logged and accepted instead of dropped. Containers can override
+// this with the whalewall.mode label.
+func WithLearnMode(enabled bool) Option {
+	return func(r *RuleManager) {
+		r.learn = enabled
+	}
+}
+
+// WithReject sets whether traffic of containers that isn't allowed is
+// rejected instead of silently dropped. Containers can override this
+// with the reject key of their rules config.
+func WithReject(enabled bool) Option {
+	return func(r *RuleManager) {
+		r.reject = enabled
+	}
+}
+
+// WithLogGroup makes rules log to the NFLOG group group instead of the
+// kernel log. Packets logged to the group are read and logged by the
+// RuleManager.
+func WithLogGroup(group uint16) Option {
+	return func(r *RuleManager) {
+		r.nflog = true
+		r.logGroup = group
+	}
+}
+
+// DefaultDropLogLimit is how many dropped packets are logged per
+// container per minute by default.
+const DefaultDropLogLimit = 10
+
+// WithDropLogging makes rules log traffic of containers that is dropped
+// or rejected because it isn't allowed. When logging to a NFLOG group,
+// logged traffic is recorded as denials.
+func WithDropLogging(enabled bool) Option {
+	return func(r *RuleManager) {
+		r.logDrops = enabled
+	}
+}
+
+// WithDropLogLimit limits how many dropped packets are logged per
+// container per minute if logging dropped traffic is enabled. If limit
+// is 0 all dropped packets are logged. Defaults to DefaultDropLogLimit.
+func WithDropLogLimit(limit uint32) Option {
+	return func(r *RuleManager) {
+		r.dropLogLimit = limit
+	}
 }
 
-func NewRuleManager(ctx context.Context, logger *zap.Logger, dbFile string, timeout time.Duration) (*RuleManager, error) {
+func NewRuleManager(ctx context.Context, logger *zap.Logger, dbFile string, timeout time.Duration, opts ...Option) (*RuleManager, error) {
 	r := RuleManager{
 		stopping: make(chan struct{}),
 		done:     make(chan struct{}),
@@ -88,9 +194,17 @@ func NewRuleManager(ctx context.Context, logger *zap.Logger, dbFile string, time
 		newFirewallClient: func() (firewallClient, error) {
 			return nftables.New()
 		},
+		hostAddrs:        interfaceAddrs,
+		addrInterface:    addrInterface,
+		checkCgroupv2:    checkCgroupv2Support,
+		containerCgroup:  containerCgroup,
 		containerTracker: container.NewTracker(logger),
 		createCh:         make(chan containerDetails),
 		deleteCh:         make(chan string),
+		dropLogLimit:     DefaultDropLogLimit,
+	}
+	for _, opt := range opts {
+		opt(&r)
 	}
 	err := r.initDB(ctx, dbFile)
 	if err != nil {
@@ -112,6 +226,54 @@ func (r *RuleManager) Start(ctx context.Context) error {
 		r.logger.Error("error cleaning up rules", zap.Error(err))
 	}
 
+	if r.nflog {
+		conn, err := nflog.Open(r.logGroup, nflogCopyLen)
+		if err != nil {
+			return fmt.Errorf("error opening NFLOG group: %w", err)
+		}
+		r.wg.Add(2)
+		go func() {
+			defer r.wg.Done()
+			r.readLogs(ctx, conn)
+		}()
+		go func() {
+			defer r.wg.Done()
+			r.trimRecordedFlows(ctx)
+		}()
+	}
+	if r.sni != nil {
+		conn, err := nfqueue.Open(r.sniQueue, sniCopyLen)
+		if err != nil {
+			return fmt.Errorf("error opening SNI queue: %w", err)
+		}
+		nfc, err := r.newFirewallClient()
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("error creating netlink connection: %w", err)
+		}
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.filterSNI(conn, nfc)
+		}()
+	}
+	if r.dns != nil {
+		conn, err := nfqueue.Open(r.dnsQueue, dnsCopyLen)
+		if err != nil {
+			return fmt.Errorf("error opening DNS queue: %w", err)
+		}
+		nfc, err := r.newFirewallClient()
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("error creating netlink connection: %w", err)
+		}
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.snoopDNS(conn, nfc)
+		}()
+	}
+
 	r.wg.Add(2)
 	go func() {
 		defer r.wg.Done()
@@ -134,6 +296,10 @@ func (r *RuleManager) Start(ctx context.Context) error {
 		for {
 			select {
 			case msg := <-messages:
+				if msg.Type == events.NetworkEventType {
+					r.handleNetworkEvent(ctx, msg)
+					continue
+				}
 				if e, ok := msg.Actor.Attributes[enabledLabel]; ok {
 					var enabled bool
 					if err := yaml.Unmarshal([]byte(e), &enabled); err != nil {
@@ -199,6 +365,12 @@ func (r *RuleManager) init(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("error connecting to docker daemon: %w", err)
 	}
+
+	r.cgroupv2Err = r.checkCgroupv2()
+	if r.cgroupv2Err != nil {
+		r.logger.Info("traffic of containers using host networking can't be filtered", zap.Error(r.cgroupv2Err))
+	}
+
 	return nil
 }
 
@@ -230,11 +402,13 @@ func (r *RuleManager) initDB(ctx context.Context, dbFile string) error {
 	if err != nil {
 		return fmt.Errorf("error opening database: %w", err)
 	}
-	// create database schema if a SQLite database didn't exist
-	if dbNotExist {
-		if _, err := sqlDB.ExecContext(ctx, dbSchema); err != nil {
-			return fmt.Errorf("error creating tables in database: %w", err)
-		}
+	// create database schema, tables that were added in newer versions
+	// will be created if the database already existed
+	if _, err := sqlDB.ExecContext(ctx, dbSchema); err != nil {
+		return fmt.Errorf("error creating tables in database: %w", err)
+	}
+	if err := migrateDB(ctx, sqlDB); err != nil {
+		return fmt.Errorf("error migrating database: %w", err)
 	}
 	if _, err := sqlDB.ExecContext(ctx, dbCommands); err != nil {
 		return fmt.Errorf("error executing commands in database: %w", err)
@@ -267,6 +441,28 @@ func (r *RuleManager) initDB(ctx context.Context, dbFile string) error {
 	return nil
 }
 
+// migrateDB adds columns that were added in newer versions to tables
+// of a database that already existed.
+func migrateDB(ctx context.Context, sqlDB *sql.DB) error {
+	var hasNetworkName bool
+	err := sqlDB.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM pragma_table_info('addrs') WHERE name = 'network_name')",
+	).Scan(&hasNetworkName)
+	if err != nil {
+		return fmt.Errorf("error getting columns of table: %w", err)
+	}
+	if !hasNetworkName {
+		// networks of addresses of existing containers are unknown
+		// until the containers are recreated
+		_, err := sqlDB.ExecContext(ctx, "ALTER TABLE addrs ADD COLUMN network_name TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			return fmt.Errorf("error adding column to table: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func addFilters(ctx context.Context, client dockerClient) (<-chan events.Message, <-chan error) {
 	filter := filters.NewArgs(
 		filters.KeyValuePair{
@@ -281,10 +477,93 @@ func addFilters(ctx context.Context, client dockerClient) (<-chan events.Message
 			Key:   "event",
 			Value: "die",
 		},
+		filters.KeyValuePair{
+			Key:   "type",
+			Value: "network",
+		},
+		filters.KeyValuePair{
+			Key:   "event",
+			Value: "connect",
+		},
+		filters.KeyValuePair{
+			Key:   "event",
+			Value: "disconnect",
+		},
 	)
 	return client.Events(ctx, types.EventsOptions{Filters: filter})
 }
 
+// handleNetworkEvent recreates the rules of a running container that
+// is connected to or disconnected from a network. The container's
+// addresses changed, and the network may have been recreated with a
+// different subnet that network_peers rules have to match, so rules of
+// other containers with network_peers rules of the network are
+// recreated as well.
+func (r *RuleManager) handleNetworkEvent(ctx context.Context, msg events.Message) {
+	id := msg.Actor.Attributes["container"]
+	if id == "" {
+		return
+	}
+	netName := msg.Actor.Attributes["name"]
+	logger := r.logger.With(zap.String("container.id", id[:12]), zap.String("network.name", netName))
+
+	// containers are connected to networks before they start, and
+	// rules of new containers are created when they start
+	exists, err := r.containerExists(ctx, r.db, id)
+	if err != nil {
+		logger.Error("error querying container from database", zap.Error(err))
+		return
+	}
+	if !exists {
+		return
+	}
+	container, err := r.dockerCli.ContainerInspect(ctx, id)
+	if err != nil {
+		logger.Error("error inspecting container", zap.Error(err))
+		return
+	}
+	// containers are disconnected from networks when they stop, and
+	// their rules are deleted when they die
+	if container.State == nil || !container.State.Running {
+		return
+	}
+
+	logger.Info("network of container changed", zap.String("network.event", msg.Action))
+	r.createCh <- containerDetails{
+		container: container,
+		recreate:  true,
+	}
+
+	peerRules, err := r.db.GetNetworkPeerRules(ctx, netName)
+	if err != nil {
+		logger.Error("error getting network peer rules from database", zap.Error(err))
+		return
+	}
+	recreated := map[string]bool{
+		id: true,
+	}
+	for _, peerRule := range peerRules {
+		if recreated[peerRule.SrcContainerID] {
+			continue
+		}
+		recreated[peerRule.SrcContainerID] = true
+
+		peer, err := r.dockerCli.ContainerInspect(ctx, peerRule.SrcContainerID)
+		if err != nil {
+			logger.Error("error inspecting container", zap.String("peer.id", peerRule.SrcContainerID[:12]), zap.Error(err))
+			continue
+		}
+		if peer.State == nil || !peer.State.Running {
+			continue
+		}
+		logger.Info("recreating rules of container with network peer rules", zap.String("peer.id", peer.ID[:12]), zap.String("peer.name", stripName(peer.Name)))
+		r.createCh <- containerDetails{
+			container: peer,
+			recreate:  true,
+		}
+	}
+}
+
 func (r *RuleManager) Done() <-chan struct{} {
 	return r.done
 }
@@ -0,0 +1,95 @@
+package whalewall
+
+import (
+	"encoding/binary"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+const (
+	markTableName = "whalewall-mangle"
+	markChainName = "whalewall-mark"
+)
+
+// Routing decisions of forwarded packets are made after the PREROUTING
+// hook, so packets have to be marked there for policy routing based on
+// marks to apply to them. The chain has the priority of the mangle
+// table so packets are marked where iptables would mark them. It's in
+// a table of its own, as iptables-nft expects chains in the filter
+// table to only be hooked into INPUT, FORWARD and OUTPUT.
+var (
+	markTable = &nftables.Table{
+		Name:   markTableName,
+		Family: nftables.TableFamilyIPv4,
+	}
+	markChain = &nftables.Chain{
+		Name:     markChainName,
+		Table:    markTable,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityMangle,
+		Type:     nftables.ChainTypeFilter,
+		Policy:   ref(nftables.ChainPolicyAccept),
+	}
+)
+
+// marked returns true if v sets the mark or conntrack mark of packets.
+func (v verdict) marked() bool {
+	return v.Mark != 0 || v.CtMark != 0
+}
+
+// createMarkRule returns a rule in the mark chain that sets the marks
+// of rd's verdict on outbound packets matched by rd.
+func (r *RuleManager) createMarkRule(nfc firewallClient, rd ruleDetails) (*nftables.Rule, error) {
+	cfg := rd.cfg
+	cfg.LogPrefix = ""
+	// the interface packets will leave on isn't known before they are
+	// routed
+	cfg.EgressInterfaces = nil
+	cfg.Verdict = verdict{
+		Mark:     rd.cfg.Verdict.Mark,
+		CtMark:   rd.cfg.Verdict.CtMark,
+		setMarks: true,
+	}
+
+	// packets of established connections are routed separately
+	// from the packets that created them, so they must be marked too
+	return r.createNFTRule(nfc, false, false, stateNewEst, rd.addr, cfg, queueNums{}, markChain, rd.contID)
+}
+
+// setMarkExprs returns expressions that set the marks of v on packets.
+func setMarkExprs(v verdict) []expr.Any {
+	var exprs []expr.Any
+	if v.Mark != 0 {
+		exprs = append(exprs,
+			// [ immediate reg 1 ... ]
+			&expr.Immediate{
+				Register: 1,
+				Data:     binary.NativeEndian.AppendUint32(nil, v.Mark),
+			},
+			// [ meta set mark with reg 1 ]
+			&expr.Meta{
+				Key:            expr.MetaKeyMARK,
+				SourceRegister: true,
+				Register:       1,
+			},
+		)
+	}
+	if v.CtMark != 0 {
+		exprs = append(exprs,
+			// [ immediate reg 1 ... ]
+			&expr.Immediate{
+				Register: 1,
+				Data:     binary.NativeEndian.AppendUint32(nil, v.CtMark),
+			},
+			// [ ct set mark with reg 1 ]
+			&expr.Ct{
+				Key:            expr.CtKeyMARK,
+				SourceRegister: true,
+				Register:       1,
+			},
+		)
+	}
+
+	return exprs
+}
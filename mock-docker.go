@@ -3,11 +3,14 @@ package whalewall
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/netip"
 	"slices"
 	"sync"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
 )
 
 type dockerClient interface {
@@ -15,6 +18,7 @@ type dockerClient interface {
 	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
 	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
 	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	NetworkInspect(ctx context.Context, network string, options types.NetworkInspectOptions) (types.NetworkResource, error)
 	Close() error
 }
 
@@ -51,6 +55,9 @@ func (m *mockDockerClient) ContainerList(_ context.Context, _ types.ContainerLis
 			Names:  []string{cont.Name},
 			Labels: cont.Config.Labels,
 		}
+		if cont.HostConfig != nil {
+			listedConts[i].HostConfig.NetworkMode = string(cont.HostConfig.NetworkMode)
+		}
 	}
 
 	return listedConts, nil
@@ -70,6 +77,55 @@ func (m *mockDockerClient) ContainerInspect(_ context.Context, containerID strin
 	return m.containers[i], nil
 }
 
+// NetworkInspect returns a network built from the network settings of
+// the containers that are attached to it.
+func (m *mockDockerClient) NetworkInspect(_ context.Context, networkName string, _ types.NetworkInspectOptions) (types.NetworkResource, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	var (
+		found    bool
+		resource = types.NetworkResource{
+			Name:       networkName,
+			Containers: make(map[string]types.EndpointResource),
+		}
+	)
+	for _, cont := range m.containers {
+		netSettings, ok := cont.NetworkSettings.Networks[networkName]
+		if !ok {
+			continue
+		}
+		if !found {
+			found = true
+			resource.ID = netSettings.NetworkID
+			addr, err := netip.ParseAddr(netSettings.IPAddress)
+			if err != nil {
+				return types.NetworkResource{}, err
+			}
+			prefix, err := addr.Prefix(netSettings.IPPrefixLen)
+			if err != nil {
+				return types.NetworkResource{}, err
+			}
+			resource.IPAM.Config = []network.IPAMConfig{
+				{
+					Subnet:  prefix.String(),
+					Gateway: netSettings.Gateway,
+				},
+			}
+		}
+		resource.Containers[cont.ID] = types.EndpointResource{
+			Name:        stripName(cont.Name),
+			EndpointID:  netSettings.EndpointID,
+			IPv4Address: fmt.Sprintf("%s/%d", netSettings.IPAddress, netSettings.IPPrefixLen),
+		}
+	}
+	if !found {
+		return types.NetworkResource{}, errors.New("network not found")
+	}
+
+	return resource, nil
+}
+
 func (m *mockDockerClient) Close() error {
 	return nil
 }
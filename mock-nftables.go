@@ -20,6 +20,7 @@ var setAllocNum = 1
 
 type firewallClient interface {
 	AddTable(t *nftables.Table) *nftables.Table
+	DelTable(t *nftables.Table)
 
 	AddChain(c *nftables.Chain) *nftables.Chain
 	DelChain(c *nftables.Chain)
@@ -27,8 +28,11 @@ type firewallClient interface {
 
 	AddSet(s *nftables.Set, vals []nftables.SetElement) error
 	DelSet(s *nftables.Set)
+	FlushSet(s *nftables.Set)
 	SetAddElements(s *nftables.Set, vals []nftables.SetElement) error
 	SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error
+	GetSets(t *nftables.Table) ([]*nftables.Set, error)
+	GetSetElements(s *nftables.Set) ([]nftables.SetElement, error)
 
 	AddRule(r *nftables.Rule) *nftables.Rule
 	DelRule(r *nftables.Rule) error
@@ -140,6 +144,29 @@ func (m *mockFirewall) AddTable(t *nftables.Table) *nftables.Table {
 	return t
 }
 
+func (m *mockFirewall) DelTable(t *nftables.Table) {
+	m.changed = true
+
+	if _, ok := m.tables[t.Name]; !ok {
+		m.logger.Errorf("table %q not found", t.Name)
+		m.flushErr = syscall.ENOENT
+		return
+	}
+
+	// chains are deleted with their table
+	for name, c := range m.chains {
+		if c.Chain.Table.Name != t.Name {
+			continue
+		}
+		for _, rule := range c.Rules {
+			m.delRule(rule, true)
+		}
+		delete(m.chains, name)
+	}
+
+	delete(m.tables, t.Name)
+}
+
 func (m *mockFirewall) AddChain(c *nftables.Chain) *nftables.Chain {
 	m.changed = true
 
@@ -227,6 +254,25 @@ func (m *mockFirewall) DelSet(s *nftables.Set) {
 	m.tables[s.Table.Name] = t
 }
 
+func (m *mockFirewall) FlushSet(s *nftables.Set) {
+	m.changed = true
+
+	t, ok := m.tables[s.Table.Name]
+	if !ok {
+		m.logger.Errorf("table %q not found", s.Table.Name)
+		m.flushErr = syscall.ENOENT
+		return
+	}
+	if _, ok := t.Sets[s.Name]; !ok {
+		m.logger.Errorf("set %q not found", s.Name)
+		m.flushErr = syscall.ENOENT
+		return
+	}
+
+	t.Sets[s.Name] = nil
+	m.tables[s.Table.Name] = t
+}
+
 func (m *mockFirewall) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
 	m.changed = true
 
@@ -285,6 +331,49 @@ func (m *mockFirewall) SetAddElements(s *nftables.Set, vals []nftables.SetElemen
 	return nil
 }
 
+func (m *mockFirewall) GetSets(t *nftables.Table) ([]*nftables.Set, error) {
+	var sets []*nftables.Set
+	var err error
+	m.bf.readBaseFirewall(func(base *mockFirewall) {
+		bt, ok := base.tables[t.Name]
+		if !ok {
+			err = syscall.ENOENT
+			return
+		}
+		for name := range bt.Sets {
+			sets = append(sets, &nftables.Set{
+				Table: t,
+				Name:  name,
+			})
+		}
+	})
+	slices.SortFunc(sets, func(a, b *nftables.Set) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return sets, err
+}
+
+func (m *mockFirewall) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	var elements []nftables.SetElement
+	var err error
+	m.bf.readBaseFirewall(func(base *mockFirewall) {
+		bt, ok := base.tables[s.Table.Name]
+		if !ok {
+			err = syscall.ENOENT
+			return
+		}
+		elems, ok := bt.Sets[s.Name]
+		if !ok {
+			err = syscall.ENOENT
+			return
+		}
+		elements = clone(elems)
+	})
+
+	return elements, err
+}
+
 func (m *mockFirewall) SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error {
 	m.changed = true
 
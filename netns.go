@@ -0,0 +1,88 @@
+package whalewall
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// sharesNetns returns true if a listed container shares the network
+// namespace of another container.
+func sharesNetns(c types.Container) bool {
+	return strings.HasPrefix(c.HostConfig.NetworkMode, "container:")
+}
+
+// netnsOwner returns the container that owns the network namespace of
+// container if container was started with a network mode of
+// "container:<name|id>". Docker Compose translates the network mode
+// "service:<name>" to this as well. The owner must have whalewall
+// enabled and its rules must already be created, as traffic of
+// container is handled by the owner's chain first.
+func (r *RuleManager) netnsOwner(ctx context.Context, container types.ContainerJSON) (types.ContainerJSON, bool, error) {
+	if container.HostConfig == nil || !container.HostConfig.NetworkMode.IsContainer() {
+		return types.ContainerJSON{}, false, nil
+	}
+
+	ownerRef := container.HostConfig.NetworkMode.ConnectedContainer()
+	owner, err := r.dockerCli.ContainerInspect(ctx, ownerRef)
+	if err != nil {
+		return types.ContainerJSON{}, false, fmt.Errorf("error inspecting network namespace owner %q: %w", ownerRef, err)
+	}
+	ownerName := stripName(owner.Name)
+	enabled, err := whalewallEnabled(owner.Config.Labels)
+	if err != nil {
+		return types.ContainerJSON{}, false, fmt.Errorf("error parsing container %q label: %w", ownerName, err)
+	}
+	if !enabled {
+		return types.ContainerJSON{}, false, fmt.Errorf("network namespace owner %q does not have whalewall enabled", ownerName)
+	}
+	if _, ok := owner.NetworkSettings.Networks[hostNetworkName]; ok {
+		return types.ContainerJSON{}, false, fmt.Errorf("network namespace owner %q is using host networking, containers sharing its network namespace are not supported", ownerName)
+	}
+	exists, err := r.containerExists(ctx, r.db, owner.ID)
+	if err != nil {
+		return types.ContainerJSON{}, false, fmt.Errorf("error querying container %s from database: %w", owner.ID[:12], err)
+	}
+	if !exists {
+		return types.ContainerJSON{}, false, fmt.Errorf("rules of network namespace owner %q have not been created", ownerName)
+	}
+
+	return owner, true, nil
+}
+
+// netnsSidecars returns the containers sharing the network namespace
+// of owner whose rules have been created.
+func (r *RuleManager) netnsSidecars(ctx context.Context, owner types.ContainerJSON) ([]types.ContainerJSON, error) {
+	listedConts, err := r.dockerCli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing running containers: %w", err)
+	}
+
+	var sidecars []types.ContainerJSON
+	for _, c := range listedConts {
+		if !sharesNetns(c) {
+			continue
+		}
+		ownerRef := container.NetworkMode(c.HostConfig.NetworkMode).ConnectedContainer()
+		if ownerRef != owner.ID && ownerRef != stripName(owner.Name) {
+			continue
+		}
+		exists, err := r.containerExists(ctx, r.db, c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error querying container %s from database: %w", c.ID[:12], err)
+		}
+		if !exists {
+			continue
+		}
+		sidecar, err := r.dockerCli.ContainerInspect(ctx, c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error inspecting container %s: %w", c.ID[:12], err)
+		}
+		sidecars = append(sidecars, sidecar)
+	}
+
+	return sidecars, nil
+}
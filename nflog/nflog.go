@@ -0,0 +1,182 @@
+// Package nflog receives packets logged to NFLOG groups by nftables
+// log statements.
+package nflog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/capnspacehook/whalewall/internal/nfnetlink"
+)
+
+// message types of the NFLOG netfilter subsystem
+const (
+	msgPacket = 0
+	msgConfig = 1
+)
+
+// attributes of NFLOG config messages
+const (
+	attrCfgCmd  = 1
+	attrCfgMode = 2
+)
+
+// cfgCmdBind is the NFLOG config command that binds to a group.
+const cfgCmdBind = 1
+
+// copyModePacket makes the kernel copy packet contents to userspace.
+const copyModePacket = 2
+
+// attributes of NFLOG packet messages
+const (
+	attrPacketHdr = 1
+	attrTimestamp = 3
+	attrInDev     = 4
+	attrOutDev    = 5
+	attrPayload   = 9
+	attrPrefix    = 10
+)
+
+// Packet is a packet that was logged to a NFLOG group.
+type Packet struct {
+	// Prefix is the prefix of the log statement that logged the packet.
+	Prefix string
+	// Hook is the netfilter hook the packet was logged from.
+	Hook uint8
+	// InIfIndex is the index of the interface the packet was received
+	// on, or 0 if unknown.
+	InIfIndex uint32
+	// OutIfIndex is the index of the interface the packet will be sent
+	// out of, or 0 if unknown.
+	OutIfIndex uint32
+	// Timestamp is when the packet was logged. It may be zero.
+	Timestamp time.Time
+	// Payload is the contents of the packet starting from the network
+	// header. It may be truncated.
+	Payload []byte
+}
+
+// Conn receives packets logged to a NFLOG group.
+type Conn struct {
+	c     *nfnetlink.Conn
+	group uint16
+}
+
+// Open binds to the NFLOG group group. At most copyLen bytes of each
+// logged packet will be copied from the kernel.
+func Open(group uint16, copyLen uint32) (*Conn, error) {
+	c, err := nfnetlink.Dial(unix.NFNL_SUBSYS_ULOG, group)
+	if err != nil {
+		return nil, err
+	}
+	conn := &Conn{
+		c:     c,
+		group: group,
+	}
+
+	if err := c.Execute(msgConfig, attrCfgCmd, []byte{cfgCmdBind}); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error binding to group %d: %w", group, err)
+	}
+	mode := binary.BigEndian.AppendUint32(nil, copyLen)
+	mode = append(mode, copyModePacket, 0)
+	if err := c.Execute(msgConfig, attrCfgMode, mode); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error setting copy mode of group %d: %w", group, err)
+	}
+
+	return conn, nil
+}
+
+// Receive blocks until packets are logged and returns them. Messages
+// that fail to parse are skipped instead of failing the whole batch,
+// and the errors parsing them are returned as skipped.
+func (c *Conn) Receive() (pkts []Packet, skipped []error, err error) {
+	msgs, err := c.c.Receive(msgPacket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pkts, skipped = parsePackets(msgs)
+	return pkts, skipped, nil
+}
+
+// parsePackets parses NFLOG packet messages, skipping any that are
+// malformed.
+func parsePackets(msgs [][]byte) ([]Packet, []error) {
+	pkts := make([]Packet, 0, len(msgs))
+	var errs []error
+	for _, msg := range msgs {
+		pkt, err := ParsePacket(msg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pkts = append(pkts, pkt)
+	}
+
+	return pkts, errs
+}
+
+// Close closes the connection, which unbinds it from the NFLOG group.
+// Any blocked calls to Receive will be unblocked.
+func (c *Conn) Close() error {
+	return c.c.Close()
+}
+
+// ParsePacket parses the data of a NFLOG packet message.
+func ParsePacket(b []byte) (Packet, error) {
+	var pkt Packet
+	ad, err := nfnetlink.Attributes(b)
+	if err != nil {
+		return pkt, err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case attrPacketHdr:
+			// struct nfulnl_msg_packet_hdr {
+			//     __be16 hw_protocol;
+			//     __u8   hook;
+			//     __u8   _pad;
+			// };
+			ad.Do(func(b []byte) error {
+				if len(b) < 3 {
+					return errors.New("packet header too short")
+				}
+				pkt.Hook = b[2]
+				return nil
+			})
+		case attrTimestamp:
+			// struct nfulnl_msg_packet_timestamp {
+			//     __aligned_be64 sec;
+			//     __aligned_be64 usec;
+			// };
+			ad.Do(func(b []byte) error {
+				if len(b) < 16 {
+					return errors.New("timestamp too short")
+				}
+				sec := binary.BigEndian.Uint64(b)
+				usec := binary.BigEndian.Uint64(b[8:])
+				pkt.Timestamp = time.Unix(int64(sec), int64(usec)*int64(time.Microsecond))
+				return nil
+			})
+		case attrInDev:
+			pkt.InIfIndex = ad.Uint32()
+		case attrOutDev:
+			pkt.OutIfIndex = ad.Uint32()
+		case attrPayload:
+			pkt.Payload = ad.Bytes()
+		case attrPrefix:
+			pkt.Prefix = ad.String()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return pkt, fmt.Errorf("error parsing attributes: %w", err)
+	}
+
+	return pkt, nil
+}
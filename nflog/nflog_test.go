@@ -0,0 +1,109 @@
+package nflog
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/capnspacehook/whalewall/internal/nfnetlink"
+)
+
+func TestParsePacket(t *testing.T) {
+	payload := []byte{
+		0x45, 0x00, 0x00, 0x3c, 0x00, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		172, 0, 1, 2,
+		1, 1, 1, 1,
+		0x9c, 0x40, 0x01, 0xbb,
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Bytes(attrPacketHdr, []byte{0x08, 0x00, 2, 0})
+	ae.Bytes(attrTimestamp, binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, 1700000000), 500))
+	ae.Uint32(attrInDev, 3)
+	ae.Uint32(attrOutDev, 7)
+	ae.Bytes(attrPayload, payload)
+	ae.String(attrPrefix, "drop whalewall-test-0123456789ab: ")
+	attrs, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("error encoding attributes: %v", err)
+	}
+
+	pkt, err := ParsePacket(append(nfnetlink.Header(unix.AF_INET, 5), attrs...))
+	if err != nil {
+		t.Fatalf("error parsing packet: %v", err)
+	}
+
+	expected := Packet{
+		Prefix:     "drop whalewall-test-0123456789ab: ",
+		Hook:       2,
+		InIfIndex:  3,
+		OutIfIndex: 7,
+		Timestamp:  time.Unix(1700000000, 500*int64(time.Microsecond)),
+		Payload:    payload,
+	}
+	if diff := cmp.Diff(expected, pkt); diff != "" {
+		t.Errorf("packets differ (-want +got):\n%s", diff)
+	}
+}
+
+func TestParsePacketTooShort(t *testing.T) {
+	if _, err := ParsePacket([]byte{unix.AF_INET, 0}); err == nil {
+		t.Error("expected error parsing truncated message")
+	}
+}
+
+func TestParsePacketsSkipsMalformed(t *testing.T) {
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.String(attrPrefix, "drop whalewall-test-0123456789ab: ")
+	attrs, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("error encoding attributes: %v", err)
+	}
+	msg := append(nfnetlink.Header(unix.AF_INET, 5), attrs...)
+
+	pkts, skipped := parsePackets([][]byte{msg, {unix.AF_INET, 0}, msg})
+	if len(pkts) != 2 {
+		t.Errorf("expected 2 packets, got %d", len(pkts))
+	}
+	for _, pkt := range pkts {
+		if pkt.Prefix != "drop whalewall-test-0123456789ab: " {
+			t.Errorf("unexpected prefix %q", pkt.Prefix)
+		}
+	}
+	if len(skipped) != 1 {
+		t.Errorf("expected 1 skipped message, got %d", len(skipped))
+	}
+}
+
+func TestCloseUnblocksReceive(t *testing.T) {
+	conn, err := Open(65000, 0xffff)
+	if err != nil {
+		t.Skipf("can't bind to NFLOG group: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, _, err := conn.Receive()
+		errCh <- err
+	}()
+	// give Receive time to block
+	time.Sleep(100 * time.Millisecond)
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("error closing connection: %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("expected Receive to return an error after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Receive is still blocked after Close")
+	}
+}
@@ -0,0 +1,195 @@
+// Package nfqueue receives packets sent to nfqueues by nftables queue
+// statements and issues verdicts for them.
+package nfqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/capnspacehook/whalewall/internal/nfnetlink"
+)
+
+// message types of the nfqueue netfilter subsystem
+const (
+	msgPacket  = 0
+	msgVerdict = 1
+	msgConfig  = 2
+)
+
+// attributes of nfqueue config messages
+const (
+	attrCfgCmd    = 1
+	attrCfgParams = 2
+)
+
+// cfgCmdBind is the nfqueue config command that binds to a queue.
+const cfgCmdBind = 1
+
+// copyModePacket makes the kernel copy packet contents to userspace.
+const copyModePacket = 2
+
+// attributes of nfqueue packet and verdict messages
+const (
+	attrPacketHdr  = 1
+	attrVerdictHdr = 2
+	attrMark       = 3
+	attrInDev      = 5
+	attrOutDev     = 6
+	attrPayload    = 10
+)
+
+// Verdict is the verdict of a queued packet.
+type Verdict uint32
+
+const (
+	// Drop drops the packet.
+	Drop Verdict = 0
+	// Accept accepts the packet, it will continue traversing the
+	// netfilter hooks after the one it was queued from.
+	Accept Verdict = 1
+)
+
+// Packet is a packet that was sent to a nfqueue.
+type Packet struct {
+	// ID identifies the packet when setting its verdict.
+	ID uint32
+	// Hook is the netfilter hook the packet was queued from.
+	Hook uint8
+	// Mark is the mark of the packet.
+	Mark uint32
+	// InIfIndex is the index of the interface the packet was received
+	// on, or 0 if unknown.
+	InIfIndex uint32
+	// OutIfIndex is the index of the interface the packet will be sent
+	// out of, or 0 if unknown.
+	OutIfIndex uint32
+	// Payload is the contents of the packet starting from the network
+	// header. It may be truncated.
+	Payload []byte
+}
+
+// Conn receives packets sent to a nfqueue.
+type Conn struct {
+	c     *nfnetlink.Conn
+	queue uint16
+}
+
+// Open binds to the nfqueue queue. At most copyLen bytes of each
+// queued packet will be copied from the kernel. Packets sent to the
+// queue are dropped until a verdict is set for them.
+func Open(queue uint16, copyLen uint32) (*Conn, error) {
+	c, err := nfnetlink.Dial(unix.NFNL_SUBSYS_QUEUE, queue)
+	if err != nil {
+		return nil, err
+	}
+	conn := &Conn{
+		c:     c,
+		queue: queue,
+	}
+
+	// struct nfqnl_msg_config_cmd {
+	//     __u8   command;
+	//     __u8   _pad;
+	//     __be16 pf;
+	// };
+	if err := c.Execute(msgConfig, attrCfgCmd, []byte{cfgCmdBind, 0, 0, 0}); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error binding to queue %d: %w", queue, err)
+	}
+	// struct nfqnl_msg_config_params {
+	//     __be32 copy_range;
+	//     __u8   copy_mode;
+	// } __attribute__ ((packed));
+	params := binary.BigEndian.AppendUint32(nil, copyLen)
+	params = append(params, copyModePacket)
+	if err := c.Execute(msgConfig, attrCfgParams, params); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error setting copy mode of queue %d: %w", queue, err)
+	}
+
+	return conn, nil
+}
+
+// Receive blocks until packets are queued and returns them.
+func (c *Conn) Receive() ([]Packet, error) {
+	msgs, err := c.c.Receive(msgPacket)
+	if err != nil {
+		return nil, err
+	}
+
+	pkts := make([]Packet, 0, len(msgs))
+	for _, msg := range msgs {
+		pkt, err := ParsePacket(msg)
+		if err != nil {
+			return nil, err
+		}
+		pkts = append(pkts, pkt)
+	}
+
+	return pkts, nil
+}
+
+// SetVerdict sets the verdict of the queued packet with the ID id.
+func (c *Conn) SetVerdict(id uint32, verdict Verdict) error {
+	// struct nfqnl_msg_verdict_hdr {
+	//     __be32 verdict;
+	//     __be32 id;
+	// };
+	hdr := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, uint32(verdict)), id)
+	return c.c.Send(msgVerdict, attrVerdictHdr, hdr)
+}
+
+// Close closes the connection, which unbinds it from the nfqueue. Any
+// blocked calls to Receive will be unblocked.
+func (c *Conn) Close() error {
+	return c.c.Close()
+}
+
+// ParsePacket parses the data of a nfqueue packet message.
+func ParsePacket(b []byte) (Packet, error) {
+	var pkt Packet
+	ad, err := nfnetlink.Attributes(b)
+	if err != nil {
+		return pkt, err
+	}
+	var hdrFound bool
+	for ad.Next() {
+		switch ad.Type() {
+		case attrPacketHdr:
+			// struct nfqnl_msg_packet_hdr {
+			//     __be32 packet_id;
+			//     __be16 hw_protocol;
+			//     __u8   hook;
+			// } __attribute__ ((packed));
+			ad.Do(func(b []byte) error {
+				if len(b) < 7 {
+					return errors.New("packet header too short")
+				}
+				pkt.ID = binary.BigEndian.Uint32(b)
+				pkt.Hook = b[6]
+				hdrFound = true
+				return nil
+			})
+		case attrMark:
+			pkt.Mark = ad.Uint32()
+		case attrInDev:
+			pkt.InIfIndex = ad.Uint32()
+		case attrOutDev:
+			pkt.OutIfIndex = ad.Uint32()
+		case attrPayload:
+			pkt.Payload = ad.Bytes()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return pkt, fmt.Errorf("error parsing attributes: %w", err)
+	}
+	// a verdict can't be set without the ID of the packet
+	if !hdrFound {
+		return pkt, errors.New("packet header missing")
+	}
+
+	return pkt, nil
+}
@@ -0,0 +1,97 @@
+package nfqueue
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/capnspacehook/whalewall/internal/nfnetlink"
+)
+
+func TestParsePacket(t *testing.T) {
+	payload := []byte{
+		0x45, 0x00, 0x00, 0x3c, 0x00, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		172, 0, 1, 2,
+		1, 1, 1, 1,
+		0x9c, 0x40, 0x01, 0xbb,
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.Bytes(attrPacketHdr, []byte{0, 0, 0, 42, 0x08, 0x00, 2})
+	ae.Uint32(attrMark, 0x10)
+	ae.Uint32(attrInDev, 3)
+	ae.Uint32(attrOutDev, 7)
+	ae.Bytes(attrPayload, payload)
+	attrs, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("error encoding attributes: %v", err)
+	}
+
+	pkt, err := ParsePacket(append(nfnetlink.Header(unix.AF_INET, 5), attrs...))
+	if err != nil {
+		t.Fatalf("error parsing packet: %v", err)
+	}
+
+	expected := Packet{
+		ID:         42,
+		Hook:       2,
+		Mark:       0x10,
+		InIfIndex:  3,
+		OutIfIndex: 7,
+		Payload:    payload,
+	}
+	if diff := cmp.Diff(expected, pkt); diff != "" {
+		t.Errorf("packets differ (-want +got):\n%s", diff)
+	}
+}
+
+func TestParsePacketNoHeader(t *testing.T) {
+	ae := netlink.NewAttributeEncoder()
+	ae.Bytes(attrPayload, []byte{0x45})
+	attrs, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("error encoding attributes: %v", err)
+	}
+
+	if _, err := ParsePacket(append(nfnetlink.Header(unix.AF_INET, 5), attrs...)); err == nil {
+		t.Error("expected error parsing packet without header")
+	}
+}
+
+func TestParsePacketTooShort(t *testing.T) {
+	if _, err := ParsePacket([]byte{unix.AF_INET, 0}); err == nil {
+		t.Error("expected error parsing truncated message")
+	}
+}
+
+func TestCloseUnblocksReceive(t *testing.T) {
+	conn, err := Open(65000, 0xffff)
+	if err != nil {
+		t.Skipf("can't bind to queue: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Receive()
+		errCh <- err
+	}()
+	// give Receive time to block
+	time.Sleep(100 * time.Millisecond)
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("error closing connection: %v", err)
+	}
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("expected Receive to return an error after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Receive is still blocked after Close")
+	}
+}
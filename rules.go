@@ -91,6 +91,26 @@ func rulesEqual(logger *zap.Logger, r1, r2 *nftables.Rule) bool {
 			}
 		}
 
+		e1Queue, e1QueueOk := r1.Exprs[i].(*expr.Queue)
+		e2Queue, e2QueueOk := r2.Exprs[i].(*expr.Queue)
+		// expressions are not of same type, rules are different
+		if e1QueueOk != e2QueueOk {
+			return false
+		}
+		if e1QueueOk && e2QueueOk {
+			// The number of queues defaults to 1 when it isn't set, and
+			// marshaling a queue expression modifies it to be 1. Compare
+			// queue expressions directly so a single queue is equal to
+			// itself whether the total is set or not.
+			if e1Queue.Num != e2Queue.Num || e1Queue.Flag != e2Queue.Flag {
+				return false
+			}
+			if max(e1Queue.Total, 1) != max(e2Queue.Total, 1) {
+				return false
+			}
+			continue
+		}
+
 		exprb1, err := expr.Marshal(byte(r1.Table.Family), r1.Exprs[i])
 		if err != nil {
 			logger.Error("error marshaling rule", zap.Error(err))
@@ -0,0 +1,287 @@
+package whalewall
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+
+	"github.com/docker/docker/api/types"
+	"github.com/google/nftables"
+	"go.uber.org/zap"
+
+	"github.com/capnspacehook/whalewall/database"
+)
+
+// selectorSetName returns the name of the set that holds the addresses
+// of the containers selected by rule i of a container chain.
+func selectorSetName(chain *nftables.Chain, inbound bool, i int) string {
+	direction := "out"
+	if inbound {
+		direction = "in"
+	}
+	return fmt.Sprintf("%s-sel-%s-%d", chain.Name, direction, i)
+}
+
+func buildSelectorSet(name string) *nftables.Set {
+	return &nftables.Set{
+		Table:   filterTable,
+		Name:    name,
+		KeyType: nftables.TypeIPAddr,
+	}
+}
+
+// createSelectorRules creates a set holding the addresses of the
+// containers selected by the container selector of rd, and returns
+// rules that allow traffic to or from the addresses in the set. Selected
+// containers need rules in their chains as well, so those rules are
+// returned too. rd is saved so containers that are started later can be
+// added to the set.
+func (r *RuleManager) createSelectorRules(ctx context.Context, nfc firewallClient, logger *zap.Logger, tx database.TX, rd ruleDetails, i int, id string) ([]*nftables.Rule, error) {
+	set := buildSelectorSet(selectorSetName(rd.chain, rd.inbound, i))
+	if err := nfc.AddSet(set, nil); err != nil {
+		return nil, fmt.Errorf("error adding set %q: %w", set.Name, err)
+	}
+	if err := ignoringErr(nfc.Flush, syscall.EEXIST); err != nil {
+		return nil, fmt.Errorf("error creating set %q: %w", set.Name, err)
+	}
+
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	if err := encoder.Encode(rd.cfg); err != nil {
+		return nil, fmt.Errorf("error encoding selector rule: %w", err)
+	}
+	var inbound int64
+	if rd.inbound {
+		inbound = 1
+	}
+	err := tx.AddSelectorRule(ctx, database.AddSelectorRuleParams{
+		SrcContainerID: id,
+		SetName:        set.Name,
+		Inbound:        inbound,
+		Addr:           rd.addr,
+		Rule:           buf.Bytes(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error adding selector rule to database: %w", err)
+	}
+
+	listedConts, err := r.dockerCli.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing running containers: %w", err)
+	}
+
+	var (
+		elems    []nftables.SetElement
+		nftRules []*nftables.Rule
+	)
+	for _, listedCont := range listedConts {
+		if listedCont.ID == id || !rd.cfg.ContainerSelector.matches(listedCont.Labels) {
+			continue
+		}
+		enabled, err := whalewallEnabled(listedCont.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing container %q label: %w", listedCont.ID[:12], err)
+		}
+		if !enabled {
+			continue
+		}
+		// only containers that have been processed have chains; the
+		// rest will be added to the set when they are processed
+		peerName, err := tx.GetContainerName(ctx, listedCont.ID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return nil, fmt.Errorf("error getting container %s name from database: %w", listedCont.ID[:12], err)
+		}
+
+		cont, err := r.dockerCli.ContainerInspect(ctx, listedCont.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error inspecting container %s: %w", listedCont.ID[:12], err)
+		}
+		peerProject := cont.Config.Labels[composeProjectLabel]
+		peerNetName, peerNetwork, ok := findNetwork(rd.cfg.Network, peerProject, cont.NetworkSettings.Networks)
+		if !ok {
+			continue
+		}
+		peerAddr, err := netip.ParseAddr(peerNetwork.IPAddress)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing IP of container %q from network %q: %w", peerName, peerNetName, err)
+		}
+		elems = append(elems, nftables.SetElement{
+			Key: ref(peerAddr.As4())[:],
+		})
+
+		peerChain := &nftables.Chain{
+			Table: filterTable,
+			Name:  buildChainName(peerName, listedCont.ID),
+		}
+		rules, err := r.createSelectedRules(nfc, logger, rd, peerAddr, peerChain, listedCont.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error creating firewall rules: %w", err)
+		}
+		nftRules = append(nftRules, rules...)
+
+		// rules in the other container's chain need to be cleaned up
+		// when this container is stopped
+		if err := tx.AddEstContainer(ctx, id, listedCont.ID); err != nil {
+			return nil, fmt.Errorf("error adding established container to database: %w", err)
+		}
+	}
+
+	// replace the elements of the set in one batch so traffic of
+	// containers that are still selected is never dropped
+	nfc.FlushSet(set)
+	if len(elems) != 0 {
+		if err := nfc.SetAddElements(set, elems); err != nil {
+			return nil, fmt.Errorf("error marshaling set elements: %w", err)
+		}
+	}
+	if err := nfc.Flush(); err != nil {
+		return nil, fmt.Errorf("error adding elements to set %q: %w", set.Name, err)
+	}
+
+	rd.cfg.addrSet = set
+	rules, err := r.createNFTRules(nfc, logger, rd)
+	if err != nil {
+		return nil, fmt.Errorf("error creating firewall rules: %w", err)
+	}
+
+	return append(rules, nftRules...), nil
+}
+
+// createSelectedRules returns the rules described by rd, a rule with a
+// container selector, that are put in the chain of a selected container.
+func (r *RuleManager) createSelectedRules(nfc firewallClient, logger *zap.Logger, rd ruleDetails, peerAddr netip.Addr, peerChain *nftables.Chain, peerID string) ([]*nftables.Rule, error) {
+	rd.cfg.addrSet = nil
+
+	var peerRule ruleDetails
+	if rd.inbound {
+		// new traffic from the selected container is handled in its
+		// own chain, as it would be for an input rule with a container
+		addr, ok := netip.AddrFromSlice(rd.addr)
+		if !ok {
+			return nil, fmt.Errorf("error parsing addr %v", rd.addr)
+		}
+		peerRule = containerInputRule(rd.cfg, peerAddr, addr, peerChain, rd.chain, peerID, rd.contID)
+	} else {
+		peerRule = rd
+		peerRule.cfg.IPs = []addrOrRange{{addr: peerAddr}}
+		peerRule.estChain = peerChain
+		peerRule.estContID = rd.contID
+	}
+
+	return r.createChainRules(nfc, logger, peerRule, peerChain)
+}
+
+// createWaitingSelectorRules adds this container to the sets of rules
+// of other containers whose container selectors select it, and creates
+// rules for those rules in this container's chain. The other containers
+// were processed before this container, so rules concerning this
+// container couldn't be created until now.
+func (r *RuleManager) createWaitingSelectorRules(ctx context.Context, nfc firewallClient, logger *zap.Logger, tx database.TX, id string, labels map[string]string, project string, addrs map[string][]byte, chain *nftables.Chain) ([]*nftables.Rule, error) {
+	selectorRules, err := tx.GetSelectorRules(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting selector rules from database: %w", err)
+	}
+
+	var (
+		addedElems bool
+		nftRules   []*nftables.Rule
+	)
+	for _, selectorRule := range selectorRules {
+		if selectorRule.SrcContainerID == id {
+			continue
+		}
+
+		ruleCfg, err := decodeRuleConfig(selectorRule.Rule)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding selector rule: %w", err)
+		}
+		if !ruleCfg.ContainerSelector.matches(labels) {
+			continue
+		}
+		netName, addr, ok := findNetwork(ruleCfg.Network, project, addrs)
+		if !ok {
+			continue
+		}
+		peerAddr, ok := netip.AddrFromSlice(addr)
+		if !ok {
+			return nil, fmt.Errorf("error parsing IP of from network %q", netName)
+		}
+
+		set := buildSelectorSet(selectorRule.SetName)
+		if err := nfc.SetAddElements(set, []nftables.SetElement{{Key: addr}}); err != nil {
+			return nil, fmt.Errorf("error marshaling set elements: %w", err)
+		}
+		addedElems = true
+
+		rd := ruleDetails{
+			inbound: selectorRule.Inbound == 1,
+			addr:    selectorRule.Addr,
+			cfg:     ruleCfg,
+			chain: &nftables.Chain{
+				Table: filterTable,
+				Name:  buildChainName(selectorRule.Name, selectorRule.SrcContainerID),
+			},
+			contID: selectorRule.SrcContainerID,
+		}
+		rules, err := r.createSelectedRules(nfc, logger, rd, peerAddr, chain, id)
+		if err != nil {
+			return nil, fmt.Errorf("error creating firewall rules: %w", err)
+		}
+		nftRules = append(nftRules, rules...)
+
+		// rules in this container's chain need to be cleaned up when
+		// the other container is stopped
+		if err := tx.AddEstContainer(ctx, selectorRule.SrcContainerID, id); err != nil {
+			return nil, fmt.Errorf("error adding established container to database: %w", err)
+		}
+	}
+	if addedElems {
+		if err := nfc.Flush(); err != nil {
+			return nil, fmt.Errorf("error adding elements to selector sets: %w", err)
+		}
+	}
+
+	return nftRules, nil
+}
+
+// deleteSelectorSets deletes the sets of rules with container
+// selectors of the container specified by id, and removes addrs from
+// the sets of other containers.
+func deleteSelectorSets(ctx context.Context, logger *zap.Logger, nfc firewallClient, tx database.TX, id string, addrs [][]byte) error {
+	selectorRules, err := tx.GetSelectorRules(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting selector rules from database: %w", err)
+	}
+
+	for _, selectorRule := range selectorRules {
+		set := buildSelectorSet(selectorRule.SetName)
+		if selectorRule.SrcContainerID == id {
+			nfc.DelSet(set)
+			if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+				logger.Error("error deleting set", zap.String("set.name", set.Name), zap.Error(err))
+			}
+			continue
+		}
+
+		for _, addr := range addrs {
+			if err := nfc.SetDeleteElements(set, []nftables.SetElement{{Key: addr}}); err != nil {
+				logger.Error("error marshaling set elements", zap.Error(err))
+				continue
+			}
+			// the container is only in the sets that selected it
+			if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+				logger.Error("error deleting set element", zap.Error(err))
+			}
+		}
+	}
+
+	return nil
+}
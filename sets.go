@@ -0,0 +1,464 @@
+package whalewall
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// RuleLayout controls how allowed traffic is laid out in container
+// chains.
+type RuleLayout uint8
+
+const (
+	// LayoutRules creates a separate nftables rule for every allowed
+	// flow of traffic. This is the default layout.
+	LayoutRules RuleLayout = iota
+	// LayoutSets stores allowed flows of traffic in concatenated sets,
+	// one per container chain and direction. The number of rules in a
+	// container chain stays constant no matter how many flows are
+	// allowed.
+	LayoutSets
+)
+
+func (l RuleLayout) String() string {
+	switch l {
+	case LayoutRules:
+		return "rules"
+	case LayoutSets:
+		return "sets"
+	default:
+		return fmt.Sprintf("layout(%d)", l)
+	}
+}
+
+// ParseRuleLayout returns the [RuleLayout] named by s.
+func ParseRuleLayout(s string) (RuleLayout, error) {
+	switch s {
+	case "rules":
+		return LayoutRules, nil
+	case "sets":
+		return LayoutSets, nil
+	default:
+		return 0, fmt.Errorf("invalid rule layout %q", s)
+	}
+}
+
+const (
+	outboundSetSuffix = "-out"
+	inboundSetSuffix  = "-in"
+
+	// size of a concatenated flow key: local addr . remote addr .
+	// proto . local port . remote port, each field padded to 4 bytes
+	flowKeyLen = 5 * 4
+)
+
+var flowKeyType = nftables.MustConcatSetType(
+	nftables.TypeIPAddr,
+	nftables.TypeIPAddr,
+	nftables.TypeInetProto,
+	nftables.TypeInetService,
+	nftables.TypeInetService,
+)
+
+// flowSets holds the elements of the concatenated sets of a container
+// chain. Each element describes a flow by the container's address, the
+// address of the peer, the protocol, the container's port and the
+// peer's port. Every field is an inclusive range.
+type flowSets struct {
+	out      *nftables.Set
+	in       *nftables.Set
+	outElems []flowElem
+	inElems  []flowElem
+}
+
+type flowElem struct {
+	start [flowKeyLen]byte
+	end   [flowKeyLen]byte
+}
+
+func newFlowSets(chain *nftables.Chain) *flowSets {
+	return &flowSets{
+		out: buildFlowSet(chain, outboundSetSuffix),
+		in:  buildFlowSet(chain, inboundSetSuffix),
+	}
+}
+
+func buildFlowSet(chain *nftables.Chain, suffix string) *nftables.Set {
+	return &nftables.Set{
+		Table:         chain.Table,
+		Name:          chain.Name + suffix,
+		Interval:      true,
+		Concatenation: true,
+		KeyType:       flowKeyType,
+	}
+}
+
+// add attempts to store the flows described by rd in the appropriate
+// set. False is returned if the rule must be created as separate
+// nftables rules instead.
+func (f *flowSets) add(rd ruleDetails) bool {
+	if !flowSetEligible(rd) {
+		return false
+	}
+
+	elems := f.outElems
+	if rd.inbound {
+		elems = f.inElems
+	}
+	// don't modify the current elements until we know all flows can be
+	// added without conflicting with an existing flow
+	elems = append([]flowElem(nil), elems...)
+	for _, elem := range flowElems(rd) {
+		var ok bool
+		elems, ok = addFlowElem(elems, elem)
+		if !ok {
+			return false
+		}
+	}
+
+	if rd.inbound {
+		f.inElems = elems
+	} else {
+		f.outElems = elems
+	}
+	return true
+}
+
+// flowSetEligible returns true if the traffic rd describes can be
+// matched by looking it up in a set. Only rules that accept traffic
+// without logging it can be, as rules that do anything else need a
+// verdict or statement of their own.
+func flowSetEligible(rd ruleDetails) bool {
+	if len(rd.addr) == 0 {
+		return false
+	}
+	// rules that involve another container's chain are tracked per
+	// rule so they can be removed when the other container is stopped
+	if rd.estChain != nil && rd.estChain != rd.chain {
+		return false
+	}
+	if rd.cfg.addrSet != nil || rd.cfg.LogPrefix != "" || len(rd.cfg.iifnames) != 0 || len(rd.cfg.hostAddrs) != 0 || len(rd.cfg.EgressInterfaces) != 0 || rd.cfg.limited() {
+		return false
+	}
+	v := rd.cfg.Verdict
+	return !v.drop && v.Chain == "" && !v.Queue.set() && !v.marked()
+}
+
+// addFlowElem adds elem to elems. Elements of concatenated interval sets
+// can't partially overlap, so if elem is covered by an existing element
+// it is not added, and existing elements covered by elem are replaced.
+// If elem partially overlaps with an existing element false is returned.
+func addFlowElem(elems []flowElem, elem flowElem) ([]flowElem, bool) {
+	j := 0
+	for _, e := range elems {
+		switch {
+		case e.contains(elem):
+			return elems, true
+		case elem.contains(e):
+			continue
+		case e.overlaps(elem):
+			return elems, false
+		}
+		elems[j] = e
+		j++
+	}
+
+	return append(elems[:j], elem), true
+}
+
+func (e flowElem) contains(o flowElem) bool {
+	for i := 0; i < flowKeyLen; i += 4 {
+		if bytes.Compare(e.start[i:i+4], o.start[i:i+4]) > 0 {
+			return false
+		}
+		if bytes.Compare(e.end[i:i+4], o.end[i:i+4]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (e flowElem) overlaps(o flowElem) bool {
+	for i := 0; i < flowKeyLen; i += 4 {
+		if bytes.Compare(e.start[i:i+4], o.end[i:i+4]) > 0 {
+			return false
+		}
+		if bytes.Compare(o.start[i:i+4], e.end[i:i+4]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// flowElems returns the set elements that describe the traffic rd
+// allows.
+func flowElems(rd ruleDetails) []flowElem {
+	type addrRange struct {
+		low, high [4]byte
+	}
+	type portRange struct {
+		low, high uint16
+	}
+
+	remoteAddrs := []addrRange{{high: [4]byte{255, 255, 255, 255}}}
+	if len(rd.cfg.IPs) != 0 {
+		remoteAddrs = remoteAddrs[:0]
+		for _, ip := range rd.cfg.IPs {
+			if addr, ok := ip.Addr(); ok {
+				remoteAddrs = append(remoteAddrs, addrRange{low: addr.As4(), high: addr.As4()})
+			} else if low, high, ok := ip.Range(); ok {
+				remoteAddrs = append(remoteAddrs, addrRange{low: low.As4(), high: high.As4()})
+			}
+		}
+	}
+
+	var protoLow, protoHigh byte = 0, 255
+	switch rd.cfg.Proto {
+	case tcp:
+		protoLow, protoHigh = protoNum(tcp), protoNum(tcp)
+	case udp:
+		protoLow, protoHigh = protoNum(udp), protoNum(udp)
+	}
+
+	toPortRanges := func(ports []rulePorts) []portRange {
+		if len(ports) == 0 {
+			return []portRange{{high: 65535}}
+		}
+		ranges := make([]portRange, len(ports))
+		for i, port := range ports {
+			if port.single != 0 {
+				ranges[i] = portRange{low: port.single, high: port.single}
+			} else {
+				ranges[i] = portRange{low: port.interval.min, high: port.interval.max}
+			}
+		}
+		return ranges
+	}
+	localPorts := toPortRanges(rd.cfg.SrcPorts)
+	remotePorts := toPortRanges(rd.cfg.DstPorts)
+	if rd.inbound {
+		localPorts = toPortRanges(rd.cfg.DstPorts)
+		remotePorts = toPortRanges(rd.cfg.SrcPorts)
+	}
+
+	elems := make([]flowElem, 0, len(remoteAddrs)*len(localPorts)*len(remotePorts))
+	for _, remoteAddr := range remoteAddrs {
+		for _, localPort := range localPorts {
+			for _, remotePort := range remotePorts {
+				var e flowElem
+				copy(e.start[0:4], rd.addr)
+				copy(e.end[0:4], rd.addr)
+				copy(e.start[4:8], remoteAddr.low[:])
+				copy(e.end[4:8], remoteAddr.high[:])
+				e.start[8] = protoLow
+				e.end[8] = protoHigh
+				binary.BigEndian.PutUint16(e.start[12:14], localPort.low)
+				binary.BigEndian.PutUint16(e.end[12:14], localPort.high)
+				binary.BigEndian.PutUint16(e.start[16:18], remotePort.low)
+				binary.BigEndian.PutUint16(e.end[16:18], remotePort.high)
+				elems = append(elems, e)
+			}
+		}
+	}
+
+	return elems
+}
+
+// setElements converts flow elements to nftables set elements.
+func setElements(elems []flowElem) []nftables.SetElement {
+	setElems := make([]nftables.SetElement, len(elems))
+	for i, e := range elems {
+		setElems[i] = nftables.SetElement{
+			Key:    bytes.Clone(e.start[:]),
+			KeyEnd: bytes.Clone(e.end[:]),
+		}
+	}
+	return setElems
+}
+
+// createFlowSets adds the concatenated sets of a container chain.
+func createFlowSets(nfc firewallClient, sets *flowSets) error {
+	if err := nfc.AddSet(sets.out, nil); err != nil {
+		return fmt.Errorf("error adding set %q: %w", sets.out.Name, err)
+	}
+	if err := nfc.AddSet(sets.in, nil); err != nil {
+		return fmt.Errorf("error adding set %q: %w", sets.in.Name, err)
+	}
+	return nil
+}
+
+// fillFlowSets replaces the elements of the concatenated sets of a
+// container chain. The sets are flushed and filled in the same batch so
+// traffic that should be allowed is never dropped when recreating
+// rules for a container.
+func fillFlowSets(nfc firewallClient, sets *flowSets) error {
+	nfc.FlushSet(sets.out)
+	nfc.FlushSet(sets.in)
+	if len(sets.outElems) != 0 {
+		if err := nfc.SetAddElements(sets.out, setElements(sets.outElems)); err != nil {
+			return fmt.Errorf("error marshaling set elements: %w", err)
+		}
+	}
+	if len(sets.inElems) != 0 {
+		if err := nfc.SetAddElements(sets.in, setElements(sets.inElems)); err != nil {
+			return fmt.Errorf("error marshaling set elements: %w", err)
+		}
+	}
+
+	return nfc.Flush()
+}
+
+// deleteFlowSets deletes the concatenated sets of a container chain if
+// they exist.
+func deleteFlowSets(nfc firewallClient, chain *nftables.Chain) error {
+	for _, suffix := range []string{outboundSetSuffix, inboundSetSuffix} {
+		nfc.DelSet(&nftables.Set{
+			Table: chain.Table,
+			Name:  chain.Name + suffix,
+		})
+		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+			return fmt.Errorf("error deleting set %q: %w", chain.Name+suffix, err)
+		}
+	}
+
+	return nil
+}
+
+// createFlowSetRules returns rules that accept traffic to or from a
+// container if it is found in the container chain's concatenated sets.
+// If newOnly is true only rules for new traffic are returned.
+func createFlowSetRules(chain *nftables.Chain, sets *flowSets, id string, newOnly bool) []*nftables.Rule {
+	// sets are keyed by container addr . peer addr . proto .
+	// container port . peer port
+	fromCont := []uint32{srcAddrOffset, dstAddrOffset, srcPortOffset, dstPortOffset}
+	toCont := []uint32{dstAddrOffset, srcAddrOffset, dstPortOffset, srcPortOffset}
+
+	if newOnly {
+		return []*nftables.Rule{
+			createFlowSetRule(chain, sets.out, fromCont, stateNew, id),
+			createFlowSetRule(chain, sets.in, toCont, stateNew, id),
+		}
+	}
+
+	return []*nftables.Rule{
+		// new and established outbound traffic
+		createFlowSetRule(chain, sets.out, fromCont, stateNewEst, id),
+		// established inbound replies to outbound traffic
+		createFlowSetRule(chain, sets.out, toCont, stateEst, id),
+		// new and established inbound traffic
+		createFlowSetRule(chain, sets.in, toCont, stateNewEst, id),
+		// established outbound replies to inbound traffic
+		createFlowSetRule(chain, sets.in, fromCont, stateEst, id),
+	}
+}
+
+func createFlowSetRule(chain *nftables.Chain, set *nftables.Set, offsets []uint32, state uint32, id string) *nftables.Rule {
+	exprs := matchFlowExprs(set, offsets[0], offsets[1], offsets[2], offsets[3])
+	exprs = append(exprs, matchConnStateExprs(state)...)
+	exprs = append(exprs, &expr.Counter{}, acceptVerdict)
+
+	return &nftables.Rule{
+		Table:    chain.Table,
+		Chain:    chain,
+		Exprs:    exprs,
+		UserData: []byte(id),
+	}
+}
+
+func matchFlowExprs(set *nftables.Set, addrOffset, peerAddrOffset, portOffset, peerPortOffset uint32) []expr.Any {
+	return append(loadFlowExprs(addrOffset, peerAddrOffset, portOffset, peerPortOffset),
+		// [ lookup reg 1 set ... ]
+		&expr.Lookup{
+			SourceRegister: 1,
+			SetName:        set.Name,
+		},
+	)
+}
+
+// loadFlowExprs returns expressions that load the flow key of a packet
+// into registers starting at register 1.
+func loadFlowExprs(addrOffset, peerAddrOffset, portOffset, peerPortOffset uint32) []expr.Any {
+	return []expr.Any{
+		// [ payload load 4b @ network header + ... => reg 1 ]
+		&expr.Payload{
+			OperationType: expr.PayloadLoad,
+			Len:           4,
+			Base:          expr.PayloadBaseNetworkHeader,
+			Offset:        addrOffset,
+			DestRegister:  1,
+		},
+		// [ payload load 4b @ network header + ... => reg 9 ]
+		&expr.Payload{
+			OperationType: expr.PayloadLoad,
+			Len:           4,
+			Base:          expr.PayloadBaseNetworkHeader,
+			Offset:        peerAddrOffset,
+			DestRegister:  9,
+		},
+		// [ meta load l4proto => reg 10 ]
+		&expr.Meta{
+			Key:      expr.MetaKeyL4PROTO,
+			Register: 10,
+		},
+		// [ payload load 2b @ transport header + ... => reg 11 ]
+		&expr.Payload{
+			OperationType: expr.PayloadLoad,
+			Len:           2,
+			Base:          expr.PayloadBaseTransportHeader,
+			Offset:        portOffset,
+			DestRegister:  11,
+		},
+		// [ payload load 2b @ transport header + ... => reg 12 ]
+		&expr.Payload{
+			OperationType: expr.PayloadLoad,
+			Len:           2,
+			Base:          expr.PayloadBaseTransportHeader,
+			Offset:        peerPortOffset,
+			DestRegister:  12,
+		},
+	}
+}
+
+func protoNum(p protocol) byte {
+	if p == udp {
+		return unix.IPPROTO_UDP
+	}
+	return unix.IPPROTO_TCP
+}
+
+// deleteMisplacedDropRules deletes the drop rules of a container chain
+// if they exist but the set lookup rules do not. This happens when
+// rules were created with a different layout before, and the drop
+// rules must be recreated after the set lookup rules so they stay last.
+func deleteMisplacedDropRules(nfc firewallClient, logger *zap.Logger, chain *nftables.Chain, flowRule *nftables.Rule, dropRules []*nftables.Rule) error {
+	rules, err := nfc.GetRules(chain.Table, chain)
+	if err != nil {
+		return fmt.Errorf("error getting rules of chain %q: %w", chain.Name, err)
+	}
+	if findRule(logger, flowRule, rules) {
+		return nil
+	}
+
+	for _, dropRule := range dropRules {
+		if !findRule(logger, dropRule, rules) {
+			continue
+		}
+
+		logger.Info("rule layout changed, recreating drop rule")
+		if err := nfc.DelRule(dropRule); err != nil {
+			return fmt.Errorf("error deleting rule: %w", err)
+		}
+		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+			return fmt.Errorf("error deleting rule: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,758 @@
+package whalewall
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"golang.org/x/sys/unix"
+
+	"github.com/capnspacehook/whalewall/nfqueue"
+)
+
+const (
+	sniPendingSetName = "whalewall-sni-pending"
+	sniAllowedSetName = "whalewall-sni-allowed"
+	sniDeniedSetName  = "whalewall-sni-denied"
+
+	// sniCopyLen is how many bytes of queued packets are copied from
+	// the kernel, enough for any TCP segment.
+	sniCopyLen = 0xffff
+	// sniMaxHelloLen is the most bytes of a ClientHello that will be
+	// buffered. ClientHellos are rarely larger than a few KiB even
+	// with post-quantum key shares.
+	sniMaxHelloLen = 16 * 1024
+	// sniHelloTimeout is how long whalewall waits for the rest of a
+	// ClientHello split across TCP segments, and how long it remembers
+	// the verdict of a connection for packets that were queued before
+	// the verdict was reached.
+	sniHelloTimeout = 10 * time.Second
+	// sniPendingTimeout is how long a connection may be idle before
+	// its first data is sent. Connections that time out are dropped.
+	sniPendingTimeout = time.Minute
+	// sniAllowedTimeout is how long an allowed connection may be idle.
+	// Connections that time out are dropped, as their server names
+	// can't be checked again.
+	sniAllowedTimeout = time.Hour
+	// sniDeniedTimeout is how long packets of a denied connection are
+	// dropped after the last one was seen.
+	sniDeniedTimeout = time.Minute
+
+	// ctDirOriginal is the conntrack direction of packets sent by the
+	// side that created a connection.
+	ctDirOriginal = 0
+)
+
+// defaultSNIPorts are the ports whose connections are checked if
+// sni_ports isn't set.
+var defaultSNIPorts = []rulePorts{{single: 443}}
+
+const (
+	tlsRecordHeaderLen      = 5
+	tlsMaxRecordLen         = 1<<14 + 2048
+	tlsRecordHandshake      = 0x16
+	tlsHandshakeClientHello = 0x01
+	tlsExtServerName        = 0
+	tlsServerNameHost       = 0
+)
+
+var (
+	// connections whose ClientHello is being checked
+	sniPendingSet = &nftables.Set{
+		Table:      filterTable,
+		Name:       sniPendingSetName,
+		KeyType:    flowKeyType,
+		Dynamic:    true,
+		HasTimeout: true,
+		Timeout:    sniPendingTimeout,
+	}
+	// connections whose server name was allowed
+	sniAllowedSet = &nftables.Set{
+		Table:      filterTable,
+		Name:       sniAllowedSetName,
+		KeyType:    flowKeyType,
+		Dynamic:    true,
+		HasTimeout: true,
+		Timeout:    sniAllowedTimeout,
+	}
+	// connections whose server name wasn't allowed
+	sniDeniedSet = &nftables.Set{
+		Table:      filterTable,
+		Name:       sniDeniedSetName,
+		KeyType:    flowKeyType,
+		Dynamic:    true,
+		HasTimeout: true,
+		Timeout:    sniDeniedTimeout,
+	}
+
+	errTruncated      = errors.New("ClientHello is truncated")
+	errNotClientHello = errors.New("not a TLS ClientHello")
+)
+
+// WithSNIQueue makes rules of containers with allowed_sni set send
+// TLS ClientHellos of outbound connections to queue. Packets sent to
+// the queue are read by the RuleManager, which accepts or drops
+// connections depending on the server name of their ClientHello.
+func WithSNIQueue(queue uint16) Option {
+	return func(r *RuleManager) {
+		r.sniQueue = queue
+		r.sni = newSNIFilter()
+	}
+}
+
+// parseClientHello returns the server name of the TLS ClientHello at
+// the start of stream. The ClientHello may be split across several
+// TLS records. errTruncated is returned if stream ends before the
+// ClientHello does. If the ClientHello has no server name extension an
+// empty name is returned.
+func parseClientHello(stream []byte) (string, error) {
+	var msg []byte
+	for {
+		// check the start of records as soon as possible so other
+		// protocols are denied without waiting for more data
+		if len(stream) >= 1 && stream[0] != tlsRecordHandshake || len(stream) >= 2 && stream[1] != 3 {
+			return "", errNotClientHello
+		}
+		if len(stream) < tlsRecordHeaderLen {
+			return "", errTruncated
+		}
+		recordLen := int(binary.BigEndian.Uint16(stream[3:5]))
+		if recordLen == 0 || recordLen > tlsMaxRecordLen {
+			return "", errNotClientHello
+		}
+		if len(stream) < tlsRecordHeaderLen+recordLen {
+			return "", errTruncated
+		}
+		msg = append(msg, stream[tlsRecordHeaderLen:tlsRecordHeaderLen+recordLen]...)
+		stream = stream[tlsRecordHeaderLen+recordLen:]
+
+		if msg[0] != tlsHandshakeClientHello {
+			return "", errNotClientHello
+		}
+		// handshake messages have a 1 byte type and 3 byte length
+		if len(msg) < 4 {
+			continue
+		}
+		msgLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+		if len(msg) >= 4+msgLen {
+			return parseClientHelloBody(msg[4 : 4+msgLen])
+		}
+	}
+}
+
+func parseClientHelloBody(body []byte) (string, error) {
+	r := tlsReader(body)
+	// legacy_version and random
+	if !r.skip(2 + 32) {
+		return "", errNotClientHello
+	}
+	// legacy_session_id, cipher_suites and legacy_compression_methods
+	_, ok1 := r.vector8()
+	_, ok2 := r.vector16()
+	_, ok3 := r.vector8()
+	if !ok1 || !ok2 || !ok3 {
+		return "", errNotClientHello
+	}
+	if len(r) == 0 {
+		// no extensions
+		return "", nil
+	}
+
+	exts, ok := r.vector16()
+	if !ok {
+		return "", errNotClientHello
+	}
+	for len(exts) != 0 {
+		extType, ok1 := exts.uint16()
+		data, ok2 := exts.vector16()
+		if !ok1 || !ok2 {
+			return "", errNotClientHello
+		}
+		if extType != tlsExtServerName {
+			continue
+		}
+
+		names, ok := data.vector16()
+		if !ok {
+			return "", errNotClientHello
+		}
+		for len(names) != 0 {
+			nameType, ok1 := names.uint8()
+			name, ok2 := names.vector16()
+			if !ok1 || !ok2 {
+				return "", errNotClientHello
+			}
+			if nameType == tlsServerNameHost {
+				return string(name), nil
+			}
+		}
+		return "", nil
+	}
+
+	return "", nil
+}
+
+// tlsReader reads fields of TLS structures, consuming them as they
+// are read.
+type tlsReader []byte
+
+func (r *tlsReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *tlsReader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *tlsReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *tlsReader) bytes(n int) (tlsReader, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+// vector8 reads a vector with a 1 byte length.
+func (r *tlsReader) vector8() (tlsReader, bool) {
+	n, ok := r.uint8()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
+
+// vector16 reads a vector with a 2 byte length.
+func (r *tlsReader) vector16() (tlsReader, bool) {
+	n, ok := r.uint16()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
+
+// parseTCPSegment parses the flow, sequence number and payload of an
+// IPv4 TCP packet.
+func parseTCPSegment(b []byte) (packetFlow, uint32, []byte, error) {
+	flow, err := parsePacketFlow(b)
+	if err != nil {
+		return flow, 0, nil, err
+	}
+	if flow.proto != unix.IPPROTO_TCP {
+		return flow, 0, nil, errors.New("packet is not TCP")
+	}
+
+	ipHdrLen := int(b[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(b[2:4]))
+	if totalLen > len(b) || totalLen < ipHdrLen+20 {
+		return flow, 0, nil, errors.New("packet truncated")
+	}
+	tcpHdr := b[ipHdrLen:totalLen]
+	tcpHdrLen := int(tcpHdr[12]>>4) * 4
+	if tcpHdrLen < 20 || tcpHdrLen > len(tcpHdr) {
+		return flow, 0, nil, errors.New("TCP header truncated")
+	}
+
+	return flow, binary.BigEndian.Uint32(tcpHdr[4:8]), tcpHdr[tcpHdrLen:], nil
+}
+
+// sniDecision is what should happen to a packet sent to the SNI queue.
+type sniDecision uint8
+
+const (
+	// sniPending means the ClientHello of the connection hasn't been
+	// fully received yet, the packet should be accepted.
+	sniPending sniDecision = iota
+	// sniOutOfOrder means the packet arrived before a segment of the
+	// ClientHello that precedes it, the packet should be dropped so
+	// it's retransmitted after the missing segment.
+	sniOutOfOrder
+	// sniAllow means the server name of the connection is allowed.
+	sniAllow
+	// sniDeny means the connection isn't allowed.
+	sniDeny
+)
+
+// sniPolicy is the server names a container is allowed to connect to.
+type sniPolicy struct {
+	contID   string
+	contName string
+	allowed  []string
+}
+
+// sniResult is the outcome of checking a packet sent to the SNI queue.
+type sniResult struct {
+	decision   sniDecision
+	flow       packetFlow
+	policy     sniPolicy
+	serverName string
+	// reason is set if the connection was denied for a reason other
+	// than its server name not being allowed
+	reason string
+	// decided is true if the verdict of the connection was reached
+	// before the packet was checked, it was queued before the sets of
+	// connections were updated
+	decided bool
+}
+
+// sniFilter checks the server names of TLS ClientHellos sent by
+// containers.
+type sniFilter struct {
+	mtx       sync.Mutex
+	policies  map[netip.Addr]sniPolicy
+	flows     map[packetFlow]*sniFlow
+	lastPurge time.Time
+}
+
+// sniFlow is a connection whose ClientHello is being reassembled, or
+// whose verdict was recently reached.
+type sniFlow struct {
+	hello   []byte
+	nextSeq uint32
+	expires time.Time
+	// decision is the verdict of the connection if it was reached
+	decision sniDecision
+}
+
+func newSNIFilter() *sniFilter {
+	return &sniFilter{
+		policies: make(map[netip.Addr]sniPolicy),
+		flows:    make(map[packetFlow]*sniFlow),
+	}
+}
+
+// setPolicy sets the server names the container with the addresses
+// addrs is allowed to connect to.
+func (f *sniFilter) setPolicy(addrs map[string][]byte, policy sniPolicy) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	for _, addr := range addrs {
+		f.policies[netip.AddrFrom4([4]byte(addr))] = policy
+	}
+}
+
+// deletePolicy removes the policy of the container with the ID id.
+func (f *sniFilter) deletePolicy(id string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	maps.DeleteFunc(f.policies, func(_ netip.Addr, p sniPolicy) bool {
+		return p.contID == id
+	})
+}
+
+// check decides what should happen to the queued packet b, buffering
+// it if it contains part of a ClientHello.
+func (f *sniFilter) check(b []byte, now time.Time) sniResult {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if now.Sub(f.lastPurge) > time.Second {
+		maps.DeleteFunc(f.flows, func(_ packetFlow, fl *sniFlow) bool {
+			return now.After(fl.expires)
+		})
+		f.lastPurge = now
+	}
+
+	var res sniResult
+	flow, seq, payload, err := parseTCPSegment(b)
+	if err != nil {
+		res.decision = sniDeny
+		res.reason = err.Error()
+		return res
+	}
+	res.flow = flow
+	policy, ok := f.policies[flow.srcAddr]
+	if !ok {
+		res.decision = sniDeny
+		res.reason = "source is not a container with allowed server names"
+		return res
+	}
+	res.policy = policy
+
+	fl, ok := f.flows[flow]
+	if ok && !now.After(fl.expires) && fl.decision != sniPending {
+		res.decision = fl.decision
+		res.decided = true
+		return res
+	}
+	if !ok || now.After(fl.expires) {
+		// packets without data, such as ACKs of the handshake, are
+		// accepted until the connection's first data is sent
+		if len(payload) == 0 {
+			return res
+		}
+		fl = &sniFlow{
+			nextSeq: seq,
+			expires: now.Add(sniHelloTimeout),
+		}
+		f.flows[flow] = fl
+	}
+
+	// TCP sequence numbers wrap, compare them by their distance
+	switch diff := int32(seq - fl.nextSeq); {
+	case diff > 0:
+		res.decision = sniOutOfOrder
+		return res
+	case int(-diff) >= len(payload):
+		// retransmission of data that was already buffered
+		return res
+	default:
+		payload = payload[-diff:]
+	}
+	fl.hello = append(fl.hello, payload...)
+	fl.nextSeq += uint32(len(payload))
+
+	name, err := parseClientHello(fl.hello)
+	switch {
+	case errors.Is(err, errTruncated) && len(fl.hello) <= sniMaxHelloLen:
+		return res
+	case errors.Is(err, errTruncated):
+		res.reason = "ClientHello is too large"
+	case err != nil:
+		res.reason = err.Error()
+	case name == "":
+		res.reason = "ClientHello has no server name"
+	}
+
+	res.serverName = name
+	if res.reason == "" && domainAllowed(policy.allowed, name) {
+		res.decision = sniAllow
+	} else {
+		res.decision = sniDeny
+	}
+	// remember the verdict for packets that were queued after the
+	// ClientHello
+	f.flows[flow] = &sniFlow{
+		expires:  now.Add(sniHelloTimeout),
+		decision: res.decision,
+	}
+	return res
+}
+
+// flowKey returns the key of flow in the sets of checked connections.
+func flowKey(flow packetFlow) []byte {
+	key := make([]byte, flowKeyLen)
+	copy(key[0:4], flow.srcAddr.AsSlice())
+	copy(key[4:8], flow.dstAddr.AsSlice())
+	key[8] = flow.proto
+	binary.BigEndian.PutUint16(key[12:14], flow.srcPort)
+	binary.BigEndian.PutUint16(key[16:18], flow.dstPort)
+	return key
+}
+
+// createSNISets creates the sets of checked connections.
+func createSNISets(nfc firewallClient) error {
+	for _, set := range []*nftables.Set{sniPendingSet, sniAllowedSet, sniDeniedSet} {
+		if err := nfc.AddSet(set, nil); err != nil {
+			return fmt.Errorf("error adding set %q: %w", set.Name, err)
+		}
+	}
+	return nil
+}
+
+// createSNIRules returns rules that send the first data of new TCP
+// connections a container makes to ports to the SNI queue, and drop
+// packets of connections whose server name wasn't allowed or wasn't
+// checked. The rules must be placed before any rules that accept
+// established traffic of the container.
+func (r *RuleManager) createSNIRules(nfc firewallClient, addrs map[string][]byte, ports []rulePorts, chain *nftables.Chain, id string) ([]*nftables.Rule, error) {
+	if len(ports) == 0 {
+		ports = defaultSNIPorts
+	}
+
+	// the flow key contains the container's address, so packets of
+	// checked connections can be matched without matching the
+	// addresses of the container
+	deniedExprs := matchFlowExprs(sniDeniedSet, srcAddrOffset, dstAddrOffset, srcPortOffset, dstPortOffset)
+	deniedExprs = append(deniedExprs,
+		// [ dynset update reg_key 1 set whalewall-sni-denied timeout ... ]
+		&expr.Dynset{
+			SrcRegKey: 1,
+			SetName:   sniDeniedSetName,
+			Operation: unix.NFT_DYNSET_OP_UPDATE,
+			Timeout:   sniDeniedTimeout,
+		},
+		&expr.Counter{},
+		dropVerdict,
+	)
+	pendingExprs := matchFlowExprs(sniPendingSet, srcAddrOffset, dstAddrOffset, srcPortOffset, dstPortOffset)
+	pendingExprs = append(pendingExprs,
+		// [ dynset update reg_key 1 set whalewall-sni-pending timeout ... ]
+		&expr.Dynset{
+			SrcRegKey: 1,
+			SetName:   sniPendingSetName,
+			Operation: unix.NFT_DYNSET_OP_UPDATE,
+			Timeout:   sniPendingTimeout,
+		},
+		&expr.Counter{},
+		&expr.Queue{
+			Num: r.sniQueue,
+		},
+	)
+	// refresh allowed connections so they aren't dropped while in use,
+	// the rules below drop packets of connections that aren't allowed
+	allowedExprs := matchFlowExprs(sniAllowedSet, srcAddrOffset, dstAddrOffset, srcPortOffset, dstPortOffset)
+	allowedExprs = append(allowedExprs,
+		// [ dynset update reg_key 1 set whalewall-sni-allowed timeout ... ]
+		&expr.Dynset{
+			SrcRegKey: 1,
+			SetName:   sniAllowedSetName,
+			Operation: unix.NFT_DYNSET_OP_UPDATE,
+			Timeout:   sniAllowedTimeout,
+		},
+	)
+
+	rules := []*nftables.Rule{
+		{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    deniedExprs,
+			UserData: []byte(id),
+		},
+		{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    pendingExprs,
+			UserData: []byte(id),
+		},
+		{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    allowedExprs,
+			UserData: []byte(id),
+		},
+	}
+
+	netNames := maps.Keys(addrs)
+	slices.Sort(netNames)
+
+	for _, netName := range netNames {
+		// each rule needs its own anonymous set of ports
+		newPortExprs, err := createPortExprs(nfc, ports, dstPortOffset, chain)
+		if err != nil {
+			return nil, err
+		}
+		estPortExprs, err := createPortExprs(nfc, ports, dstPortOffset, chain)
+		if err != nil {
+			return nil, err
+		}
+
+		// start checking connections when they're created
+		exprs := matchAddrExprs(addrs[netName], srcAddrOffset)
+		exprs = append(exprs, matchProtoExprs(unix.IPPROTO_TCP)...)
+		exprs = append(exprs, newPortExprs...)
+		exprs = append(exprs, matchConnStateExprs(stateNew)...)
+		exprs = append(exprs, loadFlowExprs(srcAddrOffset, dstAddrOffset, srcPortOffset, dstPortOffset)...)
+		exprs = append(exprs,
+			// [ dynset add reg_key 1 set whalewall-sni-pending timeout ... ]
+			&expr.Dynset{
+				SrcRegKey: 1,
+				SetName:   sniPendingSetName,
+				Operation: unix.NFT_DYNSET_OP_ADD,
+				Timeout:   sniPendingTimeout,
+			},
+		)
+		rules = append(rules, &nftables.Rule{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: []byte(id),
+		})
+
+		// drop packets of connections that were never checked or
+		// whose checks expired
+		exprs = matchAddrExprs(addrs[netName], srcAddrOffset)
+		exprs = append(exprs, matchProtoExprs(unix.IPPROTO_TCP)...)
+		exprs = append(exprs, estPortExprs...)
+		exprs = append(exprs, matchConnStateExprs(stateEst)...)
+		exprs = append(exprs,
+			// [ ct load direction => reg 1 ]
+			&expr.Ct{
+				Register: 1,
+				Key:      expr.CtKeyDIRECTION,
+			},
+			// [ cmp eq reg 1 0x00 ]
+			&expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     []byte{ctDirOriginal},
+			},
+		)
+		exprs = append(exprs, loadFlowExprs(srcAddrOffset, dstAddrOffset, srcPortOffset, dstPortOffset)...)
+		exprs = append(exprs,
+			// [ lookup reg 1 set whalewall-sni-allowed 0x1 ]
+			&expr.Lookup{
+				SourceRegister: 1,
+				SetName:        sniAllowedSetName,
+				Invert:         true,
+			},
+			&expr.Counter{},
+			dropVerdict,
+		)
+		rules = append(rules, &nftables.Rule{
+			Table:    chain.Table,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: []byte(id),
+		})
+	}
+
+	return rules, nil
+}
+
+// filterSNI sets verdicts of packets sent to the SNI queue until the
+// RuleManager is stopped.
+func (r *RuleManager) filterSNI(conn *nfqueue.Conn, nfc firewallClient) {
+	go func() {
+		<-r.stopping
+		if err := conn.Close(); err != nil {
+			r.logger.Error("error closing SNI queue", zap.Error(err))
+		}
+	}()
+
+	var errs int
+	for {
+		pkts, err := conn.Receive()
+		if err != nil {
+			select {
+			case <-r.stopping:
+				return
+			default:
+			}
+			r.logger.Error("error receiving queued packets", zap.Error(err))
+			errs++
+			if !r.receiveBackoff(errs) {
+				return
+			}
+			continue
+		}
+		errs = 0
+
+		for _, pkt := range pkts {
+			verdict := r.handleSNIPacket(nfc, pkt.Payload)
+			if err := conn.SetVerdict(pkt.ID, verdict); err != nil {
+				r.logger.Error("error setting verdict of queued packet", zap.Error(err))
+			}
+		}
+	}
+}
+
+// handleSNIPacket returns the verdict of a packet sent to the SNI
+// queue, and moves the packet's connection from the set of pending
+// connections to the set of allowed or denied connections if the
+// connection was allowed or denied.
+func (r *RuleManager) handleSNIPacket(nfc firewallClient, b []byte) nfqueue.Verdict {
+	res := r.sni.check(b, time.Now())
+	switch {
+	case res.decision == sniPending:
+		return nfqueue.Accept
+	case res.decision == sniOutOfOrder:
+		return nfqueue.Drop
+	case res.decided:
+		// the connection was already logged and its sets updated
+		if res.decision == sniAllow {
+			return nfqueue.Accept
+		}
+		return nfqueue.Drop
+	}
+
+	var fields []zap.Field
+	if res.policy.contID != "" {
+		fields = append(fields,
+			zap.String("container.id", res.policy.contID[:12]),
+			zap.String("container.name", res.policy.contName),
+		)
+	}
+	fields = append(fields,
+		zap.String("tls.server_name", res.serverName),
+		zap.Stringer("packet.src_addr", res.flow.srcAddr),
+		zap.Uint16("packet.src_port", res.flow.srcPort),
+		zap.Stringer("packet.dst_addr", res.flow.dstAddr),
+		zap.Uint16("packet.dst_port", res.flow.dstPort),
+	)
+	if res.reason != "" {
+		fields = append(fields, zap.String("reason", res.reason))
+	}
+	if res.decision == sniAllow {
+		r.logger.Debug("allowed TLS connection", fields...)
+	} else {
+		r.logger.Warn("denied TLS connection", fields...)
+	}
+	// the flow can't be put in sets if the packet couldn't be parsed
+	if !res.flow.srcAddr.IsValid() {
+		return nfqueue.Drop
+	}
+
+	set, timeout, verdict := sniAllowedSet, sniAllowedTimeout, nfqueue.Accept
+	if res.decision == sniDeny {
+		set, timeout, verdict = sniDeniedSet, sniDeniedTimeout, nfqueue.Drop
+	}
+	if err := moveSNIFlow(nfc, flowKey(res.flow), set, timeout); err != nil {
+		r.logger.Error("error updating sets of checked connections", zap.String("set.name", set.Name), zap.Error(err))
+	}
+
+	return verdict
+}
+
+// moveSNIFlow removes the connection key from the set of pending
+// connections and adds it to set in one transaction, so packets of
+// the connection are always matched by one of the sets.
+func moveSNIFlow(nfc firewallClient, key []byte, set *nftables.Set, timeout time.Duration) error {
+	elems := []nftables.SetElement{{Key: key, Timeout: timeout}}
+	if err := nfc.SetAddElements(set, elems); err != nil {
+		return fmt.Errorf("error marshaling set elements: %w", err)
+	}
+	if err := nfc.SetDeleteElements(sniPendingSet, []nftables.SetElement{{Key: key}}); err != nil {
+		return fmt.Errorf("error marshaling set elements: %w", err)
+	}
+	err := ignoringErr(nfc.Flush, syscall.EEXIST)
+	if !errors.Is(err, syscall.ENOENT) {
+		return err
+	}
+
+	// the pending element expired, add the connection by itself
+	if err := nfc.SetAddElements(set, elems); err != nil {
+		return fmt.Errorf("error marshaling set elements: %w", err)
+	}
+	return ignoringErr(nfc.Flush, syscall.EEXIST)
+}
+
+// deleteSNISets deletes the sets of checked connections.
+func deleteSNISets(nfc firewallClient) error {
+	for _, set := range []*nftables.Set{sniPendingSet, sniAllowedSet, sniDeniedSet} {
+		nfc.DelSet(set)
+		if err := ignoringErr(nfc.Flush, syscall.ENOENT); err != nil {
+			return fmt.Errorf("error deleting set %q: %w", set.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package whalewall
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// suggestedConfig is a rules config that is marshaled to YAML. Only
+// fields that were set are marshaled.
+type suggestedConfig struct {
+	MappedPorts *suggestedMappedPorts `yaml:"mapped_ports,omitempty"`
+	Output      []suggestedRule       `yaml:"output,omitempty"`
+}
+
+type suggestedMappedPorts struct {
+	Localhost *suggestedMapping `yaml:"localhost,omitempty"`
+	External  *suggestedMapping `yaml:"external,omitempty"`
+}
+
+type suggestedMapping struct {
+	Allow bool         `yaml:"allow"`
+	IPs   []netip.Addr `yaml:"ips,omitempty"`
+}
+
+type suggestedRule struct {
+	Network   string       `yaml:"network,omitempty"`
+	Container string       `yaml:"container,omitempty"`
+	IPs       []netip.Addr `yaml:"ips,omitempty"`
+	Proto     string       `yaml:"proto"`
+	// DstPorts contains uint16s for single ports and strings for port
+	// ranges so single ports aren't marshaled as quoted strings.
+	DstPorts []any `yaml:"dst_ports"`
+}
+
+func (c suggestedConfig) marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return nil, fmt.Errorf("error marshaling rules: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("error marshaling rules: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// minPortRangeLen is the minimum number of consecutive ports that will
+// be grouped into a port range.
+const minPortRangeLen = 3
+
+// groupPorts sorts and deduplicates ports and groups consecutive ports
+// into ranges.
+func groupPorts(ports []uint16) []any {
+	ports = slices.Clone(ports)
+	slices.Sort(ports)
+	ports = slices.Compact(ports)
+
+	var grouped []any
+	for i := 0; i < len(ports); {
+		j := i + 1
+		for j < len(ports) && ports[j] == ports[j-1]+1 {
+			j++
+		}
+		if j-i >= minPortRangeLen {
+			grouped = append(grouped, fmt.Sprintf("%d-%d", ports[i], ports[j-1]))
+		} else {
+			for _, port := range ports[i:j] {
+				grouped = append(grouped, port)
+			}
+		}
+		i = j
+	}
+
+	return grouped
+}
+
+func compareSuggestedRules(a, b suggestedRule) int {
+	if c := cmp.Compare(a.Network, b.Network); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.Container, b.Container); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.Proto, b.Proto); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(firstPort(a.DstPorts), firstPort(b.DstPorts)); c != 0 {
+		return c
+	}
+	if len(a.IPs) != 0 && len(b.IPs) != 0 {
+		return a.IPs[0].Compare(b.IPs[0])
+	}
+	return 0
+}
+
+// firstPort returns the first port of ports created by groupPorts.
+func firstPort(ports []any) uint16 {
+	switch port := ports[0].(type) {
+	case uint16:
+		return port
+	case string:
+		minPort, _, _ := strings.Cut(port, "-")
+		p, _ := strconv.ParseUint(minPort, 10, 16)
+		return uint16(p)
+	default:
+		return 0
+	}
+}
+
+// SuggestRules returns the YAML of a rules config that would allow
+// traffic of the container contName that was recorded in learn mode.
+// Traffic to containers managed by whalewall is allowed with container
+// rules, and traffic from them is ignored as it will be allowed by
+// their own rules. If no traffic was recorded nil is returned.
+func (r *RuleManager) SuggestRules(ctx context.Context, contName string) ([]byte, error) {
+	flows, err := r.db.GetLearnedFlows(ctx, contName)
+	if err != nil {
+		return nil, fmt.Errorf("error getting learned flows from database: %w", err)
+	}
+
+	type containerKey struct {
+		network   string
+		container string
+		proto     uint8
+	}
+	type addrKey struct {
+		addr  netip.Addr
+		proto uint8
+	}
+
+	var (
+		cfg            suggestedConfig
+		externalAddrs  []netip.Addr
+		externalPublic bool
+		containerPorts = make(map[containerKey][]uint16)
+		addrPorts      = make(map[addrKey][]uint16)
+	)
+	for _, flow := range flows {
+		proto := uint8(flow.Proto)
+		if proto != unix.IPPROTO_TCP && proto != unix.IPPROTO_UDP {
+			// rules can only match ICMP traffic by allowing all
+			// traffic to an address
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(flow.Addr)
+		if !ok {
+			return nil, fmt.Errorf("invalid address %v in database", flow.Addr)
+		}
+
+		if flow.Direction == "inbound" {
+			switch {
+			case flow.Localhost != 0:
+				if cfg.MappedPorts == nil {
+					cfg.MappedPorts = &suggestedMappedPorts{}
+				}
+				cfg.MappedPorts.Localhost = &suggestedMapping{Allow: true}
+			case flow.PeerContainer == "":
+				if !addr.IsPrivate() && !addr.IsLoopback() && !addr.IsLinkLocalUnicast() {
+					externalPublic = true
+				}
+				if !slices.Contains(externalAddrs, addr) {
+					externalAddrs = append(externalAddrs, addr)
+				}
+			}
+			continue
+		}
+
+		port := uint16(flow.Port)
+		if flow.PeerContainer != "" {
+			key := containerKey{
+				network:   flow.PeerNetwork,
+				container: flow.PeerContainer,
+				proto:     proto,
+			}
+			containerPorts[key] = append(containerPorts[key], port)
+			continue
+		}
+		key := addrKey{
+			addr:  addr,
+			proto: proto,
+		}
+		addrPorts[key] = append(addrPorts[key], port)
+	}
+
+	if len(externalAddrs) != 0 {
+		if cfg.MappedPorts == nil {
+			cfg.MappedPorts = &suggestedMappedPorts{}
+		}
+		// if traffic came from the internet, allow everyone as
+		// listing every address seen is unlikely to be useful
+		external := &suggestedMapping{Allow: true}
+		if !externalPublic {
+			slices.SortFunc(externalAddrs, netip.Addr.Compare)
+			external.IPs = externalAddrs
+		}
+		cfg.MappedPorts.External = external
+	}
+
+	for key, ports := range containerPorts {
+		cfg.Output = append(cfg.Output, suggestedRule{
+			Network:   key.network,
+			Container: key.container,
+			Proto:     protoName(key.proto),
+			DstPorts:  groupPorts(ports),
+		})
+	}
+
+	// addresses that were sent traffic on the same ports can share a
+	// rule
+	type portsKey struct {
+		proto uint8
+		ports string
+	}
+	addrsByPorts := make(map[portsKey][]netip.Addr)
+	portsByKey := make(map[portsKey][]uint16)
+	for key, ports := range addrPorts {
+		slices.Sort(ports)
+		ports = slices.Compact(ports)
+		portStrs := make([]string, len(ports))
+		for i, port := range ports {
+			portStrs[i] = strconv.Itoa(int(port))
+		}
+		pk := portsKey{
+			proto: key.proto,
+			ports: strings.Join(portStrs, ","),
+		}
+		addrsByPorts[pk] = append(addrsByPorts[pk], key.addr)
+		portsByKey[pk] = ports
+	}
+	for pk, addrs := range addrsByPorts {
+		slices.SortFunc(addrs, netip.Addr.Compare)
+		cfg.Output = append(cfg.Output, suggestedRule{
+			IPs:      addrs,
+			Proto:    protoName(pk.proto),
+			DstPorts: groupPorts(portsByKey[pk]),
+		})
+	}
+	slices.SortFunc(cfg.Output, compareSuggestedRules)
+
+	if cfg.MappedPorts == nil && len(cfg.Output) == 0 {
+		return nil, nil
+	}
+
+	return cfg.marshal()
+}
@@ -22,8 +22,17 @@ func (r *RuleManager) syncContainers(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("error listing containers: %w", err)
 	}
-	// sort containers so those that don't have dependencies go first
+	// sort containers so those that don't have dependencies go first,
+	// and containers sharing the network namespace of another container
+	// go last as the owner's rules have to be created first
 	slices.SortFunc(containers, func(a, b types.Container) int {
+		if aShares, bShares := sharesNetns(a), sharesNetns(b); aShares != bShares {
+			if bShares {
+				return -1
+			}
+			return 1
+		}
+
 		_, aHasLabels := a.Labels[composeDependsLabel]
 		_, bHasLabels := b.Labels[composeDependsLabel]
 		if aHasLabels == bHasLabels {
@@ -3,14 +3,19 @@ package whalewall
 import (
 	"bytes"
 	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/gob"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"net/netip"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"slices"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -18,6 +23,7 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
@@ -26,11 +32,15 @@ import (
 	"github.com/google/nftables/expr"
 	"github.com/matryer/is"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	"go4.org/netipx"
 	"golang.org/x/exp/maps"
 	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
 
 	"github.com/capnspacehook/whalewall/database"
+	"github.com/capnspacehook/whalewall/nflog"
+	"github.com/capnspacehook/whalewall/nfqueue"
 )
 
 const defaultTimeout = 3 * time.Second
@@ -366,6 +376,8 @@ var (
 	dstRange    = netipx.RangeOfPrefix(netip.MustParsePrefix("192.168.1.0/24"))
 	lowDstAddr  = dstRange.From()
 	highDstAddr = dstRange.To()
+
+	testUserChainName = "user-chain"
 )
 
 func TestRuleCreation(t *testing.T) {
@@ -484,6 +496,97 @@ output:
 				},
 			},
 		},
+		{
+			name: "deny metadata address, allow HTTPS outbound",
+			containers: []types.ContainerJSON{
+				{
+					ContainerJSONBase: &types.ContainerJSONBase{
+						ID:   cont1ID,
+						Name: "/" + cont1Name,
+					},
+					Config: &container.Config{
+						Labels: map[string]string{
+							enabledLabel: "true",
+							rulesLabel: `
+output:
+  - proto: tcp
+    dst_ports:
+      - 443
+deny:
+  - log_prefix: "metadata"
+    ips:
+      - 169.254.169.254
+    proto: tcp
+    dst_ports:
+      - 443`,
+						},
+					},
+					NetworkSettings: &types.NetworkSettings{
+						Networks: map[string]*network.EndpointSettings{
+							"default": {
+								Gateway:   gatewayAddr.String(),
+								IPAddress: cont1Addr.String(),
+							},
+						},
+					},
+				},
+			},
+			expectedRules: map[*nftables.Chain][]*nftables.Rule{
+				{
+					Name:  buildChainName(cont1Name, cont1ID),
+					Table: filterTable,
+				}: {
+					{
+						Exprs: slicesJoin(
+							matchAddrExprs(ref(cont1Addr.As4())[:], srcAddrOffset),
+							matchAddrExprs(ref(netip.MustParseAddr("169.254.169.254").As4())[:], dstAddrOffset),
+							matchProtoExprs(unix.IPPROTO_TCP),
+							matchPortExprs(443, dstPortOffset),
+							matchConnStateExprs(stateNew),
+							[]expr.Any{
+								&expr.Counter{},
+								logExpr(formatLogPrefix("metadata", cont1Name, cont1ID)),
+								dropVerdict,
+							},
+						),
+						UserData: []byte(cont1ID),
+					},
+					{
+						Exprs: slicesJoin(
+							matchAddrExprs(ref(cont1Addr.As4())[:], srcAddrOffset),
+							matchProtoExprs(unix.IPPROTO_TCP),
+							matchPortExprs(443, dstPortOffset),
+							matchConnStateExprs(stateNewEst),
+							[]expr.Any{
+								&expr.Counter{},
+								acceptVerdict,
+							},
+						),
+						UserData: []byte(cont1ID),
+					},
+					{
+						Exprs: slicesJoin(
+							matchAddrExprs(ref(cont1Addr.As4())[:], dstAddrOffset),
+							matchProtoExprs(unix.IPPROTO_TCP),
+							matchPortExprs(443, srcPortOffset),
+							matchConnStateExprs(stateEst),
+							[]expr.Any{
+								&expr.Counter{},
+								acceptVerdict,
+							},
+						),
+						UserData: []byte(cont1ID),
+					},
+					createDropRule(
+						&nftables.Chain{
+							Name:  buildChainName(cont1Name, cont1ID),
+							Table: filterTable,
+						},
+						cont1ID,
+					),
+				},
+			},
+		},
 		{
 			name: "allow HTTP, HTTPS outbound",
 			containers: []types.ContainerJSON{
@@ -604,9 +707,10 @@ output:
 							matchProtoExprs(unix.IPPROTO_TCP),
 							[]expr.Any{
 								getPortExpr(dstPortOffset),
-								comparePortExpr(80),
+								matchFromSetExpr(&nftables.Set{
+									Name: anonSetName,
+								}),
 							},
-							comparePortsExprs(portInterval{420, 9001}),
 							matchConnStateExprs(stateNewEst),
 							[]expr.Any{
 								&expr.Counter{},
@@ -621,9 +725,10 @@ output:
 							matchProtoExprs(unix.IPPROTO_TCP),
 							[]expr.Any{
 								getPortExpr(srcPortOffset),
-								comparePortExpr(80),
+								matchFromSetExpr(&nftables.Set{
+									Name: anonSetName,
+								}),
 							},
-							comparePortsExprs(portInterval{420, 9001}),
 							matchConnStateExprs(stateEst),
 							[]expr.Any{
 								&expr.Counter{},
@@ -913,9 +1018,10 @@ output:
 							matchAddrExprs(ref(cont1Addr.As4())[:], srcAddrOffset),
 							[]expr.Any{
 								getAddrExpr(dstAddrOffset),
-								compareAddrExpr(ref(dstAddr.As4())[:]),
+								matchFromSetExpr(&nftables.Set{
+									Name: anonSetName,
+								}),
 							},
-							compareAddrRangeExprs(ref(lowDstAddr.As4())[:], ref(highDstAddr.As4())[:]),
 							matchProtoExprs(unix.IPPROTO_UDP),
 							matchPortExprs(53, dstPortOffset),
 							matchConnStateExprs(stateNewEst),
@@ -930,9 +1036,10 @@ output:
 						Exprs: slicesJoin(
 							[]expr.Any{
 								getAddrExpr(srcAddrOffset),
-								compareAddrExpr(ref(dstAddr.As4())[:]),
+								matchFromSetExpr(&nftables.Set{
+									Name: anonSetName,
+								}),
 							},
-							compareAddrRangeExprs(ref(lowDstAddr.As4())[:], ref(highDstAddr.As4())[:]),
 							matchAddrExprs(ref(cont1Addr.As4())[:], dstAddrOffset),
 							matchProtoExprs(unix.IPPROTO_UDP),
 							matchPortExprs(53, srcPortOffset),
@@ -1295,6 +1402,105 @@ output:
 				},
 			},
 		},
+		{
+			name: "verdict with queue ranges",
+			containers: []types.ContainerJSON{
+				{
+					ContainerJSONBase: &types.ContainerJSONBase{
+						ID:   cont1ID,
+						Name: "/" + cont1Name,
+					},
+					Config: &container.Config{
+						Labels: map[string]string{
+							enabledLabel: "true",
+							rulesLabel: `
+output:
+  - proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      queue: 1000-1003
+      input_est_queue: 1004
+      output_est_queue: 1005-1006
+      fanout: true
+      bypass: true`,
+						},
+					},
+					NetworkSettings: &types.NetworkSettings{
+						Networks: map[string]*network.EndpointSettings{
+							"default": {
+								Gateway:   gatewayAddr.String(),
+								IPAddress: cont1Addr.String(),
+							},
+						},
+					},
+				},
+			},
+			expectedRules: map[*nftables.Chain][]*nftables.Rule{
+				{
+					Name:  buildChainName(cont1Name, cont1ID),
+					Table: filterTable,
+				}: {
+					{
+						Exprs: slicesJoin(
+							matchAddrExprs(ref(cont1Addr.As4())[:], srcAddrOffset),
+							matchProtoExprs(unix.IPPROTO_TCP),
+							matchPortExprs(443, dstPortOffset),
+							matchConnStateExprs(stateNew),
+							[]expr.Any{
+								&expr.Counter{},
+								&expr.Queue{
+									Num:   1000,
+									Total: 4,
+									Flag:  expr.QueueFlagFanout | expr.QueueFlagBypass,
+								},
+							},
+						),
+						UserData: []byte(cont1ID),
+					},
+					{
+						Exprs: slicesJoin(
+							matchAddrExprs(ref(cont1Addr.As4())[:], srcAddrOffset),
+							matchProtoExprs(unix.IPPROTO_TCP),
+							matchPortExprs(443, dstPortOffset),
+							matchConnStateExprs(stateEst),
+							[]expr.Any{
+								&expr.Counter{},
+								&expr.Queue{
+									Num:   1005,
+									Total: 2,
+									Flag:  expr.QueueFlagFanout | expr.QueueFlagBypass,
+								},
+							},
+						),
+						UserData: []byte(cont1ID),
+					},
+					{
+						Exprs: slicesJoin(
+							matchAddrExprs(ref(cont1Addr.As4())[:], dstAddrOffset),
+							matchProtoExprs(unix.IPPROTO_TCP),
+							matchPortExprs(443, srcPortOffset),
+							matchConnStateExprs(stateEst),
+							[]expr.Any{
+								&expr.Counter{},
+								&expr.Queue{
+									Num:  1004,
+									Flag: expr.QueueFlagBypass,
+								},
+							},
+						),
+						UserData: []byte(cont1ID),
+					},
+					createDropRule(
+						&nftables.Chain{
+							Name:  buildChainName(cont1Name, cont1ID),
+							Table: filterTable,
+						},
+						cont1ID,
+					),
+				},
+			},
+		},
 		{
 			name: "verdict with queue and same output est queue",
 			containers: []types.ContainerJSON{
@@ -2416,6 +2622,8 @@ mapped_ports:
 
 				is.NoErr(mfc.Flush())
 				is.True(len(mfc.tables[filterTableName].Sets) == 0)
+				_, ok := mfc.tables[markTableName]
+				is.True(!ok)
 				chains := maps.Values(mfc.chains)
 				slices.SortFunc(chains, func(a, b chain) int {
 					if a.Chain.Name == b.Chain.Name {
@@ -2568,7 +2776,8 @@ output:
 	}
 
 	// create mock nftables client and add required prerequisite
-	// DOCKER-USER chain
+	// DOCKER-USER chain, and a chain created by the user that rules
+	// can jump to
 	firewallCreator := newMockFirewallCreator(logger)
 	mfc := firewallCreator.newMockFirewall()
 	mfc.AddTable(filterTable)
@@ -2577,6 +2786,11 @@ output:
 		Table: filterTable,
 		Type:  nftables.ChainTypeFilter,
 	})
+	mfc.AddChain(&nftables.Chain{
+		Name:  testUserChainName,
+		Table: filterTable,
+		Type:  nftables.ChainTypeFilter,
+	})
 	is.NoErr(mfc.Flush())
 	r.newFirewallClient = func() (firewallClient, error) {
 		return firewallCreator.newMockFirewall(), nil
@@ -2710,7 +2924,8 @@ output:
 	}
 
 	// create mock nftables client and add required prerequisite
-	// DOCKER-USER chain
+	// DOCKER-USER chain, and a chain created by the user that rules
+	// can jump to
 	firewallCreator := newMockFirewallCreator(logger)
 	mfc := firewallCreator.newMockFirewall()
 	mfc.AddTable(filterTable)
@@ -2719,6 +2934,11 @@ output:
 		Table: filterTable,
 		Type:  nftables.ChainTypeFilter,
 	})
+	mfc.AddChain(&nftables.Chain{
+		Name:  testUserChainName,
+		Table: filterTable,
+		Type:  nftables.ChainTypeFilter,
+	})
 	is.NoErr(mfc.Flush())
 	r.newFirewallClient = func() (firewallClient, error) {
 		return firewallCreator.newMockFirewall(), nil
@@ -2861,7 +3081,8 @@ output:
 	}
 
 	// create mock nftables client and add required prerequisite
-	// DOCKER-USER chain
+	// DOCKER-USER chain, and a chain created by the user that rules
+	// can jump to
 	firewallCreator := newMockFirewallCreator(logger)
 	mfc := firewallCreator.newMockFirewall()
 	mfc.AddTable(filterTable)
@@ -2870,6 +3091,11 @@ output:
 		Table: filterTable,
 		Type:  nftables.ChainTypeFilter,
 	})
+	mfc.AddChain(&nftables.Chain{
+		Name:  testUserChainName,
+		Table: filterTable,
+		Type:  nftables.ChainTypeFilter,
+	})
 	is.NoErr(mfc.Flush())
 	r.newFirewallClient = func() (firewallClient, error) {
 		return firewallCreator.newMockFirewall(), nil
@@ -2997,3 +3223,6656 @@ func reverse[E any](s []E) {
 		s[i], s[j] = s[j], s[i]
 	}
 }
+
+// newTestRuleManager returns a RuleManager that uses a mock Docker
+// client that knows about containers and a mock firewall that base
+// rules have already been created in.
+func newTestRuleManager(t *testing.T, logger *zap.Logger, containers []types.ContainerJSON, opts ...Option) (*RuleManager, mockFirewallCreatorI) {
+	t.Helper()
+
+	is := is.New(t)
+
+	dbFile := filepath.Join(t.TempDir(), "db.sqlite")
+	r, err := NewRuleManager(context.Background(), logger, dbFile, defaultTimeout, opts...)
+	is.NoErr(err)
+
+	dockerCli := newMockDockerClient(clone(containers))
+	r.newDockerClient = func() (dockerClient, error) {
+		return dockerCli, nil
+	}
+	r.checkCgroupv2 = func() error {
+		return nil
+	}
+	r.addrInterface = func(addr netip.Addr) (string, error) {
+		return testInterfaces[addr], nil
+	}
+	r.containerCgroup = func(c types.ContainerJSON) (cgroup, error) {
+		return cgroup{
+			path:  "system.slice/docker-" + c.ID + ".scope",
+			level: 2,
+			id:    testCgroupID(c.ID),
+		}, nil
+	}
+
+	// create mock nftables client and add required prerequisite
+	// DOCKER-USER chain, and a chain created by the user that rules
+	// can jump to
+	firewallCreator := newMockFirewallCreator(logger)
+	mfc := firewallCreator.newMockFirewall()
+	mfc.AddTable(filterTable)
+	mfc.AddChain(&nftables.Chain{
+		Name:  dockerChainName,
+		Table: filterTable,
+		Type:  nftables.ChainTypeFilter,
+	})
+	mfc.AddChain(&nftables.Chain{
+		Name:  testUserChainName,
+		Table: filterTable,
+		Type:  nftables.ChainTypeFilter,
+	})
+	is.NoErr(mfc.Flush())
+	r.newFirewallClient = func() (firewallClient, error) {
+		return firewallCreator.newMockFirewall(), nil
+	}
+
+	// create new database and base rules
+	err = r.init(context.Background())
+	is.NoErr(err)
+	err = r.createBaseRules()
+	is.NoErr(err)
+	t.Cleanup(func() {
+		err := r.clearRules(context.Background())
+		is.NoErr(err)
+	})
+
+	return r, firewallCreator
+}
+
+type testPacket struct {
+	src   netip.Addr
+	dst   netip.Addr
+	proto uint8
+	sport uint16
+	dport uint16
+	state uint32
+	// cgroup is the ID of the cgroup of the local socket of the packet,
+	// if any
+	cgroup uint64
+	// iifname is the name of the interface the packet arrived on
+	iifname string
+	// oifname is the name of the interface the packet will leave on
+	oifname string
+	// overLimit is true if the source of the packet exceeds rate limits,
+	// connection limits and ban thresholds
+	overLimit bool
+	// reply is true if the packet was sent by the side that didn't
+	// create the connection
+	reply bool
+	// origDst is the destination address the connection was made to
+	// before being DNATed; if unset the connection wasn't DNATed
+	origDst netip.Addr
+}
+
+func (p testPacket) String() string {
+	state := "new"
+	if p.state != stateNew {
+		state = "est"
+	}
+	return fmt.Sprintf("%s:%d -> %s:%d proto %d %s", p.src, p.sport, p.dst, p.dport, p.proto, state)
+}
+
+// evalPacket returns the verdict the rules of fw would reach for pkt,
+// starting from the whalewall chain. If no verdict is reached
+// "continue" is returned.
+func evalPacket(t *testing.T, fw *mockFirewall, pkt testPacket) string {
+	t.Helper()
+
+	return evalPacketFrom(t, fw, whalewallChainName, pkt)
+}
+
+// evalPacketFrom returns the verdict the rules of fw would reach for
+// pkt, starting from chainName.
+func evalPacketFrom(t *testing.T, fw *mockFirewall, chainName string, pkt testPacket) string {
+	t.Helper()
+
+	e := packetEvaluator{
+		t:   t,
+		fw:  fw,
+		pkt: pkt,
+	}
+	if verdict := e.evalChain(chainName, 0); verdict != "" {
+		return verdict
+	}
+	return "continue"
+}
+
+// evalPacketMarks returns the mark and conntrack mark the rules of the
+// mark chain of fw would set on pkt.
+func evalPacketMarks(t *testing.T, fw *mockFirewall, pkt testPacket) (uint32, uint32) {
+	t.Helper()
+
+	e := packetEvaluator{
+		t:   t,
+		fw:  fw,
+		pkt: pkt,
+	}
+	e.evalChain(markChainName, 0)
+
+	return e.mark, e.ctMark
+}
+
+type packetEvaluator struct {
+	t   *testing.T
+	fw  *mockFirewall
+	pkt testPacket
+
+	// mark and ctMark are the marks set on the packet by rules
+	mark   uint32
+	ctMark uint32
+}
+
+func (e *packetEvaluator) evalChain(name string, depth int) string {
+	e.t.Helper()
+
+	if depth > 16 {
+		e.t.Fatalf("chain jump loop detected at chain %s", name)
+	}
+	c, ok := e.fw.chains[name]
+	if !ok {
+		// chains not created by whalewall are opaque to us
+		return "jump " + name
+	}
+
+	for _, rule := range c.Rules {
+		verdict, matched := e.evalRule(rule, depth)
+		if matched && verdict != "" {
+			return verdict
+		}
+	}
+
+	return ""
+}
+
+// evalRule evaluates the expressions of rule. If rule matches and a
+// verdict is reached, it is returned.
+func (e *packetEvaluator) evalRule(rule *nftables.Rule, depth int) (string, bool) {
+	e.t.Helper()
+
+	var regs [80]byte
+	reg := func(r uint32, n int) []byte {
+		var off uint32
+		switch {
+		case r == 0:
+			off = 0
+		case r <= 4:
+			off = r * 16
+		default:
+			off = 16 + (r-8)*4
+		}
+		return regs[off : int(off)+n]
+	}
+	// values are zero-padded to a multiple of the 32 bit register size
+	// when loaded
+	load := func(r uint32, data []byte) {
+		padded := make([]byte, (len(data)+3)/4*4)
+		copy(padded, data)
+		copy(reg(r, len(padded)), padded)
+	}
+
+	netHdr := make([]byte, 20)
+	netHdr[9] = e.pkt.proto
+	copy(netHdr[12:16], ref(e.pkt.src.As4())[:])
+	copy(netHdr[16:20], ref(e.pkt.dst.As4())[:])
+	transHdr := binary.BigEndian.AppendUint16(nil, e.pkt.sport)
+	transHdr = binary.BigEndian.AppendUint16(transHdr, e.pkt.dport)
+
+	doVerdict := func(v *expr.Verdict) string {
+		switch v.Kind {
+		case expr.VerdictAccept:
+			return "accept"
+		case expr.VerdictDrop:
+			return "drop"
+		case expr.VerdictJump:
+			return e.evalChain(v.Chain, depth+1)
+		case expr.VerdictGoto:
+			if verdict := e.evalChain(v.Chain, depth+1); verdict != "" {
+				return verdict
+			}
+			return "return"
+		case expr.VerdictReturn:
+			return "return"
+		default:
+			e.t.Fatalf("unsupported verdict kind %d", v.Kind)
+			return ""
+		}
+	}
+
+	for _, ex := range rule.Exprs {
+		switch ex := ex.(type) {
+		case *expr.Payload:
+			var hdr []byte
+			switch ex.Base {
+			case expr.PayloadBaseNetworkHeader:
+				hdr = netHdr
+			case expr.PayloadBaseTransportHeader:
+				hdr = transHdr
+			default:
+				e.t.Fatalf("unsupported payload base %d", ex.Base)
+			}
+			// loading past the end of a packet doesn't match
+			if int(ex.Offset+ex.Len) > len(hdr) {
+				return "", false
+			}
+			load(ex.DestRegister, hdr[ex.Offset:ex.Offset+ex.Len])
+		case *expr.Meta:
+			if ex.SourceRegister {
+				if ex.Key != expr.MetaKeyMARK {
+					e.t.Fatalf("unsupported meta set key %d", ex.Key)
+				}
+				e.mark = binary.NativeEndian.Uint32(reg(ex.Register, 4))
+				continue
+			}
+			switch ex.Key {
+			case expr.MetaKeyL4PROTO:
+				load(ex.Register, []byte{e.pkt.proto})
+			case expr.MetaKeyIIFNAME:
+				load(ex.Register, ifnameData(e.pkt.iifname))
+			case expr.MetaKeyOIFNAME:
+				load(ex.Register, ifnameData(e.pkt.oifname))
+			default:
+				e.t.Fatalf("unsupported meta key %d", ex.Key)
+			}
+		case *expr.Socket:
+			switch ex.Key {
+			case expr.SocketKeyCgroupv2:
+				load(ex.Register, binary.NativeEndian.AppendUint64(nil, e.pkt.cgroup))
+			default:
+				e.t.Fatalf("unsupported socket key %d", ex.Key)
+			}
+		case *expr.Ct:
+			if ex.SourceRegister {
+				if ex.Key != expr.CtKeyMARK {
+					e.t.Fatalf("unsupported ct set key %d", ex.Key)
+				}
+				e.ctMark = binary.NativeEndian.Uint32(reg(ex.Register, 4))
+				continue
+			}
+			switch ex.Key {
+			case expr.CtKeySTATE:
+				load(ex.Register, binary.LittleEndian.AppendUint32(nil, e.pkt.state))
+			case expr.CtKeyDIRECTION:
+				var dir byte
+				if e.pkt.reply {
+					dir = 1
+				}
+				load(ex.Register, []byte{dir})
+			case expr.CtKeyDST:
+				if ex.Direction != ctDirOriginal {
+					e.t.Fatalf("unsupported ct direction %d", ex.Direction)
+				}
+				origDst := e.pkt.origDst
+				if !origDst.IsValid() {
+					origDst = e.pkt.dst
+					if e.pkt.reply {
+						origDst = e.pkt.src
+					}
+				}
+				load(ex.Register, origDst.AsSlice())
+			default:
+				e.t.Fatalf("unsupported ct key %d", ex.Key)
+			}
+		case *expr.Immediate:
+			load(ex.Register, ex.Data)
+		case *expr.Bitwise:
+			src := reg(ex.SourceRegister, int(ex.Len))
+			res := make([]byte, ex.Len)
+			for i := range res {
+				res[i] = (src[i] & ex.Mask[i]) ^ ex.Xor[i]
+			}
+			load(ex.DestRegister, res)
+		case *expr.Cmp:
+			c := bytes.Compare(reg(ex.Register, len(ex.Data)), ex.Data)
+			var ok bool
+			switch ex.Op {
+			case expr.CmpOpEq:
+				ok = c == 0
+			case expr.CmpOpNeq:
+				ok = c != 0
+			case expr.CmpOpLt:
+				ok = c < 0
+			case expr.CmpOpLte:
+				ok = c <= 0
+			case expr.CmpOpGt:
+				ok = c > 0
+			case expr.CmpOpGte:
+				ok = c >= 0
+			}
+			if !ok {
+				return "", false
+			}
+		case *expr.Lookup:
+			elems, ok := e.fw.tables[rule.Table.Name].Sets[ex.SetName]
+			if !ok {
+				e.t.Fatalf("set %q not found", ex.SetName)
+			}
+			elem, found := lookupElem(elems, func(n int) []byte {
+				return reg(ex.SourceRegister, n)
+			})
+			if found == ex.Invert {
+				return "", false
+			}
+			if ex.IsDestRegSet {
+				if elem.VerdictData == nil {
+					e.t.Fatalf("set %q is not a verdict map", ex.SetName)
+				}
+				return doVerdict(elem.VerdictData), true
+			}
+		case *expr.Dynset:
+			if _, ok := e.fw.tables[rule.Table.Name].Sets[ex.SetName]; !ok {
+				e.t.Fatalf("set %q not found", ex.SetName)
+			}
+			// adding to a set without evaluating expressions always
+			// matches
+			if len(ex.Exprs) != 0 && !e.pkt.overLimit {
+				return "", false
+			}
+		case *expr.Counter, *expr.Log, *expr.Limit:
+		case *expr.Verdict:
+			return doVerdict(ex), true
+		case *expr.Queue:
+			if ex.Total > 1 {
+				return fmt.Sprintf("queue %d-%d", ex.Num, ex.Num+ex.Total-1), true
+			}
+			return fmt.Sprintf("queue %d", ex.Num), true
+		case *expr.Reject:
+			if ex.Type == unix.NFT_REJECT_TCP_RST {
+				return "reject tcp-reset", true
+			}
+			return fmt.Sprintf("reject icmp %d", ex.Code), true
+		default:
+			e.t.Fatalf("unsupported expression %T", ex)
+		}
+	}
+
+	return "", true
+}
+
+// lookupElem returns the element of a set matching the key returned by
+// key. Interval ends are treated as inclusive.
+func lookupElem(elems []nftables.SetElement, key func(n int) []byte) (nftables.SetElement, bool) {
+	if len(elems) == 0 {
+		return nftables.SetElement{}, false
+	}
+	k := key(len(elems[0].Key))
+
+	isInterval := slices.ContainsFunc(elems, func(e nftables.SetElement) bool {
+		return e.IntervalEnd
+	})
+	for i, elem := range elems {
+		switch {
+		case len(elem.KeyEnd) != 0:
+			// concatenated ranges are compared by field
+			match := true
+			for j := 0; j < len(k); j += 4 {
+				if bytes.Compare(k[j:j+4], elem.Key[j:j+4]) < 0 || bytes.Compare(k[j:j+4], elem.KeyEnd[j:j+4]) > 0 {
+					match = false
+					break
+				}
+			}
+			if match {
+				return elem, true
+			}
+		case isInterval:
+			// interval ends are exclusive, and an interval without
+			// an end reaches the largest key
+			if elem.IntervalEnd || bytes.Compare(k, elem.Key) < 0 {
+				continue
+			}
+			if i+1 == len(elems) || !elems[i+1].IntervalEnd || bytes.Compare(k, elems[i+1].Key) < 0 {
+				return elem, true
+			}
+		default:
+			if bytes.Equal(k, elem.Key) {
+				return elem, true
+			}
+		}
+	}
+
+	return nftables.SetElement{}, false
+}
+
+// equivalenceTestContainers returns containers with rules that
+// exercise many different kinds of rules.
+func equivalenceTestContainers() []types.ContainerJSON {
+	cont1 := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:   cont1ID,
+			Name: "/" + cont1Name,
+			HostConfig: &container.HostConfig{
+				PortBindings: nat.PortMap{},
+			},
+		},
+		Config: &container.Config{
+			Labels: map[string]string{
+				enabledLabel: "true",
+				rulesLabel: `
+mapped_ports:
+  localhost:
+    allow: true
+  external:
+    allow: true
+    ips:
+      - 1.1.1.0/24
+      - 192.168.1.0/24
+output:
+  - proto: udp
+    dst_ports:
+      - 53
+  - ips:
+      - 1.1.1.1
+      - 1.0.0.1
+    proto: tcp
+    dst_ports:
+      - 80
+      - 443
+  - ips:
+      - 1.1.1.1
+    proto: tcp
+    dst_ports:
+      - 1000-2000
+      - 2500-2600
+  - ips:
+      - 192.168.1.10-192.168.1.20
+      - 10.0.0.0/8
+    proto: tcp
+    dst_ports:
+      - 1000-2000
+  - ips:
+      - 1.1.1.1
+    proto: tcp
+    dst_ports:
+      - 443
+  - ips:
+      - 192.168.1.15-192.168.1.30
+    proto: tcp
+    dst_ports:
+      - 1500-3000
+  - ips:
+      - 8.8.8.8
+  - ips:
+      - 1.0.0.1
+      - 192.168.1.30-192.168.1.40
+    proto: udp
+    dst_ports:
+      - 80
+      - 1000-1500
+  - ips:
+      - 8.8.8.8
+      - 192.168.1.15
+      - 192.168.1.0/28
+    proto: udp
+    dst_ports:
+      - 2000-2500
+      - 25
+      - 2500-3000
+  - proto: udp
+    src_ports:
+      - 100-200
+    dst_ports:
+      - 500
+  - log_prefix: "logged"
+    proto: tcp
+    dst_ports:
+      - 22
+  - proto: tcp
+    dst_ports:
+      - 25
+    verdict:
+      queue: 1000
+  - network: cont_net
+    container: container2
+    proto: tcp
+    dst_ports:
+      - 9001`,
+			},
+		},
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{
+				Ports: nat.PortMap{
+					"80/tcp": []nat.PortBinding{
+						{
+							HostIP:   "0.0.0.0",
+							HostPort: "8080",
+						},
+					},
+					"9000/udp": []nat.PortBinding{
+						{
+							HostIP:   "0.0.0.0",
+							HostPort: "9000",
+						},
+					},
+				},
+			},
+			Networks: map[string]*network.EndpointSettings{
+				"default": {
+					Gateway:   gatewayAddr.String(),
+					IPAddress: cont1Addr.String(),
+				},
+				"cont_net": {
+					Gateway:   "172.0.2.1",
+					IPAddress: "172.0.2.2",
+				},
+			},
+		},
+	}
+	cont2 := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:   cont2ID,
+			Name: "/" + cont2Name,
+		},
+		Config: &container.Config{
+			Labels: map[string]string{
+				enabledLabel: "true",
+				rulesLabel: `
+mapped_ports:
+  external:
+    allow: true
+output:
+  - ips:
+      - 192.168.1.0/24
+    proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      chain: ` + testUserChainName,
+			},
+		},
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{
+				Ports: nat.PortMap{
+					"443/tcp": []nat.PortBinding{
+						{
+							HostIP:   "0.0.0.0",
+							HostPort: "443",
+						},
+					},
+				},
+			},
+			Networks: map[string]*network.EndpointSettings{
+				"cont_net": {
+					Gateway:   "172.0.2.1",
+					IPAddress: "172.0.2.3",
+				},
+			},
+		},
+	}
+	return []types.ContainerJSON{cont2, cont1}
+}
+
+// equivalenceTestPackets returns inbound and outbound packets to and
+// from containers returned by equivalenceTestContainers.
+func equivalenceTestPackets() []testPacket {
+	contAddrs := []netip.Addr{
+		cont1Addr,
+		netip.MustParseAddr("172.0.2.2"),
+		netip.MustParseAddr("172.0.2.3"),
+	}
+	peerAddrs := []netip.Addr{
+		gatewayAddr,
+		netip.MustParseAddr("172.0.2.1"),
+		netip.MustParseAddr("172.0.2.2"),
+		netip.MustParseAddr("172.0.2.3"),
+		localAddr,
+		dstAddr,
+		netip.MustParseAddr("1.0.0.1"),
+		netip.MustParseAddr("8.8.8.8"),
+		lowDstAddr,
+		netip.MustParseAddr("192.168.1.10"),
+		netip.MustParseAddr("192.168.1.15"),
+		netip.MustParseAddr("192.168.1.20"),
+		netip.MustParseAddr("192.168.1.30"),
+		netip.MustParseAddr("192.168.1.31"),
+		netip.MustParseAddr("192.168.1.40"),
+		netip.MustParseAddr("192.168.1.41"),
+		highDstAddr,
+	}
+	protos := []uint8{unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_ICMP}
+	ports := []uint16{22, 25, 53, 80, 100, 150, 200, 443, 500, 999, 1000, 1500, 1501, 2000, 2500, 3000, 3001, 8080, 9000, 9001}
+
+	var pkts []testPacket
+	for _, contAddr := range contAddrs {
+		for _, peerAddr := range peerAddrs {
+			if contAddr == peerAddr {
+				continue
+			}
+			for _, proto := range protos {
+				for _, port := range ports {
+					for _, state := range []uint32{stateNew, expr.CtStateBitESTABLISHED} {
+						pkts = append(pkts,
+							testPacket{src: contAddr, dst: peerAddr, proto: proto, sport: 40000, dport: port, state: state},
+							testPacket{src: contAddr, dst: peerAddr, proto: proto, sport: port, dport: 40000, state: state},
+							testPacket{src: peerAddr, dst: contAddr, proto: proto, sport: 40000, dport: port, state: state},
+							testPacket{src: peerAddr, dst: contAddr, proto: proto, sport: port, dport: 40000, state: state},
+						)
+					}
+				}
+			}
+		}
+	}
+
+	return pkts
+}
+
+// createTestFirewall creates rules for containers twice, once as new
+// containers and once as existing containers, and returns the
+// resulting firewall.
+func createTestFirewall(t *testing.T, logger *zap.Logger, containers []types.ContainerJSON, opts ...Option) *mockFirewall {
+	t.Helper()
+
+	is := is.New(t)
+	r, firewallCreator := newTestRuleManager(t, logger, containers, opts...)
+	for _, isNew := range []bool{true, false} {
+		for _, c := range containers {
+			err := r.createContainerRules(context.Background(), c, isNew)
+			is.NoErr(err)
+		}
+	}
+
+	return firewallCreator.newMockFirewall()
+}
+
+func TestRuleLayoutEquivalence(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := equivalenceTestContainers()
+	rulesFw := createTestFirewall(t, logger, containers, WithRuleLayout(LayoutRules))
+	setsFw := createTestFirewall(t, logger, containers, WithRuleLayout(LayoutSets))
+
+	// the sets layout should need less rules
+	cont1Chain := buildChainName(cont1Name, cont1ID)
+	is.True(len(setsFw.chains[cont1Chain].Rules) < len(rulesFw.chains[cont1Chain].Rules))
+
+	for _, pkt := range equivalenceTestPackets() {
+		rulesVerdict := evalPacket(t, rulesFw, pkt)
+		setsVerdict := evalPacket(t, setsFw, pkt)
+		if rulesVerdict != setsVerdict {
+			t.Errorf("packet %s: verdict of rules layout %q differs from sets layout %q", pkt, rulesVerdict, setsVerdict)
+		}
+	}
+}
+
+func TestIntervalSetElems(t *testing.T) {
+	t.Parallel()
+
+	port := func(p uint16) []byte {
+		return binary.BigEndian.AppendUint16(nil, p)
+	}
+	tests := []struct {
+		name      string
+		intervals []keyInterval
+		expected  []nftables.SetElement
+	}{
+		{
+			name: "single",
+			intervals: []keyInterval{
+				{low: port(80), high: port(80)},
+			},
+			expected: []nftables.SetElement{
+				{Key: port(80)},
+				{Key: port(81), IntervalEnd: true},
+			},
+		},
+		{
+			name: "disjoint",
+			intervals: []keyInterval{
+				{low: port(1000), high: port(2000)},
+				{low: port(80), high: port(80)},
+			},
+			expected: []nftables.SetElement{
+				{Key: port(80)},
+				{Key: port(81), IntervalEnd: true},
+				{Key: port(1000)},
+				{Key: port(2001), IntervalEnd: true},
+			},
+		},
+		{
+			name: "overlapping and adjacent",
+			intervals: []keyInterval{
+				{low: port(1500), high: port(1500)},
+				{low: port(1000), high: port(2000)},
+				{low: port(2001), high: port(2500)},
+				{low: port(2400), high: port(3000)},
+			},
+			expected: []nftables.SetElement{
+				{Key: port(1000)},
+				{Key: port(3001), IntervalEnd: true},
+			},
+		},
+		{
+			name: "largest key",
+			intervals: []keyInterval{
+				{low: port(80), high: port(80)},
+				{low: port(60000), high: port(65535)},
+				{low: port(65535), high: port(65535)},
+			},
+			expected: []nftables.SetElement{
+				{Key: port(80)},
+				{Key: port(81), IntervalEnd: true},
+				{Key: port(60000)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			is := is.New(t)
+
+			is.Equal(intervalSetElems(tt.intervals), tt.expected)
+		})
+	}
+}
+
+func TestRuleLayoutSetsRuleCount(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	ruleCount := func(rules string) int {
+		c := types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel:   rules,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		}
+
+		r, firewallCreator := newTestRuleManager(t, logger, []types.ContainerJSON{c}, WithRuleLayout(LayoutSets))
+		err := r.createContainerRules(context.Background(), c, true)
+		is.NoErr(err)
+
+		mfc := firewallCreator.newMockFirewall()
+		return len(mfc.chains[buildChainName(cont1Name, cont1ID)].Rules)
+	}
+
+	oneDst := ruleCount(`
+output:
+  - ips:
+      - 1.1.1.1
+    proto: tcp
+    dst_ports:
+      - 443`)
+	manyDsts := ruleCount(`
+output:
+  - ips:
+      - 1.1.1.1
+      - 1.0.0.1
+    proto: tcp
+    dst_ports:
+      - 443
+  - ips:
+      - 10.0.0.0/8
+    proto: udp
+    dst_ports:
+      - 53
+      - 5000-6000
+  - ips:
+      - 8.8.8.8
+      - 8.8.4.4
+  - ips:
+      - 9.9.9.9
+    proto: tcp
+    dst_ports:
+      - 22`)
+	is.Equal(oneDst, manyDsts)
+	// 4 set lookup rules and the drop rule
+	is.Equal(oneDst, 5)
+}
+
+func TestEstFastPath(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := equivalenceTestContainers()
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			is := is.New(t)
+
+			fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+			fastFw := createTestFirewall(t, logger, containers, WithRuleLayout(layout), WithEstablishedFastPath(true))
+
+			var rules, fastRules int
+			for name, c := range fw.chains {
+				rules += len(c.Rules)
+				fastRules += len(fastFw.chains[name].Rules)
+			}
+			is.True(fastRules < rules)
+
+			// rules outside the whalewall chain should only match new
+			// traffic
+			for name, c := range fastFw.chains {
+				if name == whalewallChainName {
+					continue
+				}
+				for _, rule := range c.Rules {
+					for i, e := range rule.Exprs {
+						if _, ok := e.(*expr.Ct); !ok {
+							continue
+						}
+						bitwise, ok := rule.Exprs[i+1].(*expr.Bitwise)
+						is.True(ok)
+						is.Equal(binary.LittleEndian.Uint32(bitwise.Mask), uint32(stateNew))
+					}
+				}
+			}
+
+			for _, pkt := range equivalenceTestPackets() {
+				verdict := evalPacket(t, fw, pkt)
+				fastVerdict := evalPacket(t, fastFw, pkt)
+				if pkt.state == stateNew {
+					if verdict != fastVerdict {
+						t.Errorf("packet %s: verdict %q differs from fast path verdict %q", pkt, verdict, fastVerdict)
+					}
+				} else if fastVerdict != "accept" {
+					t.Errorf("packet %s: established packet was not accepted by fast path: %q", pkt, fastVerdict)
+				}
+			}
+		})
+	}
+}
+
+func TestEstFastPathToggle(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	c := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:   cont1ID,
+			Name: "/" + cont1Name,
+		},
+		Config: &container.Config{
+			Labels: map[string]string{
+				enabledLabel: "true",
+			},
+		},
+		NetworkSettings: &types.NetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"default": {
+					Gateway:   gatewayAddr.String(),
+					IPAddress: cont1Addr.String(),
+				},
+			},
+		},
+	}
+
+	r, firewallCreator := newTestRuleManager(t, logger, []types.ContainerJSON{c}, WithEstablishedFastPath(true))
+	err = r.createContainerRules(context.Background(), c, true)
+	is.NoErr(err)
+
+	mfc := firewallCreator.newMockFirewall()
+	mainRules := mfc.chains[whalewallChainName].Rules
+	is.Equal(len(mainRules), 4)
+	is.True(rulesEqual(logger, mainRules[0], createEstFastPathRule(srcAddrOffset)))
+	is.True(rulesEqual(logger, mainRules[1], createEstFastPathRule(dstAddrOffset)))
+	is.Equal(mfc.tables[filterTableName].Sets[managedAddrSetName], []nftables.SetElement{{Key: ref(cont1Addr.As4())[:]}})
+
+	// disabling the fast path should remove the rules and set
+	r.estFastPath = false
+	err = r.createBaseRules()
+	is.NoErr(err)
+
+	mfc = firewallCreator.newMockFirewall()
+	is.Equal(len(mfc.chains[whalewallChainName].Rules), 2)
+	_, ok := mfc.tables[filterTableName].Sets[managedAddrSetName]
+	is.True(!ok)
+
+	// re-enabling the fast path should recreate the rules and set
+	// elements
+	r.estFastPath = true
+	err = r.createBaseRules()
+	is.NoErr(err)
+	err = r.createContainerRules(context.Background(), c, false)
+	is.NoErr(err)
+
+	mfc = firewallCreator.newMockFirewall()
+	mainRules = mfc.chains[whalewallChainName].Rules
+	is.Equal(len(mainRules), 4)
+	is.True(rulesEqual(logger, mainRules[0], createEstFastPathRule(srcAddrOffset)))
+	is.Equal(len(mfc.tables[filterTableName].Sets[managedAddrSetName]), 1)
+
+	// deleting the container should remove its elements
+	err = r.deleteContainerRules(context.Background(), cont1ID, cont1Name)
+	is.NoErr(err)
+
+	mfc = firewallCreator.newMockFirewall()
+	is.Equal(len(mfc.tables[filterTableName].Sets[managedAddrSetName]), 0)
+}
+
+func TestLogGroup(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := equivalenceTestContainers()
+	fw := createTestFirewall(t, logger, containers)
+	nflogFw := createTestFirewall(t, logger, containers, WithLogGroup(5), WithDropLogging(true))
+
+	// logging to a NFLOG group and limiting logging should not change
+	// what happens to packets
+	for _, pkt := range equivalenceTestPackets() {
+		verdict := evalPacket(t, fw, pkt)
+		nflogVerdict := evalPacket(t, nflogFw, pkt)
+		if verdict != nflogVerdict {
+			t.Errorf("packet %s: verdict %q differs from NFLOG verdict %q", pkt, verdict, nflogVerdict)
+		}
+	}
+
+	// all rules should log to the NFLOG group
+	var logs int
+	for _, c := range nflogFw.chains {
+		for _, rule := range c.Rules {
+			for _, e := range rule.Exprs {
+				log, ok := e.(*expr.Log)
+				if !ok {
+					continue
+				}
+				logs++
+				is.Equal(log.Group, uint16(5))
+				_, ok = parseLogPrefix(string(log.Data))
+				is.True(ok)
+			}
+		}
+	}
+	is.True(logs != 0)
+
+	// dropped packets should be logged with a limit
+	cont1Chain := buildChainName(cont1Name, cont1ID)
+	rules := nflogFw.chains[cont1Chain].Rules
+	logRule, dropRule := rules[len(rules)-2], rules[len(rules)-1]
+	is.Equal(logRule.Exprs[0], &expr.Limit{
+		Type: expr.LimitTypePkts,
+		Rate: 10,
+		Unit: expr.LimitTimeMinute,
+	})
+	is.Equal(string(logRule.Exprs[1].(*expr.Log).Data), "drop "+cont1Chain+": ")
+	is.Equal(dropRule.Exprs[len(dropRule.Exprs)-1], dropVerdict)
+
+	// dropped packets should all be logged without a limit
+	unlimitedFw := createTestFirewall(t, logger, containers, WithLogGroup(5), WithDropLogging(true), WithDropLogLimit(0))
+	rules = unlimitedFw.chains[cont1Chain].Rules
+	dropRule = rules[len(rules)-1]
+	is.Equal(dropRule.Exprs, []expr.Any{
+		&expr.Counter{},
+		&expr.Log{
+			Key:   (1 << unix.NFTA_LOG_PREFIX) | (1 << unix.NFTA_LOG_GROUP),
+			Group: 5,
+			Data:  []byte("drop " + cont1Chain + ": "),
+		},
+		dropVerdict,
+	})
+
+	// dropped packets should not be logged unless enabled
+	defaultFw := createTestFirewall(t, logger, containers, WithLogGroup(5))
+	rules = defaultFw.chains[cont1Chain].Rules
+	is.Equal(rules[len(rules)-1].Exprs, []expr.Any{
+		&expr.Counter{},
+		dropVerdict,
+	})
+}
+
+func TestParseLogPrefix(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		prefix   string
+		expected logPrefix
+		ok       bool
+	}{
+		{
+			prefix: "drop whalewall-container1-0123456789ab: ",
+			expected: logPrefix{
+				verdict:  "drop",
+				contName: "container1",
+				contID:   "0123456789ab",
+			},
+			ok: true,
+		},
+		{
+			prefix: "accept whalewall-my-app-1-0123456789ab web traffic: ",
+			expected: logPrefix{
+				verdict:    "accept",
+				contName:   "my-app-1",
+				contID:     "0123456789ab",
+				rulePrefix: "web traffic",
+			},
+			ok: true,
+		},
+		{
+			prefix: "queue whalewall-c-0123456789ab dns: ",
+			expected: logPrefix{
+				verdict:    "queue",
+				contName:   "c",
+				contID:     "0123456789ab",
+				rulePrefix: "dns",
+			},
+			ok: true,
+		},
+		{
+			prefix: "some other prefix",
+		},
+		{
+			prefix: "drop",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			is := is.New(t)
+
+			p, ok := parseLogPrefix(tt.prefix)
+			is.Equal(ok, tt.ok)
+			if ok {
+				is.Equal(p, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParsePacketFlow(t *testing.T) {
+	t.Parallel()
+
+	ipHdr := func(proto byte, opts int) []byte {
+		hdr := make([]byte, 20+opts)
+		hdr[0] = 0x40 | byte((20+opts)/4)
+		hdr[9] = proto
+		copy(hdr[12:], []byte{172, 0, 1, 2})
+		copy(hdr[16:], []byte{1, 1, 1, 1})
+		return hdr
+	}
+
+	tests := []struct {
+		name     string
+		pkt      []byte
+		expected packetFlow
+		wantErr  bool
+	}{
+		{
+			name: "tcp",
+			pkt:  append(ipHdr(unix.IPPROTO_TCP, 0), 0x9c, 0x40, 0x01, 0xbb),
+			expected: packetFlow{
+				srcAddr: cont1Addr,
+				dstAddr: dstAddr,
+				proto:   unix.IPPROTO_TCP,
+				srcPort: 40000,
+				dstPort: 443,
+			},
+		},
+		{
+			name: "udp with IP options",
+			pkt:  append(ipHdr(unix.IPPROTO_UDP, 8), 0x9c, 0x40, 0x00, 0x35),
+			expected: packetFlow{
+				srcAddr: cont1Addr,
+				dstAddr: dstAddr,
+				proto:   unix.IPPROTO_UDP,
+				srcPort: 40000,
+				dstPort: 53,
+			},
+		},
+		{
+			name: "icmp",
+			pkt:  append(ipHdr(unix.IPPROTO_ICMP, 0), 8, 0),
+			expected: packetFlow{
+				srcAddr: cont1Addr,
+				dstAddr: dstAddr,
+				proto:   unix.IPPROTO_ICMP,
+			},
+		},
+		{
+			name:    "truncated transport header",
+			pkt:     append(ipHdr(unix.IPPROTO_TCP, 0), 0x9c),
+			wantErr: true,
+		},
+		{
+			name:    "IPv6",
+			pkt:     append([]byte{0x60}, make([]byte, 39)...),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+
+			flow, err := parsePacketFlow(tt.pkt)
+			if tt.wantErr {
+				is.True(err != nil)
+				return
+			}
+			is.NoErr(err)
+			is.Equal(flow, tt.expected)
+		})
+	}
+}
+
+func TestLogPacket(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	containers := equivalenceTestContainers()
+	r, _ := newTestRuleManager(t, logger, containers, WithLogGroup(5))
+	for _, c := range containers {
+		err := r.createContainerRules(context.Background(), c, true)
+		is.NoErr(err)
+	}
+
+	pkt := []byte{
+		0x45, 0x00, 0x00, 0x3c, 0x00, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		1, 1, 1, 1,
+		172, 0, 1, 2,
+		0x9c, 0x40, 0x00, 0x50,
+	}
+	outPkt := []byte{
+		0x45, 0x00, 0x00, 0x3c, 0x00, 0x00, 0x40, 0x00, 0x40, 0x06, 0x00, 0x00,
+		172, 0, 1, 2,
+		1, 1, 1, 1,
+		0x00, 0x50, 0x9c, 0x40,
+	}
+	// the addresses of a container are looked up once per batch, and
+	// packets of containers that aren't known have no direction
+	r.logPackets(context.Background(), []nflog.Packet{
+		{
+			Prefix:  "drop " + buildChainName(cont1Name, cont1ID) + ": ",
+			Payload: pkt,
+		},
+		{
+			Prefix:  "accept " + buildChainName(cont1Name, cont1ID) + ": ",
+			Payload: outPkt,
+		},
+		{
+			Prefix:  "drop " + buildChainName("unknown", cont1ID) + ": ",
+			Payload: pkt,
+		},
+	})
+
+	entries := logs.FilterMessage("logged packet").All()
+	is.Equal(len(entries), 3)
+	is.Equal(entries[1].ContextMap()["packet.direction"], "outbound")
+	is.Equal(entries[2].ContextMap()["packet.direction"], "unknown")
+	is.Equal(entries[0].ContextMap(), map[string]any{
+		"container.id":     cont1ID[:12],
+		"container.name":   cont1Name,
+		"packet.direction": "inbound",
+		"packet.verdict":   "drop",
+		"packet.proto":     "tcp",
+		"packet.src_addr":  "1.1.1.1",
+		"packet.src_port":  uint16(40000),
+		"packet.dst_addr":  "172.0.1.2",
+		"packet.dst_port":  uint16(80),
+	})
+}
+
+func TestDenials(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := equivalenceTestContainers()
+	r, _ := newTestRuleManager(t, logger, containers, WithLogGroup(5))
+	for _, c := range containers {
+		err := r.createContainerRules(context.Background(), c, true)
+		is.NoErr(err)
+	}
+
+	tcpPkt := func(src, dst [4]byte, sport, dport uint16) []byte {
+		b := []byte{0x45, 0x00, 0x00, 0x3c, 0x00, 0x00, 0x40, 0x00, 0x40, unix.IPPROTO_TCP, 0x00, 0x00}
+		b = append(b, src[:]...)
+		b = append(b, dst[:]...)
+		b = binary.BigEndian.AppendUint16(b, sport)
+		return binary.BigEndian.AppendUint16(b, dport)
+	}
+	udpPkt := func(src, dst [4]byte, sport, dport uint16) []byte {
+		b := tcpPkt(src, dst, sport, dport)
+		b[9] = unix.IPPROTO_UDP
+		return b
+	}
+
+	contAddr := [4]byte{172, 0, 1, 2}
+	prefix := "drop " + buildChainName(cont1Name, cont1ID) + ": "
+	start := time.Unix(1700000000, 0)
+	pkts := [][]byte{
+		tcpPkt(contAddr, [4]byte{8, 8, 8, 8}, 40000, 443),
+		tcpPkt(contAddr, [4]byte{8, 8, 8, 8}, 40001, 443),
+		tcpPkt(contAddr, [4]byte{1, 1, 1, 1}, 40002, 443),
+		udpPkt(contAddr, [4]byte{9, 9, 9, 9}, 40003, 53),
+		tcpPkt([4]byte{1, 1, 1, 1}, contAddr, 40004, 80),
+	}
+	logged := make([]nflog.Packet, 0, len(pkts)+1)
+	for i, pkt := range pkts {
+		logged = append(logged, nflog.Packet{
+			Prefix:    prefix,
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Payload:   pkt,
+		})
+	}
+	// accepted packets should not be recorded
+	logged = append(logged, nflog.Packet{
+		Prefix:  "accept " + buildChainName(cont1Name, cont1ID) + ": ",
+		Payload: tcpPkt(contAddr, [4]byte{4, 4, 4, 4}, 40005, 443),
+	})
+	r.logPackets(context.Background(), logged)
+
+	denials, err := r.Denials(context.Background(), cont1Name)
+	is.NoErr(err)
+	is.Equal(denials, []Denial{
+		{
+			Direction: "inbound",
+			Addr:      netip.MustParseAddr("1.1.1.1"),
+			Proto:     "tcp",
+			Port:      80,
+			Count:     1,
+			FirstSeen: start.Add(4 * time.Second),
+			LastSeen:  start.Add(4 * time.Second),
+		},
+		{
+			Direction: "outbound",
+			Addr:      netip.MustParseAddr("9.9.9.9"),
+			Proto:     "udp",
+			Port:      53,
+			Count:     1,
+			FirstSeen: start.Add(3 * time.Second),
+			LastSeen:  start.Add(3 * time.Second),
+		},
+		{
+			Direction: "outbound",
+			Addr:      netip.MustParseAddr("1.1.1.1"),
+			Proto:     "tcp",
+			Port:      443,
+			Count:     1,
+			FirstSeen: start.Add(2 * time.Second),
+			LastSeen:  start.Add(2 * time.Second),
+		},
+		{
+			Direction: "outbound",
+			Addr:      netip.MustParseAddr("8.8.8.8"),
+			Proto:     "tcp",
+			Port:      443,
+			Count:     2,
+			FirstSeen: start,
+			LastSeen:  start.Add(time.Second),
+		},
+	})
+
+	rules, err := SuggestOutputRules(denials)
+	is.NoErr(err)
+	is.Equal(string(rules), `output:
+  - ips:
+      - 1.1.1.1
+      - 8.8.8.8
+    proto: tcp
+    dst_ports:
+      - 443
+  - ips:
+      - 9.9.9.9
+    proto: udp
+    dst_ports:
+      - 53
+`)
+
+	// the suggested rules should be valid
+	var cfg config
+	err = yaml.Unmarshal(rules, &cfg)
+	is.NoErr(err)
+	is.NoErr(validateConfig(cfg))
+}
+
+func TestLearnMode(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := equivalenceTestContainers()
+	enforcedContainers := equivalenceTestContainers()
+	for _, c := range enforcedContainers {
+		c.Config.Labels[modeLabel] = modeEnforce
+	}
+	learnContainers := equivalenceTestContainers()
+	for _, c := range learnContainers {
+		c.Config.Labels[modeLabel] = modeLearn
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+			learnFws := map[string]*mockFirewall{
+				"option": createTestFirewall(t, logger, containers, WithRuleLayout(layout), WithLearnMode(true)),
+				"label":  createTestFirewall(t, logger, learnContainers, WithRuleLayout(layout)),
+			}
+			enforceFw := createTestFirewall(t, logger, enforcedContainers, WithRuleLayout(layout), WithLearnMode(true))
+
+			var drops int
+			for _, pkt := range equivalenceTestPackets() {
+				verdict := evalPacket(t, fw, pkt)
+				if verdict == "drop" {
+					drops++
+				}
+				for name, learnFw := range learnFws {
+					learnVerdict := evalPacket(t, learnFw, pkt)
+					if verdict == "drop" && learnVerdict != "accept" {
+						t.Errorf("%s: packet %s: dropped packet was not accepted in learn mode: %q", name, pkt, learnVerdict)
+					} else if verdict != "drop" && learnVerdict != verdict {
+						t.Errorf("%s: packet %s: verdict %q differs from learn mode verdict %q", name, pkt, verdict, learnVerdict)
+					}
+				}
+				if enforceVerdict := evalPacket(t, enforceFw, pkt); enforceVerdict != verdict {
+					t.Errorf("packet %s: verdict %q differs from enforce mode verdict %q", pkt, verdict, enforceVerdict)
+				}
+			}
+			if drops == 0 {
+				t.Error("no packets were dropped")
+			}
+		})
+	}
+}
+
+func TestSuggestRules(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := equivalenceTestContainers()
+	r, _ := newTestRuleManager(t, logger, containers, WithLogGroup(5), WithLearnMode(true))
+	for _, c := range containers {
+		err := r.createContainerRules(context.Background(), c, true)
+		is.NoErr(err)
+	}
+
+	pkt := func(proto uint8, src, dst string, dport uint16) []byte {
+		b := []byte{0x45, 0x00, 0x00, 0x3c, 0x00, 0x00, 0x40, 0x00, 0x40, proto, 0x00, 0x00}
+		b = append(b, netip.MustParseAddr(src).AsSlice()...)
+		b = append(b, netip.MustParseAddr(dst).AsSlice()...)
+		b = binary.BigEndian.AppendUint16(b, 40000)
+		return binary.BigEndian.AppendUint16(b, dport)
+	}
+
+	chainName := buildChainName(cont1Name, cont1ID)
+	prefix := "learn " + chainName + ": "
+	localPrefix := "learn " + chainName + " " + learnLocalhostPrefix + ": "
+	contAddr := cont1Addr.String()
+	logged := []nflog.Packet{
+		// outbound traffic to addresses
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_TCP, contAddr, "8.8.8.8", 443)},
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_TCP, contAddr, "8.8.8.8", 443)},
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_TCP, contAddr, "8.8.4.4", 443)},
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_TCP, contAddr, "9.9.9.9", 443)},
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_TCP, contAddr, "9.9.9.9", 8000)},
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_TCP, contAddr, "9.9.9.9", 8001)},
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_TCP, contAddr, "9.9.9.9", 8002)},
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_UDP, contAddr, "9.9.9.9", 53)},
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_ICMP, contAddr, "9.9.9.9", 0)},
+		// outbound traffic to a container
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_TCP, "172.0.2.2", "172.0.2.3", 5432)},
+		// inbound traffic from localhost, a LAN and a container
+		{Prefix: localPrefix, Payload: pkt(unix.IPPROTO_TCP, gatewayAddr.String(), contAddr, 80)},
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_TCP, "192.168.1.50", contAddr, 80)},
+		{Prefix: prefix, Payload: pkt(unix.IPPROTO_TCP, "172.0.2.3", "172.0.2.2", 80)},
+	}
+	r.logPackets(context.Background(), logged)
+
+	rules, err := r.SuggestRules(context.Background(), cont1Name)
+	is.NoErr(err)
+	is.Equal(string(rules), `mapped_ports:
+  localhost:
+    allow: true
+  external:
+    allow: true
+    ips:
+      - 192.168.1.50
+output:
+  - ips:
+      - 8.8.4.4
+      - 8.8.8.8
+    proto: tcp
+    dst_ports:
+      - 443
+  - ips:
+      - 9.9.9.9
+    proto: tcp
+    dst_ports:
+      - 443
+      - 8000-8002
+  - ips:
+      - 9.9.9.9
+    proto: udp
+    dst_ports:
+      - 53
+  - network: cont_net
+    container: container2
+    proto: tcp
+    dst_ports:
+      - 5432
+`)
+
+	// the suggested rules should be valid
+	var cfg config
+	err = yaml.Unmarshal(rules, &cfg)
+	is.NoErr(err)
+	is.NoErr(validateConfig(cfg))
+
+	rules, err = r.SuggestRules(context.Background(), cont2Name)
+	is.NoErr(err)
+	is.Equal(rules, nil)
+}
+
+func TestDeleteOldFlows(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	r, _ := newTestRuleManager(t, logger, nil, WithLogGroup(5))
+
+	ctx := context.Background()
+	start := time.Unix(1700000000, 0)
+	for _, contName := range []string{cont1Name, cont2Name} {
+		for i := range maxRecordedFlows + 5 {
+			addr := netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}).AsSlice()
+			seen := start.Add(time.Duration(i) * time.Second).Unix()
+			err := r.db.AddDenial(ctx, database.AddDenialParams{
+				ContainerName: contName,
+				Direction:     "outbound",
+				Addr:          addr,
+				Proto:         unix.IPPROTO_TCP,
+				Port:          443,
+				FirstSeen:     seen,
+				LastSeen:      seen,
+			})
+			is.NoErr(err)
+			err = r.db.AddLearnedFlow(ctx, database.AddLearnedFlowParams{
+				ContainerName: contName,
+				Direction:     "outbound",
+				Addr:          addr,
+				Proto:         unix.IPPROTO_TCP,
+				Port:          443,
+				FirstSeen:     seen,
+				LastSeen:      seen,
+			})
+			is.NoErr(err)
+		}
+	}
+
+	r.deleteOldFlows(ctx)
+
+	// only the most recently seen flows of each container should be kept
+	for _, contName := range []string{cont1Name, cont2Name} {
+		denials, err := r.Denials(ctx, contName)
+		is.NoErr(err)
+		is.Equal(len(denials), maxRecordedFlows)
+		is.Equal(denials[len(denials)-1].LastSeen, start.Add(5*time.Second))
+
+		flows, err := r.db.GetLearnedFlows(ctx, contName)
+		is.NoErr(err)
+		is.Equal(len(flows), maxRecordedFlows)
+		for _, flow := range flows {
+			is.True(flow.LastSeen >= start.Add(5*time.Second).Unix())
+		}
+	}
+}
+
+func TestMigrateAddrs(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	// create a database with the addrs table of older versions
+	dbFile := filepath.Join(t.TempDir(), "db.sqlite")
+	sqlDB, err := sql.Open("sqlite", dbFile)
+	is.NoErr(err)
+	_, err = sqlDB.Exec(`
+CREATE TABLE containers (
+  id   TEXT PRIMARY KEY,
+  name TEXT UNIQUE NOT NULL
+) STRICT;
+
+CREATE TABLE addrs (
+  addr         BLOB PRIMARY KEY,
+  container_id TEXT NOT NULL,
+
+  FOREIGN KEY(container_id) REFERENCES containers(id)
+) STRICT;
+
+INSERT INTO containers(id, name) VALUES ('` + cont1ID + `', '` + cont1Name + `');
+INSERT INTO addrs(addr, container_id) VALUES (x'ac000102', '` + cont1ID + `');
+`)
+	is.NoErr(err)
+	is.NoErr(sqlDB.Close())
+
+	r, err := NewRuleManager(context.Background(), logger, dbFile, defaultTimeout)
+	is.NoErr(err)
+	t.Cleanup(func() {
+		is.NoErr(r.db.Close())
+	})
+
+	// the network of existing addresses is unknown
+	name, netName, err := r.findPeerContainer(context.Background(), []byte{172, 0, 1, 2})
+	is.NoErr(err)
+	is.Equal(name, cont1Name)
+	is.Equal(netName, "")
+
+	// addresses of new containers should be added with their network
+	err = r.db.AddContainer(context.Background(), cont2ID, cont2Name)
+	is.NoErr(err)
+	err = r.db.AddContainerAddr(context.Background(), database.AddContainerAddrParams{
+		Addr:        []byte{172, 0, 2, 3},
+		ContainerID: cont2ID,
+		NetworkName: "cont_net",
+	})
+	is.NoErr(err)
+	name, netName, err = r.findPeerContainer(context.Background(), []byte{172, 0, 2, 3})
+	is.NoErr(err)
+	is.Equal(name, cont2Name)
+	is.Equal(netName, "cont_net")
+}
+
+func TestGroupPorts(t *testing.T) {
+	t.Parallel()
+
+	ports := groupPorts([]uint16{443, 80, 8002, 8000, 8001, 80, 81, 9000, 9001, 9002, 9003})
+	if diff := cmp.Diff([]any{uint16(80), uint16(81), uint16(443), "8000-8002", "9000-9003"}, ports); diff != "" {
+		t.Errorf("ports differ (-want +got):\n%s", diff)
+	}
+}
+
+func TestDenyRules(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+output:
+  - proto: tcp
+    dst_ports:
+      - 443
+  - ips:
+      - 10.0.0.0/8
+    proto: tcp
+    dst_ports:
+      - 8000-9000
+deny:
+  - ips:
+      - 169.254.169.254
+  - ips:
+      - 10.10.0.0/16
+  - proto: tcp
+    dst_ports:
+      - 8443
+  - ips:
+      - 10.30.0.1
+      - 10.20.0.0/16
+    proto: tcp
+    dst_ports:
+      - 8500
+      - 8600-8700`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		dst     string
+		dport   uint16
+		verdict string
+	}{
+		{dst: "1.1.1.1", dport: 443, verdict: "accept"},
+		{dst: "169.254.169.254", dport: 443, verdict: "drop"},
+		{dst: "10.10.1.1", dport: 443, verdict: "drop"},
+		{dst: "10.11.1.1", dport: 443, verdict: "accept"},
+		{dst: "10.11.1.1", dport: 8443, verdict: "drop"},
+		{dst: "10.11.1.1", dport: 8444, verdict: "accept"},
+		{dst: "10.10.1.1", dport: 8444, verdict: "drop"},
+		// single addresses and ranges, and single ports and port
+		// ranges are matched as a union
+		{dst: "10.30.0.1", dport: 8500, verdict: "drop"},
+		{dst: "10.30.0.1", dport: 8650, verdict: "drop"},
+		{dst: "10.20.1.1", dport: 8500, verdict: "drop"},
+		{dst: "10.20.1.1", dport: 8650, verdict: "drop"},
+		{dst: "10.30.0.2", dport: 8500, verdict: "accept"},
+		{dst: "10.20.1.1", dport: 8550, verdict: "accept"},
+	}
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+			for _, tt := range tests {
+				pkt := testPacket{
+					src:   cont1Addr,
+					dst:   netip.MustParseAddr(tt.dst),
+					proto: unix.IPPROTO_TCP,
+					sport: 40000,
+					dport: tt.dport,
+					state: stateNew,
+				}
+				if verdict := evalPacket(t, fw, pkt); verdict != tt.verdict {
+					t.Errorf("packet %s: expected verdict %q, got %q", pkt, tt.verdict, verdict)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateDenyRules(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		rules string
+	}{
+		{
+			name: "container",
+			rules: `
+deny:
+  - network: default
+    container: foo`,
+		},
+		{
+			name: "verdict",
+			rules: `
+deny:
+  - ips:
+      - 1.1.1.1
+    verdict:
+      queue: 1`,
+		},
+		{
+			name: "empty",
+			rules: `
+deny:
+  - log_prefix: "foo"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			if err := validateConfig(cfg); err == nil {
+				t.Error("expected error validating rules")
+			}
+		})
+	}
+}
+
+func TestReject(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := equivalenceTestContainers()
+	dropContainers := equivalenceTestContainers()
+	for _, c := range dropContainers {
+		c.Config.Labels[rulesLabel] += "\nreject: false"
+	}
+	rejectContainers := equivalenceTestContainers()
+	for _, c := range rejectContainers {
+		c.Config.Labels[rulesLabel] += "\nreject: true"
+	}
+
+	rejected := func(pkt testPacket) string {
+		if pkt.proto == unix.IPPROTO_TCP {
+			return "reject tcp-reset"
+		}
+		return "reject icmp 13"
+	}
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		for _, nflog := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/nflog=%t", layout, nflog), func(t *testing.T) {
+				opts := []Option{WithRuleLayout(layout)}
+				if nflog {
+					opts = append(opts, WithLogGroup(5), WithDropLogging(true))
+				}
+				fw := createTestFirewall(t, logger, containers, opts...)
+				rejectFws := map[string]*mockFirewall{
+					"option": createTestFirewall(t, logger, containers, append(opts, WithReject(true))...),
+					"config": createTestFirewall(t, logger, rejectContainers, opts...),
+				}
+				dropFw := createTestFirewall(t, logger, dropContainers, append(opts, WithReject(true))...)
+
+				for _, pkt := range equivalenceTestPackets() {
+					verdict := evalPacket(t, fw, pkt)
+					for name, rejectFw := range rejectFws {
+						rejectVerdict := evalPacket(t, rejectFw, pkt)
+						// mapped ports that aren't allowed from localhost are
+						// still dropped in the whalewall chain
+						if verdict == "drop" && rejectVerdict != "drop" && rejectVerdict != rejected(pkt) {
+							t.Errorf("%s: packet %s: dropped packet was not rejected: %q", name, pkt, rejectVerdict)
+						} else if verdict != "drop" && rejectVerdict != verdict {
+							t.Errorf("%s: packet %s: verdict %q differs from reject verdict %q", name, pkt, verdict, rejectVerdict)
+						}
+					}
+					if dropVerdict := evalPacket(t, dropFw, pkt); dropVerdict != verdict {
+						t.Errorf("packet %s: verdict %q differs from verdict %q when reject is disabled", pkt, verdict, dropVerdict)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRejectDenyRules(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+output:
+  - ips:
+      - 169.254.0.0/16
+deny:
+  - ips:
+      - 169.254.169.254
+reject: true`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+
+	fw := createTestFirewall(t, logger, containers)
+	tests := []struct {
+		dst     string
+		proto   uint8
+		verdict string
+	}{
+		{dst: "169.254.1.1", proto: unix.IPPROTO_TCP, verdict: "accept"},
+		{dst: "169.254.169.254", proto: unix.IPPROTO_TCP, verdict: "reject tcp-reset"},
+		{dst: "169.254.169.254", proto: unix.IPPROTO_UDP, verdict: "reject icmp 13"},
+		{dst: "1.1.1.1", proto: unix.IPPROTO_UDP, verdict: "reject icmp 13"},
+	}
+	for _, tt := range tests {
+		pkt := testPacket{
+			src:   cont1Addr,
+			dst:   netip.MustParseAddr(tt.dst),
+			proto: tt.proto,
+			sport: 40000,
+			dport: 80,
+			state: stateNew,
+		}
+		if verdict := evalPacket(t, fw, pkt); verdict != tt.verdict {
+			t.Errorf("packet %s: expected verdict %q, got %q", pkt, tt.verdict, verdict)
+		}
+	}
+}
+
+func inputTestContainers() []types.ContainerJSON {
+	return []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"cont_net": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont2ID,
+				Name: "/" + cont2Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+input:
+  - network: cont_net
+    container: container1
+    proto: tcp
+    dst_ports:
+      - 5432
+  - ips:
+      - 10.0.0.0/8
+    proto: tcp
+    dst_ports:
+      - 80`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"cont_net": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont2Addr.String(),
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestInputRules(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	tests := []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5432, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5432, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont2Addr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 5432, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5433, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: cont2Addr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5432, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: netip.MustParseAddr("10.1.1.1"), dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 80, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont2Addr, dst: netip.MustParseAddr("10.1.1.1"), proto: unix.IPPROTO_TCP, sport: 80, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: netip.MustParseAddr("11.1.1.1"), dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 80, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: cont2Addr, dst: netip.MustParseAddr("10.1.1.1"), proto: unix.IPPROTO_TCP, sport: 40000, dport: 80, state: stateNew},
+			verdict: "drop",
+		},
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		for _, reversed := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/reversed=%t", layout, reversed), func(t *testing.T) {
+				// rules should be the same no matter which container
+				// is started first
+				containers := inputTestContainers()
+				if reversed {
+					reverse(containers)
+				}
+				fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+				for _, tt := range tests {
+					if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+						t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDeletingInputRules(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	comparer := func(r1, r2 *nftables.Rule) bool {
+		return rulesEqual(logger, r1, r2)
+	}
+
+	for _, reversed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reversed=%t", reversed), func(t *testing.T) {
+			is := is.New(t)
+
+			containers := inputTestContainers()
+			if reversed {
+				reverse(containers)
+			}
+			r, firewallCreator := newTestRuleManager(t, logger, containers)
+			for _, c := range containers {
+				err := r.createContainerRules(context.Background(), c, true)
+				is.NoErr(err)
+			}
+			mfc := firewallCreator.newMockFirewall()
+
+			cont1ChainName := buildChainName(cont1Name, cont1ID)
+			cont1Chain := &nftables.Chain{
+				Table: filterTable,
+				Name:  cont1ChainName,
+			}
+			cont1RulesBefore, err := mfc.GetRules(filterTable, cont1Chain)
+			is.NoErr(err)
+			is.Equal(len(cont1RulesBefore), 2) // rule allowing traffic to container 2 and drop rule
+
+			cont2ChainName := buildChainName(cont2Name, cont2ID)
+			cont2Chain := &nftables.Chain{
+				Table: filterTable,
+				Name:  cont2ChainName,
+			}
+			cont2RulesBefore, err := mfc.GetRules(filterTable, cont2Chain)
+			is.NoErr(err)
+
+			// rules allowing container 1 to reach container 2 should
+			// be removed from container 1's chain when container 2 is
+			// deleted
+			err = r.deleteContainerRules(context.Background(), cont2ID, cont2Name)
+			is.NoErr(err)
+			rulesAfterDeletion, err := mfc.GetRules(filterTable, cont1Chain)
+			is.NoErr(err)
+			is.Equal(len(rulesAfterDeletion), 1) // drop rule
+
+			err = r.createContainerRules(context.Background(), containers[slices.IndexFunc(containers, func(c types.ContainerJSON) bool {
+				return c.ID == cont2ID
+			})], true)
+			is.NoErr(err)
+
+			// rules allowing established traffic in container 2's
+			// chain should be removed when container 1 is deleted
+			err = r.deleteContainerRules(context.Background(), cont1ID, cont1Name)
+			is.NoErr(err)
+			rulesAfterDeletion, err = mfc.GetRules(filterTable, cont2Chain)
+			is.NoErr(err)
+			is.Equal(len(rulesAfterDeletion), len(cont2RulesBefore)-1)
+
+			err = r.createContainerRules(context.Background(), containers[slices.IndexFunc(containers, func(c types.ContainerJSON) bool {
+				return c.ID == cont1ID
+			})], true)
+			is.NoErr(err)
+
+			// ensure rules of both containers are the same as before
+			cont1RulesAfter, err := mfc.GetRules(filterTable, cont1Chain)
+			is.NoErr(err)
+			cont2RulesAfter, err := mfc.GetRules(filterTable, cont2Chain)
+			is.NoErr(err)
+
+			compareRules(t, comparer, cont1ChainName, cont1RulesBefore, cont1RulesAfter)
+			compareRules(t, comparer, cont2ChainName, cont2RulesBefore, cont2RulesAfter)
+		})
+	}
+}
+
+func TestFromHostRules(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	var (
+		contNetGateway = netip.MustParseAddr("172.0.2.1")
+		contNetAddr    = netip.MustParseAddr("172.0.2.2")
+	)
+	containers := []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+from_host:
+  - proto: tcp
+    dst_ports:
+      - 8080
+  - network: cont_net
+    proto: udp
+    dst_ports:
+      - 9000`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+					"cont_net": {
+						Gateway:   contNetGateway.String(),
+						IPAddress: contNetAddr.String(),
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			pkt:     testPacket{src: gatewayAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: gatewayAddr, proto: unix.IPPROTO_TCP, sport: 8080, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: contNetGateway, dst: contNetAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: gatewayAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8081, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: contNetGateway, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: netip.MustParseAddr("10.0.0.1"), dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: gatewayAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: contNetGateway, dst: contNetAddr, proto: unix.IPPROTO_UDP, sport: 40000, dport: 9000, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: gatewayAddr, dst: cont1Addr, proto: unix.IPPROTO_UDP, sport: 40000, dport: 9000, state: stateNew},
+			verdict: "drop",
+		},
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+			for _, tt := range tests {
+				if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+					t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+				}
+			}
+		})
+	}
+}
+
+func TestMappedPortRules(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	vpnAddr := netip.MustParseAddr("10.8.0.5")
+	extAddr := netip.MustParseAddr("1.2.3.4")
+	containers := []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+mapped_ports:
+  localhost:
+    allow: true
+    ports:
+      - port: 9090
+        proto: tcp
+        allow: false
+  external:
+    allow: true
+    ports:
+      - port: 9090
+        proto: tcp
+        allow: true
+        ips:
+          - 10.8.0.0/24`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				NetworkSettingsBase: types.NetworkSettingsBase{
+					Ports: nat.PortMap{
+						"443/tcp": []nat.PortBinding{
+							{
+								HostIP:   "0.0.0.0",
+								HostPort: "443",
+							},
+						},
+						"9090/tcp": []nat.PortBinding{
+							{
+								HostIP:   "0.0.0.0",
+								HostPort: "19090",
+							},
+						},
+					},
+				},
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: gatewayAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: vpnAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9090, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: vpnAddr, proto: unix.IPPROTO_TCP, sport: 9090, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9090, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: gatewayAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9090, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: localAddr, dst: localAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 19090, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: localAddr, dst: localAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew},
+			verdict: "continue",
+		},
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+			for _, tt := range tests {
+				if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+					t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+				}
+			}
+		})
+	}
+}
+
+// testInterfaces maps addresses of the host to the names of the network
+// interfaces that have them.
+var testInterfaces = map[netip.Addr]string{
+	netip.MustParseAddr("192.168.1.10"): "eth1",
+}
+
+func TestMappedPortBindings(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	extAddr := netip.MustParseAddr("1.2.3.4")
+	lanAddr := netip.MustParseAddr("192.168.1.20")
+	hostAddr := netip.MustParseAddr("192.168.1.10")
+	containers := []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+mapped_ports:
+  localhost:
+    allow: true
+  external:
+    allow: true`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				NetworkSettingsBase: types.NetworkSettingsBase{
+					Ports: nat.PortMap{
+						"443/tcp": []nat.PortBinding{
+							{
+								HostIP:   "0.0.0.0",
+								HostPort: "443",
+							},
+						},
+						"8080/tcp": []nat.PortBinding{
+							{
+								HostIP:   "192.168.1.10",
+								HostPort: "8080",
+							},
+						},
+						"9000/tcp": []nat.PortBinding{
+							{
+								HostIP:   "127.0.0.1",
+								HostPort: "9000",
+							},
+						},
+						"9100/tcp": []nat.PortBinding{
+							{
+								HostIP:   "10.10.10.10",
+								HostPort: "9100",
+							},
+						},
+					},
+				},
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew, iifname: "eth0"},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: lanAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew, iifname: "eth1", origDst: hostAddr},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: lanAddr, proto: unix.IPPROTO_TCP, sport: 8080, dport: 40000, state: stateEst, reply: true, origDst: hostAddr},
+			verdict: "accept",
+		},
+		// traffic sent to the bound address from other containers or
+		// over a VPN doesn't arrive on the interface of the address
+		{
+			pkt:     testPacket{src: netip.MustParseAddr("172.0.9.2"), dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew, iifname: "br-0123456789ab", origDst: hostAddr},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: netip.MustParseAddr("10.8.0.2"), dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew, iifname: "wg0", origDst: hostAddr},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew, iifname: "eth0", origDst: netip.MustParseAddr("203.0.113.10")},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: lanAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew, iifname: "eth1", origDst: netip.MustParseAddr("192.168.1.11")},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9000, state: stateNew, iifname: "eth0"},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: gatewayAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9000, state: stateNew, iifname: "docker0"},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9100, state: stateNew, iifname: "eth0"},
+			verdict: "drop",
+		},
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+			for _, tt := range tests {
+				if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+					t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+				}
+			}
+		})
+	}
+}
+
+func TestInterfaces(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	extAddr := netip.MustParseAddr("1.2.3.4")
+	containers := []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+mapped_ports:
+  external:
+    allow: true
+    interfaces:
+      - wg0
+    ports:
+      - port: 8443
+        proto: tcp
+        allow: true
+        interfaces:
+          - wg0
+          - eth0
+output:
+  - ips:
+      - 1.2.3.4
+    proto: tcp
+    dst_ports:
+      - 443
+    egress_interfaces:
+      - tun0
+  - proto: udp
+    dst_ports:
+      - 53`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				NetworkSettingsBase: types.NetworkSettingsBase{
+					Ports: nat.PortMap{
+						"443/tcp": []nat.PortBinding{
+							{
+								HostIP:   "0.0.0.0",
+								HostPort: "443",
+							},
+						},
+						"8443/tcp": []nat.PortBinding{
+							{
+								HostIP:   "0.0.0.0",
+								HostPort: "8443",
+							},
+						},
+					},
+				},
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew, iifname: "wg0"},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew, iifname: "eth0"},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8443, state: stateNew, iifname: "eth0"},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8443, state: stateNew, iifname: "eth1"},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: extAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew, oifname: "tun0"},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 443, dport: 40000, state: stateEst, iifname: "tun0"},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: extAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew, oifname: "eth0"},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: extAddr, proto: unix.IPPROTO_UDP, sport: 40000, dport: 53, state: stateNew, oifname: "eth0"},
+			verdict: "accept",
+		},
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+			for _, tt := range tests {
+				if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+					t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateEgressInterfaces(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "output",
+			rules: `
+output:
+  - egress_interfaces:
+      - tun0`,
+		},
+		{
+			name: "input",
+			rules: `
+input:
+  - proto: tcp
+    dst_ports:
+      - 80
+    egress_interfaces:
+      - tun0`,
+			wantErr: true,
+		},
+		{
+			name: "from host",
+			rules: `
+from_host:
+  - proto: tcp
+    dst_ports:
+      - 80
+    egress_interfaces:
+      - tun0`,
+			wantErr: true,
+		},
+		{
+			name: "deny",
+			rules: `
+deny:
+  - ips:
+      - 1.1.1.1
+    egress_interfaces:
+      - tun0`,
+			wantErr: true,
+		},
+		{
+			name: "invalid name",
+			rules: `
+output:
+  - egress_interfaces:
+      - ""`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err := validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func limitsTestContainers() []types.ContainerJSON {
+	return []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+mapped_ports:
+  external:
+    allow: true
+    rate_limit:
+      rate: 5
+      burst: 10
+    max_connections: 3
+input:
+  - proto: tcp
+    dst_ports:
+      - 8080
+    rate_limit:
+      rate: 100
+      unit: packets`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				NetworkSettingsBase: types.NetworkSettingsBase{
+					Ports: nat.PortMap{
+						"22/tcp": []nat.PortBinding{
+							{
+								HostIP:   "0.0.0.0",
+								HostPort: "2222",
+							},
+						},
+					},
+				},
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestLimits(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	extAddr := netip.MustParseAddr("1.2.3.4")
+	tests := []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 22, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 22, state: stateNew, overLimit: true},
+			verdict: "drop",
+		},
+		{
+			// only new connections are limited
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 22, state: stateEst, overLimit: true},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew, overLimit: true},
+			verdict: "drop",
+		},
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			fw := createTestFirewall(t, logger, limitsTestContainers(), WithRuleLayout(layout))
+			for _, tt := range tests {
+				if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+					t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+				}
+			}
+
+			// packets are limited, so established traffic is limited
+			// too unless the established fast path accepts it first
+			pkt := testPacket{src: extAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateEst, overLimit: true}
+			if verdict := evalPacket(t, fw, pkt); verdict != "drop" {
+				t.Errorf("packet %s: expected verdict %q, got %q", pkt, "drop", verdict)
+			}
+		})
+	}
+}
+
+func TestLimitStatus(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := limitsTestContainers()
+	r, firewallCreator := newTestRuleManager(t, logger, containers)
+	is.NoErr(r.createContainerRules(context.Background(), containers[0], true))
+
+	statuses, err := r.LimitStatus(context.Background(), cont1Name)
+	is.NoErr(err)
+	limits := make([]string, len(statuses))
+	for i, status := range statuses {
+		limits[i] = status.Limit
+		is.Equal(status.Sources, 0)
+	}
+	slices.Sort(limits)
+	is.Equal(limits, []string{
+		"max_connections 3",
+		"rate_limit 100/second burst 0",
+		"rate_limit 5/second burst 10",
+	})
+
+	// sets of limits should be deleted with the container
+	chain := &nftables.Chain{
+		Table: filterTable,
+		Name:  buildChainName(cont1Name, cont1ID),
+	}
+	hasLimitSets := func() bool {
+		sets, err := firewallCreator.newMockFirewall().GetSets(filterTable)
+		is.NoErr(err)
+		return slices.ContainsFunc(sets, func(s *nftables.Set) bool {
+			return isLimitSet(chain, s.Name)
+		})
+	}
+	is.True(hasLimitSets())
+	is.NoErr(r.deleteContainerRules(context.Background(), cont1ID, cont1Name))
+	is.True(!hasLimitSets())
+}
+
+func TestValidateLimits(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		rules    string
+		parseErr bool
+		wantErr  bool
+	}{
+		{
+			name: "mapped ports",
+			rules: `
+mapped_ports:
+  external:
+    allow: true
+    max_connections: 10
+    ports:
+      - port: 22
+        proto: tcp
+        allow: true
+        rate_limit:
+          rate: 1
+          burst: 3`,
+		},
+		{
+			name: "input",
+			rules: `
+input:
+  - proto: tcp
+    dst_ports:
+      - 22
+    rate_limit:
+      rate: 10
+      unit: connections
+    max_connections: 5`,
+		},
+		{
+			name: "no rate",
+			rules: `
+input:
+  - proto: tcp
+    dst_ports:
+      - 22
+    rate_limit:
+      burst: 10`,
+			wantErr: true,
+		},
+		{
+			name: "invalid unit",
+			rules: `
+input:
+  - proto: tcp
+    dst_ports:
+      - 22
+    rate_limit:
+      rate: 10
+      unit: bytes`,
+			parseErr: true,
+		},
+		{
+			name: "output",
+			rules: `
+output:
+  - proto: tcp
+    dst_ports:
+      - 22
+    max_connections: 5`,
+			wantErr: true,
+		},
+		{
+			name: "from host",
+			rules: `
+from_host:
+  - proto: tcp
+    dst_ports:
+      - 22
+    max_connections: 5`,
+			wantErr: true,
+		},
+		{
+			name: "deny",
+			rules: `
+deny:
+  - ips:
+      - 1.1.1.1
+    rate_limit:
+      rate: 10`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			err := yaml.Unmarshal([]byte(tt.rules), &cfg)
+			if tt.parseErr {
+				if err == nil {
+					t.Error("expected parse error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err = validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func bansTestContainers() []types.ContainerJSON {
+	newContainer := func(id, name string, addr netip.Addr, global bool) types.ContainerJSON {
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   id,
+				Name: "/" + name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: fmt.Sprintf(`
+mapped_ports:
+  external:
+    allow: true
+    ips:
+      - 192.168.1.0/24
+    rate_limit:
+      rate: 5
+    ban:
+      threshold: 10
+      period: hour
+      duration: 1h
+      global: %t`, global),
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				NetworkSettingsBase: types.NetworkSettingsBase{
+					Ports: nat.PortMap{
+						"22/tcp": []nat.PortBinding{
+							{
+								HostIP:   "0.0.0.0",
+								HostPort: "2222",
+							},
+						},
+					},
+				},
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:     gatewayAddr.String(),
+						IPAddress:   addr.String(),
+						IPPrefixLen: 24,
+					},
+				},
+			},
+		}
+	}
+
+	return []types.ContainerJSON{
+		newContainer(cont1ID, cont1Name, cont1Addr, false),
+		newContainer(cont2ID, cont2Name, cont2Addr, true),
+	}
+}
+
+func TestBans(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	allowedAddr := netip.MustParseAddr("192.168.1.5")
+	extAddr := netip.MustParseAddr("1.2.3.4")
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			fw := createTestFirewall(t, logger, bansTestContainers(), WithRuleLayout(layout))
+
+			for _, dst := range []netip.Addr{cont1Addr, cont2Addr} {
+				tests := []struct {
+					pkt     testPacket
+					verdict string
+				}{
+					{
+						pkt:     testPacket{src: allowedAddr, dst: dst, proto: unix.IPPROTO_TCP, sport: 40000, dport: 22, state: stateNew},
+						verdict: "accept",
+					},
+					{
+						pkt:     testPacket{src: allowedAddr, dst: dst, proto: unix.IPPROTO_TCP, sport: 40000, dport: 22, state: stateNew, overLimit: true},
+						verdict: "drop",
+					},
+					{
+						pkt:     testPacket{src: extAddr, dst: dst, proto: unix.IPPROTO_TCP, sport: 40000, dport: 22, state: stateNew},
+						verdict: "drop",
+					},
+					{
+						pkt:     testPacket{src: extAddr, dst: dst, proto: unix.IPPROTO_TCP, sport: 40000, dport: 22, state: stateNew, overLimit: true},
+						verdict: "drop",
+					},
+				}
+				for _, tt := range tests {
+					if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+						t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+					}
+				}
+			}
+
+			// traffic to mapped ports that isn't allowed and traffic
+			// over limits should be counted towards bans
+			cont1Chain := buildChainName(cont1Name, cont1ID)
+			banChainName := cont1Chain + banChainSuffix
+			var banRules []*nftables.Rule
+			for _, rule := range fw.chains[cont1Chain].Rules {
+				v, ok := rule.Exprs[len(rule.Exprs)-1].(*expr.Verdict)
+				if ok && v.Kind == expr.VerdictGoto && v.Chain == banChainName {
+					banRules = append(banRules, rule)
+				}
+			}
+			is.Equal(len(banRules), 2)
+
+			// the gateway and other containers of the network are never
+			// counted towards bans
+			for _, src := range []netip.Addr{gatewayAddr, cont2Addr} {
+				e := packetEvaluator{
+					t:   t,
+					fw:  fw,
+					pkt: testPacket{src: src, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 22, state: stateNew, overLimit: true},
+				}
+				for _, rule := range banRules {
+					_, matched := e.evalRule(rule, 0)
+					is.True(!matched)
+				}
+			}
+
+			// banned sources should be dropped before container rules
+			// are evaluated, even if their traffic is allowed
+			fw.tables[filterTableName].Sets[cont1Chain+banSetSuffix] = []nftables.SetElement{
+				{Key: ref(allowedAddr.As4())[:]},
+			}
+			fw.tables[filterTableName].Sets[globalBanSetName] = []nftables.SetElement{
+				{Key: ref(allowedAddr.As4())[:]},
+			}
+			for _, dst := range []netip.Addr{cont1Addr, cont2Addr} {
+				pkt := testPacket{src: allowedAddr, dst: dst, proto: unix.IPPROTO_TCP, sport: 40000, dport: 22, state: stateEst}
+				if verdict := evalPacket(t, fw, pkt); verdict != "drop" {
+					t.Errorf("packet %s: expected verdict %q, got %q", pkt, "drop", verdict)
+				}
+			}
+		})
+	}
+}
+
+func TestBanStatus(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := bansTestContainers()
+	r, firewallCreator := newTestRuleManager(t, logger, containers)
+	for _, c := range containers {
+		is.NoErr(r.createContainerRules(context.Background(), c, true))
+	}
+
+	ctx := context.Background()
+	bannedAddr := netip.MustParseAddr("1.2.3.4")
+	cont1Chain := buildChainName(cont1Name, cont1ID)
+	tests := []struct {
+		contName string
+		setName  string
+		global   bool
+	}{
+		{
+			contName: cont1Name,
+			setName:  cont1Chain + banSetSuffix,
+		},
+		{
+			contName: cont2Name,
+			setName:  globalBanSetName,
+			global:   true,
+		},
+	}
+	for _, tt := range tests {
+		status, err := r.BanStatus(ctx, tt.contName)
+		is.NoErr(err)
+		is.True(status.Enabled)
+		is.Equal(status.Global, tt.global)
+		is.Equal(len(status.Bans), 0)
+
+		nfc := firewallCreator.newMockFirewall()
+		set := &nftables.Set{
+			Table: filterTable,
+			Name:  tt.setName,
+		}
+		is.NoErr(nfc.SetAddElements(set, []nftables.SetElement{{Key: ref(bannedAddr.As4())[:]}}))
+		is.NoErr(nfc.Flush())
+
+		status, err = r.BanStatus(ctx, tt.contName)
+		is.NoErr(err)
+		is.Equal(status.Bans, []Ban{{Addr: bannedAddr}})
+
+		is.NoErr(r.LiftBan(ctx, tt.contName, bannedAddr))
+		status, err = r.BanStatus(ctx, tt.contName)
+		is.NoErr(err)
+		is.Equal(len(status.Bans), 0)
+		// lifting a ban of an address that isn't banned should fail
+		is.True(r.LiftBan(ctx, tt.contName, bannedAddr) != nil)
+	}
+
+	// the ban chain and sets of a container should be deleted with
+	// it, but the global ban set is kept for other containers
+	is.NoErr(r.deleteContainerRules(ctx, cont1ID, cont1Name))
+	is.NoErr(r.deleteContainerRules(ctx, cont2ID, cont2Name))
+	fw := firewallCreator.newMockFirewall()
+	is.True(!slices.ContainsFunc(maps.Keys(fw.chains), func(name string) bool {
+		return strings.HasSuffix(name, banChainSuffix)
+	}))
+	sets, err := fw.GetSets(filterTable)
+	is.NoErr(err)
+	setNames := make([]string, len(sets))
+	for i, set := range sets {
+		setNames[i] = set.Name
+	}
+	is.True(!slices.ContainsFunc(setNames, func(name string) bool {
+		return strings.HasPrefix(name, cont1Chain)
+	}))
+	is.True(slices.Contains(setNames, globalBanSetName))
+}
+
+func TestValidateBans(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		rules    string
+		parseErr bool
+		wantErr  bool
+	}{
+		{
+			name: "valid",
+			rules: `
+mapped_ports:
+  external:
+    allow: true
+    ban:
+      threshold: 5
+      period: second
+      duration: 10m
+      global: true`,
+		},
+		{
+			name: "no threshold",
+			rules: `
+mapped_ports:
+  external:
+    allow: true
+    ban:
+      duration: 10m`,
+			wantErr: true,
+		},
+		{
+			name: "no duration",
+			rules: `
+mapped_ports:
+  external:
+    allow: true
+    ban:
+      threshold: 5`,
+			wantErr: true,
+		},
+		{
+			name: "invalid period",
+			rules: `
+mapped_ports:
+  external:
+    allow: true
+    ban:
+      threshold: 5
+      period: fortnight
+      duration: 10m`,
+			parseErr: true,
+		},
+		{
+			name: "per port",
+			rules: `
+mapped_ports:
+  external:
+    allow: true
+    ports:
+      - port: 22
+        proto: tcp
+        allow: true
+        ban:
+          threshold: 5
+          duration: 10m`,
+			parseErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			dec := yaml.NewDecoder(strings.NewReader(tt.rules))
+			dec.KnownFields(true)
+			err := dec.Decode(&cfg)
+			if tt.parseErr {
+				if err == nil {
+					t.Error("expected parse error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err = validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func marksTestContainers() []types.ContainerJSON {
+	return []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+output:
+  - ips:
+      - 1.1.1.1
+    proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      mark: 0x10
+      ct_mark: 0x20
+  - ips:
+      - 8.8.8.8
+    proto: udp
+    dst_ports:
+      - 53
+    egress_interfaces:
+      - wg0
+    verdict:
+      mark: 0x30
+  - ips:
+      - 9.9.9.9
+    proto: tcp
+    dst_ports:
+      - 443`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestMarks(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	tests := []struct {
+		pkt    testPacket
+		mark   uint32
+		ctMark uint32
+	}{
+		{
+			pkt:    testPacket{src: cont1Addr, dst: netip.MustParseAddr("1.1.1.1"), proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew},
+			mark:   0x10,
+			ctMark: 0x20,
+		},
+		{
+			// established packets are routed separately
+			pkt:    testPacket{src: cont1Addr, dst: netip.MustParseAddr("1.1.1.1"), proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateEst},
+			mark:   0x10,
+			ctMark: 0x20,
+		},
+		{
+			// marks are set before the interface packets leave on is
+			// known
+			pkt:  testPacket{src: cont1Addr, dst: netip.MustParseAddr("8.8.8.8"), proto: unix.IPPROTO_UDP, sport: 40000, dport: 53, state: stateNew},
+			mark: 0x30,
+		},
+		{
+			pkt: testPacket{src: cont1Addr, dst: netip.MustParseAddr("9.9.9.9"), proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew},
+		},
+		{
+			pkt: testPacket{src: cont2Addr, dst: netip.MustParseAddr("1.1.1.1"), proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew},
+		},
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			fw := createTestFirewall(t, logger, marksTestContainers(), WithRuleLayout(layout))
+			for _, tt := range tests {
+				mark, ctMark := evalPacketMarks(t, fw, tt.pkt)
+				if mark != tt.mark || ctMark != tt.ctMark {
+					t.Errorf("packet %s: expected mark %#x and ct mark %#x, got %#x and %#x", tt.pkt, tt.mark, tt.ctMark, mark, ctMark)
+				}
+			}
+
+			// marking traffic shouldn't change whether it is allowed
+			pkt := tests[0].pkt
+			if verdict := evalPacket(t, fw, pkt); verdict != "accept" {
+				t.Errorf("packet %s: expected verdict %q, got %q", pkt, "accept", verdict)
+			}
+		})
+	}
+}
+
+func TestDeletingMarks(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := marksTestContainers()
+	r, firewallCreator := newTestRuleManager(t, logger, containers)
+	is.NoErr(r.createContainerRules(context.Background(), containers[0], true))
+	fw := firewallCreator.newMockFirewall()
+	is.Equal(fw.chains[markChainName].Chain.Table.Name, markTableName)
+	is.Equal(len(fw.chains[markChainName].Rules), 2)
+
+	is.NoErr(r.deleteContainerRules(context.Background(), cont1ID, cont1Name))
+	is.Equal(len(firewallCreator.newMockFirewall().chains[markChainName].Rules), 0)
+}
+
+func TestMigrateMarkChain(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	// older versions created the mark chain in the filter table
+	containers := marksTestContainers()
+	r, firewallCreator := newTestRuleManager(t, logger, containers)
+	fw := firewallCreator.newMockFirewall()
+	fw.DelTable(markTable)
+	oldMarkChain := *markChain
+	oldMarkChain.Table = filterTable
+	fw.AddChain(&oldMarkChain)
+	is.NoErr(fw.Flush())
+
+	is.NoErr(r.createBaseRules())
+	fw = firewallCreator.newMockFirewall()
+	_, ok := fw.tables[markTableName]
+	is.True(ok)
+	is.Equal(fw.chains[markChainName].Chain.Table.Name, markTableName)
+
+	is.NoErr(r.createContainerRules(context.Background(), containers[0], true))
+	is.Equal(len(firewallCreator.newMockFirewall().chains[markChainName].Rules), 2)
+}
+
+func TestValidateMarks(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "output",
+			rules: `
+output:
+  - ips:
+      - 1.1.1.1
+    proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      mark: 0x10
+      ct_mark: 16`,
+		},
+		{
+			name: "input",
+			rules: `
+input:
+  - proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      mark: 0x10`,
+			wantErr: true,
+		},
+		{
+			name: "mapped ports",
+			rules: `
+mapped_ports:
+  external:
+    allow: true
+    ports:
+      - port: 443
+        proto: tcp
+        allow: true
+        verdict:
+          ct_mark: 0x10`,
+			wantErr: true,
+		},
+		{
+			name: "from host",
+			rules: `
+from_host:
+  - proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      mark: 0x10`,
+			wantErr: true,
+		},
+		{
+			name: "container",
+			rules: `
+output:
+  - network: default
+    container: server
+    proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      mark: 0x10`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err := validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateQueues(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "queue range",
+			rules: `
+output:
+  - proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      queue: 10-13
+      fanout: true
+      bypass: true`,
+		},
+		{
+			name: "est queue range",
+			rules: `
+output:
+  - proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      queue: 10
+      input_est_queue: 11-12
+      output_est_queue: 13
+      fanout: true`,
+		},
+		{
+			name: "reversed queue range",
+			rules: `
+output:
+  - proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      queue: 13-10`,
+			wantErr: true,
+		},
+		{
+			name: "reversed est queue range",
+			rules: `
+output:
+  - proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      queue: 10
+      input_est_queue: 12-11
+      output_est_queue: 13`,
+			wantErr: true,
+		},
+		{
+			name: "fanout without range",
+			rules: `
+output:
+  - proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      queue: 10
+      fanout: true`,
+			wantErr: true,
+		},
+		{
+			name: "bypass without queue",
+			rules: `
+output:
+  - proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      bypass: true`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err := validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseQueues(t *testing.T) {
+	t.Parallel()
+
+	for _, text := range []string{"a", "10-", "-10", "10-13-14", "65536"} {
+		var q queueNums
+		if err := q.UnmarshalText([]byte(text)); err == nil {
+			t.Errorf("expected error parsing %q", text)
+		}
+	}
+}
+
+func TestDecodeLegacyRuleConfig(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+
+	// ruleConfig and verdict as they were before queue ranges were
+	// supported
+	type oldVerdict struct {
+		Chain          string
+		Queue          uint16
+		InputEstQueue  uint16
+		OutputEstQueue uint16
+	}
+	type oldRuleConfig struct {
+		LogPrefix string
+		Network   string
+		IPs       []addrOrRange
+		Container string
+		Proto     protocol
+		SrcPorts  []rulePorts
+		DstPorts  []rulePorts
+		Verdict   oldVerdict
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(oldRuleConfig{
+		LogPrefix: "db",
+		Network:   "backend",
+		IPs:       []addrOrRange{{addr: dstAddr}},
+		Container: cont2Name,
+		Proto:     tcp,
+		DstPorts:  []rulePorts{{single: 5432}},
+		Verdict: oldVerdict{
+			Queue:         1000,
+			InputEstQueue: 1001,
+		},
+	})
+	is.NoErr(err)
+
+	cfg, err := decodeRuleConfig(buf.Bytes())
+	is.NoErr(err)
+	is.Equal(cfg.LogPrefix, "db")
+	is.Equal(cfg.Network, "backend")
+	is.Equal(cfg.IPs, []addrOrRange{{addr: dstAddr}})
+	is.Equal(cfg.Container, cont2Name)
+	is.Equal(cfg.Proto, tcp)
+	is.Equal(cfg.DstPorts, []rulePorts{{single: 5432}})
+	is.Equal(cfg.Verdict, verdict{
+		Queue:         queueNums{first: 1000, last: 1000},
+		InputEstQueue: queueNums{first: 1001, last: 1001},
+	})
+
+	// rules encoded by this version should be decoded as is
+	buf.Reset()
+	err = gob.NewEncoder(&buf).Encode(cfg)
+	is.NoErr(err)
+	decodedCfg, err := decodeRuleConfig(buf.Bytes())
+	is.NoErr(err)
+	is.Equal(decodedCfg, cfg)
+
+	_, err = decodeRuleConfig([]byte("garbage"))
+	is.True(err != nil)
+}
+
+func TestQueueRulesEqual(t *testing.T) {
+	t.Parallel()
+
+	logger := zap.NewNop()
+	queueRule := func(q *expr.Queue) *nftables.Rule {
+		return &nftables.Rule{
+			Table: filterTable,
+			Exprs: []expr.Any{
+				&expr.Counter{},
+				q,
+			},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		q1    *expr.Queue
+		q2    *expr.Queue
+		equal bool
+	}{
+		{
+			name:  "unset and single total",
+			q1:    &expr.Queue{Num: 10},
+			q2:    &expr.Queue{Num: 10, Total: 1},
+			equal: true,
+		},
+		{
+			name: "different totals",
+			q1:   &expr.Queue{Num: 10, Total: 4},
+			q2:   &expr.Queue{Num: 10, Total: 1},
+		},
+		{
+			name: "different flags",
+			q1:   &expr.Queue{Num: 10, Total: 4, Flag: expr.QueueFlagFanout},
+			q2:   &expr.Queue{Num: 10, Total: 4, Flag: expr.QueueFlagFanout | expr.QueueFlagBypass},
+		},
+		{
+			name: "different queues",
+			q1:   &expr.Queue{Num: 10, Flag: expr.QueueFlagBypass},
+			q2:   &expr.Queue{Num: 11, Flag: expr.QueueFlagBypass},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if equal := rulesEqual(logger, queueRule(tt.q1), queueRule(tt.q2)); equal != tt.equal {
+				t.Errorf("expected rules to be equal: %v, got %v", tt.equal, equal)
+			}
+			if equal := rulesEqual(logger, queueRule(tt.q2), queueRule(tt.q1)); equal != tt.equal {
+				t.Errorf("expected rules to be equal: %v, got %v", tt.equal, equal)
+			}
+		})
+	}
+}
+
+func TestUserChains(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	chains, err := ParseUserChains(strings.NewReader(`
+chains:
+  - name: https-filter
+    rules:
+      - dst_ips:
+          - 1.1.1.1
+        proto: tcp
+        dst_ports:
+          - 443
+        verdict: accept
+      - src_ips:
+          - 1.1.1.1
+        proto: tcp
+        src_ports:
+          - 443
+        verdict: accept
+      - verdict: drop`))
+	is.NoErr(err)
+
+	containers := []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+output:
+  - ips:
+      - 1.1.1.0/24
+    proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      chain: https-filter`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+
+	r, firewallCreator := newTestRuleManager(t, logger, containers, WithUserChains(chains))
+	// rules of user chains are replaced, not added to
+	is.NoErr(r.createBaseRules())
+	for _, isNew := range []bool{true, false} {
+		is.NoErr(r.createContainerRules(context.Background(), containers[0], isNew))
+	}
+
+	fw := firewallCreator.newMockFirewall()
+	is.Equal(len(fw.chains["https-filter"].Rules), 3)
+
+	tests := []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			pkt:     testPacket{src: cont1Addr, dst: netip.MustParseAddr("1.1.1.1"), proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: netip.MustParseAddr("1.1.1.1"), dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 443, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: netip.MustParseAddr("1.1.1.2"), proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew},
+			verdict: "drop",
+		},
+	}
+	for _, tt := range tests {
+		if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+			t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+		}
+	}
+
+	is.NoErr(r.clearRules(context.Background()))
+	fw = firewallCreator.newMockFirewall()
+	_, ok := fw.chains["https-filter"]
+	is.True(!ok)
+}
+
+func TestChainRefs(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+input:
+  - proto: tcp
+    dst_ports:
+      - 80
+    verdict:
+      chain: INPUT
+output:
+  - proto: tcp
+    dst_ports:
+      - 443
+    verdict:
+      chain: ` + testUserChainName + `
+  - proto: udp
+    dst_ports:
+      - 53
+    verdict:
+      chain: missing`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+
+	r, _ := newTestRuleManager(t, logger, containers)
+	err = r.createContainerRules(context.Background(), containers[0], true)
+	is.True(err != nil)
+	// every invalid rule should be reported
+	is.True(strings.Contains(err.Error(), `input rule #0: chain "INPUT" is a base chain`))
+	is.True(strings.Contains(err.Error(), `output rule #1: chain "missing" doesn't exist`))
+	is.True(!strings.Contains(err.Error(), "output rule #0"))
+}
+
+func TestValidateUserChains(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			config: `
+chains:
+  - name: filter-dns
+    rules:
+      - dst_ips:
+          - 1.1.1.1
+          - 8.8.8.0/24
+        proto: udp
+        dst_ports:
+          - 53
+        verdict: accept
+      - proto: tcp
+        src_ports:
+          - 1000-2000
+      - verdict: reject`,
+		},
+		{
+			name:   "empty",
+			config: ``,
+		},
+		{
+			name: "no name",
+			config: `
+chains:
+  - rules:
+      - verdict: drop`,
+			wantErr: true,
+		},
+		{
+			name: "duplicate name",
+			config: `
+chains:
+  - name: filter-dns
+  - name: filter-dns`,
+			wantErr: true,
+		},
+		{
+			name: "whalewall chain",
+			config: `
+chains:
+  - name: whalewall-filter`,
+			wantErr: true,
+		},
+		{
+			name: "Docker chain",
+			config: `
+chains:
+  - name: DOCKER-USER`,
+			wantErr: true,
+		},
+		{
+			name: "base chain",
+			config: `
+chains:
+  - name: INPUT`,
+			wantErr: true,
+		},
+		{
+			name: "ports without proto",
+			config: `
+chains:
+  - name: filter-dns
+    rules:
+      - dst_ports:
+          - 53
+        verdict: accept`,
+			wantErr: true,
+		},
+		{
+			name: "symbolic address",
+			config: `
+chains:
+  - name: filter-dns
+    rules:
+      - dst_ips:
+          - internet
+        verdict: accept`,
+			wantErr: true,
+		},
+		{
+			name: "invalid verdict",
+			config: `
+chains:
+  - name: filter-dns
+    rules:
+      - verdict: queue`,
+			wantErr: true,
+		},
+		{
+			name: "unknown field",
+			config: `
+chains:
+  - name: filter-dns
+    policy: drop`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseUserChains(strings.NewReader(tt.config))
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// readPcapPackets returns the packets of a little endian pcap file of
+// raw IP packets.
+func readPcapPackets(t *testing.T, path string) [][]byte {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading pcap file: %v", err)
+	}
+	if len(b) < 24 || binary.LittleEndian.Uint32(b) != 0xa1b2c3d4 {
+		t.Fatalf("%s is not a little endian pcap file", path)
+	}
+	if linkType := binary.LittleEndian.Uint32(b[20:24]); linkType != 101 {
+		t.Fatalf("%s has link type %d, expected raw IP packets", path, linkType)
+	}
+
+	var pkts [][]byte
+	for b = b[24:]; len(b) != 0; {
+		if len(b) < 16 {
+			t.Fatalf("%s: record header truncated", path)
+		}
+		n := int(binary.LittleEndian.Uint32(b[8:12]))
+		if len(b) < 16+n {
+			t.Fatalf("%s: record truncated", path)
+		}
+		pkts = append(pkts, b[16:16+n])
+		b = b[16+n:]
+	}
+
+	return pkts
+}
+
+// tcpPayload returns the payload of a TCP packet.
+func tcpPayload(t *testing.T, pkt []byte) []byte {
+	t.Helper()
+
+	_, _, payload, err := parseTCPSegment(pkt)
+	if err != nil {
+		t.Fatalf("error parsing TCP segment: %v", err)
+	}
+	return payload
+}
+
+func TestParseClientHello(t *testing.T) {
+	t.Parallel()
+
+	hello := tcpPayload(t, readPcapPackets(t, "testdata/sni/clienthello.pcap")[0])
+	noSNI := tcpPayload(t, readPcapPackets(t, "testdata/sni/clienthello-no-sni.pcap")[0])
+	splitPkts := readPcapPackets(t, "testdata/sni/clienthello-split.pcap")
+	splitFirst := tcpPayload(t, splitPkts[0])
+	split := slicesJoin(splitFirst, tcpPayload(t, splitPkts[1]))
+
+	// a ClientHello in a handshake message split across two records
+	const recordSplit = 100
+	msg := hello[tlsRecordHeaderLen:]
+	twoRecords := slicesJoin(
+		[]byte{tlsRecordHandshake, 3, 1, 0, recordSplit},
+		msg[:recordSplit],
+		[]byte{tlsRecordHandshake, 3, 1},
+		binary.BigEndian.AppendUint16(nil, uint16(len(msg)-recordSplit)),
+		msg[recordSplit:],
+	)
+
+	tests := []struct {
+		name     string
+		stream   []byte
+		expected string
+		err      error
+	}{
+		{
+			name:     "server name",
+			stream:   hello,
+			expected: "www.example.com",
+		},
+		{
+			name:   "no server name",
+			stream: noSNI,
+		},
+		{
+			name:     "split across segments",
+			stream:   split,
+			expected: "api.example.org",
+		},
+		{
+			name:     "split across records",
+			stream:   twoRecords,
+			expected: "www.example.com",
+		},
+		{
+			name:   "first segment",
+			stream: splitFirst,
+			err:    errTruncated,
+		},
+		{
+			name:   "record header",
+			stream: hello[:3],
+			err:    errTruncated,
+		},
+		{
+			name:   "first record",
+			stream: twoRecords[:tlsRecordHeaderLen+recordSplit],
+			err:    errTruncated,
+		},
+		{
+			name:   "application data",
+			stream: slicesJoin([]byte{0x17}, hello[1:]),
+			err:    errNotClientHello,
+		},
+		{
+			name:   "server hello",
+			stream: slicesJoin(hello[:tlsRecordHeaderLen], []byte{0x02}, hello[tlsRecordHeaderLen+1:]),
+			err:    errNotClientHello,
+		},
+		{
+			name:   "not TLS",
+			stream: []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"),
+			err:    errNotClientHello,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := parseClientHello(tt.stream)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if name != tt.expected {
+				t.Errorf("expected server name %q, got %q", tt.expected, name)
+			}
+		})
+	}
+}
+
+func TestDomainAllowed(t *testing.T) {
+	t.Parallel()
+
+	patterns := []string{"www.example.com", "*.example.org"}
+	tests := []struct {
+		name    string
+		allowed bool
+	}{
+		{name: "www.example.com", allowed: true},
+		{name: "WWW.Example.COM", allowed: true},
+		{name: "www.example.com.", allowed: true},
+		{name: "example.com"},
+		{name: "api.www.example.com"},
+		{name: "api.example.org", allowed: true},
+		{name: "v1.api.example.org", allowed: true},
+		{name: "example.org"},
+		{name: "badexample.org"},
+		{name: "example.org.evil.com"},
+		{name: ""},
+	}
+
+	for _, tt := range tests {
+		if allowed := domainAllowed(patterns, tt.name); allowed != tt.allowed {
+			t.Errorf("server name %q: expected allowed to be %v, got %v", tt.name, tt.allowed, allowed)
+		}
+	}
+}
+
+func TestSNIFilter(t *testing.T) {
+	t.Parallel()
+
+	hello := readPcapPackets(t, "testdata/sni/clienthello.pcap")[0]
+	noSNI := readPcapPackets(t, "testdata/sni/clienthello-no-sni.pcap")[0]
+	split := readPcapPackets(t, "testdata/sni/clienthello-split.pcap")
+	oneByte := readPcapPackets(t, "testdata/sni/clienthello-one-byte.pcap")
+	http := readPcapPackets(t, "testdata/sni/http.pcap")
+
+	addrs := map[string][]byte{"default": cont1Addr.AsSlice()}
+	newFilter := func(allowed ...string) *sniFilter {
+		f := newSNIFilter()
+		f.setPolicy(addrs, sniPolicy{
+			contID:   cont1ID,
+			contName: cont1Name,
+			allowed:  allowed,
+		})
+		return f
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		allowed  []string
+		pkts     [][]byte
+		expected []sniDecision
+	}{
+		{
+			name:     "allowed",
+			allowed:  []string{"*.example.com"},
+			pkts:     [][]byte{hello},
+			expected: []sniDecision{sniAllow},
+		},
+		{
+			name:     "denied",
+			allowed:  []string{"example.com"},
+			pkts:     [][]byte{hello},
+			expected: []sniDecision{sniDeny},
+		},
+		{
+			name:     "no server name",
+			allowed:  []string{"*.example.com"},
+			pkts:     [][]byte{noSNI},
+			expected: []sniDecision{sniDeny},
+		},
+		{
+			name:     "split allowed",
+			allowed:  []string{"api.example.org"},
+			pkts:     split,
+			expected: []sniDecision{sniPending, sniAllow},
+		},
+		{
+			name:     "split denied",
+			allowed:  []string{"www.example.org"},
+			pkts:     split,
+			expected: []sniDecision{sniPending, sniDeny},
+		},
+		{
+			name:     "split retransmitted",
+			allowed:  []string{"api.example.org"},
+			pkts:     [][]byte{split[0], split[0], split[1]},
+			expected: []sniDecision{sniPending, sniPending, sniAllow},
+		},
+		{
+			name:     "one byte first segment",
+			allowed:  []string{"*.example.com"},
+			pkts:     oneByte,
+			expected: []sniDecision{sniPending, sniAllow},
+		},
+		{
+			name:     "one byte first segment denied",
+			allowed:  []string{"example.com"},
+			pkts:     oneByte,
+			expected: []sniDecision{sniPending, sniDeny},
+		},
+		{
+			name:     "plain HTTP",
+			allowed:  []string{"*.example.com"},
+			pkts:     http,
+			expected: []sniDecision{sniDeny, sniDeny},
+		},
+		{
+			name:     "queued after verdict",
+			allowed:  []string{"*.example.com"},
+			pkts:     [][]byte{hello, hello},
+			expected: []sniDecision{sniAllow, sniAllow},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFilter(tt.allowed...)
+			for i, pkt := range tt.pkts {
+				res := f.check(pkt, now)
+				if res.decision != tt.expected[i] {
+					t.Fatalf("packet #%d: expected decision %d, got %d (reason: %q)", i, tt.expected[i], res.decision, res.reason)
+				}
+			}
+		})
+	}
+
+	t.Run("segment before start", func(t *testing.T) {
+		f := newFilter("api.example.org")
+		// the second segment doesn't start a ClientHello
+		res := f.check(split[1], now)
+		if res.decision != sniDeny {
+			t.Fatalf("expected second segment to be denied, got %d", res.decision)
+		}
+	})
+
+	t.Run("gap", func(t *testing.T) {
+		f := newFilter("api.example.org")
+		if res := f.check(split[0], now); res.decision != sniPending {
+			t.Fatalf("expected first segment to be pending, got %d", res.decision)
+		}
+		// skip part of the second segment so it starts after the
+		// data that was buffered
+		gap := bytes.Clone(split[1])
+		seq := binary.BigEndian.Uint32(gap[24:28])
+		binary.BigEndian.PutUint32(gap[24:28], seq+10)
+		if res := f.check(gap, now); res.decision != sniOutOfOrder {
+			t.Fatalf("expected segment after a gap to be out of order, got %d", res.decision)
+		}
+		if res := f.check(split[1], now); res.decision != sniAllow {
+			t.Fatalf("expected second segment to be allowed, got %d", res.decision)
+		}
+	})
+
+	t.Run("decided", func(t *testing.T) {
+		f := newFilter("*.example.com")
+		if res := f.check(hello, now); res.decided {
+			t.Fatal("expected first verdict of connection to not be remembered")
+		}
+		if res := f.check(hello, now); !res.decided {
+			t.Fatal("expected verdict of connection to be remembered")
+		}
+		// remembered verdicts expire
+		if res := f.check(hello, now.Add(2*sniHelloTimeout)); res.decided {
+			t.Fatal("expected remembered verdict to expire")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		f := newFilter("api.example.org")
+		f.check(split[0], now)
+		res := f.check(split[1], now.Add(2*sniHelloTimeout))
+		if res.decision != sniDeny {
+			t.Fatalf("expected second segment of expired connection to be denied, got %d", res.decision)
+		}
+	})
+
+	t.Run("unknown container", func(t *testing.T) {
+		f := newFilter("*.example.com")
+		f.deletePolicy(cont1ID)
+		res := f.check(hello, now)
+		if res.decision != sniDeny {
+			t.Fatalf("expected ClientHello of unknown container to be denied, got %d", res.decision)
+		}
+	})
+}
+
+func sniTestContainers() []types.ContainerJSON {
+	return []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+output:
+  - proto: tcp
+    dst_ports:
+      - 80
+      - 443
+      - 8443
+allowed_sni:
+  - "*.example.com"`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestSNIRules(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	const queue = 7
+	helloPkt := readPcapPackets(t, "testdata/sni/clienthello.pcap")[0]
+	noSNIPkt := readPcapPackets(t, "testdata/sni/clienthello-no-sni.pcap")[0]
+	httpPkt := readPcapPackets(t, "testdata/sni/http.pcap")[0]
+	newPkt := testPacket{src: cont1Addr, dst: dstAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew}
+	estPkt := newPkt
+	estPkt.state = stateEst
+	replyPkt := testPacket{src: dstAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 443, dport: 40000, state: stateEst, reply: true}
+	noSNIEstPkt := estPkt
+	noSNIEstPkt.sport = 40001
+	httpEstPkt := estPkt
+	httpEstPkt.sport = 40003
+	// connections to ports not in sni_ports aren't checked
+	otherPortPkt := estPkt
+	otherPortPkt.dport = 80
+
+	pending := func(sport uint16) []nftables.SetElement {
+		return []nftables.SetElement{{Key: flowKey(packetFlow{
+			srcAddr: cont1Addr,
+			dstAddr: dstAddr,
+			proto:   unix.IPPROTO_TCP,
+			srcPort: sport,
+			dstPort: 443,
+		})}}
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			is := is.New(t)
+
+			containers := sniTestContainers()
+			r, firewallCreator := newTestRuleManager(t, logger, containers, WithRuleLayout(layout), WithSNIQueue(queue))
+			is.NoErr(r.createContainerRules(context.Background(), containers[0], true))
+			fw := firewallCreator.newMockFirewall()
+
+			// new connections are accepted and start being checked
+			is.Equal(evalPacket(t, fw, newPkt), "accept")
+			// established connections that weren't checked are dropped
+			is.Equal(evalPacket(t, fw, estPkt), "drop")
+			is.Equal(evalPacket(t, fw, replyPkt), "accept")
+			is.Equal(evalPacket(t, fw, otherPortPkt), "accept")
+
+			// pending connections are queued until a verdict is reached
+			for _, sport := range []uint16{40000, 40001, 40003} {
+				is.NoErr(fw.SetAddElements(sniPendingSet, pending(sport)))
+			}
+			is.NoErr(fw.Flush())
+			fw = firewallCreator.newMockFirewall()
+			is.Equal(evalPacket(t, fw, estPkt), fmt.Sprintf("queue %d", queue))
+
+			// an allowed connection is no longer pending
+			is.Equal(r.handleSNIPacket(fw, helloPkt), nfqueue.Accept)
+			fw = firewallCreator.newMockFirewall()
+			is.Equal(len(fw.tables[filterTableName].Sets[sniAllowedSetName]), 1)
+			is.Equal(evalPacket(t, fw, estPkt), "accept")
+			is.Equal(evalPacket(t, fw, noSNIEstPkt), fmt.Sprintf("queue %d", queue))
+
+			// connections without a server name are dropped
+			is.Equal(r.handleSNIPacket(fw, noSNIPkt), nfqueue.Drop)
+			fw = firewallCreator.newMockFirewall()
+			is.Equal(evalPacket(t, fw, noSNIEstPkt), "drop")
+
+			// connections that don't start with a ClientHello are
+			// dropped as soon as their first byte is seen
+			is.Equal(r.handleSNIPacket(fw, httpPkt), nfqueue.Drop)
+			fw = firewallCreator.newMockFirewall()
+			is.Equal(len(fw.tables[filterTableName].Sets[sniPendingSetName]), 0)
+			is.Equal(len(fw.tables[filterTableName].Sets[sniDeniedSetName]), 2)
+			is.Equal(evalPacket(t, fw, httpEstPkt), "drop")
+			is.Equal(evalPacket(t, fw, estPkt), "accept")
+
+			// a connection whose pending element expired is still
+			// allowed
+			is.NoErr(fw.SetDeleteElements(sniAllowedSet, pending(40000)))
+			is.NoErr(fw.Flush())
+			fw = firewallCreator.newMockFirewall()
+			is.NoErr(moveSNIFlow(fw, pending(40000)[0].Key, sniAllowedSet, sniAllowedTimeout))
+			fw = firewallCreator.newMockFirewall()
+			is.Equal(evalPacket(t, fw, estPkt), "accept")
+
+			// deleting the container forgets its allowed server names
+			is.NoErr(r.deleteContainerRules(context.Background(), cont1ID, cont1Name))
+			is.Equal(len(r.sni.policies), 0)
+		})
+	}
+}
+
+func TestSNIPorts(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := sniTestContainers()
+	containers[0].Config.Labels[rulesLabel] += `
+sni_ports:
+  - 8443`
+	fw := createTestFirewall(t, logger, containers, WithSNIQueue(7))
+
+	pkt := testPacket{src: cont1Addr, dst: dstAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateEst}
+	is.Equal(evalPacket(t, fw, pkt), "accept")
+	pkt.dport = 8443
+	is.Equal(evalPacket(t, fw, pkt), "drop")
+}
+
+func TestSNIUnsupported(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		labels map[string]string
+	}{
+		{
+			name: "no queue",
+		},
+		{
+			// established traffic would be accepted before container
+			// chains, so connections couldn't be checked
+			name: "established fast path",
+			opts: []Option{WithSNIQueue(7), WithEstablishedFastPath(true)},
+		},
+		{
+			name: "learn mode option",
+			opts: []Option{WithSNIQueue(7), WithLearnMode(true)},
+		},
+		{
+			name:   "learn mode label",
+			opts:   []Option{WithSNIQueue(7)},
+			labels: map[string]string{modeLabel: modeLearn},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := is.New(t)
+			logger, err := zap.NewDevelopment()
+			is.NoErr(err)
+
+			containers := sniTestContainers()
+			maps.Copy(containers[0].Config.Labels, tt.labels)
+			r, _ := newTestRuleManager(t, logger, containers, tt.opts...)
+			err = r.createContainerRules(context.Background(), containers[0], true)
+			is.True(err != nil)
+			is.True(strings.Contains(err.Error(), "allowed_sni"))
+		})
+	}
+}
+
+func TestValidateSNI(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			rules: `
+allowed_sni:
+  - example.com
+  - "*.example.com"
+  - API.Example.org.
+  - _acme.example.net`,
+		},
+		{
+			name: "empty",
+			rules: `
+allowed_sni:
+  - ""`,
+			wantErr: true,
+		},
+		{
+			name: "wildcard not first",
+			rules: `
+allowed_sni:
+  - "api.*.example.com"`,
+			wantErr: true,
+		},
+		{
+			name: "partial wildcard",
+			rules: `
+allowed_sni:
+  - "*api.example.com"`,
+			wantErr: true,
+		},
+		{
+			name: "bare wildcard",
+			rules: `
+allowed_sni:
+  - "*"`,
+			wantErr: true,
+		},
+		{
+			name: "empty label",
+			rules: `
+allowed_sni:
+  - "api..example.com"`,
+			wantErr: true,
+		},
+		{
+			name: "IP address",
+			rules: `
+allowed_sni:
+  - 1.1.1.1`,
+			wantErr: true,
+		},
+		{
+			name: "invalid characters",
+			rules: `
+allowed_sni:
+  - "example.com/path"`,
+			wantErr: true,
+		},
+		{
+			name: "ports",
+			rules: `
+allowed_sni:
+  - example.com
+sni_ports:
+  - 443
+  - 8000-8999`,
+		},
+		{
+			name: "ports without server names",
+			rules: `
+sni_ports:
+  - 443`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err := validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// udpPayload returns the payload of a UDP packet.
+func udpPayload(t *testing.T, pkt []byte) []byte {
+	t.Helper()
+
+	_, payload, err := parseUDPDatagram(pkt)
+	if err != nil {
+		t.Fatalf("error parsing UDP datagram: %v", err)
+	}
+	return payload
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	t.Parallel()
+
+	a := udpPayload(t, readPcapPackets(t, "testdata/dns/a.pcap")[0])
+	cname := udpPayload(t, readPcapPackets(t, "testdata/dns/cname.pcap")[0])
+	nxdomain := udpPayload(t, readPcapPackets(t, "testdata/dns/nxdomain.pcap")[0])
+
+	query := bytes.Clone(a)
+	query[2] &^= 0x80
+	// a name that points to itself
+	loop := bytes.Clone(a[:dnsHeaderLen])
+	binary.BigEndian.PutUint16(loop[4:6], 1)
+	binary.BigEndian.PutUint16(loop[6:8], 0)
+	loop = append(loop, 0xc0, dnsHeaderLen, 0, dnsTypeA, 0, dnsClassINET)
+
+	tests := []struct {
+		name     string
+		msg      []byte
+		expected []dnsRecord
+		wantErr  bool
+	}{
+		{
+			name: "A records",
+			msg:  a,
+			expected: []dnsRecord{
+				{name: "www.example.com", typ: dnsTypeA, ttl: 300, addr: netip.MustParseAddr("93.184.216.34")},
+				{name: "www.example.com", typ: dnsTypeA, ttl: 30, addr: netip.MustParseAddr("93.184.216.35")},
+			},
+		},
+		{
+			name: "CNAME records",
+			msg:  cname,
+			expected: []dnsRecord{
+				{name: "api.example.com", typ: dnsTypeCNAME, ttl: 3600, target: "edge.cdn.example.net"},
+				{name: "edge.cdn.example.net", typ: dnsTypeCNAME, ttl: 600, target: "e1.cdn.example.net"},
+				{name: "e1.cdn.example.net", typ: dnsTypeA, ttl: 120, addr: netip.MustParseAddr("203.0.113.10")},
+				{name: "other.example.org", typ: dnsTypeA, ttl: 120, addr: netip.MustParseAddr("198.51.100.7")},
+			},
+		},
+		{
+			name: "NXDOMAIN",
+			msg:  nxdomain,
+		},
+		{
+			name:    "query",
+			msg:     query,
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			msg:     a[:len(a)-2],
+			wantErr: true,
+		},
+		{
+			name:    "header truncated",
+			msg:     a[:dnsHeaderLen-1],
+			wantErr: true,
+		},
+		{
+			name:    "compression loop",
+			msg:     loop,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := parseDNSResponse(tt.msg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tt.expected, records, cmp.AllowUnexported(dnsRecord{}), cmp.Comparer(func(a, b netip.Addr) bool {
+				return a == b
+			})); diff != "" {
+				t.Errorf("records differ (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestAllowedAddrs(t *testing.T) {
+	t.Parallel()
+
+	records, err := parseDNSResponse(udpPayload(t, readPcapPackets(t, "testdata/dns/cname.pcap")[0]))
+	if err != nil {
+		t.Fatalf("error parsing DNS response: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		expected []netip.Addr
+	}{
+		{
+			name:     "CNAME of allowed domain",
+			patterns: []string{"*.example.com"},
+			expected: []netip.Addr{netip.MustParseAddr("203.0.113.10")},
+		},
+		{
+			name:     "middle of CNAME chain",
+			patterns: []string{"edge.cdn.example.net"},
+			expected: []netip.Addr{netip.MustParseAddr("203.0.113.10")},
+		},
+		{
+			name:     "unrelated record",
+			patterns: []string{"other.example.org"},
+			expected: []netip.Addr{netip.MustParseAddr("198.51.100.7")},
+		},
+		{
+			name:     "apex of wildcard",
+			patterns: []string{"*.api.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addrs []netip.Addr
+			for _, rec := range allowedAddrs(tt.patterns, records) {
+				addrs = append(addrs, rec.addr)
+			}
+			if !slices.Equal(addrs, tt.expected) {
+				t.Errorf("expected addresses %v, got %v", tt.expected, addrs)
+			}
+		})
+	}
+}
+
+func dnsTestContainers() []types.ContainerJSON {
+	containers := []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+output:
+  - ips:
+      - allowed-domains
+    proto: tcp
+    dst_ports:
+      - 443
+allowed_domains:
+  - "*.example.com"`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+	containers[0].HostConfig = &container.HostConfig{
+		DNS: []string{dstAddr.String()},
+	}
+	return containers
+}
+
+func TestParseDNSPacket(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+
+	udpPkt := readPcapPackets(t, "testdata/dns/a.pcap")[0]
+	tcpPkt := readPcapPackets(t, "testdata/dns/a-tcp.pcap")[0]
+	msg := udpPayload(t, udpPkt)
+
+	_, udpMsg, err := parseDNSPacket(udpPkt)
+	is.NoErr(err)
+	is.Equal(udpMsg, msg)
+	_, tcpMsg, err := parseDNSPacket(tcpPkt)
+	is.NoErr(err)
+	is.Equal(tcpMsg, msg)
+
+	// a message longer than the segment
+	split := bytes.Clone(tcpPkt)
+	prefix := split[40:42]
+	binary.BigEndian.PutUint16(prefix, binary.BigEndian.Uint16(prefix)+1)
+	_, _, err = parseDNSPacket(split)
+	is.True(err != nil)
+
+	// a segment without a payload
+	ack := bytes.Clone(tcpPkt[:40])
+	binary.BigEndian.PutUint16(ack[2:4], 40)
+	_, _, err = parseDNSPacket(ack)
+	is.True(err != nil)
+}
+
+func TestDNSRules(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	const queue = 5
+	aPkt := readPcapPackets(t, "testdata/dns/a.pcap")[0]
+	cnamePkt := readPcapPackets(t, "testdata/dns/cname.pcap")[0]
+	aTCPPkt := readPcapPackets(t, "testdata/dns/a-tcp.pcap")[0]
+	respPkt := testPacket{src: dstAddr, dst: cont1Addr, proto: unix.IPPROTO_UDP, sport: 53, dport: 40000, state: stateEst}
+	tcpRespPkt := respPkt
+	tcpRespPkt.proto = unix.IPPROTO_TCP
+	untrustedPkt := respPkt
+	untrustedPkt.src = netip.MustParseAddr("9.9.9.9")
+	newPkt := func(dst string) testPacket {
+		return testPacket{src: cont1Addr, dst: netip.MustParseAddr(dst), proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew}
+	}
+	setName := buildChainName(cont1Name, cont1ID) + domainSetSuffix
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			is := is.New(t)
+
+			containers := dnsTestContainers()
+			r, firewallCreator := newTestRuleManager(t, logger, containers, WithRuleLayout(layout), WithDNSQueue(queue))
+			is.NoErr(r.createContainerRules(context.Background(), containers[0], true))
+			fw := firewallCreator.newMockFirewall()
+
+			is.Equal(evalPacket(t, fw, respPkt), fmt.Sprintf("queue %d", queue))
+			is.Equal(evalPacket(t, fw, tcpRespPkt), fmt.Sprintf("queue %d", queue))
+			is.True(evalPacket(t, fw, untrustedPkt) != fmt.Sprintf("queue %d", queue))
+			is.Equal(evalPacket(t, fw, newPkt("93.184.216.34")), "drop")
+
+			// addresses of allowed domains are allowed until their
+			// TTLs expire, responses over TCP are read too
+			r.handleDNSPacket(fw, aTCPPkt)
+			fw = firewallCreator.newMockFirewall()
+			elems := fw.tables[filterTableName].Sets[setName]
+			is.Equal(len(elems), 2)
+			is.Equal(elems[0].Timeout, 300*time.Second)
+			is.Equal(elems[1].Timeout, dnsMinTimeout)
+			is.Equal(evalPacket(t, fw, newPkt("93.184.216.34")), "accept")
+			is.Equal(evalPacket(t, fw, newPkt("93.184.216.35")), "accept")
+
+			// reading the same answers again replaces the elements
+			r.handleDNSPacket(fw, aPkt)
+			fw = firewallCreator.newMockFirewall()
+			is.Equal(len(fw.tables[filterTableName].Sets[setName]), 2)
+
+			// addresses of CNAME targets of allowed domains are
+			// allowed, unrelated addresses aren't
+			r.handleDNSPacket(fw, cnamePkt)
+			fw = firewallCreator.newMockFirewall()
+			is.Equal(len(fw.tables[filterTableName].Sets[setName]), 3)
+			is.Equal(evalPacket(t, fw, newPkt("203.0.113.10")), "accept")
+			is.Equal(evalPacket(t, fw, newPkt("198.51.100.7")), "drop")
+
+			// recreating rules keeps addresses that were allowed
+			is.NoErr(r.createContainerRules(context.Background(), containers[0], false))
+			fw = firewallCreator.newMockFirewall()
+			is.Equal(len(fw.tables[filterTableName].Sets[setName]), 3)
+
+			// deleting the container deletes its set and forgets its
+			// allowed domains
+			is.NoErr(r.deleteContainerRules(context.Background(), cont1ID, cont1Name))
+			fw = firewallCreator.newMockFirewall()
+			_, ok := fw.tables[filterTableName].Sets[setName]
+			is.True(!ok)
+			is.Equal(len(r.dns.policies), 0)
+		})
+	}
+}
+
+func TestDNSUnsupported(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	// allowed_domains can't be used without a queue
+	containers := dnsTestContainers()
+	r, _ := newTestRuleManager(t, logger, containers)
+	is.True(r.createContainerRules(context.Background(), containers[0], true) != nil)
+
+	// DNS responses couldn't be read if established traffic is
+	// accepted before container chains
+	r, _ = newTestRuleManager(t, logger, containers, WithDNSQueue(5), WithEstablishedFastPath(true))
+	err = r.createContainerRules(context.Background(), containers[0], true)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "fast path"))
+
+	// responses can't be trusted if no DNS servers are known
+	containers[0].HostConfig = nil
+	r, _ = newTestRuleManager(t, logger, containers, WithDNSQueue(5))
+	err = r.createContainerRules(context.Background(), containers[0], true)
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), "trusted DNS servers"))
+}
+
+func TestDNSResolvers(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	const queue = 5
+	resolverAddr := netip.MustParseAddr("9.9.9.9")
+	respPkt := testPacket{src: resolverAddr, dst: cont1Addr, proto: unix.IPPROTO_UDP, sport: 53, dport: 40000, state: stateEst}
+	aPkt := readPcapPackets(t, "testdata/dns/a.pcap")[0]
+
+	// resolvers passed as an option are trusted in addition to the
+	// container's
+	containers := dnsTestContainers()
+	r, firewallCreator := newTestRuleManager(t, logger, containers, WithDNSQueue(queue), WithDNSResolvers([]netip.Addr{resolverAddr}))
+	is.Equal(r.containerResolvers(containers[0]), []netip.Addr{dstAddr, resolverAddr})
+	is.NoErr(r.createContainerRules(context.Background(), containers[0], true))
+	fw := firewallCreator.newMockFirewall()
+	is.Equal(evalPacket(t, fw, respPkt), fmt.Sprintf("queue %d", queue))
+
+	// responses from other servers aren't read even if they were
+	// queued
+	r.dns.setPolicy(map[string][]byte{"default": cont1Addr.AsSlice()}, dnsPolicy{
+		contID:    cont1ID,
+		contName:  cont1Name,
+		allowed:   []string{"*.example.com"},
+		set:       buildDomainSet(&nftables.Chain{Table: filterTable, Name: buildChainName(cont1Name, cont1ID)}),
+		resolvers: []netip.Addr{resolverAddr},
+	})
+	_, err = r.dns.check(aPkt)
+	is.True(err != nil)
+}
+
+func TestValidateAllowedDomains(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			rules: `
+output:
+  - network: default
+    ips:
+      - allowed-domains
+allowed_domains:
+  - example.com
+  - "*.example.org"`,
+		},
+		{
+			name: "invalid domain",
+			rules: `
+allowed_domains:
+  - "api.*.example.com"`,
+			wantErr: true,
+		},
+		{
+			name: "allowed_domains not set",
+			rules: `
+output:
+  - ips:
+      - allowed-domains`,
+			wantErr: true,
+		},
+		{
+			name: "other addresses",
+			rules: `
+output:
+  - ips:
+      - allowed-domains
+      - 1.1.1.1
+allowed_domains:
+  - example.com`,
+			wantErr: true,
+		},
+		{
+			name: "container",
+			rules: `
+output:
+  - container: other
+    ips:
+      - allowed-domains
+allowed_domains:
+  - example.com`,
+			wantErr: true,
+		},
+		{
+			name: "input rule",
+			rules: `
+input:
+  - ips:
+      - allowed-domains
+allowed_domains:
+  - example.com`,
+			wantErr: true,
+		},
+		{
+			name: "deny rule",
+			rules: `
+deny:
+  - ips:
+      - allowed-domains
+allowed_domains:
+  - example.com`,
+			wantErr: true,
+		},
+		{
+			name: "mark",
+			rules: `
+output:
+  - ips:
+      - allowed-domains
+    verdict:
+      mark: 0x10
+allowed_domains:
+  - example.com`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err := validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateMappedPorts(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			rules: `
+mapped_ports:
+  localhost:
+    allow: true
+    ports:
+      - port: 9090
+        proto: tcp
+  external:
+    ports:
+      - port: 9090
+        proto: tcp
+        allow: true
+        ips:
+          - 10.8.0.0/24
+      - port: 9090
+        proto: udp
+        allow: true`,
+		},
+		{
+			name: "invalid interface",
+			rules: `
+mapped_ports:
+  external:
+    allow: true
+    interfaces:
+      - this_name_is_too_long`,
+			wantErr: true,
+		},
+		{
+			name: "invalid port interface",
+			rules: `
+mapped_ports:
+  external:
+    ports:
+      - port: 9090
+        proto: tcp
+        allow: true
+        interfaces:
+          - ""`,
+			wantErr: true,
+		},
+		{
+			name: "no port",
+			rules: `
+mapped_ports:
+  external:
+    ports:
+      - proto: tcp
+        allow: true`,
+			wantErr: true,
+		},
+		{
+			name: "no proto",
+			rules: `
+mapped_ports:
+  localhost:
+    ports:
+      - port: 9090
+        allow: true`,
+			wantErr: true,
+		},
+		{
+			name: "duplicate port",
+			rules: `
+mapped_ports:
+  external:
+    ports:
+      - port: 9090
+        proto: tcp
+        allow: true
+      - port: 9090
+        proto: tcp
+        ips:
+          - 10.8.0.0/24`,
+			wantErr: true,
+		},
+		{
+			name: "symbolic address",
+			rules: `
+mapped_ports:
+  external:
+    ports:
+      - port: 9090
+        proto: tcp
+        allow: true
+        ips:
+          - private`,
+			wantErr: true,
+		},
+		{
+			name: "invalid verdict",
+			rules: `
+mapped_ports:
+  external:
+    ports:
+      - port: 9090
+        proto: tcp
+        allow: true
+        verdict:
+          chain: foo
+          queue: 1000`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err := validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateFromHostRules(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			rules: `
+from_host:
+  - network: default
+    proto: tcp
+    dst_ports:
+      - 8080`,
+		},
+		{
+			name: "ips",
+			rules: `
+from_host:
+  - ips:
+      - 172.17.0.1
+    proto: tcp
+    dst_ports:
+      - 8080`,
+			wantErr: true,
+		},
+		{
+			name: "container",
+			rules: `
+from_host:
+  - network: default
+    container: container2
+    proto: tcp
+    dst_ports:
+      - 8080`,
+			wantErr: true,
+		},
+		{
+			name: "no proto",
+			rules: `
+from_host:
+  - network: default`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err := validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestAddrSymbols(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	hostAddr := netip.MustParseAddr("192.168.1.10")
+	containers := []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+output:
+  - ips:
+      - gateway
+    proto: tcp
+    dst_ports:
+      - 8080
+  - ips:
+      - host
+    proto: tcp
+    dst_ports:
+      - 9090
+  - ips:
+      - internet
+    proto: tcp
+    dst_ports:
+      - 443
+  - ips:
+      - private
+      - link-local
+    proto: udp
+    dst_ports:
+      - 53
+  - ips:
+      - gateway
+      - loopback-host
+    proto: tcp
+    dst_ports:
+      - 22
+deny:
+  - ips:
+      - link-local
+      - 1.1.1.1
+    proto: tcp
+    dst_ports:
+      - 443`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		dst     string
+		proto   uint8
+		port    uint16
+		verdict string
+	}{
+		{dst: gatewayAddr.String(), proto: unix.IPPROTO_TCP, port: 8080, verdict: "accept"},
+		{dst: "172.0.1.5", proto: unix.IPPROTO_TCP, port: 8080, verdict: "drop"},
+		{dst: gatewayAddr.String(), proto: unix.IPPROTO_TCP, port: 9090, verdict: "accept"},
+		{dst: hostAddr.String(), proto: unix.IPPROTO_TCP, port: 9090, verdict: "accept"},
+		{dst: "192.168.1.11", proto: unix.IPPROTO_TCP, port: 9090, verdict: "drop"},
+		{dst: "1.0.0.1", proto: unix.IPPROTO_TCP, port: 443, verdict: "accept"},
+		{dst: "1.1.1.1", proto: unix.IPPROTO_TCP, port: 443, verdict: "drop"},
+		{dst: "10.0.0.1", proto: unix.IPPROTO_TCP, port: 443, verdict: "drop"},
+		{dst: "100.64.0.1", proto: unix.IPPROTO_TCP, port: 443, verdict: "drop"},
+		{dst: "224.0.0.1", proto: unix.IPPROTO_TCP, port: 443, verdict: "drop"},
+		{dst: "10.1.2.3", proto: unix.IPPROTO_UDP, port: 53, verdict: "accept"},
+		{dst: "169.254.169.254", proto: unix.IPPROTO_UDP, port: 53, verdict: "accept"},
+		{dst: "8.8.8.8", proto: unix.IPPROTO_UDP, port: 53, verdict: "drop"},
+		{dst: gatewayAddr.String(), proto: unix.IPPROTO_TCP, port: 22, verdict: "accept"},
+		{dst: "127.0.0.1", proto: unix.IPPROTO_TCP, port: 22, verdict: "accept"},
+		{dst: "172.0.1.5", proto: unix.IPPROTO_TCP, port: 22, verdict: "drop"},
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			is := is.New(t)
+
+			r, firewallCreator := newTestRuleManager(t, logger, containers, WithRuleLayout(layout))
+			r.hostAddrs = func() ([]netip.Addr, error) {
+				return []netip.Addr{gatewayAddr, hostAddr}, nil
+			}
+			is.NoErr(r.createContainerRules(context.Background(), containers[0], true))
+			fw := firewallCreator.newMockFirewall()
+
+			for _, tt := range tests {
+				pkt := testPacket{
+					src:   cont1Addr,
+					dst:   netip.MustParseAddr(tt.dst),
+					proto: tt.proto,
+					sport: 40000,
+					dport: tt.port,
+					state: stateNew,
+				}
+				if verdict := evalPacket(t, fw, pkt); verdict != tt.verdict {
+					t.Errorf("packet %s: expected verdict %q, got %q", pkt, tt.verdict, verdict)
+				}
+			}
+		})
+	}
+}
+
+func TestAddrSymbolsMultipleNetworks(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	var (
+		backendGateway = netip.MustParseAddr("172.0.2.1")
+		backendAddr    = netip.MustParseAddr("172.0.2.2")
+	)
+	containers := []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+output:
+  - ips:
+      - gateway
+    proto: tcp
+    dst_ports:
+      - 8080
+  - proto: tcp
+    dst_ports:
+      - 8081
+deny:
+  - ips:
+      - gateway
+    proto: tcp
+    dst_ports:
+      - 8081`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: cont1Addr.String(),
+					},
+					"backend": {
+						Gateway:   backendGateway.String(),
+						IPAddress: backendAddr.String(),
+					},
+				},
+			},
+		},
+	}
+
+	// the gateway symbol should be expanded to the gateway of each
+	// network in the rules of that network
+	tests := []struct {
+		src     netip.Addr
+		dst     netip.Addr
+		port    uint16
+		verdict string
+	}{
+		{src: cont1Addr, dst: gatewayAddr, port: 8080, verdict: "accept"},
+		{src: backendAddr, dst: backendGateway, port: 8080, verdict: "accept"},
+		{src: cont1Addr, dst: backendGateway, port: 8080, verdict: "drop"},
+		{src: backendAddr, dst: gatewayAddr, port: 8080, verdict: "drop"},
+		{src: cont1Addr, dst: gatewayAddr, port: 8081, verdict: "drop"},
+		{src: backendAddr, dst: backendGateway, port: 8081, verdict: "drop"},
+		{src: cont1Addr, dst: backendGateway, port: 8081, verdict: "accept"},
+		{src: backendAddr, dst: gatewayAddr, port: 8081, verdict: "accept"},
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		t.Run(layout.String(), func(t *testing.T) {
+			fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+			for _, tt := range tests {
+				pkt := testPacket{
+					src:   tt.src,
+					dst:   tt.dst,
+					proto: unix.IPPROTO_TCP,
+					sport: 40000,
+					dport: tt.port,
+					state: stateNew,
+				}
+				if verdict := evalPacket(t, fw, pkt); verdict != tt.verdict {
+					t.Errorf("packet %s: expected verdict %q, got %q", pkt, tt.verdict, verdict)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateAddrSymbols(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		rules    string
+		parseErr bool
+		wantErr  bool
+	}{
+		{
+			name: "output",
+			rules: `
+output:
+  - ips:
+      - internet
+      - gateway
+    proto: tcp
+    dst_ports:
+      - 443`,
+		},
+		{
+			name: "deny with address",
+			rules: `
+deny:
+  - ips:
+      - private
+      - 1.1.1.1`,
+		},
+		{
+			name: "input",
+			rules: `
+input:
+  - ips:
+      - private
+    proto: tcp
+    dst_ports:
+      - 80`,
+			wantErr: true,
+		},
+		{
+			name: "mapped ports",
+			rules: `
+mapped_ports:
+  external:
+    allow: true
+    ips:
+      - private`,
+			wantErr: true,
+		},
+		{
+			name: "unknown symbol",
+			rules: `
+output:
+  - ips:
+      - lan`,
+			parseErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			err := yaml.Unmarshal([]byte(tt.rules), &cfg)
+			if tt.parseErr {
+				if err == nil {
+					t.Error("expected parse error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err = validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func networkPeersTestContainers() []types.ContainerJSON {
+	return []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+output:
+  - network: monitoring
+    network_peers: true
+    proto: tcp
+    dst_ports:
+      - 9100`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"monitoring": {
+						Gateway:     gatewayAddr.String(),
+						IPAddress:   cont1Addr.String(),
+						IPPrefixLen: 24,
+					},
+				},
+			},
+		},
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont2ID,
+				Name: "/" + cont2Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"monitoring": {
+						Gateway:     gatewayAddr.String(),
+						IPAddress:   cont2Addr.String(),
+						IPPrefixLen: 24,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestNetworkPeers(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	unmanagedAddr := netip.MustParseAddr("172.0.1.10")
+	tests := []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9100, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont2Addr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 9100, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: unmanagedAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9100, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: unmanagedAddr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 9100, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9101, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: netip.MustParseAddr("172.0.2.10"), proto: unix.IPPROTO_TCP, sport: 40000, dport: 9100, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: cont2Addr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9100, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: cont2Addr, dst: unmanagedAddr, proto: unix.IPPROTO_TCP, sport: 9100, dport: 40000, state: stateEst},
+			verdict: "drop",
+		},
+	}
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		for _, reversed := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/reversed=%t", layout, reversed), func(t *testing.T) {
+				containers := networkPeersTestContainers()
+				if reversed {
+					reverse(containers)
+				}
+				fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+				for _, tt := range tests {
+					if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+						t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDeletingNetworkPeers(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	comparer := func(r1, r2 *nftables.Rule) bool {
+		return rulesEqual(logger, r1, r2)
+	}
+
+	containers := networkPeersTestContainers()
+	r, firewallCreator := newTestRuleManager(t, logger, containers)
+	for _, c := range containers {
+		err := r.createContainerRules(context.Background(), c, true)
+		is.NoErr(err)
+	}
+	mfc := firewallCreator.newMockFirewall()
+
+	cont2ChainName := buildChainName(cont2Name, cont2ID)
+	cont2Chain := &nftables.Chain{
+		Table: filterTable,
+		Name:  cont2ChainName,
+	}
+	cont2RulesBefore, err := mfc.GetRules(filterTable, cont2Chain)
+	is.NoErr(err)
+	is.Equal(len(cont2RulesBefore), 2) // established rule and drop rule
+
+	// rules allowing established traffic in container 2's chain
+	// should be removed when container 1 is deleted
+	err = r.deleteContainerRules(context.Background(), cont1ID, cont1Name)
+	is.NoErr(err)
+	rulesAfterDeletion, err := mfc.GetRules(filterTable, cont2Chain)
+	is.NoErr(err)
+	is.Equal(len(rulesAfterDeletion), 1) // drop rule
+
+	err = r.createContainerRules(context.Background(), containers[0], true)
+	is.NoErr(err)
+	cont2RulesAfter, err := mfc.GetRules(filterTable, cont2Chain)
+	is.NoErr(err)
+	compareRules(t, comparer, cont2ChainName, cont2RulesBefore, cont2RulesAfter)
+
+	// rules should be created in container 2's chain again when it
+	// is recreated
+	err = r.deleteContainerRules(context.Background(), cont2ID, cont2Name)
+	is.NoErr(err)
+	err = r.createContainerRules(context.Background(), containers[1], true)
+	is.NoErr(err)
+	cont2RulesAfter, err = mfc.GetRules(filterTable, cont2Chain)
+	is.NoErr(err)
+	compareRules(t, comparer, cont2ChainName, cont2RulesBefore, cont2RulesAfter)
+}
+
+func TestNetworkPeersNetworkRecreated(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := networkPeersTestContainers()
+	for _, c := range containers {
+		c.State = &types.ContainerState{Running: true}
+	}
+	r, firewallCreator := newTestRuleManager(t, logger, containers)
+	for _, c := range containers {
+		is.NoErr(r.createContainerRules(context.Background(), c, true))
+	}
+
+	// recreate the network with a different subnet, Docker sends
+	// connect events when the containers join it again
+	newGatewayAddr := netip.MustParseAddr("172.0.3.1")
+	newCont1Addr := netip.MustParseAddr("172.0.3.2")
+	newCont2Addr := netip.MustParseAddr("172.0.3.3")
+	dockerCli := r.dockerCli.(*mockDockerClient)
+	dockerCli.mtx.Lock()
+	for i, addr := range []netip.Addr{newCont1Addr, newCont2Addr} {
+		settings := dockerCli.containers[i].NetworkSettings.Networks["monitoring"]
+		settings.Gateway = newGatewayAddr.String()
+		settings.IPAddress = addr.String()
+	}
+	dockerCli.mtx.Unlock()
+
+	// rules of the container with network_peers rules of the network
+	// are recreated when another container is connected to it
+	r.createCh = make(chan containerDetails, len(containers))
+	r.handleNetworkEvent(context.Background(), events.Message{
+		Type:   events.NetworkEventType,
+		Action: "connect",
+		Actor: events.Actor{
+			Attributes: map[string]string{
+				"container": cont2ID,
+				"name":      "monitoring",
+			},
+		},
+	})
+	is.Equal(len(r.createCh), 2)
+	for _, id := range []string{cont2ID, cont1ID} {
+		c := <-r.createCh
+		is.True(c.recreate)
+		is.Equal(c.container.ID, id)
+		is.NoErr(r.recreateContainerRules(context.Background(), c.container))
+	}
+
+	fw := firewallCreator.newMockFirewall()
+	tests := []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			pkt:     testPacket{src: newCont1Addr, dst: newCont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9100, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: newCont2Addr, dst: newCont1Addr, proto: unix.IPPROTO_TCP, sport: 9100, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: newCont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9100, state: stateNew},
+			verdict: "drop",
+		},
+		// rules of the old addresses were deleted
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9100, state: stateNew},
+			verdict: "continue",
+		},
+	}
+	for _, tt := range tests {
+		if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+			t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+		}
+	}
+
+	// events of stopped containers and containers whalewall doesn't
+	// manage are ignored
+	dockerCli.mtx.Lock()
+	dockerCli.containers[0].State.Running = false
+	dockerCli.mtx.Unlock()
+	for _, id := range []string{cont1ID, cont3ID} {
+		r.handleNetworkEvent(context.Background(), events.Message{
+			Type:   events.NetworkEventType,
+			Action: "disconnect",
+			Actor: events.Actor{
+				Attributes: map[string]string{
+					"container": id,
+					"name":      "monitoring",
+				},
+			},
+		})
+	}
+	is.Equal(len(r.createCh), 0)
+}
+
+func TestValidateNetworkPeersRules(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			rules: `
+output:
+  - network: monitoring
+    network_peers: true`,
+		},
+		{
+			name: "no network",
+			rules: `
+output:
+  - network_peers: true`,
+			wantErr: true,
+		},
+		{
+			name: "ips",
+			rules: `
+output:
+  - network: monitoring
+    network_peers: true
+    ips:
+      - 172.0.1.2`,
+			wantErr: true,
+		},
+		{
+			name: "container",
+			rules: `
+output:
+  - network: monitoring
+    network_peers: true
+    container: container2`,
+			wantErr: true,
+		},
+		{
+			name: "input rule",
+			rules: `
+input:
+  - network: monitoring
+    network_peers: true`,
+			wantErr: true,
+		},
+		{
+			name: "deny rule",
+			rules: `
+deny:
+  - network: monitoring
+    network_peers: true`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err := validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+const (
+	cont3ID   = "container_three_ID"
+	cont3Name = "container3"
+)
+
+var cont3Addr = netip.MustParseAddr("172.0.1.4")
+
+func selectorTestContainers() []types.ContainerJSON {
+	newContainer := func(id, name string, addr netip.Addr, labels map[string]string) types.ContainerJSON {
+		labels[enabledLabel] = "true"
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   id,
+				Name: "/" + name,
+			},
+			Config: &container.Config{
+				Labels: labels,
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: addr.String(),
+					},
+				},
+			},
+		}
+	}
+
+	return []types.ContainerJSON{
+		newContainer(cont1ID, cont1Name, cont1Addr, map[string]string{
+			rulesLabel: `
+output:
+  - network: default
+    container_selector:
+      app.tier: db
+    proto: tcp
+    dst_ports:
+      - 5432
+input:
+  - network: default
+    container_selector:
+      app.tier: web
+    proto: tcp
+    dst_ports:
+      - 8080`,
+		}),
+		newContainer(cont2ID, cont2Name, cont2Addr, map[string]string{
+			"app.tier": "db",
+		}),
+		newContainer(cont3ID, cont3Name, cont3Addr, map[string]string{
+			"app.tier": "web",
+		}),
+	}
+}
+
+func selectorTestPackets() []struct {
+	pkt     testPacket
+	verdict string
+} {
+	return []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5432, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont2Addr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 5432, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont3Addr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont3Addr, proto: unix.IPPROTO_TCP, sport: 8080, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont3Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5432, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: cont2Addr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 8080, state: stateNew},
+			verdict: "drop",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5433, state: stateNew},
+			verdict: "drop",
+		},
+	}
+}
+
+func TestContainerSelectors(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		for _, reversed := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/reversed=%t", layout, reversed), func(t *testing.T) {
+				containers := selectorTestContainers()
+				if reversed {
+					reverse(containers)
+				}
+				fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+				for _, tt := range selectorTestPackets() {
+					if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+						t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDeletingSelectedContainers(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := selectorTestContainers()
+	r, firewallCreator := newTestRuleManager(t, logger, containers)
+	for _, c := range containers {
+		err := r.createContainerRules(context.Background(), c, true)
+		is.NoErr(err)
+	}
+	sets := func() map[string][]nftables.SetElement {
+		return firewallCreator.newMockFirewall().tables[filterTable.Name].Sets
+	}
+
+	cont1Chain := &nftables.Chain{
+		Table: filterTable,
+		Name:  buildChainName(cont1Name, cont1ID),
+	}
+	outSetName := selectorSetName(cont1Chain, false, 0)
+	inSetName := selectorSetName(cont1Chain, true, 0)
+	is.Equal(len(sets()[outSetName]), 1)
+	is.Equal(len(sets()[inSetName]), 1)
+
+	// containers should be removed from sets when they are stopped
+	err = r.deleteContainerRules(context.Background(), cont2ID, cont2Name)
+	is.NoErr(err)
+	is.Equal(len(sets()[outSetName]), 0)
+	is.Equal(len(sets()[inSetName]), 1)
+
+	// and added back when they are started again
+	err = r.createContainerRules(context.Background(), containers[1], true)
+	is.NoErr(err)
+	fw := firewallCreator.newMockFirewall()
+	for _, tt := range selectorTestPackets() {
+		if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+			t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+		}
+	}
+
+	// sets and rules in the chains of selected containers should be
+	// removed when the selecting container is stopped
+	err = r.deleteContainerRules(context.Background(), cont1ID, cont1Name)
+	is.NoErr(err)
+	_, ok := sets()[outSetName]
+	is.True(!ok)
+	_, ok = sets()[inSetName]
+	is.True(!ok)
+	for _, c := range []struct{ id, name string }{{cont2ID, cont2Name}, {cont3ID, cont3Name}} {
+		rules, err := fw.GetRules(filterTable, &nftables.Chain{
+			Table: filterTable,
+			Name:  buildChainName(c.name, c.id),
+		})
+		is.NoErr(err)
+		is.Equal(len(rules), 1) // drop rule
+	}
+}
+
+func TestValidateContainerSelectors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			rules: `
+output:
+  - network: default
+    container_selector:
+      app.tier: db
+input:
+  - network: default
+    container_selector:
+      app.tier: web`,
+		},
+		{
+			name: "no network",
+			rules: `
+output:
+  - container_selector:
+      app.tier: db`,
+			wantErr: true,
+		},
+		{
+			name: "container",
+			rules: `
+output:
+  - network: default
+    container: container2
+    container_selector:
+      app.tier: db`,
+			wantErr: true,
+		},
+		{
+			name: "deny rule",
+			rules: `
+deny:
+  - network: default
+    container_selector:
+      app.tier: db`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err := validateConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func crossProjectTestContainers() []types.ContainerJSON {
+	newContainer := func(id, name, project string, addr netip.Addr, labels map[string]string) types.ContainerJSON {
+		labels[enabledLabel] = "true"
+		labels[composeProjectLabel] = project
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   id,
+				Name: "/" + name,
+			},
+			Config: &container.Config{
+				Labels: labels,
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"infra_backend": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: addr.String(),
+					},
+				},
+			},
+		}
+	}
+
+	return []types.ContainerJSON{
+		newContainer(cont1ID, cont1Name, "app", cont1Addr, map[string]string{
+			composeServiceLabel: "web",
+			rulesLabel: `
+output:
+  - network: infra_backend
+    container: infra/postgres
+    proto: tcp
+    dst_ports:
+      - 5432`,
+		}),
+		newContainer(cont2ID, cont2Name, "infra", cont2Addr, map[string]string{
+			composeServiceLabel: "postgres",
+		}),
+		newContainer(cont3ID, cont3Name, "other", cont3Addr, map[string]string{
+			composeServiceLabel: "postgres",
+		}),
+	}
+}
+
+func TestCrossProjectContainers(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	tests := []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5432, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont2Addr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 5432, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont3Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5432, state: stateNew},
+			verdict: "drop",
+		},
+	}
+
+	for _, reversed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reversed=%t", reversed), func(t *testing.T) {
+			containers := crossProjectTestContainers()
+			if reversed {
+				reverse(containers)
+			}
+			fw := createTestFirewall(t, logger, containers)
+			for _, tt := range tests {
+				if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+					t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+				}
+			}
+		})
+	}
+}
+
+func TestContainerNameMatches(t *testing.T) {
+	t.Parallel()
+
+	labels := map[string]string{
+		composeProjectLabel: "infra",
+		composeServiceLabel: "postgres",
+	}
+	names := []string{"/infra-postgres-1"}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "postgres", want: true},
+		{name: "/postgres", want: true},
+		{name: "infra-postgres-1", want: true},
+		{name: "/infra-postgres-1", want: true},
+		{name: "infra/postgres", want: true},
+		{name: "infra/infra-postgres-1", want: true},
+		{name: "app/postgres", want: false},
+		{name: "infra/redis", want: false},
+		{name: "redis", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := containerNameMatches(tt.name, labels, names...); got != tt.want {
+			t.Errorf("containerNameMatches(%q) = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func sidecarTestContainers() []types.ContainerJSON {
+	newContainer := func(id, name string, addr netip.Addr, labels map[string]string) types.ContainerJSON {
+		labels[enabledLabel] = "true"
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:         id,
+				Name:       "/" + name,
+				HostConfig: &container.HostConfig{},
+			},
+			Config: &container.Config{
+				Labels: labels,
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"default": {
+						Gateway:   gatewayAddr.String(),
+						IPAddress: addr.String(),
+					},
+				},
+			},
+		}
+	}
+
+	sidecar := newContainer(cont3ID, cont3Name, netip.Addr{}, map[string]string{
+		rulesLabel: `
+output:
+  - network: default
+    container: container2
+    proto: tcp
+    dst_ports:
+      - 5432`,
+	})
+	sidecar.HostConfig.NetworkMode = container.NetworkMode("container:" + cont1ID)
+	sidecar.NetworkSettings.Networks = nil
+
+	return []types.ContainerJSON{
+		newContainer(cont1ID, cont1Name, cont1Addr, map[string]string{
+			rulesLabel: `
+output:
+  - network: default
+    container: container2
+    proto: tcp
+    dst_ports:
+      - 80`,
+		}),
+		newContainer(cont2ID, cont2Name, cont2Addr, map[string]string{}),
+		sidecar,
+	}
+}
+
+func TestSharedNetworkNamespace(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	tests := []struct {
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			// allowed by the owner's rules
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 80, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			// allowed by the sidecar's rules
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5432, state: stateNew},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont2Addr, dst: cont1Addr, proto: unix.IPPROTO_TCP, sport: 5432, dport: 40000, state: stateEst},
+			verdict: "accept",
+		},
+		{
+			pkt:     testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5433, state: stateNew},
+			verdict: "drop",
+		},
+	}
+
+	// the sidecar is processed both before and after the container
+	// it has rules for
+	orders := [][]int{{0, 1, 2}, {0, 2, 1}}
+	for _, layout := range []RuleLayout{LayoutRules, LayoutSets} {
+		for _, order := range orders {
+			t.Run(fmt.Sprintf("%s/order=%v", layout, order), func(t *testing.T) {
+				allContainers := sidecarTestContainers()
+				containers := make([]types.ContainerJSON, len(order))
+				for i, j := range order {
+					containers[i] = allContainers[j]
+				}
+				fw := createTestFirewall(t, logger, containers, WithRuleLayout(layout))
+				for _, tt := range tests {
+					if verdict := evalPacket(t, fw, tt.pkt); verdict != tt.verdict {
+						t.Errorf("packet %s: expected verdict %q, got %q", tt.pkt, tt.verdict, verdict)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDeletingSharedNetworkNamespace(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := sidecarTestContainers()
+	r, firewallCreator := newTestRuleManager(t, logger, containers)
+	for _, c := range containers {
+		err := r.createContainerRules(context.Background(), c, true)
+		is.NoErr(err)
+	}
+
+	sidecarPkt := testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5432, state: stateNew}
+	ownerPkt := testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 80, state: stateNew}
+	is.Equal(evalPacket(t, firewallCreator.newMockFirewall(), sidecarPkt), "accept")
+
+	// rules of the sidecar should be removed when it is deleted, but
+	// the owner's rules should be left untouched
+	err = r.deleteContainerRules(context.Background(), cont3ID, cont3Name)
+	is.NoErr(err)
+	fw := firewallCreator.newMockFirewall()
+	is.Equal(evalPacket(t, fw, sidecarPkt), "drop")
+	is.Equal(evalPacket(t, fw, ownerPkt), "accept")
+	_, ok := fw.chains[buildChainName(cont3Name, cont3ID)]
+	is.True(!ok)
+
+	// sidecar rules should be created again when it is restarted
+	err = r.createContainerRules(context.Background(), containers[2], true)
+	is.NoErr(err)
+	is.Equal(evalPacket(t, firewallCreator.newMockFirewall(), sidecarPkt), "accept")
+}
+
+func TestRecreatingSharedNetworkNamespace(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := sidecarTestContainers()
+	for _, c := range containers {
+		c.State = &types.ContainerState{Running: true}
+	}
+	r, firewallCreator := newTestRuleManager(t, logger, containers)
+	for _, c := range containers {
+		err := r.createContainerRules(context.Background(), c, true)
+		is.NoErr(err)
+	}
+
+	sidecarPkt := testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 5432, state: stateNew}
+	ownerPkt := testPacket{src: cont1Addr, dst: cont2Addr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 80, state: stateNew}
+	is.Equal(evalPacket(t, firewallCreator.newMockFirewall(), sidecarPkt), "accept")
+
+	// the sidecar's rules should be recreated along with the owner's
+	// rules when a network of the owner changes
+	r.createCh = make(chan containerDetails, len(containers))
+	r.handleNetworkEvent(context.Background(), events.Message{
+		Type:   events.NetworkEventType,
+		Action: "connect",
+		Actor: events.Actor{
+			Attributes: map[string]string{
+				"container": cont1ID,
+				"name":      "default",
+			},
+		},
+	})
+	c := <-r.createCh
+	is.True(c.recreate)
+	is.NoErr(r.recreateContainerRules(context.Background(), c.container))
+	is.Equal(len(r.createCh), 0)
+
+	fw := firewallCreator.newMockFirewall()
+	is.Equal(evalPacket(t, fw, sidecarPkt), "accept")
+	is.Equal(evalPacket(t, fw, ownerPkt), "accept")
+	_, ok := fw.chains[buildChainName(cont3Name, cont3ID)]
+	is.True(ok)
+}
+
+func TestValidateSidecarConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			rules: `
+output:
+  - network: default
+    container: container2
+    proto: tcp
+    dst_ports:
+      - 5432
+input:
+  - network: default
+    proto: tcp
+    dst_ports:
+      - 9090`,
+		},
+		{
+			name: "from host",
+			rules: `
+from_host:
+  - proto: tcp
+    dst_ports:
+      - 9090`,
+			wantErr: true,
+		},
+		{
+			name: "mapped ports",
+			rules: `
+mapped_ports:
+  localhost:
+    allow: true`,
+			wantErr: true,
+		},
+		{
+			name: "reject",
+			rules: `
+reject: true`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err := validateSidecarConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// testCgroupID returns the ID of the mock cgroup of a container.
+func testCgroupID(contID string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(contID))
+	return h.Sum64()
+}
+
+func hostNetworkTestContainers() []types.ContainerJSON {
+	return []types.ContainerJSON{
+		{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:   cont1ID,
+				Name: "/" + cont1Name,
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					enabledLabel: "true",
+					rulesLabel: `
+output:
+  - ips:
+      - 1.1.1.1
+    proto: tcp
+    dst_ports:
+      - 443
+input:
+  - proto: tcp
+    dst_ports:
+      - 9100`,
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					hostNetworkName: {},
+				},
+			},
+		},
+	}
+}
+
+func hostNetworkTestPackets() []struct {
+	chain   string
+	pkt     testPacket
+	verdict string
+} {
+	hostAddr := netip.MustParseAddr("192.168.1.10")
+	remoteAddr := netip.MustParseAddr("1.1.1.1")
+	clientAddr := netip.MustParseAddr("10.0.0.5")
+	cont1Cgroup := testCgroupID(cont1ID)
+
+	return []struct {
+		chain   string
+		pkt     testPacket
+		verdict string
+	}{
+		{
+			chain:   outputChainName,
+			pkt:     testPacket{src: hostAddr, dst: remoteAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 443, state: stateNew, cgroup: cont1Cgroup},
+			verdict: "accept",
+		},
+		{
+			chain:   inputChainName,
+			pkt:     testPacket{src: remoteAddr, dst: hostAddr, proto: unix.IPPROTO_TCP, sport: 443, dport: 40000, state: stateEst, cgroup: cont1Cgroup},
+			verdict: "accept",
+		},
+		{
+			chain:   outputChainName,
+			pkt:     testPacket{src: hostAddr, dst: remoteAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 80, state: stateNew, cgroup: cont1Cgroup},
+			verdict: "drop",
+		},
+		{
+			chain:   inputChainName,
+			pkt:     testPacket{src: clientAddr, dst: hostAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9100, state: stateNew, cgroup: cont1Cgroup},
+			verdict: "accept",
+		},
+		{
+			chain:   outputChainName,
+			pkt:     testPacket{src: hostAddr, dst: clientAddr, proto: unix.IPPROTO_TCP, sport: 9100, dport: 40000, state: stateEst, cgroup: cont1Cgroup},
+			verdict: "accept",
+		},
+		{
+			// input rules must not allow outbound traffic
+			chain:   outputChainName,
+			pkt:     testPacket{src: hostAddr, dst: clientAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 9100, state: stateNew, cgroup: cont1Cgroup},
+			verdict: "drop",
+		},
+		{
+			// traffic of other processes on the host isn't filtered
+			chain:   outputChainName,
+			pkt:     testPacket{src: hostAddr, dst: remoteAddr, proto: unix.IPPROTO_TCP, sport: 40000, dport: 80, state: stateNew},
+			verdict: "continue",
+		},
+	}
+}
+
+func TestHostNetworking(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	for _, estFastPath := range []bool{false, true} {
+		t.Run(fmt.Sprintf("est_fast_path=%t", estFastPath), func(t *testing.T) {
+			fw := createTestFirewall(t, logger, hostNetworkTestContainers(), WithEstablishedFastPath(estFastPath))
+			for _, tt := range hostNetworkTestPackets() {
+				if verdict := evalPacketFrom(t, fw, tt.chain, tt.pkt); verdict != tt.verdict {
+					t.Errorf("%s packet %s: expected verdict %q, got %q", tt.chain, tt.pkt, tt.verdict, verdict)
+				}
+			}
+		})
+	}
+}
+
+func TestDeletingHostNetworking(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := hostNetworkTestContainers()
+	r, firewallCreator := newTestRuleManager(t, logger, containers)
+	err = r.createContainerRules(context.Background(), containers[0], true)
+	is.NoErr(err)
+
+	err = r.deleteContainerRules(context.Background(), cont1ID, cont1Name)
+	is.NoErr(err)
+
+	fw := firewallCreator.newMockFirewall()
+	for _, chainName := range []string{buildChainName(cont1Name, cont1ID), buildHostInputChainName(cont1Name, cont1ID)} {
+		_, ok := fw.chains[chainName]
+		is.True(!ok)
+	}
+	for _, chainName := range []string{hostInputChainName, hostOutputChainName} {
+		is.Equal(len(fw.chains[chainName].Rules), 0)
+	}
+	for _, tt := range hostNetworkTestPackets() {
+		is.Equal(evalPacketFrom(t, fw, tt.chain, tt.pkt), "continue")
+	}
+}
+
+func TestHostNetworkingUnsupported(t *testing.T) {
+	t.Parallel()
+
+	is := is.New(t)
+	logger, err := zap.NewDevelopment()
+	is.NoErr(err)
+
+	containers := hostNetworkTestContainers()
+	r, _ := newTestRuleManager(t, logger, containers)
+	r.cgroupv2Err = errors.New("kernel version is too old")
+	err = r.createContainerRules(context.Background(), containers[0], true)
+	is.True(err != nil)
+}
+
+func TestValidateHostNetworkConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			rules: `
+output:
+  - ips:
+      - internet
+    proto: tcp
+    dst_ports:
+      - 443
+input:
+  - proto: tcp
+    dst_ports:
+      - 9100`,
+		},
+		{
+			name: "network",
+			rules: `
+output:
+  - network: default
+    proto: tcp
+    dst_ports:
+      - 443`,
+			wantErr: true,
+		},
+		{
+			name: "container",
+			rules: `
+input:
+  - network: default
+    container: container2
+    proto: tcp
+    dst_ports:
+      - 9100`,
+			wantErr: true,
+		},
+		{
+			name: "gateway",
+			rules: `
+output:
+  - ips:
+      - gateway
+    proto: tcp
+    dst_ports:
+      - 53`,
+			wantErr: true,
+		},
+		{
+			name: "deny",
+			rules: `
+deny:
+  - ips:
+      - 1.1.1.1`,
+			wantErr: true,
+		},
+		{
+			name: "from host",
+			rules: `
+from_host:
+  - proto: tcp
+    dst_ports:
+      - 9100`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config
+			if err := yaml.Unmarshal([]byte(tt.rules), &cfg); err != nil {
+				t.Fatalf("error parsing rules: %v", err)
+			}
+			err := validateHostNetworkConfig(cfg)
+			if tt.wantErr && err == nil {
+				t.Error("expected error")
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
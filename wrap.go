@@ -30,3 +30,9 @@ func (w *wrappedDockerClient) ContainerInspect(ctx context.Context, containerID
 		return w.dockerClient.ContainerInspect(ctx, containerID)
 	})
 }
+
+func (w *wrappedDockerClient) NetworkInspect(ctx context.Context, network string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	return withTimeout(ctx, w.timeout, func(ctx context.Context) (types.NetworkResource, error) {
+		return w.dockerClient.NetworkInspect(ctx, network, options)
+	})
+}